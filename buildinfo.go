@@ -11,9 +11,12 @@ import (
 // BuildInfo is build information in directory
 type BuildInfo struct {
 	variables      map[string]string
+	lists          map[string][]string // list variables (referenced via `${@name}`)
 	includes       []string
 	defines        []string
 	options        []string
+	cOptions       []string // Options for C (and Objective-C)
+	cxxOptions     []string // Options for C++ (and Objective-C++)
 	archiveOptions []string
 	convertOptions []string
 	linkOptions    []string
@@ -27,6 +30,8 @@ type BuildInfo struct {
 	subdir         []string
 	mydir          string
 	tests          []string
+	environment    map[string]ImportedEnvironment // Imported environment variables (shared with the subdirectories)
+	launcher       *LauncherSetting               // `compiler_launcher:` (inherited by the subdirectories)
 }
 
 // OptionPrefix retrieves command line option prefix
@@ -37,14 +42,36 @@ func (info *BuildInfo) OptionPrefix() string {
 	return "-"
 }
 
+// clipLists limits the capacity of the lists inherited from the parent,
+// so that appending to them never overwrites the ones shared with the sibling directories.
+func (info *BuildInfo) clipLists() {
+	clip := func(s []string) []string { return s[:len(s):len(s)] }
+	info.includes = clip(info.includes)
+	info.defines = clip(info.defines)
+	info.options = clip(info.options)
+	info.cOptions = clip(info.cOptions)
+	info.cxxOptions = clip(info.cxxOptions)
+	info.archiveOptions = clip(info.archiveOptions)
+	info.convertOptions = clip(info.convertOptions)
+	info.linkOptions = clip(info.linkOptions)
+	info.linkDepends = clip(info.linkDepends)
+	info.libraries = clip(info.libraries)
+	info.subdir = clip(info.subdir)
+	info.tests = clip(info.tests)
+}
+
+// conditionContext returns the context for evaluating `when:` conditions in the current directory.
+func (info *BuildInfo) conditionContext() ConditionContext {
+	return ConditionContext{Target: info.target, Platform: option.platform, Variant: option.variant, Environment: info.environment}
+}
+
 // AddInclude appends include path.
+// Note: The argument is not quoted (quoted while emitting commands).
+// With `-relative-paths`, the path is made absolute then converted while emitting.
 func (info *BuildInfo) AddInclude(path string) {
 	pfx := info.OptionPrefix()
-	if p := filepath.ToSlash(filepath.Clean(path)); strings.Index(p, " ") != -1 {
-		info.includes = append(info.includes, fmt.Sprintf("\"%sI%s\"", pfx, p))
-	} else {
-		info.includes = append(info.includes, fmt.Sprintf("%sI%s", pfx, p))
-	}
+	p := portablePath(filepath.ToSlash(filepath.Clean(path)))
+	info.includes = append(info.includes, fmt.Sprintf("%sI%s", pfx, p))
 }
 
 // AddDefines appends macro definitions.
@@ -56,50 +83,94 @@ func (info *BuildInfo) AddDefines(def string) {
 		Warn("not found variable in <%s>\n", def)
 		return // Should be handled properly
 	}
-	info.defines = append(info.defines, (func(s string) string {
-		kv := strings.SplitN(s, "=", 2)
-		switch len(kv) {
-		case 0: // WHAT?
-			return s
-		case 1:
-			return fmt.Sprintf("%sD%s",
-				info.OptionPrefix(),
-				strings.Replace(kv[0], "-", "_", -1))
-		case 2:
-			fallthrough
-		default:
-			return fmt.Sprintf("%sD%s=%s",
-				info.OptionPrefix(),
-				strings.Replace(kv[0], "-", "_", -1),
-				kv[1])
-		}
-	})(idef))
+	info.defines = append(info.defines, info.defineOption(idef))
+}
+
+// defineOption returns the compiler option defining `def` (`NAME` or `NAME=VALUE`).
+func (info *BuildInfo) defineOption(def string) string {
+	kv := strings.SplitN(def, "=", 2)
+	switch len(kv) {
+	case 0: // WHAT?
+		return def
+	case 1:
+		return fmt.Sprintf("%sD%s",
+			info.OptionPrefix(),
+			strings.Replace(kv[0], "-", "_", -1))
+	case 2:
+		fallthrough
+	default:
+		return fmt.Sprintf("%sD%s=%s",
+			info.OptionPrefix(),
+			strings.Replace(kv[0], "-", "_", -1),
+			kv[1])
+	}
 }
 
 // Interpolate interpolates given string `s`.
-// Note: Handles $out, $in...
+// Note: `$` sequences other than `${...}` ($out, $in, $$...) are kept as is.
 func (info *BuildInfo) Interpolate(s string) (string, error) {
-	if idx := strings.Index(s, "${"); 0 <= idx {
-		expanded, err := Interpolate(s[idx:], info.variables)
-		if err != nil {
-			return "", err
-		}
-		return s[:idx] + expanded, nil
-	}
-	return s, nil
+	return interpolate(info.variables, ninjaMode, s)
 }
 
 // StrictInterpolate strictly interpolates given string `s`.
-// Note: Handles $out, $in...
+// Note: `$` sequences other than `${...}` ($out, $in, $$...) are kept as is.
 func (info *BuildInfo) StrictInterpolate(s string) (string, error) {
-	if idx := strings.Index(s, "${"); 0 <= idx {
-		expanded, err := StrictInterpolate(s[idx:], info.variables)
-		if err != nil {
-			return "", err
+	return interpolate(info.variables, ninjaMode|strictMode, s)
+}
+
+// SetVariable defines (or overrides) the variable `name`.
+func (info *BuildInfo) SetVariable(v *Variable, value string) {
+	if info.variables == nil {
+		info.variables = make(map[string]string)
+	}
+	info.variables[v.Name] = value
+	if v.IsList() {
+		if info.lists == nil {
+			info.lists = make(map[string][]string)
+		}
+		info.lists[v.Name] = v.Values
+	} else if info.lists != nil {
+		delete(info.lists, v.Name)
+	}
+}
+
+// SpliceLists expands `${@name}` references in `items`.
+// An item containing `${@name}` is replaced by the items of the list variable `name`,
+// each of them surrounded by the text around the reference (ex. `-I${@dirs}`).
+// Scalar variables are tokenized in shell-like manner.
+func (info *BuildInfo) SpliceLists(items []string) ([]string, error) {
+	result := make([]string, 0, len(items))
+	for _, item := range items {
+		idx := strings.Index(item, "${@")
+		if idx < 0 {
+			result = append(result, item)
+			continue
+		}
+		end := strings.Index(item[idx:], "}")
+		if end < 0 {
+			return nil, errors.Errorf("unmatched brace found in \"%s\"", item)
+		}
+		end += idx
+		if strings.Contains(item[end+1:], "${@") {
+			return nil, errors.Errorf("multiple list references found in \"%s\"", item)
+		}
+		name := item[idx+3 : end]
+		values, ok := info.lists[name]
+		if !ok {
+			v, exists := info.variables[name]
+			if !exists {
+				return nil, errors.Errorf("variable \"%s\" is not defined (referenced from \"%s\")", name, item)
+			}
+			var err error
+			if values, err = Tokenize(v); err != nil {
+				return nil, err
+			}
+		}
+		for _, v := range values {
+			result = append(result, item[:idx]+v+item[end+1:])
 		}
-		return s[:idx] + expanded, nil
 	}
-	return s, nil
+	return result, nil
 }
 
 // ExpandVariable retrieves the value associated to symbol `s`.
@@ -78,6 +78,74 @@ func TestBuildInfo_AddDefines(t *testing.T) {
 	})
 }
 
+func TestBuildInfo_Interpolate(t *testing.T) {
+	Convey("GIVEN: A `BuildInfo` with variables", t, func() {
+		info := BuildInfo{variables: map[string]string{"foo": "foo-value", "bar": "${foo}/bar"}}
+		for _, v := range []testCase{
+			{input: "$out ${foo}", expected: "$out foo-value"},
+			{input: "${foo} $out", expected: "foo-value $out"},
+			{input: "${bar} $$ $in", expected: "foo-value/bar $$ $in"},
+			{input: "-MF $dep", expected: "-MF $dep"},
+		} {
+			Convey(fmt.Sprintf("WHEN: Call `StrictInterpolate (\"%s\")`", v.input), func() {
+				actual, err := info.StrictInterpolate(v.input)
+				Convey(fmt.Sprintf("THEN: Should be \"%s\"", v.expected), func() {
+					So(err, ShouldBeNil)
+					So(actual, ShouldEqual, v.expected)
+				})
+			})
+		}
+		Convey("WHEN: Call `StrictInterpolate (\"$out ${mokeke}\")`", func() {
+			_, err := info.StrictInterpolate("$out ${mokeke}")
+			Convey("THEN: Should fail", func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+	})
+}
+
+func TestBuildInfo_SpliceLists(t *testing.T) {
+	Convey("GIVEN: A `BuildInfo` with a list variable", t, func() {
+		info := BuildInfo{}
+		info.SetVariable(&Variable{Name: "dirs", Values: []string{"a", "b c"}}, JoinArgs([]string{"a", "b c"}))
+		info.SetVariable(&Variable{Name: "flags", Value: "x 'y z'"}, "x 'y z'")
+		type spliceCase struct {
+			input    []string
+			expected []string
+		}
+		for _, tc := range []spliceCase{
+			{[]string{"${@dirs}"}, []string{"a", "b c"}},
+			{[]string{"pre", "-I${@dirs}/include", "post"}, []string{"pre", "-Ia/include", "-Ib c/include", "post"}},
+			{[]string{"${@flags}"}, []string{"x", "y z"}},
+			{[]string{"${dirs}"}, []string{"${dirs}"}},
+		} {
+			Convey(fmt.Sprintf("WHEN: Call `SpliceLists (%q)`", tc.input), func() {
+				actual, err := info.SpliceLists(tc.input)
+				Convey(fmt.Sprintf("THEN: Should be %q", tc.expected), func() {
+					So(err, ShouldBeNil)
+					So(actual, ShouldResemble, tc.expected)
+				})
+			})
+		}
+		for _, input := range []string{"${@mokeke}", "${@dirs}${@dirs}", "${@dirs"} {
+			Convey(fmt.Sprintf("WHEN: Call `SpliceLists ([\"%s\"])`", input), func() {
+				_, err := info.SpliceLists([]string{input})
+				Convey("THEN: Should fail", func() {
+					So(err, ShouldNotBeNil)
+				})
+			})
+		}
+		Convey("WHEN: Overriding the list with a scalar", func() {
+			info.SetVariable(&Variable{Name: "dirs", Value: "d"}, "d")
+			actual, err := info.SpliceLists([]string{"${@dirs}"})
+			Convey(`THEN: Should be ["d"]`, func() {
+				So(err, ShouldBeNil)
+				So(actual, ShouldResemble, []string{"d"})
+			})
+		})
+	})
+}
+
 func TestBuildInfo_MakeExecutablePath(t *testing.T) {
 	Convey(`GIVEN: A BuildInfo with .outputdir = "/usr/local"`, t, func() {
 		info := BuildInfo{variables: map[string]string{}, outputdir: "/usr/local"}
@@ -99,13 +167,10 @@ func TestBuildInfo_MakeExecutablePath(t *testing.T) {
 	})
 }
 
+// addPrefix prepends `pfx` to `args` (arguments are kept unquoted).
 func addPrefix(pfx string, args ...string) []string {
 	result := make([]string, 0, len(args))
 	for _, v := range args {
-		if strings.ContainsAny(v, " \t") {
-			result = append(result, fmt.Sprintf("\"%s%s\"", pfx, v))
-			continue
-		}
 		result = append(result, pfx+v)
 	}
 	return result
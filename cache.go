@@ -0,0 +1,730 @@
+// Local content-addressed compilation cache (`cbuild cache-exec`).
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// DefaultCacheSize is the default size limit of the compilation cache.
+	DefaultCacheSize = 5 << 30
+	// cacheTrimInterval is the minimum interval between trimming the cache down to the size limit.
+	cacheTrimInterval = time.Minute
+	// cacheStatsFile holds the statistics counters of the entries in the sub-directory.
+	cacheStatsFile = "stats"
+	// cacheTrimmedFile records the last time the cache was trimmed (as the modification time).
+	cacheTrimmedFile = "trimmed"
+	// remoteCacheStateFile records the failures of the remote cache.
+	remoteCacheStateFile = "remote-state"
+	// cacheVersion is mixed into the keys (bumped when the format changes).
+	cacheVersion = "cbuild-cache-2"
+	// cacheDepTarget replaces the target of the cached dependency files (`$` is escaped as `$$` by compilers).
+	cacheDepTarget = "$out"
+)
+
+// CompileCache is a local compilation cache.
+// Outputs are stored as `<Dir>/<xx>/<key>.o` (with `.d` and `.stderr`) and evicted in LRU order
+// when the total size exceeds `MaxSize` (checked at most once per `cacheTrimInterval`).
+// Entries missing locally are looked up in `Remote` (if any).
+type CompileCache struct {
+	Dir     string
+	MaxSize int64
+	Remote  *RemoteCache
+}
+
+// CacheStats holds the statistics of the cache.
+type CacheStats struct {
+	Entries    int
+	Size       int64
+	MaxSize    int64
+	Hits       int64
+	RemoteHits int64
+	Misses     int64
+}
+
+// cacheEntry holds the outputs of a compilation (`nil` if not produced).
+type cacheEntry struct {
+	Object  []byte
+	Depfile []byte
+	Stderr  []byte
+}
+
+// cacheCounters are the names of the statistics counters.
+var cacheCounters = []string{"hits", "remote-hits", "misses"}
+
+// compileInvocation is a parsed compiler command line.
+type compileInvocation struct {
+	args    []string // Whole command line (args[0] is the compiler)
+	output  string   // `-o <output>`
+	depfile string   // `-MF <depfile>`
+	target  string   // `-MT <target>` or `-MQ <target>` (the output is used if not specified)
+	inputs  []string // Extra inputs (ex. pre-compiled headers)
+	sources []string // Source files
+	lang    string   // `-x <lang>`
+}
+
+// separateValueOptions are options taking the value as the next argument.
+var separateValueOptions = map[string]bool{
+	"-MT": true, "-MQ": true, "-include": true, "-imacros": true, "-I": true, "-D": true, "-U": true,
+	"-isystem": true, "-iquote": true, "-idirafter": true, "-isysroot": true, "-target": true,
+	"-arch": true, "-Xclang": true, "-Xpreprocessor": true, "-Xassembler": true,
+}
+
+// OpenCompileCache opens the cache specified by `$CBUILD_CACHE_DIR` and `$CBUILD_CACHE_SIZE`
+// (and the remote cache specified by `$CBUILD_REMOTE_CACHE`).
+func OpenCompileCache() (*CompileCache, error) {
+	dir := os.Getenv("CBUILD_CACHE_DIR")
+	if len(dir) == 0 {
+		base, err := os.UserCacheDir()
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to obtain the cache directory (set CBUILD_CACHE_DIR)")
+		}
+		dir = filepath.Join(base, "cbuild")
+	}
+	size := int64(DefaultCacheSize)
+	if s := os.Getenv("CBUILD_CACHE_SIZE"); 0 < len(s) {
+		var err error
+		if size, err = ParseCacheSize(s); err != nil {
+			return nil, errors.Wrap(err, "malformed CBUILD_CACHE_SIZE")
+		}
+	}
+	remote, err := OpenRemoteCache()
+	if err != nil {
+		return nil, err
+	}
+	if remote != nil {
+		remote.StateFile = filepath.Join(dir, remoteCacheStateFile)
+	}
+	return &CompileCache{Dir: dir, MaxSize: size, Remote: remote}, nil
+}
+
+// ParseCacheSize parses sizes like "500M" or "5G".
+func ParseCacheSize(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	scale := int64(1)
+	if 0 < len(s) {
+		switch strings.ToUpper(s[len(s)-1:]) {
+		case "K":
+			scale = 1 << 10
+		case "M":
+			scale = 1 << 20
+		case "G":
+			scale = 1 << 30
+		case "T":
+			scale = 1 << 40
+		}
+		if scale != 1 {
+			s = s[:len(s)-1]
+		}
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil || v < 0 {
+		return 0, errors.Errorf("invalid size \"%s\"", s)
+	}
+	return int64(v * float64(scale)), nil
+}
+
+// parseCompileInvocation parses `args`. It returns `false` if the command is not cacheable
+// (not compiling a single object file with a GCC compatible compiler).
+func parseCompileInvocation(args []string) (*compileInvocation, bool) {
+	if len(args) < 2 {
+		return nil, false
+	}
+	inv := &compileInvocation{args: args}
+	compiling := false
+	for i := 1; i < len(args); i++ {
+		next := func() string {
+			if i+1 < len(args) {
+				i++
+				return args[i]
+			}
+			return ""
+		}
+		switch a := args[i]; {
+		case a == "-c":
+			compiling = true
+		case a == "-o":
+			inv.output = next()
+		case a == "-MF":
+			inv.depfile = next()
+		case a == "-MT", a == "-MQ":
+			inv.target = next()
+		case a == "-include-pch":
+			inv.inputs = append(inv.inputs, next())
+		case a == "-x":
+			inv.lang = next()
+		case a == "-E", a == "-S", a == "-M", a == "-MM", strings.HasPrefix(a, "@"):
+			return nil, false
+		case separateValueOptions[a]:
+			next()
+		case !strings.HasPrefix(a, "-"):
+			inv.sources = append(inv.sources, a)
+		}
+	}
+	return inv, compiling && 0 < len(inv.output)
+}
+
+// outputValueOptions are options naming the outputs (excluded from the keys).
+var outputValueOptions = map[string]bool{"-o": true, "-MF": true, "-MT": true, "-MQ": true}
+
+// depTarget returns the target written in the dependency file.
+func (inv *compileInvocation) depTarget() string {
+	if 0 < len(inv.target) {
+		return inv.target
+	}
+	return inv.output
+}
+
+// preprocessArgs returns the command line for preprocessing.
+func (inv *compileInvocation) preprocessArgs() []string {
+	result := make([]string, 0, len(inv.args))
+	for i := 0; i < len(inv.args); i++ {
+		switch a := inv.args[i]; a {
+		case "-o", "-MF", "-MT", "-MQ":
+			i++ // Skips the argument
+		case "-c", "-MMD", "-MD":
+			/* NO-OP */
+		default:
+			result = append(result, a)
+		}
+	}
+	return append(result, "-E")
+}
+
+// key computes the cache key from the compiler, the arguments and the preprocessed source.
+func (inv *compileInvocation) key() (string, error) {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00", cacheVersion)
+	compiler, err := exec.LookPath(inv.args[0])
+	if err != nil {
+		return "", errors.Wrapf(err, "compiler \"%s\" is not found", inv.args[0])
+	}
+	fi, err := os.Stat(compiler)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to obtain the information of \"%s\"", compiler)
+	}
+	fmt.Fprintf(h, "%s\x00%d\x00%d\x00", compiler, fi.Size(), fi.ModTime().UnixNano())
+	// Output names are excluded for sharing the entries between the checkouts (or the build directories).
+	for i := 1; i < len(inv.args); i++ {
+		a := inv.args[i]
+		fmt.Fprintf(h, "%s\x00", a)
+		if outputValueOptions[a] {
+			i++
+		}
+	}
+	pp := inv.preprocessArgs()
+	cmd := exec.Command(pp[0], pp[1:]...)
+	cmd.Stdout = h
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", errors.Wrapf(err, "failed to preprocess: %s", strings.TrimSpace(stderr.String()))
+	}
+	for _, in := range inv.inputs {
+		f, err := os.Open(in)
+		if err != nil {
+			return "", errors.Wrapf(err, "failed to read \"%s\"", in)
+		}
+		_, err = io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return "", errors.Wrapf(err, "failed to read \"%s\"", in)
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// entryPath returns the path of the cached file for `key` (`ext` is ".o", ".d" or ".stderr").
+func (c *CompileCache) entryPath(key string, ext string) string {
+	return filepath.Join(c.Dir, key[:2], key+ext)
+}
+
+// Exec runs the compiler command line `args` (restores the outputs if cached).
+// Returns the exit code of the compiler.
+func (c *CompileCache) Exec(args []string, stdout io.Writer, stderr io.Writer) (int, error) {
+	inv, ok := parseCompileInvocation(args)
+	if !ok {
+		return runCommand(args, stdout, stderr)
+	}
+	key, err := inv.key()
+	if err != nil {
+		Verbose("%s: Not cached (%v)\n", ProgramName, err)
+		return runCommand(args, stdout, stderr)
+	}
+	if c.restore(key, inv, stderr) {
+		c.count(key, "hits")
+		return 0, nil
+	}
+	if c.fetch(key, inv, stderr) {
+		c.count(key, "remote-hits")
+		return 0, nil
+	}
+	c.count(key, "misses")
+	var captured bytes.Buffer
+	code, err := runCommand(args, stdout, io.MultiWriter(stderr, &captured))
+	if err != nil || code != 0 {
+		return code, err
+	}
+	if err := c.store(key, inv, captured.Bytes()); err != nil {
+		// Caching is optional.
+		Warn("Failed to store \"%s\" into the cache: %v", inv.output, err)
+	}
+	return 0, nil
+}
+
+// restore copies the cached outputs for `key`.
+func (c *CompileCache) restore(key string, inv *compileInvocation, stderr io.Writer) bool {
+	obj := c.entryPath(key, ".o")
+	if !Exists(obj) {
+		return false
+	}
+	if 0 < len(inv.depfile) {
+		b, err := ioutil.ReadFile(c.entryPath(key, ".d"))
+		if err != nil || !bytes.HasPrefix(b, []byte(cacheDepTarget+":")) {
+			return false
+		}
+		b = append([]byte(inv.depTarget()), b[len(cacheDepTarget):]...)
+		if writeFileAtomically(inv.depfile, b) != nil {
+			return false
+		}
+	}
+	if copyFile(obj, inv.output) != nil {
+		return false
+	}
+	if b, err := ioutil.ReadFile(c.entryPath(key, ".stderr")); err == nil {
+		stderr.Write(b)
+	}
+	// The modification time is used as the last access time.
+	now := time.Now()
+	os.Chtimes(obj, now, now)
+	return true
+}
+
+// fetch retrieves the entry for `key` from the remote cache and restores it.
+func (c *CompileCache) fetch(key string, inv *compileInvocation, stderr io.Writer) bool {
+	if c.Remote == nil {
+		return false
+	}
+	entry, err := c.Remote.Get(key)
+	if err != nil {
+		Warn("Remote cache is disabled: %v", err)
+		return false
+	}
+	if entry == nil || (0 < len(inv.depfile) && entry.Depfile == nil) {
+		return false
+	}
+	// Dependency files naming the absolute paths of the producer are useless here.
+	for _, dep := range depfileInputs(entry.Depfile) {
+		if filepath.IsAbs(dep) && !Exists(dep) {
+			Verbose("%s: Ignored the remote entry depending on \"%s\"\n", ProgramName, dep)
+			return false
+		}
+	}
+	if err := c.put(key, entry); err != nil {
+		Warn("Failed to store \"%s\" into the cache: %v", inv.output, err)
+		return false
+	}
+	return c.restore(key, inv, stderr)
+}
+
+// depfileInputs lists the dependencies in the (Makefile style) dependency file `b`.
+func depfileInputs(b []byte) []string {
+	var result []string
+	var name []byte
+	flush := func() {
+		// Skips the targets (including the phony ones for headers).
+		if 0 < len(name) && name[len(name)-1] != ':' {
+			result = append(result, string(name))
+		}
+		name = name[:0]
+	}
+	for i := 0; i < len(b); i++ {
+		switch c := b[i]; {
+		case c == '\\' && i+1 < len(b) && (b[i+1] == '\n' || b[i+1] == '\r'):
+			flush() // Continues to the next line.
+		case c == '\\' && i+1 < len(b) && (b[i+1] == ' ' || b[i+1] == '#' || b[i+1] == '\\'):
+			i++
+			name = append(name, b[i])
+		case c == '$' && i+1 < len(b) && b[i+1] == '$':
+			i++
+			name = append(name, '$')
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			flush()
+		default:
+			name = append(name, c)
+		}
+	}
+	flush()
+	return result
+}
+
+// store saves the outputs of `inv` as `key` (and uploads them to the remote cache).
+func (c *CompileCache) store(key string, inv *compileInvocation, stderr []byte) error {
+	entry := &cacheEntry{}
+	if 0 < len(stderr) {
+		entry.Stderr = stderr
+	}
+	var err error
+	if 0 < len(inv.depfile) {
+		if entry.Depfile, err = ioutil.ReadFile(inv.depfile); err != nil {
+			return err
+		}
+		// The target is replaced for restoring as the other outputs.
+		target := []byte(inv.depTarget() + ":")
+		if !bytes.HasPrefix(entry.Depfile, target) {
+			return errors.Errorf("unexpected target in \"%s\"", inv.depfile)
+		}
+		entry.Depfile = append([]byte(cacheDepTarget), entry.Depfile[len(target)-1:]...)
+	}
+	if entry.Object, err = ioutil.ReadFile(inv.output); err != nil {
+		return err
+	}
+	if c.Remote != nil {
+		if err := c.Remote.Put(key, entry); err != nil {
+			Warn("Remote cache is disabled: %v", err)
+		}
+	}
+	return c.put(key, entry)
+}
+
+// put saves `entry` as `key`.
+func (c *CompileCache) put(key string, entry *cacheEntry) error {
+	if err := os.MkdirAll(filepath.Join(c.Dir, key[:2]), 0755); err != nil {
+		return err
+	}
+	if entry.Stderr != nil {
+		if err := writeFileAtomically(c.entryPath(key, ".stderr"), entry.Stderr); err != nil {
+			return err
+		}
+	}
+	if entry.Depfile != nil {
+		if err := writeFileAtomically(c.entryPath(key, ".d"), entry.Depfile); err != nil {
+			return err
+		}
+	}
+	// Stores the object at last (it marks the entry as complete).
+	if err := writeFileAtomically(c.entryPath(key, ".o"), entry.Object); err != nil {
+		return err
+	}
+	if !c.trimDue() {
+		return nil
+	}
+	return c.trim(c.MaxSize, key)
+}
+
+// trimDue reports whether the cache should be trimmed (and records the time if so).
+// Walking the whole cache on every store is too expensive, so it is done periodically.
+func (c *CompileCache) trimDue() bool {
+	marker := filepath.Join(c.Dir, cacheTrimmedFile)
+	if fi, err := os.Stat(marker); err == nil && time.Since(fi.ModTime()) < cacheTrimInterval {
+		return false
+	}
+	return writeFileAtomically(marker, nil) == nil
+}
+
+// cacheFile holds the information of an entry in the cache.
+type cacheFile struct {
+	key   string
+	dir   string
+	size  int64
+	atime time.Time
+}
+
+// scanEntries lists the entries in the cache.
+func (c *CompileCache) scanEntries() ([]*cacheFile, error) {
+	buckets, err := c.buckets()
+	if err != nil {
+		return nil, err
+	}
+	var result []*cacheFile
+	for _, b := range buckets {
+		files, err := ioutil.ReadDir(b)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read \"%s\"", b)
+		}
+		entries := make(map[string]*cacheFile)
+		for _, fi := range files {
+			name := fi.Name()
+			ext := filepath.Ext(name)
+			if ext != ".o" && ext != ".d" && ext != ".stderr" {
+				continue // Statistics or temporaries.
+			}
+			k := strings.TrimSuffix(name, ext)
+			e, ok := entries[k]
+			if !ok {
+				e = &cacheFile{key: k, dir: b}
+				entries[k] = e
+				result = append(result, e)
+			}
+			e.size += fi.Size()
+			if ext == ".o" {
+				e.atime = fi.ModTime()
+			}
+		}
+	}
+	return result, nil
+}
+
+// trim removes the least recently used entries until the total size fits in `limit`.
+// The entry `keep` (just stored) is never removed.
+func (c *CompileCache) trim(limit int64, keep string) error {
+	entries, err := c.scanEntries()
+	if err != nil {
+		return err
+	}
+	total := int64(0)
+	for _, e := range entries {
+		total += e.size
+	}
+	if total <= limit {
+		return nil
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].atime.Equal(entries[j].atime) {
+			return entries[i].key < entries[j].key
+		}
+		return entries[i].atime.Before(entries[j].atime)
+	})
+	for _, e := range entries {
+		if total <= limit {
+			break
+		}
+		if e.key == keep {
+			continue
+		}
+		for _, ext := range []string{".o", ".d", ".stderr"} {
+			os.Remove(filepath.Join(e.dir, e.key+ext))
+		}
+		total -= e.size
+	}
+	return nil
+}
+
+// count increments the counter `name` in the sub-directory of `key`.
+// Counters are split into the sub-directories for reducing the contention between concurrent compilations
+// (an increment may be lost when they collide, so the statistics are approximate).
+func (c *CompileCache) count(key string, name string) {
+	path := filepath.Join(c.Dir, key[:2], cacheStatsFile)
+	counters := readCacheCounters(path)
+	counters[name]++
+	var b bytes.Buffer
+	for _, n := range cacheCounters {
+		fmt.Fprintf(&b, "%s %d\n", n, counters[n])
+	}
+	writeFileAtomically(path, b.Bytes())
+}
+
+// readCacheCounters reads the counters in `path` (empty if not exist).
+func readCacheCounters(path string) map[string]int64 {
+	result := make(map[string]int64)
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return result
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		var name string
+		var n int64
+		if _, err := fmt.Sscan(line, &name, &n); err == nil {
+			result[name] = n
+		}
+	}
+	return result
+}
+
+// Stats collects the statistics.
+func (c *CompileCache) Stats() (CacheStats, error) {
+	stats := CacheStats{MaxSize: c.MaxSize}
+	entries, err := c.scanEntries()
+	if err != nil {
+		return stats, err
+	}
+	for _, e := range entries {
+		stats.Size += e.size
+		if !e.atime.IsZero() {
+			stats.Entries++ // Has the object.
+		}
+	}
+	buckets, err := c.buckets()
+	if err != nil {
+		return stats, err
+	}
+	for _, b := range buckets {
+		counters := readCacheCounters(filepath.Join(b, cacheStatsFile))
+		stats.Hits += counters["hits"]
+		stats.RemoteHits += counters["remote-hits"]
+		stats.Misses += counters["misses"]
+	}
+	return stats, nil
+}
+
+// Clear removes all of the entries and the statistics.
+func (c *CompileCache) Clear() error {
+	buckets, err := c.buckets()
+	if err != nil {
+		return err
+	}
+	for _, b := range buckets {
+		if err := os.RemoveAll(b); err != nil {
+			return errors.Wrapf(err, "failed to remove \"%s\"", b)
+		}
+	}
+	if err := os.Remove(filepath.Join(c.Dir, cacheTrimmedFile)); err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "failed to remove \"%s\"", cacheTrimmedFile)
+	}
+	return nil
+}
+
+// buckets lists the sub-directories holding entries.
+func (c *CompileCache) buckets() ([]string, error) {
+	files, err := ioutil.ReadDir(c.Dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrapf(err, "failed to read \"%s\"", c.Dir)
+	}
+	result := make([]string, 0, len(files))
+	for _, fi := range files {
+		if _, err := hex.DecodeString(fi.Name()); fi.IsDir() && len(fi.Name()) == 2 && err == nil {
+			result = append(result, filepath.Join(c.Dir, fi.Name()))
+		}
+	}
+	return result, nil
+}
+
+// runCommand runs `args` and returns the exit code.
+func runCommand(args []string, stdout io.Writer, stderr io.Writer) (int, error) {
+	if len(args) == 0 {
+		return 1, errors.New("no commands to run")
+	}
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return exitErr.ExitCode(), nil
+		}
+		return 1, errors.Wrapf(err, "failed to run \"%s\"", args[0])
+	}
+	return 0, nil
+}
+
+// copyFile copies `src` to `dst` (`dst` is replaced atomically).
+func copyFile(src string, dst string) error {
+	b, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomically(dst, b)
+}
+
+// writeFileAtomically writes `b` into a temporary file then renames it to `path`.
+func writeFileAtomically(path string, b []byte) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(dir, ".cbuild-cache-")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// CacheExecMain implements `cbuild cache-exec <compiler> <args>...`.
+func CacheExecMain(args []string) int {
+	if 0 < len(args) && args[0] == "--" {
+		args = args[1:]
+	}
+	if len(args) == 0 {
+		fmt.Fprintf(os.Stderr, "Usage: %s cache-exec <compiler> <args>...\n", ProgramName)
+		return 1
+	}
+	cache, err := OpenCompileCache()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s:error: %v\n", ProgramName, err)
+		return 1
+	}
+	code, err := cache.Exec(args, os.Stdout, os.Stderr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s:error: %v\n", ProgramName, err)
+	}
+	return code
+}
+
+// CacheMain implements `cbuild cache stats` and `cbuild cache clear`.
+func CacheMain(args []string) int {
+	cache, err := OpenCompileCache()
+	if err == nil {
+		err = runCacheCommand(cache, args, os.Stdout)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s:error: %v\n", ProgramName, err)
+		return 1
+	}
+	return 0
+}
+
+func runCacheCommand(cache *CompileCache, args []string, w io.Writer) error {
+	if len(args) != 1 {
+		return errors.New("usage: cache (stats|clear)")
+	}
+	switch args[0] {
+	case "stats":
+		stats, err := cache.Stats()
+		if err != nil {
+			return err
+		}
+		rate := 0.0
+		if total := stats.Hits + stats.RemoteHits + stats.Misses; 0 < total {
+			rate = 100 * float64(stats.Hits+stats.RemoteHits) / float64(total)
+		}
+		fmt.Fprintf(w, "cache directory: %s\n", cache.Dir)
+		if cache.Remote != nil {
+			mode := "read-only"
+			if cache.Remote.Writable {
+				mode = "read-write"
+			}
+			fmt.Fprintf(w, "remote cache:    %s (%s)\n", cache.Remote.URL, mode)
+		}
+		fmt.Fprintf(w, "entries:         %d\n", stats.Entries)
+		fmt.Fprintf(w, "size:            %d / %d bytes\n", stats.Size, stats.MaxSize)
+		fmt.Fprintf(w, "hits:            %d\n", stats.Hits)
+		fmt.Fprintf(w, "remote hits:     %d\n", stats.RemoteHits)
+		fmt.Fprintf(w, "misses:          %d\n", stats.Misses)
+		fmt.Fprintf(w, "hit rate:        %.1f%%\n", rate)
+		return nil
+	case "clear":
+		return cache.Clear()
+	}
+	return errors.Errorf("unknown cache command \"%s\" (stats or clear)", args[0])
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestParseCacheSize(t *testing.T) {
+	Convey("GIVEN: Sizes", t, func() {
+		for s, expected := range map[string]int64{
+			"1024": 1024,
+			"10K":  10 << 10,
+			"500M": 500 << 20,
+			"5G":   5 << 30,
+			"1.5g": 3 << 29,
+		} {
+			v, err := ParseCacheSize(s)
+			So(err, ShouldBeNil)
+			So(v, ShouldEqual, expected)
+		}
+		for _, s := range []string{"", "G", "-1M", "abc"} {
+			_, err := ParseCacheSize(s)
+			So(err, ShouldNotBeNil)
+		}
+	})
+}
+
+func TestParseCompileInvocation(t *testing.T) {
+	Convey("GIVEN: A compile command", t, func() {
+		args := []string{"cc", "-O2", "-c", "-MMD", "-MT", "a.o", "-MF", "a.d", "-o", "a.o", "a.c"}
+		inv, ok := parseCompileInvocation(args)
+		Convey("THEN: It should be cacheable", func() {
+			So(ok, ShouldBeTrue)
+			So(inv.output, ShouldEqual, "a.o")
+			So(inv.depfile, ShouldEqual, "a.d")
+			So(inv.depTarget(), ShouldEqual, "a.o")
+		})
+		Convey("THEN: The outputs should be removed while preprocessing", func() {
+			So(inv.preprocessArgs(), ShouldResemble, []string{"cc", "-O2", "a.c", "-E"})
+		})
+	})
+	Convey("GIVEN: Commands not cacheable", t, func() {
+		for _, args := range [][]string{
+			{"ar", "rc", "a.a", "a.o"},
+			{"cc", "-o", "a", "a.o"},
+			{"cc", "-c", "a.c"},
+			{"cc", "-c", "-o", "a.o", "@a.rsp"},
+			{"cl", "-c", "-Foa.obj", "a.c"},
+		} {
+			_, ok := parseCompileInvocation(args)
+			So(ok, ShouldBeFalse)
+		}
+	})
+}
+
+func TestDepfileInputs(t *testing.T) {
+	Convey("GIVEN: A dependency file", t, func() {
+		src := "$out: a.c /usr/include/stdio.h \\\n  dir\\ with\\ space/b.h cost$$.h\n\n/usr/include/stdio.h:\n"
+		Convey("THEN: Dependencies should be listed", func() {
+			So(depfileInputs([]byte(src)), ShouldResemble, []string{"a.c", "/usr/include/stdio.h", "dir with space/b.h", "cost$.h"})
+		})
+	})
+}
+
+func TestCompileCache(t *testing.T) {
+	if _, err := exec.LookPath("cc"); err != nil {
+		t.Skip("no C compilers found")
+	}
+	dir, err := ioutil.TempDir("", "cbuild-cache-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cache := &CompileCache{Dir: filepath.Join(dir, "cache"), MaxSize: DefaultCacheSize}
+	src := filepath.Join(dir, "a.c")
+	hdr := filepath.Join(dir, "a.h")
+	obj := filepath.Join(dir, "a.o")
+	dep := filepath.Join(dir, "a.d")
+	write := func(p string, s string) {
+		if err := ioutil.WriteFile(p, []byte(s), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(hdr, "#define VALUE 1\n")
+	write(src, "#include \"a.h\"\n#warning cached\nint value() { return VALUE; }\n")
+	compile := func() (int, string) {
+		var stderr bytes.Buffer
+		code, err := cache.Exec([]string{"cc", "-c", "-MMD", "-MF", dep, "-o", obj, src}, ioutil.Discard, &stderr)
+		So(err, ShouldBeNil)
+		return code, stderr.String()
+	}
+	stats := func() CacheStats {
+		s, err := cache.Stats()
+		So(err, ShouldBeNil)
+		return s
+	}
+	Convey("GIVEN: An empty cache", t, func() {
+		So(cache.Clear(), ShouldBeNil)
+		Convey("WHEN: Compiling twice", func() {
+			code, msg := compile()
+			So(code, ShouldEqual, 0)
+			So(msg, ShouldContainSubstring, "cached")
+			expected, err := ioutil.ReadFile(obj)
+			So(err, ShouldBeNil)
+			So(os.Remove(obj), ShouldBeNil)
+			So(os.Remove(dep), ShouldBeNil)
+			code, msg = compile()
+			Convey("THEN: Outputs should be restored from the cache", func() {
+				So(code, ShouldEqual, 0)
+				So(msg, ShouldContainSubstring, "cached")
+				b, err := ioutil.ReadFile(obj)
+				So(err, ShouldBeNil)
+				So(b, ShouldResemble, expected)
+				d, err := ioutil.ReadFile(dep)
+				So(err, ShouldBeNil)
+				So(string(d), ShouldContainSubstring, "a.h")
+				s := stats()
+				So(s.Entries, ShouldEqual, 1)
+				So(s.Hits, ShouldEqual, 1)
+				So(s.Misses, ShouldEqual, 1)
+			})
+			Convey("THEN: Modifying the header should miss", func() {
+				write(hdr, "#define VALUE 2\n")
+				code, _ := compile()
+				So(code, ShouldEqual, 0)
+				s := stats()
+				So(s.Entries, ShouldEqual, 2)
+				So(s.Misses, ShouldEqual, 2)
+			})
+			Convey("THEN: `cache stats` and `cache clear` should work", func() {
+				var out bytes.Buffer
+				So(runCacheCommand(cache, []string{"stats"}, &out), ShouldBeNil)
+				So(out.String(), ShouldContainSubstring, "hit rate:        50.0%")
+				So(runCacheCommand(cache, []string{"clear"}, &out), ShouldBeNil)
+				So(stats(), ShouldResemble, CacheStats{MaxSize: DefaultCacheSize})
+				So(runCacheCommand(cache, []string{"purge"}, &out), ShouldNotBeNil)
+			})
+		})
+		Convey("WHEN: Compilation fails", func() {
+			write(src, "#error broken\n")
+			code, msg := compile()
+			Convey("THEN: The exit code should be returned without caching", func() {
+				So(code, ShouldNotEqual, 0)
+				So(msg, ShouldContainSubstring, "broken")
+				So(stats().Entries, ShouldEqual, 0)
+			})
+		})
+	})
+}
+
+func TestCompileCacheSharing(t *testing.T) {
+	if _, err := exec.LookPath("cc"); err != nil {
+		t.Skip("no C compilers found")
+	}
+	dir, err := ioutil.TempDir("", "cbuild-cache-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(cwd)
+	cache := &CompileCache{Dir: filepath.Join(dir, "cache"), MaxSize: DefaultCacheSize}
+	// Compiles in the checkout `name` (outputs are specified by the absolute paths).
+	compile := func(name string) (string, string) {
+		root := filepath.Join(dir, name)
+		So(os.MkdirAll(filepath.Join(root, "out"), 0755), ShouldBeNil)
+		So(ioutil.WriteFile(filepath.Join(root, "a.c"), []byte("int value() { return 1; }\n"), 0644), ShouldBeNil)
+		So(os.Chdir(root), ShouldBeNil)
+		obj := filepath.Join(root, "out", "a.o")
+		dep := filepath.Join(root, "out", "a.d")
+		code, err := cache.Exec([]string{"cc", "-c", "-MMD", "-MF", dep, "-o", obj, "a.c"}, ioutil.Discard, ioutil.Discard)
+		So(err, ShouldBeNil)
+		So(code, ShouldEqual, 0)
+		b, err := ioutil.ReadFile(dep)
+		So(err, ShouldBeNil)
+		return obj, string(b)
+	}
+	Convey("GIVEN: A source compiled in a checkout", t, func() {
+		So(cache.Clear(), ShouldBeNil)
+		_, original := compile("first")
+		Convey("WHEN: Compiling the same source in another checkout", func() {
+			obj, dep := compile("second")
+			Convey("THEN: The entry should be shared", func() {
+				s, err := cache.Stats()
+				So(err, ShouldBeNil)
+				So(s.Hits, ShouldEqual, 1)
+				So(s.Entries, ShouldEqual, 1)
+			})
+			Convey("THEN: The dependency file should name the output in the checkout", func() {
+				So(dep, ShouldStartWith, obj+":")
+				So(dep[len(obj):], ShouldEqual, original[len(filepath.Join(dir, "first", "out", "a.o")):])
+			})
+		})
+	})
+}
+
+func TestCacheEviction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cbuild-cache-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cache := &CompileCache{Dir: dir}
+	write := func(key string, size int, atime time.Time) {
+		for _, ext := range []string{".o", ".d"} {
+			p := filepath.Join(dir, key[:2], key+ext)
+			So(os.MkdirAll(filepath.Dir(p), 0755), ShouldBeNil)
+			So(ioutil.WriteFile(p, bytes.Repeat([]byte{'x'}, size), 0644), ShouldBeNil)
+			So(os.Chtimes(p, atime, atime), ShouldBeNil)
+		}
+	}
+	list := func() string {
+		var names []string
+		for _, b := range []string{"ab", "cd"} {
+			files, _ := ioutil.ReadDir(filepath.Join(dir, b))
+			for _, fi := range files {
+				names = append(names, fi.Name())
+			}
+		}
+		return strings.Join(names, " ")
+	}
+	Convey("GIVEN: Entries in the different sub-directories accessed at different times", t, func() {
+		So(os.RemoveAll(dir), ShouldBeNil)
+		base := time.Now().Add(-time.Hour)
+		for i, key := range []string{"ab2", "cd0", "ab1"} {
+			write(key, 100, base.Add(time.Duration(i)*time.Minute))
+		}
+		Convey("WHEN: Trimming", func() {
+			So(cache.trim(450, ""), ShouldBeNil)
+			Convey("THEN: The least recently used entries should be removed across the sub-directories", func() {
+				So(list(), ShouldEqual, "ab1.d ab1.o cd0.d cd0.o")
+			})
+		})
+		Convey("WHEN: Trimming after storing a large entry", func() {
+			write("cd9", 1000, time.Now())
+			So(cache.trim(450, "cd9"), ShouldBeNil)
+			Convey("THEN: The stored entry should be kept", func() {
+				So(list(), ShouldEqual, "cd9.d cd9.o")
+			})
+		})
+		Convey("WHEN: Storing entries", func() {
+			So(cache.trimDue(), ShouldBeTrue)
+			Convey("THEN: The cache should be trimmed periodically", func() {
+				So(cache.trimDue(), ShouldBeFalse)
+			})
+		})
+	})
+}
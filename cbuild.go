@@ -4,7 +4,8 @@
 package main
 
 import (
-	"bufio"
+	"bytes"
+	"crypto/sha256"
 	"flag"
 	"fmt"
 	"io/ioutil"
@@ -13,12 +14,11 @@ import (
 	"regexp"
 	"runtime"
 	"strings"
+	"sync"
 	"text/template"
 
 	"github.com/pkg/errors"
 	"gopkg.in/yaml.v2"
-
-	"github.com/kuma777/go-msbuild"
 )
 
 //
@@ -40,12 +40,24 @@ var (
 		variant             string
 		templateFile        string
 		useCompilerLauncher bool
+		backend             string
+		jobs                int
+		pathRoot            string
+		relativePaths       bool
+		useCompileCache     bool
+		useDistCompile      bool
+		compdbNoGenerated   bool   // Excludes generated (`$`-prefixed) sources from `compile_commands.json`
+		compdbFormat        string // "arguments" or "command"
+		compdbRoot          string // "copy" or "symlink" to place `compile_commands.json` in the current directory
+		compdbPerProject    bool   // Writes databases per project
+		compdbMerge         string // Comma separated databases merged into `compile_commands.json`
 	}
 
 	useResponse     bool
 	groupArchives   bool
 	responseNewline bool
 	useDepsMsvc     bool
+	commandShell    ShellType
 
 	emitContext struct {
 		subNinjaList      []string
@@ -54,11 +66,14 @@ var (
 		commandList       []*BuildCommand
 		otherRuleFileList []OtherRuleFile
 		scannedConfigs    []string // remembers all scanned configuration files.
+		generatedFiles    []string // files written by the generation (ex. unity files).
 		defaultTargets    []string
+		environment       map[string]ImportedEnvironment // imported environment variables.
 	}
 
 	project struct {
 		headerFiles []string
+		targets     []*ProjectTarget // targets for project file generators.
 	}
 
 	// ProgramPath holds path to the invoked program.
@@ -73,6 +88,23 @@ var (
 // The entry point.
 func main() {
 	ProgramName = filepath.Base(ProgramPath)
+	// Sub-commands used from the generated build files.
+	if 1 < len(os.Args) {
+		switch os.Args[1] {
+		case "cache-exec":
+			os.Exit(CacheExecMain(os.Args[2:]))
+		case "cache":
+			os.Exit(CacheMain(os.Args[2:]))
+		case "dist-exec":
+			os.Exit(DistExecMain(os.Args[2:]))
+		case "worker":
+			os.Exit(WorkerMain(os.Args[2:]))
+		case "scan-modules":
+			os.Exit(ScanModulesMain(os.Args[2:]))
+		case "collate-modules":
+			os.Exit(CollateModulesMain(os.Args[2:]))
+		}
+	}
 	var (
 		isDebug          bool
 		isRelease        bool
@@ -97,20 +129,43 @@ func main() {
 	flag.StringVar(&option.outputRoot, "o", "build", "build directory")
 	flag.StringVar(&option.ninjaFile, "f", "build.ninja", "output build.ninja filename")
 	flag.StringVar(&option.templateFile, "template", "", "Use external template file")
-	flag.BoolVar(&option.useCompilerLauncher, "use-compiler-launcher", false, "Use compiler launcher")
-	genMSBuild := flag.Bool("msbuild", false, "Export MSBuild project")
-	projdir := flag.String("msbuild-dir", "./", "MSBuild project output directory")
-	projname := flag.String("msbuild-proj", "out", "MSBuild project name")
+	flag.StringVar(&option.backend, "backend", "ninja",
+		fmt.Sprintf("Comma separated output generators (%s)", strings.Join(GeneratorNames(), ", ")))
+	flag.BoolVar(&option.useCompilerLauncher, "use-compiler-launcher", false, "Use SN-DBS compiler launcher (unless `compiler_launcher:` is specified)")
+	flag.BoolVar(&option.useCompileCache, "compile-cache", false, "Compile via the compilation cache (cache-exec)")
+	flag.BoolVar(&option.useDistCompile, "dist-compile", false, "Compile on the workers listed in $CBUILD_DIST_WORKERS (dist-exec)")
+	flag.BoolVar(&option.compdbNoGenerated, "compdb-exclude-generated", false, "Exclude generated ($-prefixed) sources from compile_commands.json")
+	flag.StringVar(&option.compdbFormat, "compdb-format", compileDbArguments, "Form of the commands in compile_commands.json (arguments or command)")
+	flag.StringVar(&option.compdbRoot, "compdb-root", "", "Place compile_commands.json in the current directory (copy or symlink)")
+	flag.BoolVar(&option.compdbPerProject, "compdb-per-project", false, "Write compile_commands.json per project (into compdb/<project>/ of the output directory)")
+	flag.StringVar(&option.compdbMerge, "compdb-merge", "", "Merge compile_commands.json files (comma separated, ex. the ones for other variants or platforms)")
+	flag.BoolVar(&EnableShellInterpolation, "enable-shell", false, "Enable ${shell:...} in variables")
+	flag.IntVar(&option.jobs, "j", runtime.NumCPU(), "Number of directories read concurrently")
+	flag.StringVar(&option.pathRoot, "root", "", "Write paths under the directory relative to the current directory (for reproducible outputs)")
+	flag.BoolVar(&option.relativePaths, "relative-paths", false, "Write paths relative to the directory of the build file (under -root, or the current directory)")
+	genMSBuild := flag.Bool("msbuild", false, "Export MSBuild project (same as -backend msbuild)")
+	for _, g := range generators {
+		g.RegisterFlags(flag.CommandLine)
+	}
 	showVersionAndExit := flag.Bool("version", false, "display version")
 	dumpDefaultTemplates := flag.Bool("show-default-template", false, "Show default template")
+	checkEnvironment := flag.String("check-environment", "", "Update the environment record file if imported variables are changed (used by ninja)")
 	flag.Parse()
+	if !isFlagSpecified("backend") {
+		switch {
+		case *genMSBuild:
+			option.backend = "msbuild"
+		case isFlagSpecified("export-cmake"):
+			option.backend = "cmake"
+		}
+	}
 
 	if *showVersionAndExit {
 		fmt.Fprintf(os.Stdout, "%s: %v (%s/%s)\n", ProgramName, cbuildVersion, runtime.Version(), runtime.Compiler)
 		os.Exit(0)
 	}
 	if *dumpDefaultTemplates {
-		src, err := getNinjaTemplateSource("")
+		src, err := getNinjaTemplateSource()
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "%s: Failed to obtain the default template\n", ProgramName)
 			os.Exit(1)
@@ -118,6 +173,13 @@ func main() {
 		fmt.Println(src)
 		os.Exit(0)
 	}
+	if 0 < len(*checkEnvironment) {
+		if err := CheckEnvironment(*checkEnvironment); err != nil {
+			fmt.Fprintf(os.Stderr, "%s:error: %v\n", ProgramName, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
 	// Temporally sets option.outputDir
 	option.outputDir = option.outputRoot
 	if len(option.variant) == 0 {
@@ -138,9 +200,10 @@ func main() {
 			option.variant = Develop.String()
 		}
 	}
-	emitContext.appendRules = make(map[string]AppendBuild)
-	emitContext.otherRuleList = make(map[string]OtherRule)
-	err := cbuild(*projdir, *projname, *genMSBuild)
+	selected, err := SelectGenerators(option.backend)
+	if err == nil {
+		err = cbuild(selected)
+	}
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "%s:error: %v\n", ProgramName, err)
 		os.Exit(1)
@@ -148,18 +211,57 @@ func main() {
 	os.Exit(0)
 }
 
-func cbuild(projdir string, projname string, genMSBuild bool) error {
-	useResponse = false
-	groupArchives = false
-	responseNewline = false
-	useDepsMsvc = false
+func cbuild(selected []Generator) error {
 	if 0 < flag.NArg() && len(option.targetName) == 0 {
 		option.targetName = flag.Arg(0)
 	}
 	if 0 < len(option.targetName) {
 		Verbose("%s: Target is \"%s\"\n", ProgramName, option.targetName)
 	}
-	initialDictionary := importEnvironmentVariables()
+	if err := collectAll(); err != nil {
+		return err
+	}
+	graph := currentBuildGraph()
+	if graph.IsEmpty() {
+		fmt.Fprintf(os.Stderr, "%s: No commands to run.\n", ProgramName)
+		return nil
+	}
+	for _, g := range selected {
+		Verbose("%s: Emits outputs with \"%s\".\n", ProgramName, g.Name())
+		if err := g.Emit(graph); err != nil {
+			return errors.Wrapf(err, "backend \"%s\" failed", g.Name())
+		}
+	}
+	return nil
+}
+
+// collectVariants collects build graphs for each of `variants`.
+// Options modified while collecting (ex. `option.outputDir`) are restored at last.
+func collectVariants(variants []string) ([]*BuildGraph, error) {
+	saved := option
+	defer (func() { option = saved })()
+
+	result := make([]*BuildGraph, 0, len(variants))
+	for _, v := range variants {
+		option.variant = v
+		if err := collectAll(); err != nil {
+			return nil, errors.Wrapf(err, "failed to collect configurations for \"%s\"", v)
+		}
+		result = append(result, currentBuildGraph())
+	}
+	return result, nil
+}
+
+// collectAll resets the states then collects configurations for the current variant.
+func collectAll() error {
+	useResponse = false
+	groupArchives = false
+	responseNewline = false
+	useDepsMsvc = false
+	commandShell = DefaultShell()
+	// Environment variables are imported via `environment:` sections.
+	setImportedEnvironment(make(map[string]ImportedEnvironment))
+	initialDictionary := make(map[string]string)
 	const optPrefixSym = "option_prefix"
 	if _, ok := initialDictionary[optPrefixSym]; !ok {
 		initialDictionary[optPrefixSym] = "-"
@@ -169,28 +271,18 @@ func cbuild(projdir string, projname string, genMSBuild bool) error {
 		selectedTarget: option.targetName,
 		target:         option.targetName,
 	}
-	if _, err := CollectConfigurations(buildInfo, ""); err != nil {
-		return err
-	}
-	if (len(emitContext.commandList) + len(emitContext.otherRuleFileList)) <= 0 {
-		fmt.Fprintf(os.Stderr, "%s: No commands to run.\n", ProgramName)
-		return nil
-	}
-	if genMSBuild {
-		Verbose("%s: Creates VC++ project file(s).\n", ProgramName)
-		outputMSBuild(projdir, projname)
-	} else {
-		if err := outputNinja(); err != nil {
-			return err
-		}
-		if err := outputCompileDb(); err != nil {
-			return err
+	if option.useCompilerLauncher && !option.useCompileCache && !option.useDistCompile {
+		// Overridden by `compiler_launcher:`.
+		if path := FindCompilerLauncher(); path != "" {
+			buildInfo.launcher = &LauncherSetting{Command: path, Args: "-p $project", Link: true}
 		}
 	}
-	return nil
+	_, err := CollectConfigurations(buildInfo, "")
+	return err
 }
 
-// CollectConfigurations collects configurations recursively.
+// CollectConfigurations collects configurations recursively and stores them into the globals.
+// Sibling directories are read concurrently (up to `option.jobs` goroutines).
 func CollectConfigurations(info BuildInfo, relChildDir string) ([]string, error) {
 	var childPath string
 	if len(relChildDir) == 0 {
@@ -198,10 +290,51 @@ func CollectConfigurations(info BuildInfo, relChildDir string) ([]string, error)
 	} else {
 		childPath = filepath.ToSlash(filepath.Clean(relChildDir)) + "/"
 	}
-	return traverse(info, childPath, 0)
+	c, err := newTraverser(option.jobs).traverse(info, childPath, 0, nil)
+	if err != nil {
+		return nil, err
+	}
+	c.publish()
+	return c.artifacts, nil
+}
+
+// configCache holds parsed configurations keyed by the SHA-256 of their contents.
+// It lives only in this process: every regeneration still reads and traverses
+// the whole tree, and nothing is persisted in the build directory.
+var configCache = struct {
+	sync.Mutex
+	entries map[[sha256.Size]byte]*Data
+}{entries: make(map[[sha256.Size]byte]*Data)}
+
+// loadConfiguration reads and parses `yamlSource`.
+// Parsed results are shared within a run while the contents are same
+// (ex. collecting several variants).
+// The result should not be modified.
+func loadConfiguration(yamlSource string) (*Data, error) {
+	buf, err := ioutil.ReadFile(yamlSource)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read \"%s\"", yamlSource)
+	}
+	key := sha256.Sum256(buf)
+	configCache.Lock()
+	conf, ok := configCache.entries[key]
+	configCache.Unlock()
+	if ok {
+		return conf, nil
+	}
+	conf = &Data{}
+	if err := yaml.Unmarshal(buf, conf); err != nil {
+		return nil, errors.Wrapf(err, "failed to unmarshal \"%s\"", yamlSource)
+	}
+	configCache.Lock()
+	configCache.entries[key] = conf
+	configCache.Unlock()
+	return conf, nil
 }
 
-func traverse(info BuildInfo, relChildDir string, level int) ([]string, error) {
+// traverse collects the configuration in `relChildDir` and its sub-directories.
+// `parent` is the collection of the parent directory (`nil` for the root).
+func (t *traverser) traverse(info BuildInfo, relChildDir string, level int, parent *collection) (*collection, error) {
 	var err error
 	if !strings.HasSuffix(relChildDir, "/") {
 		return nil, errors.New("output directory should end with '/'")
@@ -210,22 +343,18 @@ func traverse(info BuildInfo, relChildDir string, level int) ([]string, error) {
 	defer Verbose("%s: Leave \"%s\"\n", ProgramName, relChildDir)
 
 	yamlSource := filepath.Join(relChildDir, "make.yml")
-	buf, err := ioutil.ReadFile(yamlSource)
+	conf, err := loadConfiguration(yamlSource)
 	if err != nil {
-		return nil, errors.Wrapf(err, "failed to read \"%s\"", yamlSource)
-	}
-
-	var conf Data
-	if err = yaml.Unmarshal(buf, &conf); err != nil {
-		return nil, errors.Wrapf(err, "failed to unmarshal \"%s\"", yamlSource)
+		return nil, err
 	}
+	c := newCollection(parent)
 	{
 		var absPath string
 		absPath, err = filepath.Abs(yamlSource)
 		if err != nil {
 			return nil, errors.Wrapf(err, "failed to convert \"%s\" to absolute path", yamlSource)
 		}
-		emitContext.scannedConfigs = append(emitContext.scannedConfigs, filepath.ToSlash(absPath))
+		c.configs = append(c.configs, filepath.ToSlash(absPath))
 	}
 
 	info.mydir = relChildDir
@@ -255,23 +384,62 @@ func traverse(info BuildInfo, relChildDir string, level int) ([]string, error) {
 		}
 		return result
 	})()
+	info.lists = (func() map[string][]string {
+		result := make(map[string][]string)
+		for ik, iv := range info.lists {
+			result[ik] = iv
+		}
+		return result
+	})()
+	info.clipLists()
+	if err = importEnvironment(&info, c, conf.Environment); err != nil {
+		return nil, errors.Wrapf(err, "failed to import environment variables in \"%s\"", yamlSource)
+	}
+	if err = checkConditionEnvironment(conf.conditions(), info.environment); err != nil {
+		return nil, errors.Wrapf(err, "malformed conditions in \"%s\"", yamlSource)
+	}
 
 	for _, v := range conf.Variable {
-		if val, ok := v.GetMatchedValue(info.target, option.platform, option.variant); ok {
+		if val, ok := v.GetMatchedValue(info.conditionContext()); ok {
+			// Global flags are assigned in order after traversing.
 			switch v.Name {
 			case "enable_response":
-				useResponse = ToBoolean(val)
+				b := ToBoolean(val)
+				c.settings = append(c.settings, func() { useResponse = b })
 			case "response_newline":
-				responseNewline = ToBoolean(val)
+				b := ToBoolean(val)
+				c.settings = append(c.settings, func() { responseNewline = b })
 			case "group_archives":
-				groupArchives = ToBoolean(val)
+				b := ToBoolean(val)
+				c.settings = append(c.settings, func() { groupArchives = b })
 			case "deps_msvc":
-				useDepsMsvc = ToBoolean(val)
+				b := ToBoolean(val)
+				c.settings = append(c.settings, func() { useDepsMsvc = b })
+			case "command_shell":
+				sh, err := ParseShellType(val)
+				if err != nil {
+					return nil, err
+				}
+				c.settings = append(c.settings, func() { commandShell = sh })
 			default: /* NO-OP */
 			}
-			info.variables[v.Name] = val
+			info.SetVariable(&v, val)
 		}
 	}
+	for _, l := range conf.Launcher {
+		if !l.Match(info.conditionContext()) {
+			continue
+		}
+		s, err := newLauncherSetting(&info, &l)
+		if err != nil {
+			return nil, errors.Wrapf(err, "malformed `compiler_launcher:` in \"%s\"", yamlSource)
+		}
+		if option.useCompileCache || option.useDistCompile {
+			Warn("`compiler_launcher:` in \"%s\" is ignored (-compile-cache or -dist-compile is specified).", yamlSource)
+			continue
+		}
+		info.launcher = s
+	}
 	optionPrefix := info.OptionPrefix()
 
 	if level == 0 {
@@ -292,7 +460,11 @@ func traverse(info BuildInfo, relChildDir string, level int) ([]string, error) {
 	info.outputdir = JoinPaths(option.outputDir, relChildDir) + "/" // Proofs '/' ending
 
 	// Constructs include path arguments.
-	for _, pth := range filterByBuildTarget(conf.Include, info.target) {
+	includes, err := info.SpliceLists(filterByBuildTarget(conf.Include, info.conditionContext()))
+	if err != nil {
+		return nil, err
+	}
+	for _, pth := range includes {
 		const prefix = "$output"
 		if strings.HasPrefix(pth, prefix) {
 			info.AddInclude(JoinPaths(info.outputdir, "output"+pth[len(prefix):]))
@@ -310,19 +482,38 @@ func traverse(info BuildInfo, relChildDir string, level int) ([]string, error) {
 		}
 	}
 	// Constructs defines.
-	for _, d := range filterByBuildTarget(conf.Define, info.target) {
+	defines, err := info.SpliceLists(filterByBuildTarget(conf.Define, info.conditionContext()))
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range defines {
 		info.AddDefines(d)
 	}
 	// Construct other options.
-	for _, o := range filterByBuildTarget(conf.Option, info.target) {
+	for _, o := range filterByBuildTarget(conf.Option, info.conditionContext()) {
 		opts, err := makeOptionArgs(info, o, optionPrefix)
 		if err != nil {
 			return nil, err
 		}
 		info.options = append(info.options, opts...)
 	}
+	// Constructs language specific options.
+	for _, o := range filterByBuildTarget(conf.COption, info.conditionContext()) {
+		opts, err := makeOptionArgs(info, o, optionPrefix)
+		if err != nil {
+			return nil, err
+		}
+		info.cOptions = append(info.cOptions, opts...)
+	}
+	for _, o := range filterByBuildTarget(conf.CXXOption, info.conditionContext()) {
+		opts, err := makeOptionArgs(info, o, optionPrefix)
+		if err != nil {
+			return nil, err
+		}
+		info.cxxOptions = append(info.cxxOptions, opts...)
+	}
 	// Constructs option list for archiver.
-	for _, a := range filterByBuildTarget(conf.ArchiveOption, info.target) {
+	for _, a := range filterByBuildTarget(conf.ArchiveOption, info.conditionContext()) {
 		opts, err := makeOptionArgs(info, a, "")
 		if err != nil {
 			return nil, err
@@ -330,7 +521,7 @@ func traverse(info BuildInfo, relChildDir string, level int) ([]string, error) {
 		info.archiveOptions = append(info.archiveOptions, opts...)
 	}
 	// Constructs option list for converters.
-	for _, c := range filterByBuildTarget(conf.ConvertOption, info.target) {
+	for _, c := range filterByBuildTarget(conf.ConvertOption, info.conditionContext()) {
 		opts, err := makeOptionArgs(info, c, "")
 		if err != nil {
 			return nil, err
@@ -338,7 +529,7 @@ func traverse(info BuildInfo, relChildDir string, level int) ([]string, error) {
 		info.convertOptions = append(info.convertOptions, opts...)
 	}
 	// Construct option list for linker.
-	for _, l := range filterByBuildTarget(conf.LinkOption, info.target) {
+	for _, l := range filterByBuildTarget(conf.LinkOption, info.conditionContext()) {
 		opts, err := makeOptionArgs(info, l, optionPrefix)
 		if err != nil {
 			return nil, err
@@ -346,7 +537,7 @@ func traverse(info BuildInfo, relChildDir string, level int) ([]string, error) {
 		info.linkOptions = append(info.linkOptions, opts...)
 	}
 	// Constructs system library list.
-	for _, ls := range filterByBuildTarget(conf.Libraries, info.target) {
+	for _, ls := range filterByBuildTarget(conf.Libraries, info.conditionContext()) {
 		opts, err := makeOptionArgs(info, ls, optionPrefix+"l")
 		if err != nil {
 			return nil, err
@@ -354,7 +545,7 @@ func traverse(info BuildInfo, relChildDir string, level int) ([]string, error) {
 		info.libraries = append(info.libraries, opts...)
 	}
 	// Constructs library list.
-	for _, ld := range filterByBuildTarget(conf.LinkDepend, info.target) {
+	for _, ld := range filterByBuildTarget(conf.LinkDepend, info.conditionContext()) {
 		opts, err := makeOptionArgs(info, ld, "")
 		if err != nil {
 			return nil, err
@@ -362,59 +553,76 @@ func traverse(info BuildInfo, relChildDir string, level int) ([]string, error) {
 		info.linkDepends = append(info.linkDepends, opts...)
 	}
 	// Constructs sub-ninjas
-	for _, subninja := range filterByBuildTarget(conf.SubNinja, info.target) {
-		emitContext.subNinjaList = append(emitContext.subNinjaList, subninja)
+	for _, subninja := range filterByBuildTarget(conf.SubNinja, info.conditionContext()) {
+		c.subNinjas = append(c.subNinjas, subninja)
 	}
 
 	// Constructs header files.
-	for _, h := range filterByBuildTarget(conf.Headers, info.target) {
+	headers := make([]string, 0)
+	for _, h := range filterByBuildTarget(conf.Headers, info.conditionContext()) {
 		h, err = info.StrictInterpolate(h)
 		if err != nil {
 			return nil, err
 		}
 		h, _ = filepath.Abs(filepath.Join(relChildDir, h))
-		project.headerFiles = append(project.headerFiles, h)
+		c.headers = append(c.headers, h)
+		headers = append(headers, filepath.ToSlash(h))
 	}
 
-	if err = registerOtherRules(&emitContext.otherRuleList, info, conf.Other); err != nil {
+	if err = registerOtherRules(c, info, conf.Other); err != nil {
 		return nil, err
 	}
 
-	files := filterByBuildTarget(conf.Source, info.target)
-	cvfiles := filterByBuildTarget(conf.ConvertList, info.target)
-	testfiles := filterByBuildTarget(conf.Tests, info.target)
+	files, err := info.SpliceLists(filterByBuildTarget(conf.Source, info.conditionContext()))
+	if err != nil {
+		return nil, err
+	}
+	sourceOptions := filterSourceOptions(conf.Source, info.conditionContext())
+	cvfiles := filterByBuildTarget(conf.ConvertList, info.conditionContext())
+	testfiles := filterByBuildTarget(conf.Tests, info.conditionContext())
 
 	// sub-directories
-	subdirs := filterByBuildTarget(conf.Subdirs, info.target)
+	subdirs := filterByBuildTarget(conf.Subdirs, info.conditionContext())
 
-	subArtifacts := make([]string, 0, len(subdirs))
+	firstChildTarget := len(c.targets)
 
 	// Recurse into the sub-directories.
-	for _, s := range subdirs {
-		// relChildDir always ends with '/'
-		odir := relChildDir + filepath.ToSlash(filepath.Clean(s)) + "/"
-		if r, err := traverse(info, odir, level+1); err == nil {
-			if 0 < len(r) {
-				subArtifacts = append(subArtifacts, r...)
-			}
-		} else {
-			return nil, err
-		}
+	subArtifacts, err := t.traverseSubdirs(info, relChildDir, level, subdirs, c)
+	if err != nil {
+		return nil, err
 	}
 
 	// pre build files
-	cmds, err := makePreBuildCommands(info, relChildDir, conf.Prebuild)
+	cmds, err := makePreBuildCommands(info, c, relChildDir, conf.Prebuild)
 	if err != nil {
 		return nil, err
 	}
-	emitContext.commandList = append(emitContext.commandList, cmds...)
+	c.commands = append(c.commands, cmds...)
+	prebuilds := cmds
 	// create compile list
-	cmds, artifacts, err := makeCompileCommands(info, &emitContext.otherRuleList, relChildDir, files, targetTag, currentTarget.Name)
+	firstOtherRuleFile := len(c.otherRuleFiles)
+	cmds, artifacts, err := makeCompileCommands(info, c, relChildDir, files, sourceOptions, targetTag, currentTarget.Name, &currentTarget.PCH, &currentTarget.Unity)
 	if err != nil {
 		return nil, err
 	}
-	emitContext.commandList = append(emitContext.commandList, cmds...)
+	c.commands = append(c.commands, cmds...)
+	compiled := make([]string, 0, len(cmds))
+	for _, c := range cmds {
+		if c.CommandType != "compile" {
+			continue
+		}
+		if 0 < len(c.Sources) {
+			compiled = append(compiled, c.Sources...)
+		} else {
+			compiled = append(compiled, c.InFiles...)
+		}
+	}
+	for _, o := range c.otherRuleFiles[firstOtherRuleFile:] {
+		compiled = append(compiled, o.Infile)
+	}
 	var result []string
+	projectOutput := ""
+	var testOutputs []string // Test programs built by "test" targets
 
 	switch currentTarget.Type {
 	case "library":
@@ -426,9 +634,10 @@ func traverse(info BuildInfo, relChildDir string, level int) ([]string, error) {
 			if err != nil {
 				return nil, err
 			}
-			emitContext.commandList = append(emitContext.commandList, libCmd)
+			c.commands = append(c.commands, libCmd)
 			result = append(subArtifacts, libCmd.OutFile)
-			emitContext.defaultTargets = append(emitContext.defaultTargets, libCmd.OutFile)
+			projectOutput = libCmd.OutFile
+			c.defaultTargets = append(c.defaultTargets, libCmd.OutFile)
 		} else {
 			Warn("There are no files to build in \"%s\".", relChildDir)
 		}
@@ -447,10 +656,11 @@ func traverse(info BuildInfo, relChildDir string, level int) ([]string, error) {
 			if err != nil {
 				return nil, err
 			}
-			emitContext.commandList = append(emitContext.commandList, cmds...)
+			c.commands = append(c.commands, cmds...)
 			for _, t := range cmds {
-				emitContext.defaultTargets = append(emitContext.defaultTargets, t.OutFile)
+				c.defaultTargets = append(c.defaultTargets, t.OutFile)
 			}
+			projectOutput = cmds[0].OutFile
 		} else {
 			Warn("There are no files to build in \"%s\".", relChildDir)
 		}
@@ -460,7 +670,8 @@ func traverse(info BuildInfo, relChildDir string, level int) ([]string, error) {
 			if e != nil {
 				return nil, e
 			}
-			emitContext.commandList = append(emitContext.commandList, cmd)
+			c.commands = append(c.commands, cmd)
+			projectOutput = cmd.OutFile
 		} else {
 			Warn("There are no files to convert in \"%s\".", relChildDir)
 		}
@@ -469,14 +680,52 @@ func traverse(info BuildInfo, relChildDir string, level int) ([]string, error) {
 		result = append(subArtifacts, artifacts...)
 	case "test":
 		// unit tests
-		cmds, err := createTest(info, testfiles, relChildDir)
+		cmds, err := createTest(info, c, testfiles, relChildDir)
 		if err != nil {
 			return nil, err
 		}
-		emitContext.commandList = append(emitContext.commandList, cmds...)
+		c.commands = append(c.commands, cmds...)
+		for _, c := range cmds {
+			if c.CommandType == "link" {
+				testOutputs = append(testOutputs, c.OutFile)
+			}
+		}
 	default:
 		/* NO-OP */
 	}
+	if 0 < len(projectOutput) || 0 < len(testOutputs) {
+		pt := ProjectTarget{
+			Name:        currentTarget.Name,
+			Type:        currentTarget.Type,
+			Dir:         relChildDir,
+			Sources:     compiled,
+			Headers:     headers,
+			Includes:    stripOptionPrefix(info.includes, optionPrefix+"I"),
+			Defines:     stripOptionPrefix(info.defines, optionPrefix+"D"),
+			Options:     info.options,
+			LinkOptions: info.linkOptions,
+			Libraries:   stripOptionPrefix(info.libraries, optionPrefix+"l"),
+			LinkDepends: info.linkDepends,
+			Prebuilds:   prebuilds,
+			OutFile:     projectOutput,
+		}
+		for _, child := range c.targets[firstChildTarget:] {
+			if child.Type == "library" {
+				pt.Depends = append(pt.Depends, child)
+			}
+		}
+		if currentTarget.Type == "test" {
+			// Each test program is a target.
+			for _, out := range testOutputs {
+				t := pt
+				t.Name = strings.TrimSuffix(filepath.Base(out), filepath.Ext(out))
+				t.OutFile = out
+				c.targets = append(c.targets, &t)
+			}
+		} else {
+			c.targets = append(c.targets, &pt)
+		}
+	}
 
 	Verbose("%s: Artifacts in \"%s\":\n", ProgramName, relChildDir)
 	if option.verbose {
@@ -484,18 +733,54 @@ func traverse(info BuildInfo, relChildDir string, level int) ([]string, error) {
 			fmt.Fprintf(os.Stderr, "#   %s\n", rc)
 		}
 	}
-	return result, nil
+	c.artifacts = result
+	return c, nil
 }
 
-// filterByBuildTarget accumulates items associated to `buildTarget` and current build platform/variant.
-func filterByBuildTarget(block []StringList, buildTarget string) []string {
+// filterByBuildTarget accumulates items matched `ctx` (build target and current build platform/variant).
+func filterByBuildTarget(block []StringList, ctx ConditionContext) []string {
 	lists := make([]string, 0, len(block))
 	for _, item := range block {
-		lists = append(lists, item.GetMatchedItems(buildTarget, option.platform, option.variant)...)
+		lists = append(lists, item.GetMatchedItems(ctx)...)
 	}
 	return lists
 }
 
+// filterSourceOptions accumulates per-file settings matched `ctx` (build target and current build platform/variant).
+// Settings are keyed by the (slash separated) file name.
+func filterSourceOptions(block []StringList, ctx ConditionContext) map[string]*SourceOption {
+	result := make(map[string]*SourceOption)
+	for _, item := range block {
+		for _, o := range item.GetMatchedSourceOptions(ctx) {
+			result[filepath.ToSlash(filepath.Clean(o.File))] = o
+		}
+	}
+	return result
+}
+
+// makeSourceArgs constructs the compiler arguments (defines and options) from the per-file settings.
+func makeSourceArgs(info BuildInfo, o *SourceOption) ([]string, error) {
+	if o == nil {
+		return nil, nil
+	}
+	result := make([]string, 0, len(o.Define)+len(o.Option))
+	for _, d := range o.Define {
+		def, err := info.StrictInterpolate(d)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, info.defineOption(def))
+	}
+	for _, opt := range o.Option {
+		opts, err := makeOptionArgs(info, opt, info.OptionPrefix())
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, opts...)
+	}
+	return result, nil
+}
+
 func interpolateStrings(info BuildInfo, args []string) ([]string, error) {
 	result := make([]string, 0, len(args))
 	for _, s := range args {
@@ -521,6 +806,7 @@ func makeArchiveCommand(info BuildInfo, inputs []string, libName string) (*Build
 		Args:        info.archiveOptions,
 		InFiles:     inputs,
 		Project:     libName,
+		Launcher:    info.linkLauncher(),
 		OutFile: (func() string {
 			switch option.platform {
 			case "WIN32":
@@ -569,6 +855,7 @@ func makeLinkCommand(
 		Depends:          info.linkDepends,
 		NeedCommandAlias: true,
 		Project:          info.target,
+		Launcher:         info.linkLauncher(),
 	}
 	result = append(result, &cmd)
 	//fmt.Println("-o " + NowTarget.Name + flist)
@@ -585,7 +872,11 @@ func makeLinkCommand(
 		if err != nil {
 			return result, err
 		}
-		packagerArgs, err = interpolateStrings(info, strings.Split(packager.Option, " "))
+		packagerArgs, err = Tokenize(packager.Option)
+		if err != nil {
+			return result, err
+		}
+		packagerArgs, err = interpolateStrings(info, packagerArgs)
 		if err != nil {
 			return result, err
 		}
@@ -637,7 +928,7 @@ func makeConvertCommand(
 //
 // unit tests
 //
-func createTest(info BuildInfo, inputs []string, loaddir string) ([]*BuildCommand, error) {
+func createTest(info BuildInfo, c *collection, inputs []string, loaddir string) ([]*BuildCommand, error) {
 	carg := append(info.includes, info.defines...)
 	result := make([]*BuildCommand, 0, len(inputs))
 	for _, ca := range info.options {
@@ -656,7 +947,7 @@ func createTest(info BuildInfo, inputs []string, loaddir string) ([]*BuildComman
 
 	for _, f := range inputs {
 		// first, compile a test driver
-		objcmds, artifacts, err := makeCompileCommands(info, &emitContext.otherRuleList, loaddir, []string{f}, "", "")
+		objcmds, artifacts, err := makeCompileCommands(info, c, loaddir, []string{f}, nil, "", "", nil, nil)
 		if err != nil {
 			return nil, errors.Wrap(err, "failed to construct a commmand")
 		}
@@ -676,19 +967,29 @@ func createTest(info BuildInfo, inputs []string, loaddir string) ([]*BuildComman
 }
 
 // makeOptionArgs constructs option arguments from rawOpts.
+// `rawOpts` is tokenized in shell-like manner and `optionPrefix` is prepended to the 1st one
+// (or to each item if the 1st one is a `${@list}` reference).
 // All variable references are resolved here.
 func makeOptionArgs(info BuildInfo, rawOpts string, optionPrefix string) ([]string, error) {
-	options := strings.Split(optionPrefix+rawOpts, " ")
-	result := make([]string, 0, len(options))
+	tokens, err := Tokenize(rawOpts)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]string, 0, len(tokens))
 
-	for _, opt := range options {
-		s, err := info.StrictInterpolate(opt)
+	for i, tok := range tokens {
+		options, err := info.SpliceLists([]string{tok})
 		if err != nil {
 			return result, err
 		}
-		if strings.ContainsAny(s, " \t") {
-			result = append(result, fmt.Sprintf(`"%s"`, s))
-		} else {
+		for _, opt := range options {
+			if i == 0 {
+				opt = optionPrefix + opt
+			}
+			s, err := info.StrictInterpolate(opt)
+			if err != nil {
+				return result, err
+			}
 			result = append(result, s)
 		}
 	}
@@ -737,27 +1038,30 @@ func chooseTarget(info BuildInfo, candidates []Target) (target Target, tag strin
 // FixupCommandPath fixes command path (appeared at the 1st element).
 // Returns fixed command-line and command path
 func FixupCommandPath(command string, commandDir string) (commandLine string, commandPath string) {
-	args := strings.Split(command, " ")
-	cmd := args[0]
-	commandPath = JoinPaths(commandDir, cmd)
-	args[0] = commandPath
-	commandLine = strings.Join(args, " ")
+	cmd, rest := splitCommand(command)
+	commandPath = portablePath(JoinPaths(commandDir, cmd))
+	commandLine = commandPath
+	if 0 < len(rest) {
+		commandLine += " " + rest
+	}
 	return
 }
 
 // makePreBuildCommands constructs a command list for preparing later builds.
-func makePreBuildCommands(info BuildInfo, loaddir string, buildItems []Build) ([]*BuildCommand, error) {
+func makePreBuildCommands(info BuildInfo, c *collection, loaddir string, buildItems []Build) ([]*BuildCommand, error) {
 	result := make([]*BuildCommand, 0)
 	for _, build := range buildItems {
-		if !build.Match(info.target, option.platform) {
+		if !build.Match(info.conditionContext()) {
 			continue
 		}
 
 		// register prebuild
-		sources := filterByBuildTarget(build.Source, info.target)
+		sources := filterByBuildTarget(build.Source, info.conditionContext())
 		if len(sources) == 0 {
 			return result, errors.Errorf("no sources for command `%s`", build.Name)
 		}
+		// Sources following "always" are treated as implicit dependencies.
+		var implicitSources []string
 		{
 			// Fixes source elements
 			newSources := sources[:0]
@@ -767,7 +1071,8 @@ func makePreBuildCommands(info BuildInfo, loaddir string, buildItems []Build) ([
 					sabs, _ := filepath.Abs(filepath.Join(info.outputdir, "output", src[1:]))
 					src = JoinPaths(sabs)
 				case src == "always":
-					src = "always |"
+					implicitSources = append(implicitSources, src)
+					continue
 				default:
 					expanded, err := info.Interpolate(src)
 					if err != nil {
@@ -775,8 +1080,13 @@ func makePreBuildCommands(info BuildInfo, loaddir string, buildItems []Build) ([
 					}
 					src = JoinPaths(loaddir, expanded)
 				}
+				if implicitSources != nil {
+					implicitSources = append(implicitSources, src)
+					continue
+				}
 				newSources = append(newSources, src)
 			}
+			sources = newSources
 		}
 		buildCommand, ok := info.variables[build.Command]
 		if !ok {
@@ -794,7 +1104,7 @@ func makePreBuildCommands(info BuildInfo, loaddir string, buildItems []Build) ([
 		})(build.Command)
 		deps := []string{}
 
-		if _, ok := emitContext.appendRules[commandLabel]; !ok {
+		if _, ok := c.appendRule(commandLabel); !ok {
 			// Create a rule...
 			// Fixes command path.
 			switch {
@@ -812,13 +1122,20 @@ func makePreBuildCommands(info BuildInfo, loaddir string, buildItems []Build) ([
 				deps = append(deps, d)
 				buildCommand = r
 			}
-			emitContext.appendRules[commandLabel] = AppendBuild{
+			c.appendRules[commandLabel] = AppendBuild{
 				Command: strings.Replace(buildCommand, "$target", info.target, -1),
 				Desc:    build.Command,
 				Deps:    0 < len(build.Deps),
 			}
 		}
 
+		implicitDeps := implicitSources
+		if implicitSources != nil {
+			// Dependencies following "always" are also implicit.
+			implicitDeps = append(implicitDeps, deps...)
+			deps = nil
+		}
+
 		if build.Name[0] != '$' || strings.HasPrefix(build.Name, "$target/") {
 			pn := build.Name
 			if pn[0] == '$' { // bulid.Name is "$target/..."
@@ -834,6 +1151,7 @@ func makePreBuildCommands(info BuildInfo, loaddir string, buildItems []Build) ([
 				Command:          build.Command,
 				CommandType:      commandLabel,
 				Depends:          deps,
+				ImplicitDepends:  implicitDeps,
 				InFiles:          sources,
 				OutFile:          JoinPaths(outfile),
 				NeedCommandAlias: false,
@@ -854,6 +1172,7 @@ func makePreBuildCommands(info BuildInfo, loaddir string, buildItems []Build) ([
 					Command:          build.Command,
 					CommandType:      commandLabel,
 					Depends:          deps,
+					ImplicitDepends:  implicitDeps,
 					InFiles:          []string{src},
 					OutFile:          JoinPaths(outfile),
 					NeedCommandAlias: false,
@@ -902,10 +1221,15 @@ func Basename(path string, args ...string) string {
 
 // Build command for compiling C, C++...
 // Returns command and artifact list.
+// Pre-compiled headers are created as specified by `pch` (`nil` for the default),
+// and sources are batched into unity files as specified by `unity` (`nil` to compile individually).
+// Sources having the per-file settings in `sourceOptions` are compiled individually with them.
+// C++ sources are scanned for C++20 modules if the target (or the sub-directories) has module interface units.
 func makeCompileCommands(
 	info BuildInfo,
-	otherDict *map[string]OtherRule,
-	loaddir string, files []string, targetTag, projectName string) (result []*BuildCommand, artifactPaths []string, err error) {
+	c *collection,
+	loaddir string, files []string, sourceOptions map[string]*SourceOption,
+	targetTag, projectName string, pch *PCHSetting, unity *UnitySetting) (result []*BuildCommand, artifactPaths []string, err error) {
 
 	if len(files) == 0 {
 		return
@@ -917,17 +1241,58 @@ func makeCompileCommands(
 	if err != nil {
 		return result, artifactPaths, errors.Wrapf(err, "missing ${compiler} definitions")
 	}
-	pchCmd, err := createPCH(info, loaddir, compiler, targetTag)
+	pchs, err := createPCHs(info, loaddir, compiler, targetTag, pch)
 	if err != nil {
 		return result, artifactPaths, err
 	}
-	if pchCmd != nil {
-		result = append(result, pchCmd)
+	for _, p := range pchs.sorted() {
+		result = append(result, p.command)
+		if 0 < len(p.object) {
+			artifactPaths = append(artifactPaths, p.object)
+		}
+	}
+	files, unityFiles, err := makeUnityFiles(info, loaddir, files, unity, func(src string) bool {
+		_, custom := c.otherRule(filepath.Ext(src))
+		_, overridden := sourceOptions[filepath.ToSlash(filepath.Clean(src))]
+		return custom || overridden || pchs.excludes(src)
+	})
+	if err != nil {
+		return result, artifactPaths, err
+	}
+	targetProject := projectName
+	if targetProject == "" {
+		targetProject = info.target
+	}
+	// Collated outputs are named after the target (or the test program).
+	moduleName := projectName
+	if moduleName == "" {
+		moduleName = Basename(files[0], filepath.Ext(files[0]))
+	}
+	modules, err := newModuleScan(&info, files, targetTag, moduleName, targetProject, c.moduleInfos)
+	if err != nil {
+		return result, artifactPaths, err
 	}
 
 	arg1 := append(info.includes, info.defines...)
 
 	for _, srcPath := range files {
+		srcOption := sourceOptions[filepath.ToSlash(filepath.Clean(srcPath))]
+		srcPCH := pchs.lookup(srcPath)
+		if !srcOption.UsePCH() {
+			srcPCH = nil
+		}
+		srcUnity := unityFiles[srcPath]
+		srcArgs, err := makeSourceArgs(info, srcOption)
+		if err != nil {
+			return result, artifactPaths, errors.Wrapf(err, "malformed settings for \"%s\"", srcPath)
+		}
+		srcLang := lookupSourceLang(srcPath)
+		srcCompiler, srcLangArgs, err := info.languageCompiler(srcLang, compiler)
+		if err != nil {
+			return result, artifactPaths, errors.Wrapf(err, "missing the compiler for \"%s\"", srcPath)
+		}
+		srcOptions := append(append(srcLangArgs, info.options...), info.languageOptions(srcLang)...)
+		srcOptions = append(srcOptions, srcArgs...)
 		dstPathBase := srcPath // `dstPathBase` contains the basename of the `srcPath`.
 		var objdir string
 		if srcPath[0] == '$' {
@@ -955,9 +1320,9 @@ func makeCompileCommands(
 
 		artifactPaths = append(artifactPaths, objName)
 
-		carg := make([]string, 0, len(arg1)+len(info.options))
+		carg := make([]string, 0, len(arg1)+len(srcOptions))
 		carg = append(carg, arg1...)
-		for _, ca := range info.options {
+		for _, ca := range srcOptions {
 			switch ca {
 			case "$out":
 				ca = objName
@@ -971,11 +1336,7 @@ func makeCompileCommands(
 			carg = append(carg, ca)
 		}
 		srcExt := filepath.Ext(srcPath)
-		targetProject := projectName
-		if targetProject == "" {
-			targetProject = info.target
-		}
-		if rule, exists := (*otherDict)[srcExt]; exists {
+		if rule, exists := c.otherRule(srcExt); exists {
 			// Custom rules
 			if customCompiler, ok := info.variables[rule.Compiler]; ok {
 				customCompiler, err = info.Interpolate(customCompiler)
@@ -990,13 +1351,13 @@ func makeCompileCommands(
 					Compiler: customCompiler,
 					Infile:   srcName,
 					Outfile:  objName,
-					Include: (func() string {
+					Include: (func() []string {
 						if !rule.needInclude {
-							return ""
+							return nil
 						}
-						return strings.Join(info.includes, " ")
+						return info.includes
 					})(),
-					Option: (func() string {
+					Option: (func() []string {
 						opts := make([]string, 0, len(rule.Options))
 						for _, o := range rule.Options {
 							switch o {
@@ -1010,20 +1371,21 @@ func makeCompileCommands(
 								opts = append(opts, o)
 							}
 						}
-						return strings.Join(opts, " ")
+						return append(opts, srcArgs...)
 					})(),
-					Define: (func() string {
+					Define: (func() []string {
 						if !rule.needDefine {
-							return ""
+							return nil
 						}
-						return strings.Join(info.defines, " ")
+						return info.defines
 					})(),
-					Project: targetProject,
+					Project:  targetProject,
+					Launcher: info.launcher,
 				}
 				if rule.NeedDepend == true {
 					ocmd.Depend = depName
 				}
-				emitContext.otherRuleFileList = append(emitContext.otherRuleFileList, ocmd) // Record it
+				c.otherRuleFiles = append(c.otherRuleFiles, ocmd) // Record it
 			} else {
 				Warn("compiler: Missing a compiler \"%s\" definitions in \"%s\".",
 					rule.Compiler,
@@ -1032,7 +1394,7 @@ func makeCompileCommands(
 		} else {
 			// normal
 			cmd := BuildCommand{
-				Command:          compiler,
+				Command:          srcCompiler,
 				CommandType:      "compile",
 				Args:             carg,
 				InFiles:          []string{srcName},
@@ -1040,12 +1402,28 @@ func makeCompileCommands(
 				DepFile:          depName,
 				NeedCommandAlias: true,
 				Project:          targetProject,
+				Launcher:         info.launcher,
+			}
+			if srcLang != nil && !srcLang.depends {
+				cmd.DepFile = "" // Not preprocessed (no dependencies).
+			}
+			if srcPCH != nil {
+				cmd.ImplicitDepends = []string{srcPCH.command.OutFile}
+				cmd.Args = append(carg[:len(carg):len(carg)], srcPCH.useArgs...)
 			}
-			if pchCmd != nil {
-				cmd.ImplicitDepends = append(cmd.ImplicitDepends, pchCmd.OutFile)
-				cmd.Args = append(cmd.Args, "-include-pch", pchCmd.OutFile)
+			if srcUnity != nil {
+				cmd.Sources = srcUnity.sources
+				c.generated = append(c.generated, srcName)
+			}
+			scanned := modules != nil && (sourceLanguage(srcName) == "c++" || isModuleInterface(srcName))
+			if scanned {
+				result = append(result, modules.scan(srcCompiler, arg1, srcOptions, srcName, objName))
+				modules.bind(&cmd, srcName)
 			}
 			result = append(result, &cmd)
+			if srcLang != nil && !srcLang.analyzed {
+				continue
+			}
 			subExt := func(s string, newExt string) string {
 				ex := filepath.Ext(s)
 				if len(ex) == 0 {
@@ -1054,7 +1432,7 @@ func makeCompileCommands(
 				return s[:len(s)-len(ex)] + newExt
 			}
 			analyzeCmd := BuildCommand{
-				Command:          compiler,
+				Command:          srcCompiler,
 				CommandType:      "analyze",
 				Args:             carg,
 				InFiles:          []string{srcName},
@@ -1063,55 +1441,23 @@ func makeCompileCommands(
 				NeedCommandAlias: true,
 				Project:          targetProject,
 			}
-			if pchCmd != nil {
-				analyzeCmd.ImplicitDepends = append(cmd.ImplicitDepends, pchCmd.OutFile)
-				analyzeCmd.Args = append(analyzeCmd.Args, "-include-pch", pchCmd.OutFile)
+			if srcPCH != nil {
+				analyzeCmd.ImplicitDepends = []string{srcPCH.command.OutFile}
+				analyzeCmd.Args = append(carg[:len(carg):len(carg)], srcPCH.analyzeArgs...)
+			}
+			if scanned {
+				modules.bindAnalysis(&analyzeCmd, &cmd, srcName)
 			}
 			result = append(result, &analyzeCmd)
 		}
 	}
-	return result, artifactPaths, nil
-}
-
-// Create pre-compiled header if possible.
-func createPCH(info BuildInfo, srcdir string, compiler string, targetTag string) (*BuildCommand, error) {
-	const pchName = "00-common-prefix.hpp"
-	pchSrc := JoinPaths(srcdir, pchName)
-	if !Exists(pchSrc) {
-		Verbose("%s: \"%s\" is not detected.\n", ProgramName, pchSrc)
-		return nil, nil
-	}
-	Verbose("%s: \"%s\" found.\n", ProgramName, pchSrc)
-	pchDst := JoinPaths(info.outputdir, srcdir, buildDirectory+targetTag, pchName+".pch")
-	Verbose("%s: Create PCH \"%s\"\n", ProgramName, pchDst)
-	args := append(info.includes, info.defines...)
-	for _, opt := range info.options {
-		args = append(args, (func(o string) string {
-			switch o {
-			case "$out":
-				return pchDst
-			case "$dep":
-				return pchDst + ".dep"
-			case "$in":
-				return pchSrc
-			default:
-				return o
-			}
-		})(opt))
-	}
-	// PCH source found.
-	Verbose("%s: PCH creation command line is \"%s\".\n", ProgramName, strings.Join(args, " "))
-	cmd := BuildCommand{
-		Command:          compiler,
-		CommandType:      "gen_pch",
-		Args:             args,
-		InFiles:          []string{pchSrc},
-		OutFile:          pchDst,
-		DepFile:          pchDst + ".dep",
-		NeedCommandAlias: true,
-		Project:          info.target,
+	if modules != nil {
+		result = append(result, modules.collate())
+		if modules.provides {
+			c.moduleInfos = append(c.moduleInfos, modules.info())
+		}
 	}
-	return &cmd, nil
+	return result, artifactPaths, nil
 }
 
 // Exists checks `filename` existence.
@@ -1120,18 +1466,52 @@ func Exists(filename string) bool {
 	return err == nil
 }
 
+// updateFile replaces `path` with `content` via a temporal file.
+// Returns false if `path` already has the same contents (and it is left untouched).
+func updateFile(path string, content []byte) (bool, error) {
+	if prev, err := ioutil.ReadFile(path); err == nil && bytes.Equal(prev, content) {
+		return false, nil
+	}
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return false, errors.Wrapf(err, "failed to create directory \"%s\"", dir)
+	}
+	file, err := ioutil.TempFile(dir, filepath.Base(path)+"-")
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to create temporal output for \"%s\"", path)
+	}
+	defer (func() {
+		_ = file.Close()
+		_ = os.Remove(file.Name())
+	})()
+	if _, err := file.Write(content); err != nil {
+		return false, errors.Wrapf(err, "failed to write \"%s\"", file.Name())
+	}
+	if err := file.Close(); err != nil {
+		return false, errors.Wrapf(err, "closing \"%s\" failed.", file.Name())
+	}
+	if err := os.Chmod(file.Name(), 0644); err != nil {
+		return false, errors.Wrapf(err, "failed to change the mode of \"%s\"", file.Name())
+	}
+	if err := os.Rename(file.Name(), path); err != nil {
+		return false, errors.Wrapf(err, "renaming \"%s\" to \"%s\" failed.", file.Name(), path)
+	}
+	Verbose("%s: Updated \"%s\"\n", ProgramName, path)
+	return true, nil
+}
+
 // Registers custom rules.
-func registerOtherRules(dict *map[string]OtherRule, info BuildInfo, others []Other) error {
+func registerOtherRules(c *collection, info BuildInfo, others []Other) error {
 	optPrefix := info.OptionPrefix()
 	for _, ot := range others {
-		if !ot.MatchPlatform(option.platform) {
+		if !ot.Match(info.conditionContext()) {
 			continue
 		}
 
 		ext := ot.Extension
 
 		var optlist []string
-		for _, o := range filterByBuildTarget(ot.Option, info.target) {
+		for _, o := range filterByBuildTarget(ot.Option, info.conditionContext()) {
 			ol, err := makeOptionArgs(info, o, optPrefix)
 			if err != nil {
 				return errors.Wrapf(err, "failed to construct option list for custom rules")
@@ -1142,12 +1522,16 @@ func registerOtherRules(dict *map[string]OtherRule, info BuildInfo, others []Oth
 		needInclude := false
 		needOption := false
 		needDefine := false
-		rule, ok := (*dict)[ext]
+		rule, ok := c.otherRule(ext)
 		if ok {
-			rule.Options = append(rule.Options, optlist...)
+			// Appends options to the registered one.
+			rule = OtherRule{Options: optlist}
 		} else {
 			// no exist rule
-			cmdl := strings.Split(ot.Command, " ")
+			cmdl, err := Tokenize(ot.Command)
+			if err != nil {
+				return errors.Wrapf(err, "failed to parse the command for \"%s\"", ext)
+			}
 			if len(cmdl) == 0 {
 				return errors.Errorf("no commands to \"%s\"", ext)
 			}
@@ -1173,7 +1557,7 @@ func registerOtherRules(dict *map[string]OtherRule, info BuildInfo, others []Oth
 
 			rule = OtherRule{
 				Compiler:    compiler,
-				Command:     strings.Join(commands, " "),
+				Command:     JoinArgs(commands),
 				Title:       ot.Description,
 				Options:     optlist,
 				needInclude: needInclude,
@@ -1182,7 +1566,7 @@ func registerOtherRules(dict *map[string]OtherRule, info BuildInfo, others []Oth
 				NeedDepend:  ot.NeedDepend,
 			}
 		}
-		(*dict)[ext] = rule
+		c.addOtherRule(ext, rule)
 	}
 	return nil
 }
@@ -1196,143 +1580,102 @@ func checkPlatformType(vlist []Variable) string {
 	return "default"
 }
 
-// Creates *.ninja file.
-func outputNinja() error {
-	Verbose("%s: Creates \"%s\"\n", ProgramName, option.ninjaFile)
+// ninjaGenerator writes `build.ninja` and `compile_commands.json`.
+type ninjaGenerator struct {
+	showTemplateData bool
+}
 
-	var err error
+func init() {
+	RegisterGenerator(&ninjaGenerator{})
+}
 
-	tDir := filepath.Dir(option.ninjaFile)
+func (*ninjaGenerator) Name() string { return "ninja" }
 
-	if !Exists(tDir) {
-		err = os.MkdirAll(tDir, 0755)
-		if err != nil {
-			return err
-		}
+func (g *ninjaGenerator) RegisterFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&g.showTemplateData, "show-template-data", false, "Show the data passed to the template as JSON (nothing is written)")
+}
+
+func (g *ninjaGenerator) Emit(graph *BuildGraph) error {
+	graph, err := normalizeGraph(graph, option.ninjaFile)
+	if err != nil {
+		return err
 	}
-	file, err := ioutil.TempFile(tDir, "ninja-")
-	defer (func() {
-		_ = file.Close()
-		_ = os.Remove(file.Name())
-	})()
-	Verbose("%s: Creating transient output \"%s\"\n", ProgramName, file.Name())
-	sink := bufio.NewWriter(file)
+	if g.showTemplateData {
+		return ShowNinjaWriteContext(os.Stdout, makeNinjaWriteContext(graph))
+	}
+	if err := outputNinja(graph); err != nil {
+		return err
+	}
+	return outputCompileDb(graph)
+}
+
+// Creates *.ninja file.
+// The existing file is left untouched if the contents are not changed.
+func outputNinja(graph *BuildGraph) error {
+	Verbose("%s: Creates \"%s\"\n", ProgramName, option.ninjaFile)
 
 	tmpl, err := getNinjaTemplate(option.templateFile)
 	if err != nil {
 		return errors.Wrapf(err, "failed to obtain a template")
 	}
 
-	// Emits rules for updating `build.ninja`
-	type WriteContext struct {
-		TemplateFile       string
-		Platform           string
-		OutputDirectory    string
-		OtherRules         map[string]OtherRule
-		AppendRules        map[string]AppendBuild
-		NinjaUpdater       string
-		UsePCH             bool
-		UseDepsMsvc        bool
-		UseResponse        bool
-		NewlineAsDelimiter bool
-		GroupArchives      bool
-		CompilerLauncher   string
-
-		Commands         []*BuildCommand
-		OtherRuleTargets []OtherRuleFile
-		SubNinjas        []string
-		NinjaFile        string
-		ConfigSources    []string
-		AnalysisReports  []string
-		DefaultTargets   []string
-	}
-	osArgs := make([]string, 0, len(os.Args))
-	osArgs = append(osArgs, filepath.ToSlash(os.Args[0]))
-	osArgs = append(osArgs, os.Args[1:]...)
-	launcher := ""
-	if option.useCompilerLauncher {
-		launcher = FindCompilerLauncher()
-		if launcher != "" {
-			launcher = "\"" + launcher + "\" -p $project"
-		}
-	}
-	ctx := WriteContext{
-		TemplateFile:       option.templateFile,
-		Platform:           option.platform,
-		UseResponse:        useResponse,
-		NewlineAsDelimiter: responseNewline,
-		GroupArchives:      groupArchives,
-		OutputDirectory:    filepath.ToSlash(option.outputDir),
-		OtherRules:         emitContext.otherRuleList,
-		AppendRules:        emitContext.appendRules,
-		UsePCH:             true,
-		UseDepsMsvc:        useDepsMsvc,
-		NinjaUpdater:       strings.Join(osArgs, " "),
-		CompilerLauncher:   launcher,
-
-		Commands:         emitContext.commandList,
-		OtherRuleTargets: emitContext.otherRuleFileList,
-		SubNinjas:        emitContext.subNinjaList,
-		NinjaFile:        option.ninjaFile,
-		ConfigSources:    emitContext.scannedConfigs,
-		DefaultTargets:   emitContext.defaultTargets,
-	}
-	for _, f := range emitContext.commandList {
-		if f.CommandType != "analyze" {
-			continue
+	ctx := makeNinjaWriteContext(graph)
+	if 0 < len(ctx.Environment) {
+		if _, err := writeEnvironmentRecord(graph.LocalPath(ctx.EnvironmentFile), ctx.Environment); err != nil {
+			return err
 		}
-		ctx.AnalysisReports = append(ctx.AnalysisReports, f.OutFile)
 	}
-	err = tmpl.Execute(sink, ctx)
-	if err != nil {
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, ctx); err != nil {
 		return errors.Wrap(err, "failed to render template")
 	}
-
-	sink.Flush()
-
-	if err := file.Close(); err != nil {
-		return errors.Wrapf(err, "closing \"%s\" failed.", file.Name())
+	updated, err := updateFile(option.ninjaFile, b.Bytes())
+	if err != nil {
+		return err
 	}
-	if err := os.Rename(file.Name(), option.ninjaFile); err != nil {
-		return errors.Wrapf(err, "renaming \"%s\" to \"%s\" failed.", file.Name(), option.ninjaFile)
+	if !updated {
+		Verbose("%s: \"%s\" is up to date\n", ProgramName, option.ninjaFile)
 	}
-	Verbose("%s: Renaming %s to %s\n", ProgramName, file.Name(), option.ninjaFile)
 	return nil
 }
 
+// getNinjaTemplate parses the built-in template then the user template at `path` (if any).
+// A user template containing only `{{define}}`s overrides the named blocks of the built-in one,
+// otherwise it replaces the whole template.
 func getNinjaTemplate(path string) (*template.Template, error) {
 	const rootName = "root"
 
-	funcs := template.FuncMap{
-		"escape_drive":         escapeDriveColon,
-		"join":                 strings.Join,
-		"intercalate":          intercalate,
-		"substitute_extension": substituteExtension,
+	src, err := getNinjaTemplateSource()
+	if err != nil {
+		return nil, err
 	}
-
-	src, err := getNinjaTemplateSource(path)
+	tmpl, err := template.New(rootName).Funcs(ninjaTemplateFuncs()).Parse(src)
 	if err != nil {
-		return nil, errors.Wrapf(err, "failed to load template \"%s\"", path)
+		return nil, errors.Wrap(err, "failed to parse the built-in template")
 	}
-	return template.New(rootName).Funcs(funcs).Parse(src)
-}
-
-func getNinjaTemplateSource(path string) (string, error) {
 	if 0 < len(path) && Exists(path) {
 		b, err := ioutil.ReadFile(path)
 		if err != nil {
-			return "", errors.Wrapf(err, "failed to load template \"%s\"", path)
+			return nil, errors.Wrapf(err, "failed to load template \"%s\"", path)
+		}
+		if _, err := tmpl.Parse(string(b)); err != nil {
+			return nil, errors.Wrapf(err, "failed to parse template \"%s\"", path)
 		}
-		return string(b), nil
 	}
+	return tmpl, nil
+}
+
+// getNinjaTemplateSource returns the built-in template.
+// It consists of named blocks (`rules`, `compile_rule`, `commands`, `other_targets` and `defaults`).
+func getNinjaTemplateSource() (string, error) {
 	defaultTemplate := `# AUTOGENERATED using built-in template
-# Rule definitions
+{{block "rules" .}}# Rule definitions
 builddir = {{.OutputDirectory}}
 
-rule compile
+{{block "compile_rule" .}}rule compile
     description = Compiling: $desc
 {{- if eq .Platform "WIN32"}}
-    command = {{.CompilerLauncher}} "$compile" $options -Fo$out $in
+    command = {{.CompilerLauncher}} $compile $options -Fo$out $in
     {{- if .UseDepsMsvc}}
     deps = msvc
     {{- else}}
@@ -1340,10 +1683,10 @@ rule compile
     deps = gcc
     {{- end}}
 {{- else}}
-    command = {{.CompilerLauncher}} "$compile" $options -o $out $in
+    command = {{.CompilerLauncher}} $compile $options -o $out $in
     depfile = $depf
     deps = gcc
-{{end}}
+{{end}}{{end}}
 
 rule analyze
     description = Analyzing: $desc
@@ -1354,36 +1697,53 @@ rule analyze
 {{- if .UsePCH}}
 rule gen_pch
     description = Create PCH: $desc
-    command = $gen_pch $options -x c++-header -o $out $in
+    command = {{with .CompilerLauncher}}{{.}} {{end}}$gen_pch $options $in
+{{- if and (eq .Platform "WIN32") .UseDepsMsvc}}
+    deps = msvc
+{{- else}}
     depfile = $depf
     deps = gcc
 {{- end}}
+{{- end}}
+{{- if .UseModules}}
+
+rule scan_modules
+    description = Scanning modules: $desc
+    command = {{.ModuleTool}} scan-modules -o $out -- $scan_modules $options
+    depfile = $depf
+    restat = 1
+
+rule collate_modules
+    description = Collating modules: $desc
+    command = {{.ModuleTool}} collate-modules $options $in
+    restat = 1
+{{- end}}
 
 rule ar
     description = Archiving: $desc
 {{- if .UseResponse}}
-    command = $ar $options {{if eq .Platform "WIN32"}}/out:$out{{else}}$out{{end}} @$out.rsp
+    command = {{with .LinkLauncher}}{{.}} {{end}}$ar $options {{if eq .Platform "WIN32"}}/out:$out{{else}}$out{{end}} @$out.rsp
     rspfile = $out.rsp
     rspfile_content = {{if .NewlineAsDelimiter}}$in_newline{{else}}$in{{end}}
 {{- else}}
-    command = {{.CompilerLauncher}} "$ar" $options $out $in
+    command = {{.LinkLauncher}} $ar $options $out $in
 {{- end}}
 
 rule link
     description = Linking: $desc
 {{- if .UseResponse}}
     {{- if eq .Platform "WIN32"}}
-    command = $link $options /out:$out @$out.rsp
+    command = {{with .LinkLauncher}}{{.}} {{end}}$link $options /out:$out @$out.rsp
     {{- else}}
-    command = $link $options -o $out @$out.rsp
+    command = {{with .LinkLauncher}}{{.}} {{end}}$link $options -o $out @$out.rsp
     {{- end}}
     rspfile = $out.rsp
     rspfile_content = {{if .NewlineAsDelimiter}}$in_newline{{else}}$in{{end}}
 {{- else}}
     {{- if .GroupArchives}}
-    command = $link $options -o $out -Wl,--start-group $in -Wl,--end-group
+    command = {{with .LinkLauncher}}{{.}} {{end}}$link $options -o $out -Wl,--start-group $in -Wl,--end-group
     {{- else}}
-    command = $link -o $out $in $options
+    command = {{with .LinkLauncher}}{{.}} {{end}}$link -o $out $in $options
     {{- end}}
 {{- end}}
 
@@ -1397,7 +1757,7 @@ rule convert
 {{range $k, $v := .OtherRules}}
 rule compile{{- $k}}
     description = {{$v.Title}}: $desc
-    command = {{$v.Command}}
+    command = {{with $.CompilerLauncher}}{{.}} {{end}}{{$v.Command}}
     {{- if $v.NeedDepend}}
     depfile = $depf
     deps = gcc
@@ -1416,120 +1776,247 @@ rule update_ninja_file
     description = Update $desc
     command     = {{.NinjaUpdater}}
     generator   = 1
+    restat      = 1
+{{- if .Environment}}
+
+rule check_environment
+    description = Check environment variables
+    command     = {{.EnvironmentChecker}}
+    restat      = 1
+{{- end}}
 
 build always: phony
 
-build analyze-all : phony {{.AnalysisReports | escape_drive | intercalate " "}}
+build analyze-all : phony {{.AnalysisReports | escape_path | intercalate " "}}
 
-# end of [Rule definitions]
+# end of [Rule definitions]{{end}}
 
 {{- define "IMPDEPS_"}}
-    {{- if .}} | {{escape_drive . | intercalate " "}}{{end}}
+    {{- if .}} | {{escape_path . | intercalate " "}}{{end}}
+{{- end}}
+{{- define "ORDERDEPS_"}}
+    {{- if .}} || {{escape_path . | intercalate " "}}{{end}}
 {{- end}}
 {{/* Render rules */}}
-
+{{block "commands" .}}
 # Commands
-build {{.NinjaFile | escape_drive}} : update_ninja_file {{escape_drive .ConfigSources | intercalate " "}}
-    desc = {{.NinjaFile}}
+build {{.NinjaFile | escape_path}}{{template "IMPDEPS_" .GeneratedFiles}} : update_ninja_file {{escape_path .ConfigSources | intercalate " "}}{{if .Environment}} {{.EnvironmentFile | escape_path}}{{end}}
+    desc = {{.NinjaFile | escape_value}}
+{{- if .Environment}}
+
+# Imported environment variables
+build {{.EnvironmentFile | escape_path}} : check_environment | always
+    desc = {{.EnvironmentFile | escape_value}}
+{{- range $e := .Environment}}
+    env.{{$e.Name}} = {{$e.Value | escape_value}}
+{{- end}}
+{{- end}}
 {{range $c := .Commands}}
-build {{$c.OutFile | escape_drive}} : {{$c.CommandType}} {{escape_drive $c.InFiles | intercalate " "}} {{escape_drive $c.Depends | intercalate " "}} {{template "IMPDEPS_" $c.ImplicitDepends}}
-    desc = {{$c.OutFile}}
+build {{$c.OutFile | escape_path}}{{template "IMPDEPS_" $c.ImplicitOutputs}} : {{$c.CommandType}} {{escape_path $c.InFiles | intercalate " "}} {{escape_path $c.Depends | intercalate " "}} {{template "IMPDEPS_" $c.ImplicitDepends}}{{template "ORDERDEPS_" $c.OrderOnlyDepends}}
+    desc = {{$c.OutFile | escape_value}}
+{{- if $c.Dyndep}}
+    dyndep = {{$c.Dyndep | escape_value}}
+{{- end}}
 {{- if $c.NeedCommandAlias}}
-    {{$c.CommandType}} = {{$c.Command}}
+    {{$c.CommandType}} = {{$c.Command | shell_quote | escape_value}}
 {{- end}}
 {{- if $c.DepFile}}
-    depf = {{$c.DepFile}}
+    depf = {{$c.DepFile | escape_value}}
     deps = gcc
 {{- end}}
 {{- if $c.Args}}
-    options = {{intercalate " " $c.Args}}
+    options = {{shell_join $c.Args}}
 {{- end}}
 {{- if $c.Project}}
     project = {{$c.Project}}
 {{- end}}
+{{- with $c.LauncherCommand}}
+    launcher = {{.}}
+{{- end}}
 {{end}}
-
+{{end}}{{block "other_targets" .}}
 # Other targets
 {{range $item := .OtherRuleTargets}}
-build {{$item.Outfile | escape_drive}} : {{$item.Rule}} {{escape_drive $item.Infile}}
-    desc     = {{$item.Outfile}}
-    compiler = {{$item.Compiler}}
+build {{$item.Outfile | escape_path}} : {{$item.Rule}} {{escape_path $item.Infile}}
+    desc     = {{$item.Outfile | escape_value}}
+    compiler = {{$item.Compiler | shell_quote | escape_value}}
 {{- if $item.Include}}
-    include  = {{$item.Include}}
+    include  = {{shell_join $item.Include}}
 {{- end}}
 {{- if  $item.Option}}
-    option   = {{$item.Option}}
+    option   = {{shell_join $item.Option}}
 {{- end}}
 {{- if $item.Define}}
-    define   = {{$item.Define}}
+    define   = {{shell_join $item.Define}}
 {{- end}}
 {{- if $item.Depend}}
-    depf     = {{$item.Depend}}
+    depf     = {{$item.Depend | escape_value}}
 {{- end}}
 {{- if $item.Project}}
     project = {{$item.Project}}
 {{- end}}
+{{- with $item.LauncherCommand}}
+    launcher = {{.}}
+{{- end}}
 {{end}}
 {{- if .SubNinjas}}
 {{range $subninja := .SubNinjas}}
-subninja {{$subninja}}
-{{end}}
+subninja {{$subninja | escape_path}}
 {{end}}
-default {{.DefaultTargets | escape_drive | intercalate " "}}
-`
+{{end}}{{end}}{{block "defaults" .}}
+default {{.DefaultTargets | escape_path | intercalate " "}}
+{{end}}`
 	return defaultTemplate, nil
 }
 
-// Creates *.vcxproj (for VisualStudio).
-func outputMSBuild(outdir, projname string) error {
-	targets := make([]string, 0, len(emitContext.commandList)+len(project.headerFiles))
-	for _, command := range emitContext.commandList {
-		if command.CommandType != "compile" {
-			continue
-		}
-		targets = append(targets, command.InFiles...)
-	}
-	targets = append(targets, project.headerFiles...)
-	msbuild.ExportProject(targets, outdir, projname)
-	return nil
-}
-
-func outputCompileDb() error {
+// Creates `compile_commands.json` (and the ones per project, the one in the current directory if requested).
+func outputCompileDb(graph *BuildGraph) error {
 	ninjaDir, err := filepath.Abs(filepath.Dir(option.ninjaFile))
 	if err != nil {
 		return err
 	}
 	ninjaDir = filepath.ToSlash(ninjaDir)
-	if !Exists(option.outputDir) {
-		err := os.MkdirAll(option.outputDir, 0755)
+	// With `-root`, "directory" is also relative to the root (for reproducible outputs).
+	directory := ninjaDir
+	if 0 < len(option.pathRoot) {
+		root, err := filepath.Abs(option.pathRoot)
 		if err != nil {
-			return errors.Wrapf(err, "failed to create directory \"%s\"", option.outputDir)
+			return err
+		}
+		if rel, err := filepath.Rel(root, ninjaDir); err == nil {
+			directory = filepath.ToSlash(rel)
 		}
 	}
-	outPath := filepath.Join(option.outputDir, "compile_commands.json")
-	items := make([]CompileDbItem, 0, len(emitContext.commandList))
-	for _, c := range emitContext.commandList {
-		if c.CommandType != "compile" || len(c.Args) == 0 {
-			continue
+	outputDir := graph.LocalPath(graph.OutputDir)
+	if !Exists(outputDir) {
+		err := os.MkdirAll(outputDir, 0755)
+		if err != nil {
+			return errors.Wrapf(err, "failed to create directory \"%s\"", outputDir)
+		}
+	}
+	outPath := filepath.Join(outputDir, "compile_commands.json")
+	generatedDir, _ := filepath.Abs(outputDir)
+	generatedDir = filepath.ToSlash(generatedDir) + "/"
+	items := make([]CompileDbItem, 0, len(graph.Commands)+len(graph.OtherRuleFiles))
+	// Arguments are the unquoted argv (ninja escapes are also restored).
+	appendItem := func(project string, infile string, output string, command string, args []string, tail ...string) {
+		if option.compdbNoGenerated {
+			if p, err := filepath.Abs(graph.LocalPath(infile)); err == nil && strings.HasPrefix(filepath.ToSlash(p), generatedDir) {
+				return
+			}
 		}
-		infile := c.InFiles[0]
 		if p, err := filepath.Rel(ninjaDir, infile); err == nil {
 			infile = filepath.ToSlash(p)
 		}
-		args := make([]string, 0, 1+len(c.Args))
-		args = append(args, c.Command)
-		args = append(args, c.Args...)
-		args = append(args, "-o", c.OutFile, infile)
+		argv := make([]string, 0, 1+len(args)+len(tail))
+		argv = append(argv, command)
+		for _, a := range args {
+			argv = append(argv, UnescapeNinja(a))
+		}
+		for _, a := range tail {
+			if a == "$in" {
+				a = infile
+			}
+			argv = append(argv, a)
+		}
 		items = append(
 			items,
 			CompileDbItem{
 				File:      infile,
-				Directory: ninjaDir,
-				Output:    c.OutFile,
-				Arguments: args,
+				Directory: directory,
+				Output:    output,
+				Arguments: argv,
+				project:   project,
 			})
 	}
-	return CreateCompileDbFile(outPath, items)
+	for _, c := range graph.Commands {
+		if len(c.Args) == 0 {
+			continue
+		}
+		switch c.CommandType {
+		case "compile":
+			// Sources included by the unity file are listed instead.
+			sources := c.InFiles[:1]
+			if 0 < len(c.Sources) {
+				sources = c.Sources
+			}
+			for _, infile := range sources {
+				appendItem(c.Project, infile, c.OutFile, c.Command, c.Args, "-o", c.OutFile, "$in")
+			}
+		case "gen_pch":
+			appendItem(c.Project, c.InFiles[0], c.OutFile, c.Command, c.Args, "$in")
+		}
+	}
+	for _, o := range graph.OtherRuleFiles {
+		rule, ok := graph.OtherRules[strings.TrimPrefix(o.Rule, "compile")]
+		if !ok {
+			continue
+		}
+		args, err := otherRuleArgs(rule, o)
+		if err != nil {
+			return errors.Wrapf(err, "failed to reconstruct the command for \"%s\"", o.Infile)
+		}
+		appendItem(o.Project, o.Infile, o.Outfile, o.Compiler, args)
+	}
+	if option.compdbPerProject {
+		for project, projectItems := range groupCompileDbByProject(items) {
+			dir := filepath.Join(outputDir, "compdb", project)
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				return errors.Wrapf(err, "failed to create directory \"%s\"", dir)
+			}
+			if err := CreateCompileDbFile(filepath.Join(dir, "compile_commands.json"), projectItems, option.compdbFormat); err != nil {
+				return err
+			}
+		}
+	}
+	if 0 < len(option.compdbMerge) {
+		for _, p := range strings.Split(option.compdbMerge, ",") {
+			p = strings.TrimSpace(p)
+			if len(p) == 0 {
+				continue
+			}
+			if !Exists(p) {
+				Warn("compile_commands.json: \"%s\" is not found (not merged).", p)
+				continue
+			}
+			merged, err := ReadCompileDbFile(p)
+			if err != nil {
+				return err
+			}
+			items = append(items, merged...)
+		}
+		items = UniqueCompileDbItems(items)
+	}
+	if err := CreateCompileDbFile(outPath, items, option.compdbFormat); err != nil {
+		return err
+	}
+	return installCompileDb(outPath, "compile_commands.json", option.compdbRoot)
+}
+
+// otherRuleArgs reconstructs the arguments (except the compiler) of the custom rule `rule` for `file`.
+func otherRuleArgs(rule OtherRule, file OtherRuleFile) ([]string, error) {
+	tokens, err := Tokenize(rule.Command)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, errors.New("no commands")
+	}
+	vars := strings.NewReplacer("$out", file.Outfile, "$depf", file.Depend, "$in", file.Infile)
+	result := make([]string, 0, len(tokens)+len(file.Include)+len(file.Option)+len(file.Define))
+	for _, tok := range tokens[1:] { // `tokens[0]` is `$compiler`
+		switch tok {
+		case "$include":
+			result = append(result, file.Include...)
+		case "$option":
+			result = append(result, file.Option...)
+		case "$define":
+			result = append(result, file.Define...)
+		default:
+			result = append(result, vars.Replace(tok))
+		}
+	}
+	return result, nil
 }
 
 // JoinPaths joins suppiled path components and normalize the result.
@@ -1537,6 +2024,15 @@ func JoinPaths(paths ...string) string {
 	return filepath.ToSlash(filepath.Clean(filepath.Join(paths...)))
 }
 
+// stripOptionPrefix removes `prefix` (ex. "-I") from `args`.
+func stripOptionPrefix(args []string, prefix string) []string {
+	result := make([]string, 0, len(args))
+	for _, arg := range args {
+		result = append(result, strings.TrimPrefix(arg, prefix))
+	}
+	return result
+}
+
 func intercalate(sep string, arg interface{}) (string, error) {
 	switch v := arg.(type) {
 	case []string:
@@ -1553,36 +2049,6 @@ func intercalate(sep string, arg interface{}) (string, error) {
 	return "", errors.Errorf("can't convert \"%v\" to string", arg)
 }
 
-// Escapes ':' in path.
-func escapeDriveColon(arg interface{}) (interface{}, error) {
-	switch v := arg.(type) {
-	case string:
-		return escapeDriveColon1(v), nil
-	case []string:
-		tmp := make([]string, 0, len(v))
-		for _, p := range v {
-			tmp = append(tmp, escapeDriveColon1(p))
-		}
-		return tmp, nil
-	default:
-		if s, ok := arg.(fmt.Stringer); ok {
-			return escapeDriveColon1(s.String()), nil
-		}
-	}
-	return "", errors.Errorf("can't convert \"%v\" to string", arg)
-}
-
-func escapeDriveColon1(p string) string {
-	if filepath.IsAbs(p) && strings.Index(p, ":") == 1 {
-		drive := filepath.VolumeName(p)
-		if 0 < len(drive) {
-			drive = strings.Replace(strings.ToLower(drive), ":", "$:", 1)
-			p = drive + p[2:]
-		}
-	}
-	return p
-}
-
 func substituteExtension(ext string, arg interface{}) (interface{}, error) {
 	switch v := arg.(type) {
 	case string:
@@ -1627,6 +2093,17 @@ func ToBoolean(s string) bool {
 	return false
 }
 
+// isFlagSpecified checks the flag `name` is specified in the command line.
+func isFlagSpecified(name string) bool {
+	specified := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			specified = true
+		}
+	})
+	return specified
+}
+
 // Obtains executable path if possible.
 func getExecutablePath(defaultName string) string {
 	if n, err := os.Executable(); err == nil {
@@ -1634,19 +2111,3 @@ func getExecutablePath(defaultName string) string {
 	}
 	return defaultName
 }
-
-func importEnvironmentVariables() map[string]string {
-	result := make(map[string]string)
-	for _, env := range os.Environ() {
-		values := strings.SplitN(env, "=", 2)
-		switch len(values) {
-		case 0:
-			continue
-		case 1:
-			result[env] = ""
-		default:
-			result[values[0]] = filepath.ToSlash(values[1]) // Kludge! should be avoided if possible.
-		}
-	}
-	return result
-}
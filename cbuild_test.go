@@ -2,9 +2,12 @@ package main
 
 import (
 	"fmt"
+	"io/ioutil"
+	"os"
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	"path/filepath"
 
@@ -220,3 +223,125 @@ func ExampleBasename() {
 	// baz.qux
 	// baz
 }
+
+func TestUpdateFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cbuild-update-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "sub", "build.ninja")
+	Convey("GIVEN: A file written by updateFile", t, func() {
+		So(os.RemoveAll(filepath.Dir(path)), ShouldBeNil)
+		updated, err := updateFile(path, []byte("foo\n"))
+		So(err, ShouldBeNil)
+		So(updated, ShouldBeTrue)
+		past := time.Now().Add(-time.Hour).Truncate(time.Second)
+		So(os.Chtimes(path, past, past), ShouldBeNil)
+		Convey("WHEN: Writing the same contents", func() {
+			updated, err := updateFile(path, []byte("foo\n"))
+			Convey("THEN: The file should be left untouched", func() {
+				So(err, ShouldBeNil)
+				So(updated, ShouldBeFalse)
+				fi, err := os.Stat(path)
+				So(err, ShouldBeNil)
+				So(fi.ModTime().Equal(past), ShouldBeTrue)
+			})
+		})
+		Convey("WHEN: Writing different contents", func() {
+			updated, err := updateFile(path, []byte("bar\n"))
+			Convey("THEN: The file should be replaced", func() {
+				So(err, ShouldBeNil)
+				So(updated, ShouldBeTrue)
+				b, err := ioutil.ReadFile(path)
+				So(err, ShouldBeNil)
+				So(string(b), ShouldEqual, "bar\n")
+			})
+		})
+	})
+}
+
+func TestLoadConfiguration(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cbuild-config-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := "target:\n- {name: foo, type: library}\n"
+	a, b := filepath.Join(dir, "a.yml"), filepath.Join(dir, "b.yml")
+	Convey("GIVEN: Files having the same contents", t, func() {
+		So(ioutil.WriteFile(a, []byte(src), 0644), ShouldBeNil)
+		So(ioutil.WriteFile(b, []byte(src), 0644), ShouldBeNil)
+		Convey("WHEN: Loading them", func() {
+			ca, err := loadConfiguration(a)
+			So(err, ShouldBeNil)
+			cb, err := loadConfiguration(b)
+			So(err, ShouldBeNil)
+			Convey("THEN: The parsed result should be shared", func() {
+				So(ca.Target[0].Name, ShouldEqual, "foo")
+				So(cb, ShouldPointTo, ca)
+			})
+		})
+		Convey("WHEN: The contents are changed", func() {
+			ca, err := loadConfiguration(a)
+			So(err, ShouldBeNil)
+			So(ioutil.WriteFile(a, []byte(strings.Replace(src, "foo", "bar", 1)), 0644), ShouldBeNil)
+			changed, err := loadConfiguration(a)
+			So(err, ShouldBeNil)
+			Convey("THEN: It should be parsed again", func() {
+				So(changed, ShouldNotPointTo, ca)
+				So(changed.Target[0].Name, ShouldEqual, "bar")
+			})
+		})
+	})
+}
+
+func TestSourceOptions(t *testing.T) {
+	dir := copySampleTree(t, nil)
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "common.hpp"), []byte("#pragma once\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	editSampleFile(t, dir, "make.yml",
+		"  - sub/test_sub.cpp\n", "  - {file: sub/test_sub.cpp, option: [O1, Wno-unused], define: [SUB=1], pch: false}\n",
+		"  - $hello.c\n", "  - $hello.c\n  - {file: missing.cpp, exclude_variant: [debug]}\n",
+		"- name: test\n  type: execute\n", "- name: test\n  type: execute\n  pch: common.hpp\n",
+	)
+	Convey("GIVEN: Sources with per-file settings", t, func() {
+		var graph *BuildGraph
+		So(generateSample(dir, "build.ninja", func(g *BuildGraph) error {
+			graph = g
+			return (&ninjaGenerator{}).Emit(g)
+		}), ShouldBeNil)
+		find := func(suffix string) *BuildCommand {
+			for _, c := range graph.Commands {
+				if c.CommandType == "compile" && strings.HasSuffix(c.InFiles[0], suffix) {
+					return c
+				}
+			}
+			return nil
+		}
+		Convey("THEN: Settings should be applied to the file only", func() {
+			sub := find("/test_sub.cpp")
+			So(sub.Args, ShouldContain, "-O1")
+			So(sub.Args, ShouldContain, "-Wno-unused")
+			So(sub.Args, ShouldContain, "-DSUB=1")
+			So(strings.Join(sub.Args, " "), ShouldEndWith, "-DSUB=1 -O1 -Wno-unused")
+			main := find("/test.cpp")
+			So(main.Args, ShouldNotContain, "-O1")
+			So(main.Args, ShouldNotContain, "-DSUB=1")
+		})
+		Convey("THEN: The pre-compiled header can be disabled", func() {
+			So(find("/test_sub.cpp").ImplicitDepends, ShouldBeEmpty)
+			So(find("/test.cpp").ImplicitDepends, ShouldNotBeEmpty)
+		})
+		Convey("THEN: Excluded sources should not be compiled", func() {
+			So(find("/missing.cpp"), ShouldBeNil)
+		})
+		Convey("THEN: The compilation database should have the settings", func() {
+			b, err := ioutil.ReadFile(filepath.Join(dir, "build", "LINUX", "Debug", "compile_commands.json"))
+			So(err, ShouldBeNil)
+			So(string(b), ShouldContainSubstring, `"-DSUB=1",`)
+		})
+	})
+}
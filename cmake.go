@@ -0,0 +1,608 @@
+// Exports the project model as CMake projects.
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/pkg/errors"
+)
+
+// CMakeMinimumVersion is the minimum CMake version required by the generated files (`target_link_options`).
+const CMakeMinimumVersion = "3.13"
+
+// CMakeConfiguration maps a variant to the CMake build type.
+type CMakeConfiguration struct {
+	Name    string // Value of `CMAKE_BUILD_TYPE`
+	Variant string
+}
+
+// cmakeConfigurations lists build types in the generated files.
+var cmakeConfigurations = []CMakeConfiguration{
+	{Name: "Debug", Variant: Debug.String()},
+	{Name: "Release", Variant: Release.String()},
+	{Name: "Product", Variant: Product.String()},
+}
+
+// cmakeReservedTargets are target names which cannot be used in CMake.
+var cmakeReservedTargets = map[string]bool{
+	"all": true, "clean": true, "help": true, "install": true, "test": true,
+	"package": true, "package_source": true, "edit_cache": true, "rebuild_cache": true,
+}
+
+// CMakeDirectory holds the contents of a `CMakeLists.txt`.
+type CMakeDirectory struct {
+	Dir            string // Relative to the root directory ("" for the root)
+	Project        string // Project name (root only)
+	SourceDir      string // Root source directory relative to the export directory (root only)
+	MinimumVersion string
+	Subdirs        []string // Sub-directories added by the root
+	Commands       []*CMakeCommand
+	Targets        []*CMakeTarget
+}
+
+// IsRoot returns true if `d` is the top level directory.
+func (d *CMakeDirectory) IsRoot() bool {
+	return d.Dir == ""
+}
+
+// CMakeCommand is an `add_custom_command` entry.
+type CMakeCommand struct {
+	Output  string
+	Command []string
+	Depends []string
+	Comment string
+}
+
+// CMakeTarget is an `add_library` or `add_executable` entry.
+type CMakeTarget struct {
+	Name        string
+	Kind        string // "STATIC" for libraries, "" for executables
+	OutputName  string
+	Suffix      string
+	Sources     []string
+	Includes    []string
+	Defines     []string
+	Options     []string
+	LinkOptions []string
+	Libraries   []string
+}
+
+// IsLibrary returns true if `t` is built with `add_library`.
+func (t *CMakeTarget) IsLibrary() bool {
+	return 0 < len(t.Kind)
+}
+
+// CMakeSettings holds the settings for exporting.
+type CMakeSettings struct {
+	Project   string // Project name
+	RootDir   string // Absolute path of the directory contains the root `make.yml`
+	ExportDir string // Absolute path of the directory to write `CMakeLists.txt`s
+}
+
+// cmakePathMapper rewrites paths into the ones relative to CMake's directories.
+type cmakePathMapper struct {
+	rootDir   string
+	outputDir string // Absolute output directory of the variant
+}
+
+// Map rewrites `p` if it points inside the output or the source tree.
+// Relative paths (ex. the ones under `-root`) are relative to the source tree.
+func (m *cmakePathMapper) Map(p string) string {
+	abs := filepath.ToSlash(p)
+	relative := !path.IsAbs(abs) && !filepath.IsAbs(p)
+	if relative {
+		abs = path.Join(m.rootDir, abs)
+	}
+	if rel, ok := cmakeRelative(m.outputDir, abs); ok {
+		return path.Join("${CMAKE_BINARY_DIR}", rel)
+	}
+	if rel, ok := cmakeRelative(m.rootDir, abs); ok {
+		return path.Join("${CBUILD_SOURCE_DIR}", rel)
+	}
+	if relative {
+		return "${CBUILD_SOURCE_DIR}/" + path.Clean(filepath.ToSlash(p))
+	}
+	return abs
+}
+
+// MapArg rewrites `arg` only if it refers to the output directory.
+func (m *cmakePathMapper) MapArg(arg string) string {
+	abs := filepath.ToSlash(arg)
+	if !path.IsAbs(abs) {
+		abs = path.Join(m.rootDir, abs)
+	}
+	if rel, ok := cmakeRelative(m.outputDir, abs); ok {
+		return path.Join("${CMAKE_BINARY_DIR}", rel)
+	}
+	return arg
+}
+
+// cmakeRelative returns `p` relative to `base` if `p` is inside of `base`.
+func cmakeRelative(base string, p string) (string, bool) {
+	if p == base {
+		return ".", true
+	}
+	if strings.HasPrefix(p, strings.TrimSuffix(base, "/")+"/") {
+		return p[len(strings.TrimSuffix(base, "/"))+1:], true
+	}
+	return "", false
+}
+
+// DefaultCMakeExportDir is used when `-backend cmake` is specified without `-export-cmake`.
+const DefaultCMakeExportDir = "cmake"
+
+// cmakeGenerator writes `CMakeLists.txt`s.
+type cmakeGenerator struct {
+	dir string
+}
+
+func init() {
+	RegisterGenerator(&cmakeGenerator{})
+}
+
+func (*cmakeGenerator) Name() string { return "cmake" }
+
+func (g *cmakeGenerator) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&g.dir, "export-cmake", DefaultCMakeExportDir, "Export CMakeLists.txt files into the directory")
+}
+
+// Emit collects other build types by itself since `CMakeLists.txt` contains all of them.
+func (g *cmakeGenerator) Emit(graph *BuildGraph) error {
+	Verbose("%s: Exports CMake project to \"%s\".\n", ProgramName, g.dir)
+	return outputCMake(graph, g.dir)
+}
+
+// outputCMake collects targets for each build type (except the one of `graph`), then writes `CMakeLists.txt`s into `exportDir`.
+func outputCMake(graph *BuildGraph, exportDir string) error {
+	variants := make([]string, 0, len(cmakeConfigurations))
+	for _, cfg := range cmakeConfigurations {
+		if cfg.Variant != graph.Variant {
+			variants = append(variants, cfg.Variant)
+		}
+	}
+	others, err := collectVariants(variants)
+	if err != nil {
+		return err
+	}
+	collected := make([]*BuildGraph, 0, len(cmakeConfigurations))
+	for _, cfg := range cmakeConfigurations {
+		c := graph
+		if cfg.Variant != graph.Variant {
+			c, others = others[0], others[1:]
+		}
+		// Paths are written relative to `${CBUILD_SOURCE_DIR}` (the current directory).
+		c, err = normalizeGraph(c, "CMakeLists.txt")
+		if err != nil {
+			return err
+		}
+		collected = append(collected, c)
+	}
+	root, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	absExport, err := filepath.Abs(exportDir)
+	if err != nil {
+		return errors.Wrapf(err, "failed to obtain the absolute path for \"%s\"", exportDir)
+	}
+	settings := CMakeSettings{
+		Project:   filepath.Base(root),
+		RootDir:   filepath.ToSlash(root),
+		ExportDir: filepath.ToSlash(absExport),
+	}
+	dirs := MakeCMakeDirectories(&settings, cmakeConfigurations, collected)
+	if len(dirs) == 0 {
+		fmt.Fprintf(os.Stderr, "%s: No targets to export.\n", ProgramName)
+		return nil
+	}
+	for _, d := range dirs {
+		var b bytes.Buffer
+		if err := WriteCMakeLists(&b, d); err != nil {
+			return err
+		}
+		outdir := filepath.Join(absExport, filepath.FromSlash(d.Dir))
+		if err := os.MkdirAll(outdir, 0755); err != nil {
+			return errors.Wrapf(err, "failed to create directory \"%s\"", outdir)
+		}
+		out := filepath.Join(outdir, "CMakeLists.txt")
+		updated, err := updateFile(out, b.Bytes())
+		if err != nil {
+			return err
+		}
+		if updated {
+			Verbose("%s: Writing \"%s\"\n", ProgramName, out)
+		}
+	}
+	return nil
+}
+
+// MakeCMakeDirectories merges `collected` targets (one for each of `configs`) into `CMakeLists.txt` contents.
+func MakeCMakeDirectories(settings *CMakeSettings, configs []CMakeConfiguration, collected []*BuildGraph) []*CMakeDirectory {
+	type entry struct {
+		target  *CMakeTarget
+		perConf []*ProjectTarget
+	}
+	keyOf := func(t *ProjectTarget) string { return t.Dir + ":" + t.Name }
+	mappers := make([]*cmakePathMapper, len(collected))
+	for i, c := range collected {
+		out := filepath.ToSlash(c.OutputDir)
+		if !path.IsAbs(out) {
+			out = path.Join(settings.RootDir, out)
+		}
+		mappers[i] = &cmakePathMapper{rootDir: settings.RootDir, outputDir: out}
+	}
+
+	// Creates targets and directories in the order of appearance.
+	dirs := make([]*CMakeDirectory, 0)
+	dirByName := make(map[string]*CMakeDirectory)
+	entries := make(map[string]*entry)
+	targetOf := make(map[string]*CMakeTarget) // Key -> CMake target
+	names := make(map[string]bool)
+	order := make([]string, 0)
+	for ci, c := range collected {
+		for _, t := range c.Targets {
+			if t.Type == "test" {
+				continue
+			}
+			if t.Type != "library" && t.Type != "execute" {
+				Warn("Target \"%s\" (%s) is not exported to CMake.", t.Name, t.Type)
+				continue
+			}
+			key := keyOf(t)
+			e, ok := entries[key]
+			if !ok {
+				name := t.Name
+				if cmakeReservedTargets[name] {
+					name = name + "_target"
+				}
+				base := name
+				for i := 2; names[name]; i++ {
+					name = fmt.Sprintf("%s_%d", base, i)
+				}
+				names[name] = true
+				ct := &CMakeTarget{Name: name}
+				base = path.Base(filepath.ToSlash(t.OutFile))
+				if t.Type == "library" {
+					ct.Kind = "STATIC"
+					ct.OutputName = strings.TrimPrefix(strings.TrimSuffix(base, path.Ext(base)), "lib")
+				} else {
+					ct.Suffix = path.Ext(base)
+					ct.OutputName = strings.TrimSuffix(base, ct.Suffix)
+				}
+				e = &entry{target: ct, perConf: make([]*ProjectTarget, len(collected))}
+				entries[key] = e
+				targetOf[key] = ct
+				order = append(order, key)
+
+				dirName := cmakeDirName(t.Dir)
+				d, ok := dirByName[dirName]
+				if !ok {
+					d = &CMakeDirectory{Dir: dirName}
+					dirByName[dirName] = d
+					dirs = append(dirs, d)
+				}
+				d.Targets = append(d.Targets, ct)
+			}
+			e.perConf[ci] = t
+		}
+	}
+	if len(dirs) == 0 {
+		return dirs
+	}
+	for _, key := range order {
+		e := entries[key]
+		ct := e.target
+		var sources, includes, defines, options, linkOptions, libraries [][]string
+		for ci, t := range e.perConf {
+			if t == nil {
+				sources = append(sources, nil)
+				includes = append(includes, nil)
+				defines = append(defines, nil)
+				options = append(options, nil)
+				linkOptions = append(linkOptions, nil)
+				libraries = append(libraries, nil)
+				continue
+			}
+			m := mappers[ci]
+			sources = append(sources, mapStrings(t.Sources, m.Map))
+			includes = append(includes, mapStrings(t.Includes, m.Map))
+			defines = append(defines, t.Defines)
+			options = append(options, cmakeCompileOptions(t.Options))
+			linkOptions = append(linkOptions, cmakeLinkOptions(t.LinkOptions))
+			libs := make([]string, 0, len(t.Depends)+len(t.Libraries)+len(t.LinkDepends))
+			for _, dep := range t.Depends {
+				if d, ok := targetOf[keyOf(dep)]; ok {
+					libs = append(libs, d.Name)
+				}
+			}
+			libs = append(libs, t.Libraries...)
+			libs = append(libs, mapStrings(t.LinkDepends, m.Map)...)
+			libraries = append(libraries, libs)
+		}
+		ct.Sources = cmakeMergeConfigs(configs, sources, "")
+		ct.Includes = cmakeMergeConfigs(configs, includes, "")
+		ct.Defines = cmakeMergeConfigs(configs, defines, "")
+		ct.Options = cmakeMergeConfigs(configs, options, "$<COMPILE_LANGUAGE:CXX>")
+		ct.LinkOptions = cmakeMergeConfigs(configs, linkOptions, "")
+		ct.Libraries = cmakeMergeConfigs(configs, libraries, "")
+	}
+
+	// Prebuild commands belong to the directory of the first target having them.
+	generated := make(map[string]bool)
+	for ci, c := range collected {
+		for _, t := range c.Targets {
+			if _, ok := entries[keyOf(t)]; !ok {
+				continue
+			}
+			d := dirByName[cmakeDirName(t.Dir)]
+			for _, pb := range t.Prebuilds {
+				cmd := makeCMakeCommand(mappers[ci], c.AppendRules, pb)
+				if cmd == nil || generated[cmd.Output] {
+					continue
+				}
+				generated[cmd.Output] = true
+				d.Commands = append(d.Commands, cmd)
+			}
+		}
+	}
+
+	// The root directory adds all other directories.
+	root, ok := dirByName[""]
+	if !ok {
+		root = &CMakeDirectory{}
+		dirs = append([]*CMakeDirectory{root}, dirs...)
+	}
+	root.Project = settings.Project
+	root.MinimumVersion = CMakeMinimumVersion
+	if rel, err := filepath.Rel(filepath.FromSlash(settings.ExportDir), filepath.FromSlash(settings.RootDir)); err == nil {
+		root.SourceDir = filepath.ToSlash(rel)
+	} else {
+		root.SourceDir = settings.RootDir
+	}
+	for _, d := range dirs {
+		if !d.IsRoot() {
+			root.Subdirs = append(root.Subdirs, d.Dir)
+		}
+	}
+	sort.Strings(root.Subdirs)
+	return dirs
+}
+
+// cmakeDirName converts a directory name of `ProjectTarget` into the relative path ("" for the root).
+func cmakeDirName(dir string) string {
+	if d := path.Clean(dir); d != "." {
+		return d
+	}
+	return ""
+}
+
+// makeCMakeCommand converts a prebuild command into `add_custom_command` (returns nil if not convertible).
+func makeCMakeCommand(m *cmakePathMapper, rules map[string]AppendBuild, cmd *BuildCommand) *CMakeCommand {
+	rule, ok := rules[cmd.CommandType]
+	if !ok {
+		return nil
+	}
+	tokens, err := Tokenize(rule.Command)
+	if err != nil {
+		Warn("Failed to parse the command `%s`: %v", rule.Command, err)
+		return nil
+	}
+	output := m.Map(cmd.OutFile)
+	inputs := mapStrings(cmd.InFiles, m.Map)
+	args := make([]string, 0, len(tokens))
+	for _, tok := range tokens {
+		switch tok {
+		case "$in", "${in}", "$in_newline":
+			args = append(args, inputs...)
+			continue
+		}
+		tok = strings.Replace(tok, "${out}", output, -1)
+		tok = strings.Replace(tok, "$out", output, -1)
+		args = append(args, m.MapArg(tok))
+	}
+	depends := append([]string{}, inputs...)
+	for _, d := range append(append([]string{}, cmd.Depends...), cmd.ImplicitDepends...) {
+		if d == "always" {
+			continue
+		}
+		depends = append(depends, m.Map(d))
+	}
+	return &CMakeCommand{
+		Output:  output,
+		Command: args,
+		Depends: depends,
+		Comment: fmt.Sprintf("%s: %s", rule.Desc, path.Base(output)),
+	}
+}
+
+// cmakeCompileOptions removes options handled by CMake itself (compile only, dependency files...).
+func cmakeCompileOptions(options []string) []string {
+	result := make([]string, 0, len(options))
+	for i := 0; i < len(options); i++ {
+		opt := options[i]
+		switch strings.TrimLeft(opt, "-/") {
+		case "c", "MMD", "MD", "MP":
+			continue
+		case "MT", "MF", "MQ", "o":
+			i++ // Skips the argument too.
+			continue
+		}
+		if strings.Contains(opt, "$out") || strings.Contains(opt, "$dep") || strings.Contains(opt, "$in") {
+			continue
+		}
+		result = append(result, opt)
+	}
+	return result
+}
+
+// cmakeLinkOptions removes options referring to the output of the linker.
+func cmakeLinkOptions(options []string) []string {
+	result := make([]string, 0, len(options))
+	for _, opt := range options {
+		if strings.Contains(opt, "$out") {
+			continue
+		}
+		result = append(result, opt)
+	}
+	return result
+}
+
+// cmakeMergeConfigs merges per-configuration lists.
+// Items not shared by all configurations are wrapped with `$<CONFIG:...>`.
+// If `condition` is not empty, all items are guarded with it.
+func cmakeMergeConfigs(configs []CMakeConfiguration, lists [][]string, condition string) []string {
+	counts := make(map[string]int)
+	for _, l := range lists {
+		seen := make(map[string]bool)
+		for _, item := range l {
+			if !seen[item] {
+				seen[item] = true
+				counts[item]++
+			}
+		}
+	}
+	guard := func(cond string, items []string) string {
+		return fmt.Sprintf("$<%s:%s>", cond, strings.Join(items, ";"))
+	}
+	result := make([]string, 0)
+	common := make([]string, 0)
+	emitted := make(map[string]bool)
+	for _, l := range lists {
+		for _, item := range l {
+			if counts[item] == len(lists) && !emitted[item] {
+				emitted[item] = true
+				common = append(common, item)
+			}
+		}
+	}
+	if 0 < len(common) {
+		if len(condition) == 0 {
+			result = append(result, common...)
+		} else {
+			result = append(result, guard(condition, common))
+		}
+	}
+	for ci, l := range lists {
+		if len(configs) <= ci {
+			break
+		}
+		specific := make([]string, 0)
+		for _, item := range l {
+			if counts[item] < len(lists) {
+				specific = append(specific, item)
+			}
+		}
+		if len(specific) == 0 {
+			continue
+		}
+		cond := "$<CONFIG:" + configs[ci].Name + ">"
+		if 0 < len(condition) {
+			cond = "$<AND:" + condition + "," + cond + ">"
+		}
+		result = append(result, guard(cond, specific))
+	}
+	return result
+}
+
+// mapStrings applies `f` to each of `items`.
+func mapStrings(items []string, f func(string) string) []string {
+	result := make([]string, 0, len(items))
+	for _, item := range items {
+		result = append(result, f(item))
+	}
+	return result
+}
+
+// CMakeQuote quotes `arg` as a CMake argument.
+// Variable references and generator expressions are kept as they are.
+func CMakeQuote(arg string) string {
+	if len(arg) != 0 && !strings.ContainsAny(arg, " \t\n\"\\;#()") {
+		return arg
+	}
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	return `"` + r.Replace(arg) + `"`
+}
+
+// WriteCMakeLists writes the contents of `CMakeLists.txt` for `d`.
+func WriteCMakeLists(w io.Writer, d *CMakeDirectory) error {
+	tmpl, err := template.New("cmake").Funcs(template.FuncMap{
+		"quote": CMakeQuote,
+	}).Parse(cmakeListsTemplate)
+	if err != nil {
+		return errors.Wrap(err, "failed to parse the CMake template")
+	}
+	return tmpl.Execute(w, d)
+}
+
+const cmakeListsTemplate = `# AUTOGENERATED by cbuild. DO NOT EDIT.
+{{- if .IsRoot}}
+cmake_minimum_required(VERSION {{.MinimumVersion}})
+project({{quote .Project}} C CXX)
+
+get_filename_component(CBUILD_SOURCE_DIR "${CMAKE_CURRENT_LIST_DIR}/{{.SourceDir}}" ABSOLUTE)
+{{- end}}
+{{- range .Commands}}
+
+add_custom_command(
+    OUTPUT {{quote .Output}}
+    COMMAND{{range .Command}} {{quote .}}{{end}}
+    DEPENDS{{range .Depends}} {{quote .}}{{end}}
+    WORKING_DIRECTORY "${CBUILD_SOURCE_DIR}"
+    COMMENT {{quote .Comment}}
+    VERBATIM)
+{{- end}}
+{{- range .Targets}}
+{{- $name := .Name}}
+
+{{if .IsLibrary}}add_library({{$name}} {{.Kind}}{{else}}add_executable({{$name}}{{end}}
+{{- range .Sources}}
+    {{quote .}}
+{{- end}})
+set_target_properties({{$name}} PROPERTIES OUTPUT_NAME {{quote .OutputName}}{{if .Suffix}} SUFFIX {{quote .Suffix}}{{end}})
+{{- if .Includes}}
+target_include_directories({{$name}} PRIVATE
+{{- range .Includes}}
+    {{quote .}}
+{{- end}})
+{{- end}}
+{{- if .Defines}}
+target_compile_definitions({{$name}} PRIVATE
+{{- range .Defines}}
+    {{quote .}}
+{{- end}})
+{{- end}}
+{{- if .Options}}
+target_compile_options({{$name}} PRIVATE
+{{- range .Options}}
+    {{quote .}}
+{{- end}})
+{{- end}}
+{{- if .LinkOptions}}
+target_link_options({{$name}} PRIVATE
+{{- range .LinkOptions}}
+    {{quote .}}
+{{- end}})
+{{- end}}
+{{- if .Libraries}}
+target_link_libraries({{$name}} PRIVATE
+{{- range .Libraries}}
+    {{quote .}}
+{{- end}})
+{{- end}}
+{{- end}}
+{{- if .Subdirs}}
+{{range .Subdirs}}
+add_subdirectory({{quote .}})
+{{- end}}
+{{- end}}
+`
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestCMakeMergeConfigs(t *testing.T) {
+	configs := []CMakeConfiguration{{Name: "Debug"}, {Name: "Release"}}
+	Convey("GIVEN: Per-configuration lists", t, func() {
+		lists := [][]string{{"-g", "-O0", "-Wall"}, {"-g", "-O2", "-Wall"}}
+		Convey("WHEN: Merged without condition", func() {
+			actual := cmakeMergeConfigs(configs, lists, "")
+			Convey("THEN: Specific items should be guarded by the configuration", func() {
+				So(actual, ShouldResemble, []string{"-g", "-Wall", "$<$<CONFIG:Debug>:-O0>", "$<$<CONFIG:Release>:-O2>"})
+			})
+		})
+		Convey("WHEN: Merged with condition", func() {
+			actual := cmakeMergeConfigs(configs, lists, "$<COMPILE_LANGUAGE:CXX>")
+			Convey("THEN: All items should be guarded", func() {
+				So(actual, ShouldResemble, []string{
+					"$<$<COMPILE_LANGUAGE:CXX>:-g;-Wall>",
+					"$<$<AND:$<COMPILE_LANGUAGE:CXX>,$<CONFIG:Debug>>:-O0>",
+					"$<$<AND:$<COMPILE_LANGUAGE:CXX>,$<CONFIG:Release>>:-O2>",
+				})
+			})
+		})
+	})
+	Convey("GIVEN: Compile options", t, func() {
+		So(cmakeCompileOptions([]string{"-c", "-g", "-MMD", "-MT", "$out", "-MF", "$dep", "-std=c++14"}),
+			ShouldResemble, []string{"-g", "-std=c++14"})
+		So(CMakeQuote("${CBUILD_SOURCE_DIR}/a.cpp"), ShouldEqual, "${CBUILD_SOURCE_DIR}/a.cpp")
+		So(CMakeQuote(`MSG="a b"`), ShouldEqual, `"MSG=\"a b\""`)
+	})
+}
+
+func TestMakeCMakeDirectories(t *testing.T) {
+	rules := map[string]AppendBuild{
+		"gen.build": {Command: "/work/build/Debug/tool -o $out $in", Desc: "gen"},
+	}
+	configs := []CMakeConfiguration{{Name: "Debug"}, {Name: "Release"}}
+	collect := func(variant string, options ...string) *BuildGraph {
+		out := "build/" + variant
+		lib := &ProjectTarget{
+			Name:    "foo",
+			Type:    "library",
+			Dir:     "./foo/",
+			Sources: []string{"/work/foo/a.cpp"},
+			Options: options,
+			OutFile: out + "/foo/libfoo.a",
+		}
+		app := &ProjectTarget{
+			Name:      "test",
+			Type:      "execute",
+			Dir:       "./",
+			Sources:   []string{"/work/main.cpp", "/work/" + out + "/gen.c"},
+			Includes:  []string{"include"},
+			Defines:   []string{`MSG="hello"`},
+			Libraries: []string{"m"},
+			OutFile:   out + "/test.elf",
+			Depends:   []*ProjectTarget{lib},
+			Prebuilds: []*BuildCommand{{
+				CommandType: "gen.build",
+				InFiles:     []string{"gen.txt"},
+				OutFile:     "/work/" + out + "/gen.c",
+				Depends:     []string{"/work/build/Debug/tool"},
+			}},
+		}
+		return &BuildGraph{Variant: variant, OutputDir: out, AppendRules: rules, Targets: []*ProjectTarget{lib, app}}
+	}
+	collected := []*BuildGraph{collect("Debug", "-c", "-O0"), collect("Release", "-c", "-O2")}
+	settings := CMakeSettings{Project: "sample", RootDir: "/work", ExportDir: "/work/cmake"}
+	Convey("GIVEN: Targets collected for Debug and Release", t, func() {
+		Convey("WHEN: Making directories", func() {
+			dirs := MakeCMakeDirectories(&settings, configs, collected)
+			So(len(dirs), ShouldEqual, 2)
+			foo, root := dirs[0], dirs[1]
+			Convey("THEN: The root should add other directories", func() {
+				So(root.IsRoot(), ShouldBeTrue)
+				So(root.SourceDir, ShouldEqual, "..")
+				So(root.Subdirs, ShouldResemble, []string{"foo"})
+				So(foo.Dir, ShouldEqual, "foo")
+			})
+			Convey("THEN: Targets should be merged", func() {
+				lib := foo.Targets[0]
+				So(lib.Kind, ShouldEqual, "STATIC")
+				So(lib.OutputName, ShouldEqual, "foo")
+				So(lib.Options, ShouldResemble, []string{
+					"$<$<AND:$<COMPILE_LANGUAGE:CXX>,$<CONFIG:Debug>>:-O0>",
+					"$<$<AND:$<COMPILE_LANGUAGE:CXX>,$<CONFIG:Release>>:-O2>",
+				})
+				app := root.Targets[0]
+				So(app.Name, ShouldEqual, "test_target")
+				So(app.Sources, ShouldResemble, []string{"${CBUILD_SOURCE_DIR}/main.cpp", "${CMAKE_BINARY_DIR}/gen.c"})
+				So(app.Libraries, ShouldResemble, []string{"foo", "m"})
+			})
+			Convey("THEN: Generated CMakeLists.txt should contain the commands", func() {
+				var b bytes.Buffer
+				So(WriteCMakeLists(&b, root), ShouldBeNil)
+				expected := `# AUTOGENERATED by cbuild. DO NOT EDIT.
+cmake_minimum_required(VERSION 3.13)
+project(sample C CXX)
+
+get_filename_component(CBUILD_SOURCE_DIR "${CMAKE_CURRENT_LIST_DIR}/.." ABSOLUTE)
+
+add_custom_command(
+    OUTPUT ${CMAKE_BINARY_DIR}/gen.c
+    COMMAND ${CMAKE_BINARY_DIR}/tool -o ${CMAKE_BINARY_DIR}/gen.c ${CBUILD_SOURCE_DIR}/gen.txt
+    DEPENDS ${CBUILD_SOURCE_DIR}/gen.txt ${CMAKE_BINARY_DIR}/tool
+    WORKING_DIRECTORY "${CBUILD_SOURCE_DIR}"
+    COMMENT "gen: gen.c"
+    VERBATIM)
+
+add_executable(test_target
+    ${CBUILD_SOURCE_DIR}/main.cpp
+    ${CMAKE_BINARY_DIR}/gen.c)
+set_target_properties(test_target PROPERTIES OUTPUT_NAME test SUFFIX .elf)
+target_include_directories(test_target PRIVATE
+    ${CBUILD_SOURCE_DIR}/include)
+target_compile_definitions(test_target PRIVATE
+    "MSG=\"hello\"")
+target_link_libraries(test_target PRIVATE
+    foo
+    m)
+
+add_subdirectory(foo)
+`
+				So(b.String(), ShouldEqual, expected)
+			})
+		})
+	})
+}
+
+func TestCMakePathMapper(t *testing.T) {
+	Convey("GIVEN: A mapper for the source tree", t, func() {
+		m := &cmakePathMapper{rootDir: "/work/src", outputDir: "/work/src/build/Debug"}
+		Convey("THEN: Paths in the trees should be relative to them", func() {
+			So(m.Map("/work/src/a.cpp"), ShouldEqual, "${CBUILD_SOURCE_DIR}/a.cpp")
+			So(m.Map("include"), ShouldEqual, "${CBUILD_SOURCE_DIR}/include")
+			So(m.Map("build/Debug/gen.c"), ShouldEqual, "${CMAKE_BINARY_DIR}/gen.c")
+		})
+		Convey("THEN: Relative paths outside of the tree (normalized with -root) should be kept relative", func() {
+			So(m.Map("../lib/b.cpp"), ShouldEqual, "${CBUILD_SOURCE_DIR}/../lib/b.cpp")
+			So(m.Map("/work/lib/b.cpp"), ShouldEqual, "/work/lib/b.cpp")
+		})
+	})
+}
+
+func TestCMakeEmit(t *testing.T) {
+	dir := copySampleTree(t, nil)
+	defer os.RemoveAll(dir)
+	lists := filepath.Join(dir, "cmake", "CMakeLists.txt")
+	Convey("GIVEN: The sample tree", t, func() {
+		Convey("WHEN: Exporting the passed graph", func() {
+			So(generateSample(dir, "build.ninja", func(graph *BuildGraph) error {
+				targets := make([]*ProjectTarget, 0, len(graph.Targets))
+				for _, t := range graph.Targets {
+					c := *t
+					c.Defines = append(append([]string{}, t.Defines...), "FROM_GRAPH")
+					targets = append(targets, &c)
+				}
+				graph.Targets = targets
+				return (&cmakeGenerator{dir: "cmake"}).Emit(graph)
+			}), ShouldBeNil)
+			Convey("THEN: The graph should be used for its build type", func() {
+				b, err := ioutil.ReadFile(lists)
+				So(err, ShouldBeNil)
+				So(string(b), ShouldContainSubstring, "$<$<CONFIG:Debug>:FROM_GRAPH>")
+			})
+		})
+		Convey("WHEN: Exporting again without changes", func() {
+			emit := (&cmakeGenerator{dir: "cmake"}).Emit
+			So(generateSample(dir, "build.ninja", emit), ShouldBeNil)
+			old := time.Now().Add(-time.Hour)
+			So(os.Chtimes(lists, old, old), ShouldBeNil)
+			So(generateSample(dir, "build.ninja", emit), ShouldBeNil)
+			Convey("THEN: CMakeLists.txt should not be rewritten", func() {
+				fi, err := os.Stat(lists)
+				So(err, ShouldBeNil)
+				So(fi.ModTime().Unix(), ShouldEqual, old.Unix())
+			})
+		})
+	})
+}
+
+func TestCMakeExport(t *testing.T) {
+	if _, err := exec.LookPath("cmake"); err != nil {
+		t.Skip("\"cmake\" is not available")
+	}
+	dir := prepareSampleTree(t)
+	defer os.RemoveAll(dir)
+	Convey("GIVEN: The sample tree", t, func() {
+		So(generateSample(dir, "build.ninja", (&cmakeGenerator{dir: "cmake"}).Emit), ShouldBeNil)
+		Convey("WHEN: Building with CMake", func() {
+			bin := filepath.Join(dir, "cmake-build")
+			_, err := exec.Command("cmake", "-S", filepath.Join(dir, "cmake"), "-B", bin, "-DCMAKE_BUILD_TYPE=Debug").CombinedOutput()
+			So(err, ShouldBeNil)
+			out, err := exec.Command("cmake", "--build", bin).CombinedOutput()
+			Convey("THEN: The executable should be built", func() {
+				So(err, ShouldBeNil)
+				So(string(out), ShouldContainSubstring, "txt2c")
+				So(Exists(filepath.Join(bin, "test.elf")), ShouldBeTrue)
+			})
+		})
+	})
+}
@@ -0,0 +1,226 @@
+// Traverses the configuration tree (sibling directories are read concurrently).
+
+package main
+
+import (
+	"path/filepath"
+	"runtime"
+	"sync"
+)
+
+// collection holds the results of traversing a directory (including its sub-directories).
+// Each traversal accumulates into its own collection instead of the globals,
+// and the results of the sub-directories are merged in the order of `subdir:`.
+type collection struct {
+	artifacts      []string // Artifacts bubbled up to the parent
+	configs        []string
+	generated      []string // Files written while collecting (ex. unity files)
+	subNinjas      []string
+	headers        []string
+	commands       []*BuildCommand
+	otherRuleFiles []OtherRuleFile
+	defaultTargets []string
+	targets        []*ProjectTarget
+	moduleInfos    []string // Modules provided by the directory (and the sub-directories)
+	appendRules    map[string]AppendBuild
+	otherRules     map[string]OtherRule  // Rules visible from the directory (inherited + registered)
+	otherRuleLog   []otherRuleEntry      // Rules registered in the directory (and the sub-directories)
+	environment    []ImportedEnvironment // Imported variables in order
+	settings       []func()              // Assignments to the global flags (ex. `useResponse`) in order
+	parent         *collection
+	// Rules looked up in the directory (and the sub-directories).
+	// A directory is traversed again if an earlier sibling registered one of them.
+	otherRuleReads  map[string]bool
+	appendRuleReads map[string]bool
+}
+
+type otherRuleEntry struct {
+	ext  string
+	rule OtherRule
+}
+
+// newCollection creates a collection inheriting the custom rules of `parent` (may be `nil`).
+func newCollection(parent *collection) *collection {
+	c := &collection{
+		appendRules:     make(map[string]AppendBuild),
+		otherRules:      make(map[string]OtherRule),
+		parent:          parent,
+		otherRuleReads:  make(map[string]bool),
+		appendRuleReads: make(map[string]bool),
+	}
+	if parent != nil {
+		for ext, r := range parent.otherRules {
+			c.otherRules[ext] = r
+		}
+	}
+	return c
+}
+
+// otherRule looks up the custom rule for `ext`.
+func (c *collection) otherRule(ext string) (OtherRule, bool) {
+	c.otherRuleReads[ext] = true
+	r, ok := c.otherRules[ext]
+	return r, ok
+}
+
+// appendRule looks up the rule `label` registered in the directory or the ones visited before.
+func (c *collection) appendRule(label string) (AppendBuild, bool) {
+	c.appendRuleReads[label] = true
+	for p := c; p != nil; p = p.parent {
+		if r, ok := p.appendRules[label]; ok {
+			return r, true
+		}
+	}
+	return AppendBuild{}, false
+}
+
+// dependsOn checks `c` looked up one of the rules registered in `registered`.
+func (c *collection) dependsOn(registered *collection) bool {
+	for _, e := range registered.otherRuleLog {
+		if c.otherRuleReads[e.ext] {
+			return true
+		}
+	}
+	for label := range registered.appendRules {
+		if c.appendRuleReads[label] {
+			return true
+		}
+	}
+	return false
+}
+
+// addOtherRule registers `rule` for `ext` (or appends the options if already registered).
+func (c *collection) addOtherRule(ext string, rule OtherRule) {
+	mergeOtherRule(c.otherRules, ext, rule)
+	c.otherRuleLog = append(c.otherRuleLog, otherRuleEntry{ext: ext, rule: rule})
+}
+
+func mergeOtherRule(dict map[string]OtherRule, ext string, rule OtherRule) {
+	r, ok := dict[ext]
+	if !ok {
+		dict[ext] = rule
+		return
+	}
+	// Options may be shared with the other collections.
+	r.Options = append(r.Options[:len(r.Options):len(r.Options)], rule.Options...)
+	dict[ext] = r
+}
+
+// merge appends the results of the sub-directory `child`.
+func (c *collection) merge(child *collection) {
+	c.configs = append(c.configs, child.configs...)
+	c.generated = append(c.generated, child.generated...)
+	c.subNinjas = append(c.subNinjas, child.subNinjas...)
+	c.headers = append(c.headers, child.headers...)
+	c.commands = append(c.commands, child.commands...)
+	c.otherRuleFiles = append(c.otherRuleFiles, child.otherRuleFiles...)
+	c.defaultTargets = append(c.defaultTargets, child.defaultTargets...)
+	c.targets = append(c.targets, child.targets...)
+	c.moduleInfos = append(c.moduleInfos, child.moduleInfos...)
+	for label, r := range child.appendRules {
+		if _, ok := c.appendRules[label]; !ok {
+			c.appendRules[label] = r
+		}
+	}
+	for _, e := range child.otherRuleLog {
+		mergeOtherRule(c.otherRules, e.ext, e.rule)
+	}
+	c.otherRuleLog = append(c.otherRuleLog, child.otherRuleLog...)
+	c.environment = append(c.environment, child.environment...)
+	c.settings = append(c.settings, child.settings...)
+	for ext := range child.otherRuleReads {
+		c.otherRuleReads[ext] = true
+	}
+	for label := range child.appendRuleReads {
+		c.appendRuleReads[label] = true
+	}
+}
+
+// publish stores the results into the globals.
+func (c *collection) publish() {
+	emitContext.subNinjaList = c.subNinjas
+	emitContext.appendRules = c.appendRules
+	emitContext.otherRuleList = c.otherRules
+	emitContext.commandList = c.commands
+	emitContext.otherRuleFileList = c.otherRuleFiles
+	emitContext.scannedConfigs = c.configs
+	emitContext.generatedFiles = c.generated
+	emitContext.defaultTargets = c.defaultTargets
+	environment := make(map[string]ImportedEnvironment)
+	for _, v := range c.environment {
+		environment[v.Name] = v
+	}
+	setImportedEnvironment(environment)
+	project.headerFiles = c.headers
+	project.targets = c.targets
+	for _, s := range c.settings {
+		s()
+	}
+}
+
+// traverser traverses the sub-directories concurrently (up to `jobs` goroutines).
+type traverser struct {
+	slots chan struct{}
+}
+
+// newTraverser creates a traverser. `jobs` less than 1 means the number of CPUs.
+func newTraverser(jobs int) *traverser {
+	if jobs < 1 {
+		jobs = runtime.NumCPU()
+	}
+	// The calling goroutine is also counted.
+	return &traverser{slots: make(chan struct{}, jobs-1)}
+}
+
+// traverseSubdirs traverses `subdirs` of `relChildDir` and merges the results into `c` in order.
+// A sub-directory is traversed in the calling goroutine if no slots are available.
+// Sub-directories are traversed without the rules registered by the earlier siblings,
+// so the ones which looked up such rules are traversed again after merging them (as the sequential traversal).
+func (t *traverser) traverseSubdirs(info BuildInfo, relChildDir string, level int, subdirs []string, c *collection) ([]string, error) {
+	results := make([]*collection, len(subdirs))
+	errs := make([]error, len(subdirs))
+	odirs := make([]string, len(subdirs))
+	var wg sync.WaitGroup
+	for i, s := range subdirs {
+		// relChildDir always ends with '/'
+		odir := relChildDir + filepath.ToSlash(filepath.Clean(s)) + "/"
+		odirs[i] = odir
+		select {
+		case t.slots <- struct{}{}:
+			wg.Add(1)
+			go func(i int, odir string) {
+				defer wg.Done()
+				defer func() { <-t.slots }()
+				results[i], errs[i] = t.traverse(info, odir, level+1, c)
+			}(i, odir)
+		default:
+			results[i], errs[i] = t.traverse(info, odir, level+1, c)
+		}
+	}
+	wg.Wait()
+	subArtifacts := make([]string, 0, len(subdirs))
+	for i := range results {
+		if 0 < i && retraverse(results[i], errs[i], results[:i]) {
+			results[i], errs[i] = t.traverse(info, odirs[i], level+1, c)
+		}
+		if errs[i] != nil {
+			return nil, errs[i]
+		}
+		subArtifacts = append(subArtifacts, results[i].artifacts...)
+		c.merge(results[i])
+	}
+	return subArtifacts, nil
+}
+
+// retraverse checks a sibling traversed to `result` (or failed with `err`) depends on the rules registered by `earlier` ones.
+func retraverse(result *collection, err error, earlier []*collection) bool {
+	for _, e := range earlier {
+		if len(e.otherRuleLog) == 0 && len(e.appendRules) == 0 {
+			continue
+		}
+		if err != nil || result.dependsOn(e) {
+			return true
+		}
+	}
+	return false
+}
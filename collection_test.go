@@ -0,0 +1,310 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// prepareWideTree creates a configuration tree having `width` sibling libraries (each has a nested one).
+func prepareWideTree(t *testing.T, width int) string {
+	dir, err := ioutil.TempDir("", "cbuild-wide-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	write := func(rel string, content string) {
+		p := filepath.Join(dir, rel)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	libs := make([]string, 0, width)
+	for i := 0; i < width; i++ {
+		lib := fmt.Sprintf("lib%02d", i)
+		libs = append(libs, lib)
+		write(filepath.Join(lib, "make.yml"), fmt.Sprintf(`
+variable:
+- {name: enable_response, value: "%[2]t"}
+define:
+- list: [ %[1]s ]
+other:
+- ext: .c
+  command: compiler.c @option -o $out $in
+  option:
+  - list: [ D%[1]s ]
+source:
+- list: [ a.cpp, b.c ]
+subdir:
+- list: [ nested ]
+target:
+- name: %[1]s
+  type: library
+`, lib, i%2 == 0))
+		write(filepath.Join(lib, "nested", "make.yml"), `
+source:
+- list: [ nested.cpp ]
+target:
+- name: nested
+  type: library
+`)
+	}
+	write("make.yml", fmt.Sprintf(`
+variable:
+- {name: compiler, value: "c++"}
+- {name: compiler.c, value: "cc"}
+- {name: archiver, value: "ar"}
+- {name: linker, value: "c++"}
+option:
+- list: [ c, MMD, MT $out, MF $dep ]
+archive_option:
+- list: [ rc ]
+other:
+- ext: .c
+  command: compiler.c @option -o $out $in
+  option:
+  - list: [ c ]
+source:
+- list: [ main.cpp ]
+subdir:
+- list: [ %s ]
+target:
+- name: app
+  type: execute
+`, strings.Join(libs, ", ")))
+	return dir
+}
+
+func TestConcurrentTraversal(t *testing.T) {
+	dir := prepareWideTree(t, 24)
+	defer os.RemoveAll(dir)
+	saved := option.jobs
+	defer (func() {
+		option.jobs = saved
+		setImportedEnvironment(nil)
+	})()
+	generate := func(jobs int, outFile string) (*BuildGraph, []byte) {
+		option.jobs = jobs
+		var graph *BuildGraph
+		So(generateSample(dir, outFile, func(g *BuildGraph) error {
+			graph = g
+			return (&ninjaGenerator{}).Emit(g)
+		}), ShouldBeNil)
+		b, err := ioutil.ReadFile(filepath.Join(dir, outFile))
+		So(err, ShouldBeNil)
+		return graph, b
+	}
+	Convey("GIVEN: A tree having many sibling directories", t, func() {
+		Convey("WHEN: Generating sequentially and concurrently", func() {
+			seqGraph, seq := generate(1, "sequential.ninja")
+			seqResponse := useResponse
+			parGraph, par := generate(8, "concurrent.ninja")
+			Convey("THEN: The outputs should be identical (except the output name)", func() {
+				So(strings.Replace(string(par), "concurrent.ninja", "sequential.ninja", -1), ShouldEqual, string(seq))
+				So(parGraph.ConfigSources, ShouldResemble, seqGraph.ConfigSources)
+				So(len(parGraph.Targets), ShouldEqual, 2*24+1)
+				So(useResponse, ShouldEqual, seqResponse)
+			})
+			Convey("THEN: Results should be merged in the order of sub-directories", func() {
+				So(len(seqGraph.ConfigSources), ShouldEqual, 2*24+1)
+				So(seqGraph.ConfigSources[1], ShouldEndWith, "/lib00/make.yml")
+				So(seqGraph.ConfigSources[2], ShouldEndWith, "/lib00/nested/make.yml")
+				So(seqGraph.ConfigSources[3], ShouldEndWith, "/lib01/make.yml")
+				app := seqGraph.Targets[len(seqGraph.Targets)-1]
+				So(app.Name, ShouldEqual, "app")
+				So(len(app.Depends), ShouldEqual, 2*24)
+				// Last `enable_response` wins.
+				So(seqResponse, ShouldBeFalse)
+			})
+			Convey("THEN: Options of the custom rule should be appended in order", func() {
+				rule := seqGraph.OtherRules[".c"]
+				So(rule.Options[:3], ShouldResemble, []string{"-c", "-Dlib00", "-Dlib01"})
+				So(parGraph.OtherRules[".c"].Options, ShouldResemble, rule.Options)
+			})
+		})
+	})
+}
+
+func TestSiblingRules(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cbuild-sibling-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	write := func(rel string, content string) {
+		p := filepath.Join(dir, rel)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("make.yml", `
+variable:
+- {name: compiler, value: "c++"}
+- {name: compiler.c, value: "cc"}
+- {name: archiver, value: "ar"}
+- {name: linker, value: "c++"}
+option:
+- list: [ c ]
+source:
+- list: [ main.cpp ]
+subdir:
+- list: [ a, b ]
+target:
+- name: app
+  type: execute
+`)
+	// `a` registers the rule for `.c` used by the later sibling `b`.
+	write("a/make.yml", `
+other:
+- ext: .c
+  command: compiler.c @option -o $out $in
+  option:
+  - list: [ c, DFROM_A ]
+source:
+- list: [ a.cpp ]
+target:
+- {name: a, type: library}
+`)
+	write("b/make.yml", `
+source:
+- list: [ b.c ]
+target:
+- {name: b, type: library}
+`)
+	saved := option.jobs
+	defer (func() { option.jobs = saved })()
+	generate := func(jobs int, outFile string) (*BuildGraph, string) {
+		option.jobs = jobs
+		var graph *BuildGraph
+		So(generateSample(dir, outFile, func(g *BuildGraph) error {
+			graph = g
+			return (&ninjaGenerator{}).Emit(g)
+		}), ShouldBeNil)
+		b, err := ioutil.ReadFile(filepath.Join(dir, outFile))
+		So(err, ShouldBeNil)
+		return graph, strings.Replace(string(b), outFile, "build.ninja", -1)
+	}
+	Convey("GIVEN: A sibling using the rule registered by the earlier one", t, func() {
+		Convey("WHEN: Generating sequentially and concurrently", func() {
+			seqGraph, seq := generate(1, "sequential.ninja")
+			_, par := generate(8, "concurrent.ninja")
+			Convey("THEN: The sibling should be compiled with the rule (as the sequential traversal)", func() {
+				So(len(seqGraph.OtherRuleFiles), ShouldEqual, 1)
+				f := seqGraph.OtherRuleFiles[0]
+				So(f.Rule, ShouldEqual, "compile.c")
+				So(f.Infile, ShouldEndWith, "/b/b.c")
+				So(f.Option, ShouldContain, "-DFROM_A")
+				for _, c := range seqGraph.Commands {
+					So(c.InFiles, ShouldNotContain, f.Infile)
+				}
+			})
+			Convey("THEN: The outputs should be identical", func() {
+				So(par, ShouldEqual, seq)
+			})
+		})
+	})
+}
+
+func TestConcurrentEnvironmentScope(t *testing.T) {
+	const imported = "CBUILD_SCOPE_TEST_IMPORTED"
+	os.Unsetenv(imported)
+	dir, err := ioutil.TempDir("", "cbuild-scope-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	write := func(rel string, content string) {
+		p := filepath.Join(dir, rel)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Even directories import the variable and define a macro by referring it.
+	const width = 16
+	writeLibs := func(referredBy func(i int) bool) {
+		for i := 0; i < width; i++ {
+			lib := fmt.Sprintf("lib%02d", i)
+			content := ""
+			if i%2 == 0 {
+				content = fmt.Sprintf("environment:\n- {name: %s, default: imported}\n", imported)
+			}
+			if referredBy(i) {
+				content += fmt.Sprintf("define:\n- {when: 'env.%s == imported', list: [ SEE_IMPORTED ]}\n", imported)
+			}
+			write(filepath.Join(lib, "make.yml"), content+fmt.Sprintf("source:\n- list: [ a.cpp ]\ntarget:\n- {name: %s, type: library}\n", lib))
+		}
+	}
+	libs := make([]string, 0, width)
+	for i := 0; i < width; i++ {
+		libs = append(libs, fmt.Sprintf("lib%02d", i))
+	}
+	write("make.yml", fmt.Sprintf(`
+variable:
+- {name: compiler, value: "c++"}
+- {name: archiver, value: "ar"}
+- {name: linker, value: "c++"}
+option:
+- list: [ c ]
+source:
+- list: [ main.cpp ]
+subdir:
+- list: [ %s ]
+target:
+- name: app
+  type: execute
+`, strings.Join(libs, ", ")))
+	saved := option.jobs
+	defer (func() {
+		option.jobs = saved
+		setImportedEnvironment(nil)
+	})()
+	Convey("GIVEN: Sibling directories importing an environment variable", t, func() {
+		option.jobs = 8
+		Convey("WHEN: Only the importing directories refer it", func() {
+			writeLibs(func(i int) bool { return i%2 == 0 })
+			var graph *BuildGraph
+			So(generateSample(dir, "build.ninja", func(g *BuildGraph) error {
+				graph = g
+				return nil
+			}), ShouldBeNil)
+			Convey("THEN: The conditions should see the imported value", func() {
+				checked := 0
+				for _, c := range graph.Commands {
+					if c.CommandType != "compile" || !strings.Contains(c.InFiles[0], "/lib") {
+						continue
+					}
+					var n int
+					fmt.Sscanf(filepath.Base(filepath.Dir(c.InFiles[0])), "lib%d", &n)
+					So(strings.Contains(strings.Join(c.Args, " "), "-DSEE_IMPORTED"), ShouldEqual, n%2 == 0)
+					checked++
+				}
+				So(checked, ShouldEqual, width)
+			})
+			Convey("THEN: The imported variable should be recorded", func() {
+				So(graph.Environment, ShouldResemble, []ImportedEnvironment{{Name: imported, Value: "imported"}})
+			})
+		})
+		Convey("WHEN: A sibling refers the variable imported by the others", func() {
+			writeLibs(func(i int) bool { return i%2 == 0 || i == 5 })
+			err := generateSample(dir, "build.ninja", func(g *BuildGraph) error { return nil })
+			Convey("THEN: Should fail (imports are not visible from the siblings)", func() {
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldContainSubstring, "lib05/make.yml")
+				So(err.Error(), ShouldContainSubstring, imported)
+			})
+		})
+	})
+}
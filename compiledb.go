@@ -1,15 +1,23 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"io"
 	"io/ioutil"
 	"os"
+	"path"
 	"path/filepath"
 
 	"github.com/pkg/errors"
 )
 
+// Forms of the commands in the compilation database.
+const (
+	compileDbArguments = "arguments" // argv (`arguments`)
+	compileDbCommand   = "command"   // Shell command line (`command`)
+)
+
 // CompileDbItem represents an entry for json compilation database (https://clang.llvm.org/docs/JSONCompilationDatabase.html)
 type CompileDbItem struct {
 	// The working directory
@@ -19,32 +27,25 @@ type CompileDbItem struct {
 	// The output
 	Output string `json:"output"`
 	// Compilation command
-	Arguments []string `json:"arguments"`
+	Arguments []string `json:"arguments,omitempty"`
+	// Compilation command (as a shell command line)
+	Command string `json:"command,omitempty"`
+	project string // Project compiling the file
 }
 
-// CreateCompileDbFile creates compilation-database file.
-func CreateCompileDbFile(outPath string, defs []CompileDbItem) error {
-	var err error
-
-	outDir := filepath.Dir(outPath)
-	tmpOut, err := ioutil.TempFile(outDir, "cdb-")
+// CreateCompileDbFile creates compilation-database file in the `format` ("arguments" or "command").
+// The existing file is left untouched if the contents are not changed.
+func CreateCompileDbFile(outPath string, defs []CompileDbItem, format string) error {
+	defs, err := FormatCompileDb(defs, format)
 	if err != nil {
-		return errors.Wrapf(err, "failed to create temporal output for \"%s\"", outPath)
+		return err
 	}
-	defer (func() {
-		tmpOut.Close()
-		os.Remove(tmpOut.Name())
-	})()
-	err = WriteCompileDb(tmpOut, defs)
-	if err != nil {
-		errors.Wrapf(err, "failed to write definitions")
-	}
-	tmpOut.Close()
-	err = os.Rename(tmpOut.Name(), outPath)
-	if err != nil {
-		return errors.Wrapf(err, "failed to rename \"%s\" to \"%s\"", tmpOut.Name(), outPath)
+	var b bytes.Buffer
+	if err := WriteCompileDb(&b, defs); err != nil {
+		return errors.Wrapf(err, "failed to write definitions")
 	}
-	return nil
+	_, err = updateFile(outPath, b.Bytes())
+	return err
 }
 
 // WriteCompileDb writes definitions to output.
@@ -60,3 +61,115 @@ func WriteCompileDb(output io.Writer, defs []CompileDbItem) error {
 	}
 	return nil
 }
+
+// ReadCompileDbFile reads the compilation-database file.
+func ReadCompileDbFile(inPath string) ([]CompileDbItem, error) {
+	b, err := ioutil.ReadFile(inPath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read \"%s\"", inPath)
+	}
+	var defs []CompileDbItem
+	if err := json.Unmarshal(b, &defs); err != nil {
+		return nil, errors.Wrapf(err, "malformed compilation database \"%s\"", inPath)
+	}
+	return defs, nil
+}
+
+// FormatCompileDb converts the commands of `defs` into the `format` ("arguments" or "command", "" for "arguments").
+// Entries having the command line only (ex. merged from other databases) are left as is for "arguments".
+func FormatCompileDb(defs []CompileDbItem, format string) ([]CompileDbItem, error) {
+	switch format {
+	case "", compileDbArguments:
+		return defs, nil
+	case compileDbCommand:
+		result := make([]CompileDbItem, 0, len(defs))
+		for _, d := range defs {
+			if d.Arguments != nil {
+				d.Command = commandShell.JoinArgs(d.Arguments)
+				d.Arguments = nil
+			}
+			result = append(result, d)
+		}
+		return result, nil
+	}
+	return nil, errors.Errorf("unknown compilation database format \"%s\" (%s or %s)", format, compileDbArguments, compileDbCommand)
+}
+
+// UniqueCompileDbItems removes entries for the same file (the first one is kept).
+func UniqueCompileDbItems(defs []CompileDbItem) []CompileDbItem {
+	result := make([]CompileDbItem, 0, len(defs))
+	seen := make(map[string]bool, len(defs))
+	for _, d := range defs {
+		file := filepath.ToSlash(d.File)
+		if !path.IsAbs(file) && !filepath.IsAbs(d.File) {
+			file = path.Join(filepath.ToSlash(d.Directory), file)
+		}
+		file = path.Clean(file)
+		if seen[file] {
+			continue
+		}
+		seen[file] = true
+		result = append(result, d)
+	}
+	return result
+}
+
+// groupCompileDbByProject groups `defs` by the project (entries without the project are omitted).
+func groupCompileDbByProject(defs []CompileDbItem) map[string][]CompileDbItem {
+	result := make(map[string][]CompileDbItem)
+	for _, d := range defs {
+		if len(d.project) == 0 {
+			continue
+		}
+		result[d.project] = append(result[d.project], d)
+	}
+	return result
+}
+
+// installCompileDb places the database `src` as `dst` by the `method` ("copy", "symlink" or "" for nothing).
+// Falls back to copying if symbolic links are not available (ex. Windows without the privilege).
+func installCompileDb(src string, dst string, method string) error {
+	switch method {
+	case "":
+		return nil
+	}
+	absSrc, _ := filepath.Abs(src)
+	absDst, _ := filepath.Abs(dst)
+	if absSrc == absDst {
+		return nil
+	}
+	switch method {
+	case "copy":
+	case "symlink":
+		target, err := filepath.Rel(filepath.Dir(dst), src)
+		if err != nil {
+			target, _ = filepath.Abs(src)
+		}
+		if current, err := os.Readlink(dst); err == nil && current == target {
+			return nil
+		}
+		if fi, err := os.Lstat(dst); err == nil && !fi.IsDir() {
+			if err := os.Remove(dst); err != nil {
+				return errors.Wrapf(err, "failed to remove \"%s\"", dst)
+			}
+		}
+		err = os.Symlink(target, dst)
+		if err == nil {
+			return nil
+		}
+		Warn("compile_commands.json: failed to create the symbolic link \"%s\" (copied instead): %v", dst, err)
+	default:
+		return errors.Errorf("unknown method \"%s\" to place the compilation database (copy or symlink)", method)
+	}
+	b, err := ioutil.ReadFile(src)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read \"%s\"", src)
+	}
+	if fi, err := os.Lstat(dst); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+		if err := os.Remove(dst); err != nil {
+			return errors.Wrapf(err, "failed to remove \"%s\"", dst)
+		}
+	}
+	_, err = updateFile(dst, b)
+	return err
+}
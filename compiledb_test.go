@@ -3,6 +3,9 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 
 	. "github.com/smartystreets/goconvey/convey"
@@ -74,3 +77,212 @@ func TestWriteCompileDb(t *testing.T) {
 		})
 	})
 }
+
+func TestOtherRuleArgs(t *testing.T) {
+	Convey("GIVEN: A custom rule", t, func() {
+		rule := OtherRule{Compiler: "compiler.c", Command: "$compiler $include $define $option -o $out $in"}
+		file := OtherRuleFile{
+			Rule:     "compile.c",
+			Compiler: "cc",
+			Infile:   "src/a.c",
+			Outfile:  "out/a.c.o",
+			Include:  []string{"-Iinclude"},
+			Option:   []string{"-c", "-MF", "out/a.c.d"},
+			Define:   []string{"-DFOO"},
+			Depend:   "out/a.c.d",
+		}
+		Convey("WHEN: Reconstructing the arguments", func() {
+			args, err := otherRuleArgs(rule, file)
+			Convey("THEN: Substitutions should be expanded", func() {
+				So(err, ShouldBeNil)
+				So(args, ShouldResemble, []string{"-Iinclude", "-DFOO", "-c", "-MF", "out/a.c.d", "-o", "out/a.c.o", "src/a.c"})
+			})
+		})
+		Convey("WHEN: The command refers the dependency file", func() {
+			rule.Command = "$compiler -MF$depf -o$out $in"
+			args, err := otherRuleArgs(rule, file)
+			Convey("THEN: Embedded variables should be expanded", func() {
+				So(err, ShouldBeNil)
+				So(args, ShouldResemble, []string{"-MFout/a.c.d", "-oout/a.c.o", "src/a.c"})
+			})
+		})
+	})
+}
+
+func TestCompileDbEntries(t *testing.T) {
+	dir := copySampleTree(t, nil)
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "common.hpp"), []byte("#pragma once\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	editSampleFile(t, dir, "make.yml", "- name: test\n  type: execute\n", "- name: test\n  type: execute\n  pch: common.hpp\n")
+	read := func() map[string]CompileDbItem {
+		b, err := ioutil.ReadFile(filepath.Join(dir, "build", "LINUX", "Debug", "compile_commands.json"))
+		So(err, ShouldBeNil)
+		var items []CompileDbItem
+		So(json.Unmarshal(b, &items), ShouldBeNil)
+		result := make(map[string]CompileDbItem)
+		for _, item := range items {
+			result[filepath.Base(item.File)] = item
+		}
+		return result
+	}
+	Convey("GIVEN: Sources built with the custom rule and the PCH", t, func() {
+		So(generateSample(dir, "build.ninja", (&ninjaGenerator{}).Emit), ShouldBeNil)
+		items := read()
+		Convey("THEN: Sources of the custom rule should be listed with the real arguments", func() {
+			item, ok := items["hello.c"]
+			So(ok, ShouldBeTrue)
+			So(item.Arguments[0], ShouldEqual, "/opt/clang/bin/clang")
+			So(item.Arguments, ShouldContain, "-Iinclude")
+			So(item.Arguments, ShouldContain, "-DDEBUG")
+			So(item.Arguments[len(item.Arguments)-3:], ShouldResemble, []string{"-o", item.Output, filepath.ToSlash(filepath.Join(dir, "build/LINUX/Debug/hello.c"))})
+		})
+		Convey("THEN: The PCH generation should be listed", func() {
+			item, ok := items["common.hpp"]
+			So(ok, ShouldBeTrue)
+			So(item.Arguments, ShouldContain, "c++-header")
+			So(item.Arguments[len(item.Arguments)-1], ShouldEqual, item.File)
+		})
+		Convey("WHEN: Generated sources are excluded", func() {
+			So(generateSample(dir, "build.ninja", func(g *BuildGraph) error {
+				option.compdbNoGenerated = true
+				return (&ninjaGenerator{}).Emit(g)
+			}), ShouldBeNil)
+			items := read()
+			Convey("THEN: Generated sources should not be listed", func() {
+				So(items, ShouldNotContainKey, "hello.c")
+				So(items, ShouldContainKey, "test.cpp")
+			})
+		})
+	})
+}
+
+func TestFormatCompileDb(t *testing.T) {
+	Convey("GIVEN: Definitions", t, func() {
+		src := []CompileDbItem{
+			{File: "a.c", Directory: "/work", Output: "a.o", Arguments: []string{"cc", "-DNAME=\"a b\"", "-c", "a.c"}},
+			{File: "b.c", Directory: "/work", Output: "b.o", Command: "cc -c b.c"},
+		}
+		saved := commandShell
+		defer (func() { commandShell = saved })()
+		commandShell = PosixShell
+		Convey("WHEN: Formatting as commands", func() {
+			actual, err := FormatCompileDb(src, "command")
+			Convey("THEN: Arguments should be joined into the command line", func() {
+				So(err, ShouldBeNil)
+				So(actual[0].Arguments, ShouldBeNil)
+				So(actual[0].Command, ShouldEqual, `cc '-DNAME="a b"' -c a.c`)
+				So(actual[1].Command, ShouldEqual, "cc -c b.c")
+				So(src[0].Arguments, ShouldNotBeNil)
+				var buf bytes.Buffer
+				So(WriteCompileDb(&buf, actual), ShouldBeNil)
+				So(buf.String(), ShouldNotContainSubstring, `"arguments"`)
+			})
+		})
+		Convey("WHEN: Formatting as arguments", func() {
+			actual, err := FormatCompileDb(src, "arguments")
+			Convey("THEN: Definitions should be kept", func() {
+				So(err, ShouldBeNil)
+				So(actual, ShouldResemble, src)
+			})
+		})
+		Convey("WHEN: Formatting with an unknown format", func() {
+			_, err := FormatCompileDb(src, "argv")
+			Convey("THEN: It should be an error", func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+	})
+}
+
+func TestUniqueCompileDbItems(t *testing.T) {
+	Convey("GIVEN: Definitions from some databases", t, func() {
+		src := []CompileDbItem{
+			{File: "a.c", Directory: "/work", Output: "debug/a.o"},
+			{File: "/work/b.c", Directory: "/work", Output: "debug/b.o"},
+			{File: "./a.c", Directory: "/work/", Output: "release/a.o"},
+			{File: "b.c", Directory: "/work", Output: "release/b.o"},
+			{File: "a.c", Directory: "/work/sub", Output: "release/sub/a.o"},
+		}
+		Convey("THEN: The first entry for a file should be kept", func() {
+			actual := UniqueCompileDbItems(src)
+			So(actual, ShouldResemble, []CompileDbItem{src[0], src[1], src[4]})
+		})
+	})
+}
+
+func TestCompileDbOutputs(t *testing.T) {
+	dir := copySampleTree(t, nil)
+	defer os.RemoveAll(dir)
+	other := []CompileDbItem{
+		{File: "test.cpp", Directory: dir, Output: "release/test.o", Arguments: []string{"cc", "-O2", "test.cpp"}},
+		{File: "win.cpp", Directory: dir, Output: "win/win.o", Command: "cl -c win.cpp"},
+	}
+	if err := CreateCompileDbFile(filepath.Join(dir, "other.json"), other, ""); err != nil {
+		t.Fatal(err)
+	}
+	generate := func(setup func()) {
+		So(generateSample(dir, "build.ninja", func(g *BuildGraph) error {
+			setup()
+			return (&ninjaGenerator{}).Emit(g)
+		}), ShouldBeNil)
+	}
+	Convey("GIVEN: The sample tree", t, func() {
+		Convey("WHEN: Writing per project databases", func() {
+			generate(func() { option.compdbPerProject = true })
+			Convey("THEN: Entries should be grouped by the project", func() {
+				items, err := ReadCompileDbFile(filepath.Join(dir, "build/LINUX/Debug/compdb/test/compile_commands.json"))
+				So(err, ShouldBeNil)
+				var files []string
+				for _, item := range items {
+					files = append(files, filepath.Base(item.File))
+				}
+				So(files, ShouldContain, "test.cpp")
+				So(files, ShouldNotContain, "data.cpp")
+				So(Exists(filepath.Join(dir, "build/LINUX/Debug/compdb/data/compile_commands.json")), ShouldBeTrue)
+			})
+		})
+		Convey("WHEN: Merging databases into the one in the current directory", func() {
+			generate(func() {
+				option.compdbMerge = "other.json, missing.json"
+				option.compdbRoot = "copy"
+				option.compdbFormat = "command"
+			})
+			Convey("THEN: Entries should be merged without duplicates", func() {
+				items, err := ReadCompileDbFile(filepath.Join(dir, "compile_commands.json"))
+				So(err, ShouldBeNil)
+				outputs := make(map[string]string)
+				for _, item := range items {
+					So(item.Arguments, ShouldBeNil)
+					outputs[filepath.Base(item.File)] = item.Output
+				}
+				So(outputs["test.cpp"], ShouldEqual, "build/LINUX/Debug/CBuild.dir_test/test.cpp.o")
+				So(outputs["win.cpp"], ShouldEqual, "win/win.o")
+				fi, err := os.Lstat(filepath.Join(dir, "compile_commands.json"))
+				So(err, ShouldBeNil)
+				So(fi.Mode()&os.ModeSymlink, ShouldEqual, 0)
+			})
+		})
+		Convey("WHEN: Linking the database to the current directory", func() {
+			generate(func() { option.compdbRoot = "symlink" })
+			Convey("THEN: The symbolic link should refer the database", func() {
+				target, err := os.Readlink(filepath.Join(dir, "compile_commands.json"))
+				So(err, ShouldBeNil)
+				So(filepath.ToSlash(target), ShouldEqual, "build/LINUX/Debug/compile_commands.json")
+				items, err := ReadCompileDbFile(filepath.Join(dir, "compile_commands.json"))
+				So(err, ShouldBeNil)
+				So(items, ShouldNotBeEmpty)
+			})
+		})
+		Convey("WHEN: Specifying an unknown format", func() {
+			err := generateSample(dir, "build.ninja", func(g *BuildGraph) error {
+				option.compdbFormat = "argv"
+				return (&ninjaGenerator{}).Emit(g)
+			})
+			Convey("THEN: It should be an error", func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+	})
+}
@@ -3,8 +3,35 @@ package main
 import (
 	"os"
 	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
 )
 
+// LauncherSetting is the compiler launcher specified by `compiler_launcher:`.
+type LauncherSetting struct {
+	Command string // Launcher (ex. ccache, sccache, distcc...)
+	Args    string // Arguments in ninja syntax (`$project`, `$out` and `$in` are available)
+	Link    bool   // Also applied to archiving and linking
+}
+
+// newLauncherSetting interpolates `l` in the context of `info`.
+func newLauncherSetting(info *BuildInfo, l *Launcher) (*LauncherSetting, error) {
+	if len(l.Command) == 0 {
+		return nil, errors.New("`command:` is required")
+	}
+	cmd, err := info.StrictInterpolate(l.Command)
+	if err != nil {
+		return nil, err
+	}
+	args, err := info.StrictInterpolate(l.Args)
+	if err != nil {
+		return nil, err
+	}
+	return &LauncherSetting{Command: cmd, Args: args, Link: l.Link}, nil
+}
+
 // FindCompilerLanuncher probes compiler launcher if exists.
 // Currently only probes SN-DBS launcher.
 func FindCompilerLauncher() string {
@@ -17,3 +44,82 @@ func FindCompilerLauncher() string {
 	}
 	return ""
 }
+
+// linkLauncher returns the launcher applied to archiving and linking (`nil` if none).
+func (info *BuildInfo) linkLauncher() *LauncherSetting {
+	if info.launcher == nil || !info.launcher.Link {
+		return nil
+	}
+	return info.launcher
+}
+
+// expand returns the launcher (in ninja syntax) for the command producing `out` from `in`.
+// `$project`, `$out` and `$in` are substituted here since the bindings on the build statements
+// are evaluated before ninja binds them.
+func (l *LauncherSetting) expand(project string, out string, in []string) string {
+	quote := func(paths ...string) string {
+		quoted := make([]string, 0, len(paths))
+		for _, p := range paths {
+			quoted = append(quoted, commandShell.QuoteArg(p))
+		}
+		return EscapeNinjaValue(strings.Join(quoted, " "))
+	}
+	result := EscapeNinjaValue(commandShell.QuoteArg(l.Command))
+	if 0 < len(l.Args) {
+		result += " " + rxLauncherVariable.ReplaceAllStringFunc(l.Args, func(v string) string {
+			switch strings.Trim(v, "${}") {
+			case "project":
+				return EscapeNinjaValue(project)
+			case "out":
+				return quote(out)
+			default:
+				return quote(in...)
+			}
+		})
+	}
+	return result
+}
+
+// rxLauncherVariable matches the variables available in the launcher arguments.
+var rxLauncherVariable = regexp.MustCompile(`\$(?:project|out|in)\b|\$\{(?:project|out|in)\}`)
+
+// LauncherCommand returns the launcher (in ninja syntax) prepended to the command ("" if not launched).
+func (c *BuildCommand) LauncherCommand() string {
+	if c.Launcher == nil {
+		return ""
+	}
+	return c.Launcher.expand(c.Project, c.OutFile, c.InFiles)
+}
+
+// LauncherCommand returns the launcher (in ninja syntax) prepended to the command ("" if not launched).
+func (f OtherRuleFile) LauncherCommand() string {
+	if f.Launcher == nil {
+		return ""
+	}
+	return f.Launcher.expand(f.Project, f.Outfile, []string{f.Infile})
+}
+
+// selectCompilerLaunchers returns the commands (in ninja syntax) prepended to the compile commands
+// (`compile`, `gen_pch` and custom rules) and to the archive/link commands.
+// The compilation cache (`-compile-cache`) and the distributed compilation (`-dist-compile`)
+// take precedence over `compiler_launcher:` (and `-use-compiler-launcher`).
+// Otherwise `$launcher` bound per command (`LauncherCommand`) is used if any commands are launched.
+func selectCompilerLaunchers(graph *BuildGraph) (compile string, link string) {
+	switch {
+	case option.useCompileCache:
+		return EscapeNinjaValue(commandShell.QuoteArg(filepath.ToSlash(ProgramPath))) + " cache-exec", ""
+	case option.useDistCompile:
+		return EscapeNinjaValue(commandShell.QuoteArg(filepath.ToSlash(ProgramPath))) + " dist-exec", ""
+	}
+	for _, c := range graph.Commands {
+		if c.Launcher != nil {
+			return "$launcher", "$launcher"
+		}
+	}
+	for _, f := range graph.OtherRuleFiles {
+		if f.Launcher != nil {
+			return "$launcher", "$launcher"
+		}
+	}
+	return "", ""
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestCompilerLauncher(t *testing.T) {
+	generateIn := func(yml string, launcher string, output func(*BuildGraph) error, outFile string) string {
+		dir := copySampleTree(t, func(rel string, b []byte) []byte {
+			if rel != yml {
+				return b
+			}
+			return append(b, []byte(launcher)...)
+		})
+		defer os.RemoveAll(dir)
+		So(generateSample(dir, outFile, output), ShouldBeNil)
+		b, err := ioutil.ReadFile(filepath.Join(dir, outFile))
+		So(err, ShouldBeNil)
+		return string(b)
+	}
+	generate := func(launcher string, output func(*BuildGraph) error, outFile string) string {
+		return generateIn("make.yml", launcher, output, outFile)
+	}
+	rule := func(s string, name string) string {
+		m := regexp.MustCompile(`(?m)^rule ` + regexp.QuoteMeta(name) + `\n(?:    .*\n)*`).FindString(s)
+		So(m, ShouldNotBeEmpty)
+		return m
+	}
+	build := func(s string, out string) string {
+		m := regexp.MustCompile(`(?m)^build ` + regexp.QuoteMeta(out) + ` : .*\n(?:    .*\n)*`).FindString(s)
+		So(m, ShouldNotBeEmpty)
+		return m
+	}
+	Convey("GIVEN: `compiler_launcher:` in make.yml", t, func() {
+		Convey("WHEN: Generating ninja", func() {
+			ninja := generate(`
+compiler_launcher:
+- command: dbsbuild
+  type: WIN32
+- command: ${tool_path}ccache
+  args: --project $project
+`, outputNinja, "build.ninja")
+			Convey("THEN: The launcher should be applied to the compile commands", func() {
+				So(rule(ninja, "compile"), ShouldContainSubstring, `command = $launcher $compile $options`)
+				So(rule(ninja, "compile.c"), ShouldContainSubstring, "command = $launcher $compiler $include")
+			})
+			Convey("THEN: The matched launcher should be bound per command", func() {
+				So(build(ninja, "build/LINUX/Debug/CBuild.dir_test/test.cpp.o"), ShouldContainSubstring, "    launcher = /opt/clang/bin/ccache --project test\n")
+				So(build(ninja, "build/LINUX/Debug/CBuild.dir_test/hello.c.o"), ShouldContainSubstring, "    launcher = /opt/clang/bin/ccache --project test\n")
+				So(build(ninja, "build/LINUX/Debug/data/CBuild.dir/data.cpp.o"), ShouldContainSubstring, "    launcher = /opt/clang/bin/ccache --project data\n")
+			})
+			Convey("THEN: Archiving and linking should not be launched", func() {
+				So(build(ninja, "build/LINUX/Debug/data/libdata.a"), ShouldNotContainSubstring, "launcher")
+				So(ninja, ShouldNotContainSubstring, "dbsbuild")
+			})
+		})
+		Convey("WHEN: The launcher is also applied to linking", func() {
+			ninja := generate(`
+compiler_launcher:
+- {command: wrap, args: -o $out, link: true}
+`, outputNinja, "build.ninja")
+			Convey("THEN: Archive and link commands should be launched", func() {
+				So(rule(ninja, "ar"), ShouldContainSubstring, `command = $launcher $ar $options`)
+				So(rule(ninja, "link"), ShouldContainSubstring, "command = $launcher $link")
+				So(build(ninja, "build/LINUX/Debug/data/libdata.a"), ShouldContainSubstring, "    launcher = wrap -o build/LINUX/Debug/data/libdata.a\n")
+			})
+		})
+		Convey("WHEN: The launcher is specified in the sub-directory", func() {
+			ninja := generateIn("data/make.yml", `
+compiler_launcher:
+- {command: ccache}
+`, outputNinja, "build.ninja")
+			Convey("THEN: It should be applied only to the commands in the sub-directory", func() {
+				So(build(ninja, "build/LINUX/Debug/data/CBuild.dir/data.cpp.o"), ShouldContainSubstring, "    launcher = ccache\n")
+				So(build(ninja, "build/LINUX/Debug/CBuild.dir_test/test.cpp.o"), ShouldNotContainSubstring, "launcher")
+			})
+		})
+		Convey("WHEN: The compilation cache is used", func() {
+			saved := option.useCompileCache
+			option.useCompileCache = true
+			defer (func() { option.useCompileCache = saved })()
+			ninja := generate(`
+compiler_launcher:
+- {command: ccache}
+`, outputNinja, "build.ninja")
+			Convey("THEN: The launcher should be ignored", func() {
+				So(rule(ninja, "compile"), ShouldContainSubstring, `cache-exec $compile $options`)
+				So(ninja, ShouldNotContainSubstring, "launcher")
+			})
+		})
+		Convey("WHEN: Generating Makefile", func() {
+			makefile := generate(`
+compiler_launcher:
+- command: ccache
+  args: --project $project
+`, (&makeGenerator{makefile: "Makefile"}).Emit, "Makefile")
+			Convey("THEN: The launcher should be converted to make syntax", func() {
+				So(makefile, ShouldContainSubstring, `cmd_compile = $(launcher) $(compile) $(options)`)
+				So(makefile, ShouldContainSubstring, "cmd_compile.c = $(launcher) $(compiler) $(include)")
+				So(makefile, ShouldContainSubstring, "build/LINUX/Debug/CBuild.dir_test/test.cpp.o: private launcher = ccache --project test\n")
+				So(makefile, ShouldContainSubstring, "build/LINUX/Debug/test.elf: private project")
+				So(makefile, ShouldNotContainSubstring, "build/LINUX/Debug/test.elf: private launcher")
+			})
+		})
+		Convey("WHEN: `command:` is missing", func() {
+			dir := copySampleTree(t, func(rel string, b []byte) []byte {
+				if rel != "make.yml" {
+					return b
+				}
+				return append(b, []byte("\ncompiler_launcher:\n- args: -v\n")...)
+			})
+			defer os.RemoveAll(dir)
+			err := generateSample(dir, "build.ninja", outputNinja)
+			Convey("THEN: It should be an error", func() {
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldContainSubstring, "compiler_launcher")
+			})
+		})
+	})
+}
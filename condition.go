@@ -0,0 +1,466 @@
+// Conditional expressions used by `when:` entries.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+/*
+ * expr    : and ('||' and)*
+ *         ;
+ * and     : unary ('&&' unary)*
+ *         ;
+ * unary   : '!' unary
+ *         | '(' expr ')'
+ *         | compare
+ *         ;
+ * compare : operand (('==' | '!=') operand
+ *                   | ('in' | 'not' 'in') '[' operand (',' operand)* ']')?
+ *         ;
+ * operand : <word> | <quoted string>
+ *         ;
+ *
+ * Words `target`, `platform` (or `type`), `variant` and `env.<NAME>` are references,
+ * other words are treated as literals on the right-hand side (ex. `platform == LINUX`).
+ * The left-hand side should be a reference or a quoted string (typos like `platfrom` are errors).
+ */
+
+// ConditionError holds the error information occurs while parsing a `when:` expression.
+type ConditionError struct {
+	// Expr holds the whole expression.
+	Expr string
+	// Pos holds the (0 origin) byte offset where the error is detected.
+	Pos int
+	// Message describes the error.
+	Message string
+}
+
+func (e *ConditionError) Error() string {
+	return fmt.Sprintf("%s at column %d in \"%s\"", e.Message, e.Pos+1, e.Expr)
+}
+
+// ConditionContext holds values referenced from conditional expressions.
+type ConditionContext struct {
+	Target   string
+	Platform string
+	Variant  string
+	// Environment holds the variables imported in the directory (and its ancestors).
+	Environment map[string]ImportedEnvironment
+}
+
+// Condition is a parsed `when:` expression.
+type Condition struct {
+	source string
+	root   condNode
+	env    []string // Names referenced as `env.NAME`
+}
+
+// ParseCondition parses supplied expression `s`.
+func ParseCondition(s string) (*Condition, error) {
+	p := condParser{src: s}
+	if err := p.tokenize(); err != nil {
+		return nil, err
+	}
+	root, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != tokEOF {
+		return nil, p.errorAt(tok, fmt.Sprintf("unexpected \"%s\"", tok.text))
+	}
+	return &Condition{source: s, root: root, env: p.env}, nil
+}
+
+// String returns the source expression.
+func (c *Condition) String() string {
+	if c == nil {
+		return ""
+	}
+	return c.source
+}
+
+// EnvironmentReferences returns the names of environment variables referenced by the condition.
+func (c *Condition) EnvironmentReferences() []string {
+	if c == nil {
+		return nil
+	}
+	return c.env
+}
+
+// Evaluate evaluates the condition under `ctx`.
+// A `nil` condition always holds.
+func (c *Condition) Evaluate(ctx ConditionContext) bool {
+	if c == nil || c.root == nil {
+		return true
+	}
+	return c.root.eval(&ctx)
+}
+
+// Equals checks c == other.
+func (c *Condition) Equals(other *Condition) bool {
+	return c.String() == other.String()
+}
+
+// UnmarshalYAML is called while unmarshaling Condition.
+func (c *Condition) UnmarshalYAML(unmarshaler func(interface{}) error) error {
+	var src string
+	if err := unmarshaler(&src); err != nil {
+		return err
+	}
+	cond, err := ParseCondition(src)
+	if err != nil {
+		return err
+	}
+	*c = *cond
+	return nil
+}
+
+// MarshalYAML is called while marshaling Condition.
+func (c *Condition) MarshalYAML() (interface{}, error) {
+	return c.String(), nil
+}
+
+// lookupEnv retrieves the environment variable referenced by `env.NAME`.
+// Only the variables imported via `environment:` are visible (defaults and path normalization are applied),
+// references to the others are rejected before evaluating (see `checkConditionEnvironment`).
+func (ctx *ConditionContext) lookupEnv(name string) string {
+	return ctx.Environment[name].Value
+}
+
+type condNode interface {
+	eval(ctx *ConditionContext) bool
+}
+
+type condOperand interface {
+	value(ctx *ConditionContext) string
+}
+
+type condLiteral string
+
+func (l condLiteral) value(*ConditionContext) string { return string(l) }
+
+type condReference string
+
+func (r condReference) value(ctx *ConditionContext) string {
+	switch name := string(r); name {
+	case "target":
+		return ctx.Target
+	case "platform", "type":
+		return ctx.Platform
+	case "variant":
+		return ctx.Variant
+	default:
+		return ctx.lookupEnv(strings.TrimPrefix(name, "env."))
+	}
+}
+
+type condNot struct{ arg condNode }
+
+func (n *condNot) eval(ctx *ConditionContext) bool { return !n.arg.eval(ctx) }
+
+type condAnd struct{ lhs, rhs condNode }
+
+func (n *condAnd) eval(ctx *ConditionContext) bool { return n.lhs.eval(ctx) && n.rhs.eval(ctx) }
+
+type condOr struct{ lhs, rhs condNode }
+
+func (n *condOr) eval(ctx *ConditionContext) bool { return n.lhs.eval(ctx) || n.rhs.eval(ctx) }
+
+type condEqual struct {
+	lhs, rhs condOperand
+	negate   bool
+}
+
+func (n *condEqual) eval(ctx *ConditionContext) bool {
+	return (n.lhs.value(ctx) == n.rhs.value(ctx)) != n.negate
+}
+
+type condIn struct {
+	lhs    condOperand
+	set    []condOperand
+	negate bool
+}
+
+func (n *condIn) eval(ctx *ConditionContext) bool {
+	v := n.lhs.value(ctx)
+	for _, s := range n.set {
+		if s.value(ctx) == v {
+			return !n.negate
+		}
+	}
+	return n.negate
+}
+
+// condTruthy holds when the operand is non-empty and not falsy (ex. `env.CI`).
+type condTruthy struct{ arg condOperand }
+
+func (n *condTruthy) eval(ctx *ConditionContext) bool {
+	v := n.arg.value(ctx)
+	return 0 < len(v) && !rxFalsy.MatchString(v)
+}
+
+type condTokenKind int
+
+const (
+	tokEOF condTokenKind = iota
+	tokWord
+	tokString
+	tokLParen
+	tokRParen
+	tokLBracket
+	tokRBracket
+	tokComma
+	tokNot
+	tokAnd
+	tokOr
+	tokEqual
+	tokNotEqual
+)
+
+type condToken struct {
+	kind condTokenKind
+	text string
+	pos  int
+}
+
+type condParser struct {
+	src    string
+	tokens []condToken
+	index  int
+	env    []string
+}
+
+func (p *condParser) errorAt(tok condToken, msg string) *ConditionError {
+	return &ConditionError{Expr: p.src, Pos: tok.pos, Message: msg}
+}
+
+func (p *condParser) tokenize() error {
+	s := p.src
+	for i := 0; i < len(s); {
+		ch := s[i]
+		switch {
+		case ch == ' ' || ch == '\t' || ch == '\n' || ch == '\r':
+			i++
+		case ch == '(':
+			p.tokens = append(p.tokens, condToken{tokLParen, "(", i})
+			i++
+		case ch == ')':
+			p.tokens = append(p.tokens, condToken{tokRParen, ")", i})
+			i++
+		case ch == '[':
+			p.tokens = append(p.tokens, condToken{tokLBracket, "[", i})
+			i++
+		case ch == ']':
+			p.tokens = append(p.tokens, condToken{tokRBracket, "]", i})
+			i++
+		case ch == ',':
+			p.tokens = append(p.tokens, condToken{tokComma, ",", i})
+			i++
+		case strings.HasPrefix(s[i:], "&&"):
+			p.tokens = append(p.tokens, condToken{tokAnd, "&&", i})
+			i += 2
+		case strings.HasPrefix(s[i:], "||"):
+			p.tokens = append(p.tokens, condToken{tokOr, "||", i})
+			i += 2
+		case strings.HasPrefix(s[i:], "=="):
+			p.tokens = append(p.tokens, condToken{tokEqual, "==", i})
+			i += 2
+		case strings.HasPrefix(s[i:], "!="):
+			p.tokens = append(p.tokens, condToken{tokNotEqual, "!=", i})
+			i += 2
+		case ch == '!':
+			p.tokens = append(p.tokens, condToken{tokNot, "!", i})
+			i++
+		case ch == '"' || ch == '\'':
+			end := strings.IndexByte(s[i+1:], ch)
+			if end < 0 {
+				return &ConditionError{Expr: s, Pos: i, Message: "unterminated string"}
+			}
+			p.tokens = append(p.tokens, condToken{tokString, s[i+1 : i+1+end], i})
+			i += end + 2
+		case ch == '&' || ch == '|' || ch == '=':
+			return &ConditionError{Expr: s, Pos: i, Message: fmt.Sprintf("unexpected '%c'", ch)}
+		default:
+			start := i
+			for i < len(s) && isConditionWordChar(rune(s[i])) {
+				i++
+			}
+			if start == i {
+				return &ConditionError{Expr: s, Pos: i, Message: fmt.Sprintf("unexpected '%c'", ch)}
+			}
+			p.tokens = append(p.tokens, condToken{tokWord, s[start:i], start})
+		}
+	}
+	p.tokens = append(p.tokens, condToken{tokEOF, "end of expression", len(s)})
+	return nil
+}
+
+func isConditionWordChar(ch rune) bool {
+	if unicode.IsSpace(ch) {
+		return false
+	}
+	return !strings.ContainsRune("()[],!&|=\"'", ch)
+}
+
+func (p *condParser) peek() condToken {
+	return p.tokens[p.index]
+}
+
+func (p *condParser) next() condToken {
+	tok := p.tokens[p.index]
+	if tok.kind != tokEOF {
+		p.index++
+	}
+	return tok
+}
+
+func (p *condParser) expect(kind condTokenKind, what string) (condToken, error) {
+	tok := p.next()
+	if tok.kind != kind {
+		return tok, p.errorAt(tok, fmt.Sprintf("expected %s but found \"%s\"", what, tok.text))
+	}
+	return tok, nil
+}
+
+func (p *condParser) parseExpr() (condNode, error) {
+	lhs, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().kind == tokOr {
+		p.next()
+		rhs, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		lhs = &condOr{lhs, rhs}
+	}
+	return lhs, nil
+}
+
+func (p *condParser) parseAnd() (condNode, error) {
+	lhs, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().kind == tokAnd {
+		p.next()
+		rhs, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		lhs = &condAnd{lhs, rhs}
+	}
+	return lhs, nil
+}
+
+func (p *condParser) parseUnary() (condNode, error) {
+	switch p.peek().kind {
+	case tokNot:
+		p.next()
+		arg, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &condNot{arg}, nil
+	case tokLParen:
+		p.next()
+		e, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := p.expect(tokRParen, "')'"); err != nil {
+			return nil, err
+		}
+		return e, nil
+	default:
+		return p.parseCompare()
+	}
+}
+
+func (p *condParser) parseCompare() (condNode, error) {
+	lhs, err := p.parseOperand(true)
+	if err != nil {
+		return nil, err
+	}
+	tok := p.peek()
+	switch {
+	case tok.kind == tokEqual, tok.kind == tokNotEqual:
+		p.next()
+		rhs, err := p.parseOperand(false)
+		if err != nil {
+			return nil, err
+		}
+		return &condEqual{lhs: lhs, rhs: rhs, negate: tok.kind == tokNotEqual}, nil
+	case tok.kind == tokWord && tok.text == "in":
+		p.next()
+		set, err := p.parseSet()
+		if err != nil {
+			return nil, err
+		}
+		return &condIn{lhs: lhs, set: set}, nil
+	case tok.kind == tokWord && tok.text == "not":
+		p.next()
+		if t := p.next(); t.kind != tokWord || t.text != "in" {
+			return nil, p.errorAt(t, fmt.Sprintf("expected \"in\" but found \"%s\"", t.text))
+		}
+		set, err := p.parseSet()
+		if err != nil {
+			return nil, err
+		}
+		return &condIn{lhs: lhs, set: set, negate: true}, nil
+	default:
+		return &condTruthy{lhs}, nil
+	}
+}
+
+func (p *condParser) parseSet() ([]condOperand, error) {
+	if _, err := p.expect(tokLBracket, "'['"); err != nil {
+		return nil, err
+	}
+	result := make([]condOperand, 0)
+	for {
+		v, err := p.parseOperand(false)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, v)
+		tok := p.next()
+		switch tok.kind {
+		case tokComma:
+			continue
+		case tokRBracket:
+			return result, nil
+		default:
+			return nil, p.errorAt(tok, fmt.Sprintf("expected ',' or ']' but found \"%s\"", tok.text))
+		}
+	}
+}
+
+// parseOperand parses an operand. Unknown words are rejected for the left-hand side (`lhs`).
+func (p *condParser) parseOperand(lhs bool) (condOperand, error) {
+	tok := p.next()
+	switch tok.kind {
+	case tokString:
+		return condLiteral(tok.text), nil
+	case tokWord:
+		switch {
+		case tok.text == "target", tok.text == "platform", tok.text == "type", tok.text == "variant":
+			return condReference(tok.text), nil
+		case strings.HasPrefix(tok.text, "env."):
+			if len(tok.text) == len("env.") {
+				return nil, p.errorAt(tok, "missing environment variable name")
+			}
+			p.env = append(p.env, strings.TrimPrefix(tok.text, "env."))
+			return condReference(tok.text), nil
+		case lhs:
+			return nil, p.errorAt(tok, fmt.Sprintf("unknown reference \"%s\" (quote it if it is a literal)", tok.text))
+		}
+		return condLiteral(tok.text), nil
+	default:
+		return nil, p.errorAt(tok, fmt.Sprintf("expected an operand but found \"%s\"", tok.text))
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestParseCondition(t *testing.T) {
+	Convey("GIVEN: A context (target = foo, platform = LINUX, variant = debug)", t, func() {
+		ctx := ConditionContext{Target: "foo", Platform: "LINUX", Variant: "debug"}
+		type testCase struct {
+			input    string
+			expected bool
+		}
+		for _, tc := range []testCase{
+			{`platform == LINUX`, true},
+			{`type == LINUX`, true},
+			{`platform != LINUX`, false},
+			{`platform in [LINUX, winclang]`, true},
+			{`platform in [Mac, winclang]`, false},
+			{`platform not in [Mac, winclang]`, true},
+			{`variant != product && target == foo`, true},
+			{`variant == product || target == foo`, true},
+			{`!(variant == debug)`, false},
+			{`variant == "debug" && !(platform == 'WIN32')`, true},
+			{`variant == product || target == bar && platform == LINUX`, false},
+			{`(variant == product || target == foo) && platform == LINUX`, true},
+			{`variant in [develop-release, debug]`, true},
+			{`"LINUX" == platform`, true},
+		} {
+			Convey(fmt.Sprintf("WHEN: Parsing \"%s\"", tc.input), func() {
+				cond, err := ParseCondition(tc.input)
+				Convey(fmt.Sprintf("THEN: Should evaluate to %v", tc.expected), func() {
+					So(err, ShouldBeNil)
+					So(cond.Evaluate(ctx), ShouldEqual, tc.expected)
+					So(cond.String(), ShouldEqual, tc.input)
+				})
+			})
+		}
+		Convey("WHEN: Referencing imported environment variables", func() {
+			const key = "CBUILD_CONDITION_TEST"
+			os.Setenv(key, "0")
+			defer os.Unsetenv(key)
+			ctx.Environment = map[string]ImportedEnvironment{
+				key:                      {Name: key, Value: "1"},
+				"CBUILD_CONDITION_EMPTY": {Name: "CBUILD_CONDITION_EMPTY"},
+			}
+			cond, err := ParseCondition(`env.CBUILD_CONDITION_TEST == "1" && env.CBUILD_CONDITION_TEST && !env.CBUILD_CONDITION_EMPTY`)
+			Convey("THEN: Should evaluate to true with the imported values", func() {
+				So(err, ShouldBeNil)
+				So(cond.Evaluate(ctx), ShouldBeTrue)
+				So(cond.EnvironmentReferences(), ShouldResemble, []string{key, key, "CBUILD_CONDITION_EMPTY"})
+			})
+			Convey("THEN: References to the variables not imported should be rejected", func() {
+				other, err := ParseCondition(`env.CBUILD_CONDITION_OTHER || env.CBUILD_CONDITION_TEST`)
+				So(err, ShouldBeNil)
+				So(checkConditionEnvironment([]*Condition{cond}, ctx.Environment), ShouldBeNil)
+				err = checkConditionEnvironment([]*Condition{cond, other}, ctx.Environment)
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldContainSubstring, "CBUILD_CONDITION_OTHER")
+			})
+		})
+		Convey("WHEN: Evaluating `nil` condition", func() {
+			var cond *Condition
+			Convey("THEN: Should always hold", func() {
+				So(cond.Evaluate(ctx), ShouldBeTrue)
+			})
+		})
+	})
+}
+
+func TestParseConditionErrors(t *testing.T) {
+	Convey("GIVEN: Malformed expressions", t, func() {
+		type errTestCase struct {
+			input string
+			pos   int
+		}
+		for _, tc := range []errTestCase{
+			{`platform ==`, 11},
+			{`platform in LINUX`, 12},
+			{`platform in [LINUX winclang]`, 19},
+			{`(variant == debug`, 17},
+			{`variant = debug`, 8},
+			{`variant == "debug`, 11},
+			{`variant == debug debug`, 17},
+			{`env. == 1`, 0},
+			{`platform not [LINUX]`, 13},
+			{`platfrom == LINUX`, 0},
+			{`variant == debug && varaint != product`, 20},
+			{`LINUX in [platform]`, 0},
+			{`!debug`, 1},
+		} {
+			Convey(fmt.Sprintf("WHEN: Parsing \"%s\"", tc.input), func() {
+				_, err := ParseCondition(tc.input)
+				Convey(fmt.Sprintf("THEN: Should fail at %d", tc.pos), func() {
+					So(err, ShouldNotBeNil)
+					e, ok := err.(*ConditionError)
+					So(ok, ShouldBeTrue)
+					So(e.Pos, ShouldEqual, tc.pos)
+					So(e.Expr, ShouldEqual, tc.input)
+				})
+			})
+		}
+	})
+}
@@ -0,0 +1,525 @@
+// Distributed compilation (`cbuild worker` and `cbuild dist-exec`).
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/gob"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// distProtocolVersion is the version of the worker protocol.
+	distProtocolVersion = 1
+	// DefaultDistTimeout is the default timeout for connecting to the workers.
+	DefaultDistTimeout = 3 * time.Second
+	// distCompileTimeout limits the time for compiling on the workers.
+	distCompileTimeout = 10 * time.Minute
+)
+
+// The worker protocol consists of gob encoded messages over TCP:
+//
+//	client -> worker: distHello
+//	worker -> client: distCapabilities (the connection is closed if not authenticated)
+//	client -> worker: distRequest
+//	worker -> client: distResult
+//
+// Sources are preprocessed by the client (the depfile is also produced at that time),
+// so the workers only need the same compiler.
+
+// distHello starts the session.
+type distHello struct {
+	Version int
+	Token   string
+}
+
+// distCapabilities advertises the compilers (digests of the executables) available on the worker.
+type distCapabilities struct {
+	Compilers []string
+	Error     string
+}
+
+// distRequest is a compile request.
+type distRequest struct {
+	Compiler   string   // Digest of the compiler
+	Args       []string // Arguments excluding the inputs and the outputs
+	SourceName string   // Name of the preprocessed source (the extension selects the language)
+	Source     []byte
+}
+
+// distResult is the result of a request. `Error` is set if the worker failed to run the compiler.
+type distResult struct {
+	ExitCode int
+	Object   []byte
+	Stderr   []byte
+	Error    string
+}
+
+// DistWorker serves compile requests.
+type DistWorker struct {
+	Token     string
+	compilers map[string]string // Digest to the path of the compiler
+	slots     chan struct{}
+	served    int64
+}
+
+// NewDistWorker creates a worker which can run `compilers` (at most `jobs` in parallel).
+func NewDistWorker(token string, compilers []string, jobs int) (*DistWorker, error) {
+	if len(token) == 0 {
+		return nil, errors.New("authentication token is required (-token or CBUILD_DIST_TOKEN)")
+	}
+	if jobs < 1 {
+		jobs = runtime.NumCPU()
+	}
+	w := &DistWorker{Token: token, compilers: make(map[string]string), slots: make(chan struct{}, jobs)}
+	for _, c := range compilers {
+		path, err := exec.LookPath(c)
+		if err != nil {
+			return nil, errors.Wrapf(err, "compiler \"%s\" is not found", c)
+		}
+		digest, err := compilerDigest(path)
+		if err != nil {
+			return nil, err
+		}
+		w.compilers[digest] = path
+	}
+	return w, nil
+}
+
+// Served returns the number of requests served.
+func (w *DistWorker) Served() int64 {
+	return atomic.LoadInt64(&w.served)
+}
+
+// Serve accepts the connections from `l`.
+func (w *DistWorker) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go (func() {
+			defer conn.Close()
+			if err := w.handle(conn); err != nil {
+				Verbose("%s: %v\n", ProgramName, err)
+			}
+		})()
+	}
+}
+
+// handle processes a session.
+func (w *DistWorker) handle(conn net.Conn) error {
+	conn.SetDeadline(time.Now().Add(DefaultDistTimeout))
+	enc := gob.NewEncoder(conn)
+	dec := gob.NewDecoder(conn)
+	var hello distHello
+	if err := dec.Decode(&hello); err != nil {
+		return errors.Wrap(err, "malformed hello")
+	}
+	switch {
+	case hello.Version != distProtocolVersion:
+		return enc.Encode(&distCapabilities{Error: fmt.Sprintf("unsupported protocol version %d", hello.Version)})
+	case subtle.ConstantTimeCompare([]byte(hello.Token), []byte(w.Token)) != 1:
+		return enc.Encode(&distCapabilities{Error: "authentication failed"})
+	}
+	caps := distCapabilities{}
+	for digest := range w.compilers {
+		caps.Compilers = append(caps.Compilers, digest)
+	}
+	if err := enc.Encode(&caps); err != nil {
+		return err
+	}
+	var req distRequest
+	if err := dec.Decode(&req); err != nil {
+		if err == io.EOF {
+			return nil // Not requested.
+		}
+		return errors.Wrap(err, "malformed request")
+	}
+	conn.SetDeadline(time.Now().Add(distCompileTimeout))
+	w.slots <- struct{}{}
+	result := w.compile(&req)
+	<-w.slots
+	atomic.AddInt64(&w.served, 1)
+	return enc.Encode(result)
+}
+
+// compile runs the compiler for `req` in a temporary directory.
+func (w *DistWorker) compile(req *distRequest) *distResult {
+	compiler, ok := w.compilers[req.Compiler]
+	if !ok {
+		return &distResult{Error: "unknown compiler"}
+	}
+	if err := checkDistArgs(req.Args); err != nil {
+		return &distResult{Error: err.Error()}
+	}
+	dir, err := ioutil.TempDir("", "cbuild-worker-")
+	if err != nil {
+		return &distResult{Error: err.Error()}
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, filepath.Base(req.SourceName))
+	if err := ioutil.WriteFile(src, req.Source, 0644); err != nil {
+		return &distResult{Error: err.Error()}
+	}
+	obj := filepath.Join(dir, "output.o")
+	args := append(append([]string{compiler}, req.Args...), "-c", "-o", obj, src)
+	var stderr bytes.Buffer
+	code, err := runCommand(args, ioutil.Discard, &stderr)
+	if err != nil {
+		return &distResult{Error: err.Error()}
+	}
+	result := &distResult{ExitCode: code, Stderr: stderr.Bytes()}
+	if code == 0 {
+		if result.Object, err = ioutil.ReadFile(obj); err != nil {
+			return &distResult{Error: err.Error()}
+		}
+	}
+	return result
+}
+
+// distAllowedFlags are the code generation and the warning options allowed on the workers.
+// Anything else (including the unknown ones) is compiled locally.
+var distAllowedFlags = map[string]bool{
+	"-w": true, "-pedantic": true, "-pedantic-errors": true, "-pipe": true, "-pthread": true,
+	"-g": true, "-g0": true, "-g1": true, "-g2": true, "-g3": true, "-ggdb": true,
+	"-gdwarf-4": true, "-gdwarf-5": true, "-gline-tables-only": true,
+	"-fPIC": true, "-fpic": true, "-fPIE": true, "-fpie": true, "-fno-pic": true, "-fno-pie": true,
+	"-fexceptions": true, "-fno-exceptions": true, "-frtti": true, "-fno-rtti": true,
+	"-fvisibility=default": true, "-fvisibility=hidden": true, "-fvisibility-inlines-hidden": true,
+	"-ffunction-sections": true, "-fdata-sections": true,
+	"-fomit-frame-pointer": true, "-fno-omit-frame-pointer": true,
+	"-fstack-protector": true, "-fstack-protector-strong": true, "-fstack-protector-all": true, "-fno-stack-protector": true,
+	"-fstrict-aliasing": true, "-fno-strict-aliasing": true, "-fno-common": true, "-fno-builtin": true,
+	"-ffast-math": true, "-fwrapv": true, "-fsigned-char": true, "-funsigned-char": true,
+	"-fno-plt": true, "-fcf-protection": true, "-fno-threadsafe-statics": true,
+	"-fcolor-diagnostics": true, "-fno-color-diagnostics": true,
+	"-fdiagnostics-color": true, "-fdiagnostics-color=always": true, "-fdiagnostics-color=never": true,
+	"-m32": true, "-m64": true, "-msse2": true, "-msse3": true, "-mssse3": true, "-msse4.1": true, "-msse4.2": true,
+	"-mavx": true, "-mavx2": true, "-mfma": true, "-mbmi": true, "-mbmi2": true, "-mpopcnt": true, "-mlzcnt": true,
+	"-maes": true, "-mpclmul": true, "-mf16c": true,
+}
+
+// distAllowedPatterns are the options taking values allowed on the workers.
+// Values are restricted to the ones never naming files (ex. `-Wa,...` is not matched).
+var distAllowedPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`^-O([0-3sz]|g|fast)?$`),
+	regexp.MustCompile(`^-W(no-)?[a-z][a-z0-9+-]*(=[a-z0-9+-]+)?$`),
+	regexp.MustCompile(`^-std=[a-z0-9+]+$`),
+	regexp.MustCompile(`^-m(arch|tune|cpu)=[a-zA-Z0-9._+-]+$`),
+	regexp.MustCompile(`^-f(no-)?sanitize=[a-z,-]+$`),
+}
+
+// checkDistArgs accepts only the code generation and the warning options,
+// so that the arguments never read or write arbitrary files (or run programs) on the worker.
+func checkDistArgs(args []string) error {
+	for _, a := range args {
+		if !distAllowedArg(a) {
+			return errors.Errorf("argument \"%s\" is not allowed", a)
+		}
+	}
+	return nil
+}
+
+// distAllowedArg checks the argument `a` can be passed to the compiler on the worker.
+func distAllowedArg(a string) bool {
+	if distAllowedFlags[a] {
+		return true
+	}
+	for _, re := range distAllowedPatterns {
+		if re.MatchString(a) {
+			return true
+		}
+	}
+	return false
+}
+
+// DistClient sends compile requests to the workers.
+type DistClient struct {
+	Workers []string // `host:port` of the workers
+	Token   string
+	Timeout time.Duration // Timeout for connecting to the workers
+}
+
+// OpenDistClient creates a client from `$CBUILD_DIST_WORKERS` (comma separated `host:port`),
+// `$CBUILD_DIST_TOKEN` and `$CBUILD_DIST_TIMEOUT`.
+func OpenDistClient() (*DistClient, error) {
+	c := &DistClient{Token: os.Getenv("CBUILD_DIST_TOKEN"), Timeout: DefaultDistTimeout}
+	for _, w := range strings.Split(os.Getenv("CBUILD_DIST_WORKERS"), ",") {
+		if w = strings.TrimSpace(w); 0 < len(w) {
+			c.Workers = append(c.Workers, w)
+		}
+	}
+	if s := os.Getenv("CBUILD_DIST_TIMEOUT"); 0 < len(s) {
+		var err error
+		if c.Timeout, err = time.ParseDuration(s); err != nil {
+			return nil, errors.Wrap(err, "malformed CBUILD_DIST_TIMEOUT")
+		}
+	}
+	return c, nil
+}
+
+// Exec compiles `args` on a worker (or locally if not possible). Returns the exit code of the compiler.
+func (c *DistClient) Exec(args []string, stdout io.Writer, stderr io.Writer) (int, error) {
+	inv, ok := parseCompileInvocation(args)
+	if !ok || len(inv.sources) != 1 || len(inv.inputs) != 0 || len(c.Workers) == 0 {
+		return runCommand(args, stdout, stderr)
+	}
+	req, err := inv.distRequest()
+	if err != nil {
+		Verbose("%s: Compiles locally (%v)\n", ProgramName, err)
+		return runCommand(args, stdout, stderr)
+	}
+	h := fnv.New32a()
+	h.Write([]byte(inv.output))
+	start := int(h.Sum32() % uint32(len(c.Workers)))
+	for i := range c.Workers {
+		worker := c.Workers[(start+i)%len(c.Workers)]
+		result, err := c.send(worker, req)
+		if err != nil {
+			Verbose("%s: %s: %v\n", ProgramName, worker, err)
+			continue
+		}
+		stderr.Write(result.Stderr)
+		if result.ExitCode == 0 {
+			if err := writeFileAtomically(inv.output, result.Object); err != nil {
+				return 1, errors.Wrapf(err, "failed to write \"%s\"", inv.output)
+			}
+		}
+		return result.ExitCode, nil
+	}
+	// No workers available.
+	return runCommand(args, stdout, stderr)
+}
+
+// send sends `req` to `worker`.
+func (c *DistClient) send(worker string, req *distRequest) (*distResult, error) {
+	conn, err := net.DialTimeout("tcp", worker, c.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(c.Timeout))
+	enc := gob.NewEncoder(conn)
+	dec := gob.NewDecoder(conn)
+	if err := enc.Encode(&distHello{Version: distProtocolVersion, Token: c.Token}); err != nil {
+		return nil, err
+	}
+	var caps distCapabilities
+	if err := dec.Decode(&caps); err != nil {
+		return nil, err
+	}
+	if 0 < len(caps.Error) {
+		return nil, errors.New(caps.Error)
+	}
+	if !containsString(caps.Compilers, req.Compiler) {
+		return nil, errors.New("the compiler is not available")
+	}
+	conn.SetDeadline(time.Now().Add(distCompileTimeout))
+	if err := enc.Encode(req); err != nil {
+		return nil, err
+	}
+	var result distResult
+	if err := dec.Decode(&result); err != nil {
+		return nil, err
+	}
+	if 0 < len(result.Error) {
+		return nil, errors.New(result.Error)
+	}
+	return &result, nil
+}
+
+// distRequest preprocesses the source (writing the depfile) and constructs the request.
+// Returns an error if the request would be rejected by the workers (should be compiled locally).
+func (inv *compileInvocation) distRequest() (*distRequest, error) {
+	compiler, err := exec.LookPath(inv.args[0])
+	if err != nil {
+		return nil, err
+	}
+	digest, err := compilerDigest(compiler)
+	if err != nil {
+		return nil, err
+	}
+	pp, remote := inv.splitDistArgs()
+	if err := checkDistArgs(remote); err != nil {
+		return nil, err // Rejected by the workers.
+	}
+	lang := inv.lang
+	if len(lang) == 0 {
+		lang = sourceLanguage(inv.sources[0])
+	}
+	ext, ok := distSourceSuffixes[lang]
+	if !ok {
+		return nil, errors.Errorf("language \"%s\" is not compiled on the workers", lang)
+	}
+	if 0 < len(inv.lang) {
+		pp = append(pp, "-x", inv.lang)
+	}
+	pp = append(append([]string{compiler}, pp...), "-E", inv.sources[0])
+	var source, stderr bytes.Buffer
+	cmd := exec.Command(pp[0], pp[1:]...)
+	cmd.Stdout = &source
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, errors.Wrapf(err, "failed to preprocess: %s", strings.TrimSpace(stderr.String()))
+	}
+	return &distRequest{
+		Compiler:   digest,
+		Args:       remote,
+		SourceName: "source" + ext,
+		Source:     source.Bytes(),
+	}, nil
+}
+
+// distSourceSuffixes maps the languages to the suffixes of the preprocessed sources
+// (the worker selects the language by the suffix).
+var distSourceSuffixes = map[string]string{
+	"c":                  ".i",
+	"c++":                ".ii",
+	"objective-c":        ".mi",
+	"objective-c++":      ".mii",
+	"assembler-with-cpp": ".s",
+}
+
+// splitDistArgs splits the arguments (except the compiler, the inputs and the outputs)
+// into the ones for preprocessing locally (writing the depfile) and the ones for compiling on the worker.
+func (inv *compileInvocation) splitDistArgs() (pp []string, remote []string) {
+	pp = make([]string, 0, len(inv.args)+3)
+	remote = make([]string, 0, len(inv.args))
+	hasTarget := false
+	for i := 1; i < len(inv.args); i++ {
+		a := inv.args[i]
+		switch {
+		case a == "-o" || a == "-x":
+			i++
+		case a == "-c":
+			/* NO-OP */
+		case a == "-MF" || a == "-MT" || a == "-MQ":
+			hasTarget = hasTarget || a != "-MF"
+			if i+1 < len(inv.args) {
+				pp = append(pp, a, inv.args[i+1])
+			}
+			i++
+		case strings.HasPrefix(a, "-M"):
+			pp = append(pp, a)
+		case separateValueOptions[a]:
+			if i+1 < len(inv.args) {
+				pp = append(pp, a, inv.args[i+1])
+				if !preprocessorValueOptions[a] {
+					remote = append(remote, a, inv.args[i+1])
+				}
+			}
+			i++
+		case strings.HasPrefix(a, "-I") || strings.HasPrefix(a, "-D") || strings.HasPrefix(a, "-U"):
+			pp = append(pp, a)
+		case a == inv.sources[0]:
+			/* NO-OP */
+		default:
+			pp = append(pp, a)
+			remote = append(remote, a)
+		}
+	}
+	if 0 < len(inv.depfile) && !hasTarget {
+		pp = append(pp, "-MT", inv.output)
+	}
+	return pp, remote
+}
+
+// preprocessorValueOptions are preprocessor options taking the value as the next argument
+// (not needed to compile the preprocessed source).
+var preprocessorValueOptions = map[string]bool{
+	"-include": true, "-imacros": true, "-I": true, "-D": true, "-U": true,
+	"-isystem": true, "-iquote": true, "-idirafter": true, "-isysroot": true, "-Xpreprocessor": true,
+}
+
+var compilerDigests sync.Map
+
+// compilerDigest computes the digest of the compiler executable.
+// Results are memoized in the temporary directory (keyed by the path, the size and the modification time).
+func compilerDigest(path string) (string, error) {
+	if d, ok := compilerDigests.Load(path); ok {
+		return d.(string), nil
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to obtain the information of \"%s\"", path)
+	}
+	memo := filepath.Join(os.TempDir(), fmt.Sprintf("cbuild-compiler-%s", digestOf([]byte(fmt.Sprintf("%s\x00%d\x00%d", path, fi.Size(), fi.ModTime().UnixNano())))[:32]))
+	if b, err := ioutil.ReadFile(memo); err == nil && len(b) == sha256.Size*2 {
+		compilerDigests.Store(path, string(b))
+		return string(b), nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to read \"%s\"", path)
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", errors.Wrapf(err, "failed to read \"%s\"", path)
+	}
+	digest := hex.EncodeToString(h.Sum(nil))
+	writeFileAtomically(memo, []byte(digest))
+	compilerDigests.Store(path, digest)
+	return digest, nil
+}
+
+// DistExecMain implements `cbuild dist-exec <compiler> <args>...`.
+func DistExecMain(args []string) int {
+	if 0 < len(args) && args[0] == "--" {
+		args = args[1:]
+	}
+	if len(args) == 0 {
+		fmt.Fprintf(os.Stderr, "Usage: %s dist-exec <compiler> <args>...\n", ProgramName)
+		return 1
+	}
+	client, err := OpenDistClient()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s:error: %v\n", ProgramName, err)
+		return 1
+	}
+	code, err := client.Exec(args, os.Stdout, os.Stderr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s:error: %v\n", ProgramName, err)
+	}
+	return code
+}
+
+// WorkerMain implements `cbuild worker`.
+func WorkerMain(args []string) int {
+	flags := flag.NewFlagSet(ProgramName+" worker", flag.ExitOnError)
+	listen := flags.String("listen", ":7373", "Address to listen")
+	token := flags.String("token", os.Getenv("CBUILD_DIST_TOKEN"), "Authentication token (default: $CBUILD_DIST_TOKEN)")
+	compilers := flags.String("compilers", "cc,c++", "Comma separated compilers to serve")
+	jobs := flags.Int("j", 0, "Number of parallel compilations (0: number of CPUs)")
+	flags.Parse(args)
+	w, err := NewDistWorker(*token, strings.Split(*compilers, ","), *jobs)
+	if err == nil {
+		var l net.Listener
+		if l, err = net.Listen("tcp", *listen); err == nil {
+			fmt.Fprintf(os.Stderr, "%s: Listening on %s\n", ProgramName, l.Addr())
+			err = w.Serve(l)
+		}
+	}
+	fmt.Fprintf(os.Stderr, "%s:error: %v\n", ProgramName, err)
+	return 1
+}
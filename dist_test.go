@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// startWorker starts a worker on localhost.
+func startWorker(t *testing.T, token string, compilers ...string) (*DistWorker, string, func()) {
+	w, err := NewDistWorker(token, compilers, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go w.Serve(l)
+	return w, l.Addr().String(), func() { l.Close() }
+}
+
+func TestDistRequest(t *testing.T) {
+	if _, err := exec.LookPath("cc"); err != nil {
+		t.Skip("no C compilers found")
+	}
+	dir, err := ioutil.TempDir("", "cbuild-dist-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "a.c")
+	dep := filepath.Join(dir, "a.d")
+	for name, content := range map[string]string{
+		"a.h": "#define VALUE X\n",
+		"a.c": "#include \"a.h\"\nint value() { return VALUE; }\n",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	Convey("GIVEN: A compile command", t, func() {
+		inv, ok := parseCompileInvocation([]string{
+			"cc", "-O2", "-I", dir, "-D", "X=42", "-c", "-MMD", "-MF", dep, "-o", "a.o", "-g", src})
+		So(ok, ShouldBeTrue)
+		So(inv.sources, ShouldResemble, []string{src})
+		Convey("WHEN: Constructing the request", func() {
+			req, err := inv.distRequest()
+			So(err, ShouldBeNil)
+			Convey("THEN: The source should be preprocessed", func() {
+				So(req.SourceName, ShouldEqual, "source.i")
+				So(string(req.Source), ShouldContainSubstring, "return 42;")
+				So(req.Args, ShouldResemble, []string{"-O2", "-g"})
+			})
+			Convey("THEN: The depfile should be written locally", func() {
+				b, err := ioutil.ReadFile(dep)
+				So(err, ShouldBeNil)
+				So(string(b), ShouldStartWith, "a.o:")
+				So(string(b), ShouldContainSubstring, "a.h")
+			})
+		})
+	})
+	Convey("GIVEN: Sources in other languages", t, func() {
+		for name, content := range map[string]string{
+			"b.S": "#include \"a.h\"\n\t.long VALUE\n",
+			"c.s": "\t.long 1\n",
+		} {
+			So(ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644), ShouldBeNil)
+		}
+		request := func(args ...string) (*distRequest, error) {
+			inv, ok := parseCompileInvocation(append([]string{"cc", "-I", dir, "-D", "X=42", "-c", "-o", "a.o"}, args...))
+			So(ok, ShouldBeTrue)
+			return inv.distRequest()
+		}
+		Convey("THEN: The preprocessed source should be named after the language", func() {
+			req, err := request(filepath.Join(dir, "b.S"))
+			So(err, ShouldBeNil)
+			So(req.SourceName, ShouldEqual, "source.s")
+			So(string(req.Source), ShouldContainSubstring, ".long 42")
+			req, err = request("-x", "c++", src)
+			So(err, ShouldBeNil)
+			So(req.SourceName, ShouldEqual, "source.ii")
+			So(distSourceSuffixes["objective-c"], ShouldEqual, ".mi")
+			So(distSourceSuffixes["objective-c++"], ShouldEqual, ".mii")
+		})
+		Convey("THEN: Sources not preprocessed should be compiled locally", func() {
+			_, err := request(filepath.Join(dir, "c.s"))
+			So(err, ShouldNotBeNil)
+		})
+	})
+	Convey("GIVEN: A compile command with arguments rejected by the workers", t, func() {
+		inv, ok := parseCompileInvocation([]string{"cc", "-Xclang", "-load", "-Xclang", "x.so", "-c", "-o", "a.o", src})
+		So(ok, ShouldBeTrue)
+		Convey("THEN: The request should not be constructed (compiled locally)", func() {
+			_, err := inv.distRequest()
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "-Xclang")
+		})
+	})
+	Convey("GIVEN: Arguments sent to a worker", t, func() {
+		Convey("THEN: Code generation and warning options should be allowed", func() {
+			So(checkDistArgs([]string{"-O2", "-g", "-march=native", "-Wall", "-Wno-unused", "-fPIC", "-std=c++17", "-pedantic"}), ShouldBeNil)
+			So(checkDistArgs([]string{"-Ofast", "-Werror=return-type", "-Wframe-larger-than=4096", "-std=gnu++20", "-fsanitize=address,undefined"}), ShouldBeNil)
+		})
+		Convey("THEN: Options not in the allowlist should be rejected", func() {
+			for _, a := range []string{
+				"-ftime-trace=/tmp/x", "-fproc-stat-report=/tmp/x", "-fcrash-diagnostics-dir=/tmp/x",
+				"-fmemory-profile=/tmp/x", "-fdiagnostics-format=sarif-file", "-fdiagnostics-format=json-file",
+				"-fsanitize-coverage-allowlist=/tmp/x", "-fbasic-block-sections=list=/tmp/x",
+				"-fprebuilt-module-path=/tmp/x", "-Wl,-Map=/tmp/x", "-O/tmp/x", "-std=/tmp/x", "-march=../x",
+			} {
+				So(checkDistArgs([]string{a}), ShouldNotBeNil)
+			}
+		})
+		Convey("THEN: Options reading or writing files should be rejected", func() {
+			for _, a := range []string{"-o", "@args.rsp", "-fplugin=x.so", "-B/tmp", "-MD", "-include", "-specs=x", "-save-temps"} {
+				So(checkDistArgs([]string{a}), ShouldNotBeNil)
+			}
+		})
+		Convey("THEN: Escapes via other options should be rejected", func() {
+			for _, args := range [][]string{
+				{"-Xclang", "-load", "-Xclang", "x.so"},
+				{"-wrapper", "sh,-c,id"},
+				{"-dumpdir", "/tmp/x"},
+				{"-fdump-tree-all"},
+				{"-aux-info", "/tmp/x"},
+				{"-fprofile-generate=/tmp/x"},
+				{"--sysroot=/"},
+				{"--sysroot", "/"},
+				{"-Wa,-adhln=/tmp/x"},
+				{"-Wp,-MD,/tmp/x"},
+				{"-fmodule-mapper=|sh"},
+				{"-fpass-plugin=x.so"},
+				{"-mllvm", "-pass-remarks-output=/tmp/x"},
+			} {
+				So(checkDistArgs(args), ShouldNotBeNil)
+			}
+		})
+	})
+}
+
+func TestDistCompile(t *testing.T) {
+	if _, err := exec.LookPath("cc"); err != nil {
+		t.Skip("no C compilers found")
+	}
+	if _, err := exec.LookPath("true"); err != nil {
+		t.Skip("\"true\" is not available")
+	}
+	dir, err := ioutil.TempDir("", "cbuild-dist-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	good, goodAddr, stop := startWorker(t, "secret", "cc")
+	defer stop()
+	other, otherAddr, stop := startWorker(t, "secret", "true")
+	defer stop()
+	locked, lockedAddr, stop := startWorker(t, "another", "cc")
+	defer stop()
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadAddr := dead.Addr().String()
+	dead.Close()
+
+	src := filepath.Join(dir, "a.c")
+	obj := filepath.Join(dir, "a.o")
+	dep := filepath.Join(dir, "a.d")
+	compile := func(c *DistClient) (int, string) {
+		var stderr bytes.Buffer
+		code, err := c.Exec([]string{"cc", "-c", "-MMD", "-MF", dep, "-o", obj, src}, ioutil.Discard, &stderr)
+		So(err, ShouldBeNil)
+		return code, stderr.String()
+	}
+	Convey("GIVEN: Workers on localhost", t, func() {
+		So(ioutil.WriteFile(src, []byte("int value() { return 1; }\n"), 0644), ShouldBeNil)
+		os.Remove(obj)
+		served := good.Served()
+		Convey("WHEN: Some of the workers are not available", func() {
+			c := &DistClient{Workers: []string{deadAddr, otherAddr, goodAddr}, Token: "secret", Timeout: time.Second}
+			code, _ := compile(c)
+			Convey("THEN: It should be compiled on the worker having the same compiler", func() {
+				So(code, ShouldEqual, 0)
+				So(good.Served(), ShouldEqual, served+1)
+				So(other.Served(), ShouldEqual, 0)
+				b, err := ioutil.ReadFile(obj)
+				So(err, ShouldBeNil)
+				So(string(b[:4]), ShouldEqual, "\x7fELF")
+				So(Exists(dep), ShouldBeTrue)
+			})
+		})
+		Convey("WHEN: The source has errors", func() {
+			So(ioutil.WriteFile(src, []byte("int value() { return 1 }\n"), 0644), ShouldBeNil)
+			c := &DistClient{Workers: []string{goodAddr}, Token: "secret", Timeout: time.Second}
+			code, msg := compile(c)
+			Convey("THEN: Diagnostics should be reported with the original name", func() {
+				So(code, ShouldNotEqual, 0)
+				So(msg, ShouldContainSubstring, "a.c")
+				So(good.Served(), ShouldEqual, served+1)
+				So(Exists(obj), ShouldBeFalse)
+			})
+		})
+		Convey("WHEN: The token is not accepted", func() {
+			c := &DistClient{Workers: []string{lockedAddr}, Token: "secret", Timeout: time.Second}
+			code, _ := compile(c)
+			Convey("THEN: It should be compiled locally", func() {
+				So(code, ShouldEqual, 0)
+				So(locked.Served(), ShouldEqual, 0)
+				So(Exists(obj), ShouldBeTrue)
+			})
+		})
+	})
+	Convey("GIVEN: No tokens", t, func() {
+		_, err := NewDistWorker("", []string{"cc"}, 1)
+		Convey("THEN: Workers should not start", func() {
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
@@ -0,0 +1,222 @@
+// Importing environment variables.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+var rxEnvironmentName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// EnvironmentVariable make.yml environment variable to import (`- {name: ..., default: ...}` or `- NAME`)
+type EnvironmentVariable struct {
+	Name string
+	// Default holds the value used when the variable is not defined (`nil` means no defaults).
+	Default *string
+	// Required reports an error if the variable is not defined (and no defaults).
+	Required bool
+	// Path converts path separators to '/'.
+	Path bool
+}
+
+// UnmarshalYAML is the custom handler for mapping YAML to `EnvironmentVariable`
+func (e *EnvironmentVariable) UnmarshalYAML(unmarshaler func(interface{}) error) error {
+	var name string
+	if err := unmarshaler(&name); err != nil {
+		var slots struct {
+			Name     string
+			Default  *string
+			Required bool
+			Path     bool
+		}
+		if err := unmarshaler(&slots); err != nil {
+			return err
+		}
+		*e = EnvironmentVariable(slots)
+	} else {
+		*e = EnvironmentVariable{Name: name}
+	}
+	if !rxEnvironmentName.MatchString(e.Name) {
+		return errors.Errorf("invalid environment variable name \"%s\"", e.Name)
+	}
+	return nil
+}
+
+// ImportedEnvironment holds the imported environment variable.
+type ImportedEnvironment struct {
+	Name string
+	// Value holds the value used in interpolation (defaults and path normalization are applied).
+	Value string
+	// Raw holds the value in the process environment.
+	Raw string
+	// Defined is `true` if the variable is defined in the process environment.
+	Defined bool
+}
+
+// Import retrieves the variable from the process environment.
+func (e *EnvironmentVariable) Import() (ImportedEnvironment, error) {
+	raw, defined := os.LookupEnv(e.Name)
+	result := ImportedEnvironment{Name: e.Name, Value: raw, Raw: raw, Defined: defined}
+	if !defined {
+		if e.Default == nil {
+			if e.Required {
+				return result, errors.Errorf("environment variable \"%s\" is required", e.Name)
+			}
+			return result, nil
+		}
+		result.Value = *e.Default
+	}
+	if e.Path {
+		result.Value = filepath.ToSlash(result.Value)
+	}
+	return result, nil
+}
+
+// environmentLock guards `emitContext.environment`.
+var environmentLock sync.RWMutex
+
+// importEnvironment imports `vars` into `info` and records them to `c`.
+// They are visible from conditions (`env.NAME`) in this directory and its subdirectories.
+func importEnvironment(info *BuildInfo, c *collection, vars []EnvironmentVariable) error {
+	if len(vars) == 0 {
+		return nil
+	}
+	// Copied for not to be seen from the sibling directories.
+	environment := make(map[string]ImportedEnvironment, len(info.environment)+len(vars))
+	for k, v := range info.environment {
+		environment[k] = v
+	}
+	info.environment = environment
+	for _, v := range vars {
+		imported, err := v.Import()
+		if err != nil {
+			return err
+		}
+		environment[v.Name] = imported
+		c.environment = append(c.environment, imported)
+		if imported.Defined || v.Default != nil {
+			info.variables[v.Name] = imported.Value
+		}
+	}
+	return nil
+}
+
+// checkConditionEnvironment checks the environment variables referenced by `conds` are imported.
+// Otherwise the build would depend on the variables not recorded (and changing them would not regenerate the outputs).
+func checkConditionEnvironment(conds []*Condition, imported map[string]ImportedEnvironment) error {
+	missing := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, c := range conds {
+		for _, name := range c.EnvironmentReferences() {
+			if _, ok := imported[name]; ok || seen[name] {
+				continue
+			}
+			seen[name] = true
+			missing = append(missing, name)
+		}
+	}
+	if 0 < len(missing) {
+		sort.Strings(missing)
+		return errors.Errorf("environment variables referenced by `when:` are not imported via `environment:` (%s)", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// setImportedEnvironment replaces the imported variables.
+func setImportedEnvironment(envs map[string]ImportedEnvironment) {
+	environmentLock.Lock()
+	defer environmentLock.Unlock()
+	emitContext.environment = envs
+}
+
+// importedEnvironments returns the imported variables sorted by their names.
+func importedEnvironments() []ImportedEnvironment {
+	environmentLock.RLock()
+	defer environmentLock.RUnlock()
+	result := make([]ImportedEnvironment, 0, len(emitContext.environment))
+	for _, v := range emitContext.environment {
+		result = append(result, v)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result
+}
+
+// formatEnvironmentRecord formats `envs` as `NAME="value"` (or `NAME` if undefined) lines.
+func formatEnvironmentRecord(envs []ImportedEnvironment) []byte {
+	var b bytes.Buffer
+	for _, e := range envs {
+		if e.Defined {
+			fmt.Fprintf(&b, "%s=%s\n", e.Name, strconv.Quote(e.Raw))
+		} else {
+			fmt.Fprintf(&b, "%s\n", e.Name)
+		}
+	}
+	return b.Bytes()
+}
+
+// parseEnvironmentRecord parses the output of `formatEnvironmentRecord`.
+func parseEnvironmentRecord(src []byte) ([]ImportedEnvironment, error) {
+	result := make([]ImportedEnvironment, 0)
+	scanner := bufio.NewScanner(bytes.NewReader(src))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if len(line) == 0 {
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) == 1 {
+			result = append(result, ImportedEnvironment{Name: kv[0]})
+			continue
+		}
+		v, err := strconv.Unquote(kv[1])
+		if err != nil {
+			return nil, errors.Wrapf(err, "malformed line \"%s\"", line)
+		}
+		result = append(result, ImportedEnvironment{Name: kv[0], Value: v, Raw: v, Defined: true})
+	}
+	return result, scanner.Err()
+}
+
+// writeEnvironmentRecord writes `envs` to `path` only if the content differs
+// (keeps the timestamp for ninja's `restat`).
+func writeEnvironmentRecord(path string, envs []ImportedEnvironment) (bool, error) {
+	return updateFile(path, formatEnvironmentRecord(envs))
+}
+
+// CheckEnvironment compares the recorded variables in `path` with the current environment,
+// then updates `path` if some of them are changed.
+func CheckEnvironment(path string) error {
+	src, err := ioutil.ReadFile(path)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read \"%s\"", path)
+	}
+	recorded, err := parseEnvironmentRecord(src)
+	if err != nil {
+		return errors.Wrapf(err, "failed to parse \"%s\"", path)
+	}
+	current := make([]ImportedEnvironment, 0, len(recorded))
+	for _, e := range recorded {
+		raw, defined := os.LookupEnv(e.Name)
+		current = append(current, ImportedEnvironment{Name: e.Name, Value: raw, Raw: raw, Defined: defined})
+	}
+	updated, err := writeEnvironmentRecord(path, current)
+	if err != nil {
+		return err
+	}
+	if updated {
+		Verbose("%s: Environment variables are changed.\n", ProgramName)
+	}
+	return nil
+}
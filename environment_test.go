@@ -0,0 +1,109 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestEnvironmentVariable(t *testing.T) {
+	srcYAML := `# YAML Source
+environment:
+- CBUILD_ENV_TEST_PLAIN
+- {name: CBUILD_ENV_TEST_PATH, path: true}
+- {name: CBUILD_ENV_TEST_UNDEFINED, default: "c:\\foo bar", path: true}
+- {name: CBUILD_ENV_TEST_REQUIRED, required: true}
+`
+	Convey("GIVEN: `environment:` section", t, func() {
+		var conf Data
+		err := yaml.Unmarshal([]byte(srcYAML), &conf)
+		So(err, ShouldBeNil)
+		So(len(conf.Environment), ShouldEqual, 4)
+		Convey("WHEN: Unmarshaled", func() {
+			Convey("THEN: Short and long forms should be accepted", func() {
+				So(conf.Environment[0], ShouldResemble, EnvironmentVariable{Name: "CBUILD_ENV_TEST_PLAIN"})
+				So(conf.Environment[1].Path, ShouldBeTrue)
+				So(*conf.Environment[2].Default, ShouldEqual, `c:\foo bar`)
+				So(conf.Environment[3].Required, ShouldBeTrue)
+			})
+		})
+		Convey("WHEN: Importing them", func() {
+			os.Setenv("CBUILD_ENV_TEST_PLAIN", `a\b`)
+			os.Setenv("CBUILD_ENV_TEST_PATH", `a\b`)
+			os.Unsetenv("CBUILD_ENV_TEST_UNDEFINED")
+			os.Unsetenv("CBUILD_ENV_TEST_REQUIRED")
+			defer os.Unsetenv("CBUILD_ENV_TEST_PLAIN")
+			defer os.Unsetenv("CBUILD_ENV_TEST_PATH")
+			results := make([]ImportedEnvironment, 0)
+			for _, e := range conf.Environment[:3] {
+				v, err := e.Import()
+				So(err, ShouldBeNil)
+				results = append(results, v)
+			}
+			_, err := conf.Environment[3].Import()
+			Convey("THEN: Defaults and path normalization should be applied", func() {
+				So(results[0].Value, ShouldEqual, `a\b`)
+				So(results[1].Value, ShouldEqual, filepath.ToSlash(`a\b`))
+				So(results[1].Raw, ShouldEqual, `a\b`)
+				So(results[2].Value, ShouldEqual, filepath.ToSlash(`c:\foo bar`))
+				So(results[2].Defined, ShouldBeFalse)
+			})
+			Convey("THEN: Missing required variable should be an error", func() {
+				So(err, ShouldNotBeNil)
+			})
+			Convey("THEN: Record should be restored", func() {
+				restored, err := parseEnvironmentRecord(formatEnvironmentRecord(results))
+				So(err, ShouldBeNil)
+				So(len(restored), ShouldEqual, 3)
+				So(restored[1], ShouldResemble, ImportedEnvironment{Name: "CBUILD_ENV_TEST_PATH", Value: `a\b`, Raw: `a\b`, Defined: true})
+				So(restored[2], ShouldResemble, ImportedEnvironment{Name: "CBUILD_ENV_TEST_UNDEFINED"})
+			})
+		})
+	})
+	Convey("GIVEN: Malformed name", t, func() {
+		var e EnvironmentVariable
+		err := yaml.Unmarshal([]byte(`{name: "FOO BAR"}`), &e)
+		Convey("THEN: Should fail", func() {
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestImportEnvironment(t *testing.T) {
+	const key = "CBUILD_ENV_TEST_NOT_IMPORTED"
+	os.Setenv(key, "process")
+	defer os.Unsetenv(key)
+	Convey("GIVEN: Variables imported in the parent directory", t, func() {
+		def := "default"
+		parent := BuildInfo{variables: make(map[string]string)}
+		So(importEnvironment(&parent, &collection{}, []EnvironmentVariable{{Name: "CBUILD_ENV_TEST_PARENT", Default: &def}}), ShouldBeNil)
+		Convey("WHEN: Importing variables in the subdirectory", func() {
+			child := parent
+			c := &collection{}
+			So(importEnvironment(&child, c, []EnvironmentVariable{{Name: "CBUILD_ENV_TEST_CHILD", Default: &def}}), ShouldBeNil)
+			Convey("THEN: Imported variables should be recorded", func() {
+				So(c.environment, ShouldResemble, []ImportedEnvironment{{Name: "CBUILD_ENV_TEST_CHILD", Value: "default"}})
+			})
+			Convey("THEN: Conditions should see the variables imported in the subdirectory and its ancestors", func() {
+				ctx := child.conditionContext()
+				So(ctx.lookupEnv("CBUILD_ENV_TEST_PARENT"), ShouldEqual, "default")
+				So(ctx.lookupEnv("CBUILD_ENV_TEST_CHILD"), ShouldEqual, "default")
+			})
+			Convey("THEN: The parent should not see the variables imported in the subdirectory", func() {
+				ctx := parent.conditionContext()
+				So(ctx.lookupEnv("CBUILD_ENV_TEST_CHILD"), ShouldBeEmpty)
+			})
+			Convey("THEN: Conditions should not refer the process environment for the others", func() {
+				ctx := child.conditionContext()
+				So(ctx.lookupEnv(key), ShouldBeEmpty)
+				cond, err := ParseCondition("env." + key)
+				So(err, ShouldBeNil)
+				So(checkConditionEnvironment([]*Condition{cond}, child.environment), ShouldNotBeNil)
+			})
+		})
+	})
+}
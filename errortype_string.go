@@ -4,9 +4,9 @@ package main
 
 import "fmt"
 
-const _ErrorType_name = "ExceedRecursionLimitUnmatchedBraceUnknownReferenceInvalidDollarSequence"
+const _ErrorType_name = "ExceedRecursionLimitUnmatchedBraceUnknownReferenceInvalidDollarSequenceRequiredReferenceUnknownFunctionFunctionFailed"
 
-var _ErrorType_index = [...]uint8{0, 20, 34, 50, 71}
+var _ErrorType_index = [...]uint8{0, 20, 34, 50, 71, 88, 103, 117}
 
 func (i ErrorType) String() string {
 	if i < 0 || i >= ErrorType(len(_ErrorType_index)-1) {
@@ -0,0 +1,126 @@
+// Pluggable output generators.
+
+package main
+
+import (
+	"flag"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Generator emits build files or project files from the collected build graph.
+type Generator interface {
+	// Name returns the name used for `-backend`.
+	Name() string
+	// RegisterFlags registers generator specific flags to `fs`.
+	RegisterFlags(fs *flag.FlagSet)
+	// Emit writes the outputs for `graph`.
+	Emit(graph *BuildGraph) error
+}
+
+// BuildGraph holds everything collected for a variant.
+type BuildGraph struct {
+	Variant        string
+	BaseDir        string // Paths in the graph are relative to it (empty for the current directory)
+	OutputDir      string
+	Commands       []*BuildCommand
+	OtherRuleFiles []OtherRuleFile
+	AppendRules    map[string]AppendBuild
+	OtherRules     map[string]OtherRule
+	SubNinjas      []string
+	ConfigSources  []string
+	GeneratedFiles []string // Written by the generation (regenerated if missing)
+	DefaultTargets []string
+	Environment    []ImportedEnvironment // Sorted by the name
+	Headers        []string
+	Targets        []*ProjectTarget
+}
+
+// IsEmpty returns true if there are no commands to run.
+func (g *BuildGraph) IsEmpty() bool {
+	return len(g.Commands)+len(g.OtherRuleFiles) == 0
+}
+
+// LocalPath converts the path `p` in the graph to the one from the current directory.
+func (g *BuildGraph) LocalPath(p string) string {
+	if len(g.BaseDir) == 0 || filepath.IsAbs(p) || path.IsAbs(p) {
+		return p
+	}
+	return JoinPaths(g.BaseDir, p)
+}
+
+// currentBuildGraph captures the result of the last `collectAll`.
+func currentBuildGraph() *BuildGraph {
+	return &BuildGraph{
+		Variant:        option.variant,
+		OutputDir:      option.outputDir,
+		Commands:       emitContext.commandList,
+		OtherRuleFiles: emitContext.otherRuleFileList,
+		AppendRules:    emitContext.appendRules,
+		OtherRules:     emitContext.otherRuleList,
+		SubNinjas:      emitContext.subNinjaList,
+		ConfigSources:  emitContext.scannedConfigs,
+		GeneratedFiles: emitContext.generatedFiles,
+		DefaultTargets: emitContext.defaultTargets,
+		Environment:    importedEnvironments(),
+		Headers:        project.headerFiles,
+		Targets:        project.targets,
+	}
+}
+
+// generators holds the registered generators in the order of registration.
+var generators []Generator
+
+// RegisterGenerator makes `g` selectable with `-backend`.
+func RegisterGenerator(g Generator) {
+	if _, ok := LookupGenerator(g.Name()); ok {
+		panic("generator \"" + g.Name() + "\" is already registered")
+	}
+	generators = append(generators, g)
+}
+
+// LookupGenerator finds the generator named `name`.
+func LookupGenerator(name string) (Generator, bool) {
+	for _, g := range generators {
+		if g.Name() == name {
+			return g, true
+		}
+	}
+	return nil, false
+}
+
+// GeneratorNames returns the sorted names of the registered generators.
+func GeneratorNames() []string {
+	result := make([]string, 0, len(generators))
+	for _, g := range generators {
+		result = append(result, g.Name())
+	}
+	sort.Strings(result)
+	return result
+}
+
+// SelectGenerators parses comma separated generator names (ex. "ninja,vscode").
+func SelectGenerators(spec string) ([]Generator, error) {
+	result := make([]Generator, 0)
+	selected := make(map[string]bool)
+	for _, name := range strings.Split(spec, ",") {
+		name = strings.TrimSpace(name)
+		if len(name) == 0 || selected[name] {
+			continue
+		}
+		g, ok := LookupGenerator(name)
+		if !ok {
+			return nil, errors.Errorf("unknown backend \"%s\" (available: %s)", name, strings.Join(GeneratorNames(), ", "))
+		}
+		selected[name] = true
+		result = append(result, g)
+	}
+	if len(result) == 0 {
+		return nil, errors.New("no backends are specified")
+	}
+	return result, nil
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestSelectGenerators(t *testing.T) {
+	Convey("GIVEN: Registered generators", t, func() {
+		So(GeneratorNames(), ShouldResemble, []string{"cmake", "make", "msbuild", "ninja", "vscode"})
+		Convey("WHEN: Selecting several generators", func() {
+			selected, err := SelectGenerators("ninja, vscode,ninja")
+			Convey("THEN: They should be selected once in order", func() {
+				So(err, ShouldBeNil)
+				So(len(selected), ShouldEqual, 2)
+				So(selected[0].Name(), ShouldEqual, "ninja")
+				So(selected[1].Name(), ShouldEqual, "vscode")
+			})
+		})
+		Convey("WHEN: Selecting an unknown generator", func() {
+			_, err := SelectGenerators("ninja,xcode")
+			Convey("THEN: Should fail", func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+	})
+}
@@ -4,8 +4,11 @@ package main
 
 import (
 	"fmt"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"runtime"
 	"strings"
-	"unicode/utf8"
 )
 
 /*
@@ -13,12 +16,24 @@ import (
  *     ;
  * s : (* empty *)
  *   | <literal>
- *   | ${<literal>}
+ *   | $$                        (* `$` *)
+ *   | $}                        (* `}` *)
+ *   | ${<name>}
+ *   | ${@<name>}                (* same as ${<name>}, lists are spliced by `BuildInfo.SpliceLists` *)
+ *   | ${<name>:-<str>}          (* <str> if <name> is undefined or empty *)
+ *   | ${<name>:?<str>}          (* error with message <str> if <name> is undefined or empty *)
+ *   | ${<function>:<str>}       (* apply <function> to the interpolated <str> *)
  *   ;
+ * name : (<literal> | ${...})*  (* nested references are allowed (ex. ${tool_${platform}}) *)
+ *      ;
  */
 
 const recursionLimit = 500
 
+// EnableShellInterpolation enables `${shell:...}` function.
+// Disabled by default since it runs arbitrary commands.
+var EnableShellInterpolation = false
+
 // ErrorType means type of the error.
 type ErrorType int
 
@@ -34,6 +49,12 @@ const (
 	// InvalidDollerSequence means there is an unknown `$` prefixed sequence in the argument.
 	// Note: Only used in strict-mode
 	InvalidDollarSequence
+	// RequiredReference means the variable referenced by `${name:?message}` is undefined or empty.
+	RequiredReference
+	// UnknownFunction means `${function:...}` refers an unknown function.
+	UnknownFunction
+	// FunctionFailed means the function invoked by `${function:...}` reported an error.
+	FunctionFailed
 )
 
 // InterpolationError holds the error information occurs inside interpolator.
@@ -42,18 +63,29 @@ type InterpolationError struct {
 	Type ErrorType
 	// Arg holds the string cause this error.
 	Arg string
+	// Pos holds the (0 origin) byte offset in `Arg` where the error is detected.
+	Pos int
+	// Message holds the additional information.
+	Message string
 }
 
 func (e InterpolationError) Error() string {
+	where := fmt.Sprintf("at %d while interpolating \"%s\"", e.Pos, e.Arg)
 	switch e.Type {
 	case ExceedRecursionLimit:
-		return fmt.Sprintf("recursion limit exceeded while interpolating \"%s\"", e.Arg)
+		return fmt.Sprintf("recursion limit exceeded %s", where)
 	case UnmatchedBrace:
-		return fmt.Sprintf("unmached brace found while interpolating \"%s\"", e.Arg)
+		return fmt.Sprintf("unmached brace found %s", where)
 	case UnknownReference:
-		return fmt.Sprintf("unknown reference found while interpolating \"%s\"", e.Arg)
+		return fmt.Sprintf("unknown reference \"%s\" found %s", e.Message, where)
 	case InvalidDollarSequence:
-		return fmt.Sprintf("unknown '$' start sequence found while interpolating \"%s\"", e.Arg)
+		return fmt.Sprintf("unknown '$' start sequence found %s", where)
+	case RequiredReference:
+		return fmt.Sprintf("%s %s", e.Message, where)
+	case UnknownFunction:
+		return fmt.Sprintf("unknown function \"%s\" found %s", e.Message, where)
+	case FunctionFailed:
+		return fmt.Sprintf("%s %s", e.Message, where)
 	default:
 		return fmt.Sprintf("bad error type (%d)", int(e.Type))
 	}
@@ -62,76 +94,285 @@ func (e InterpolationError) Error() string {
 // Interpolate interpolates supplied `s` using `dict`.
 // If `s` contains unknown reference, treat it as an empty string ("").
 func Interpolate(s string, dict map[string]string) (string, error) {
-	return interpolate(dict, false, s)
+	return interpolate(dict, 0, s)
 }
 
 // StrictInterpolate interpolates supplied `s` using `dict`.
 // If `s` contains unknown reference, treat it as an error.
 func StrictInterpolate(s string, dict map[string]string) (string, error) {
-	return interpolate(dict, true, s)
+	return interpolate(dict, strictMode, s)
+}
+
+type interpolationMode int
+
+const (
+	// strictMode treats unknown references as errors.
+	strictMode interpolationMode = 1 << iota
+	// ninjaMode keeps `$` sequences other than `${...}` as is (ex. `$out`, `$$`).
+	ninjaMode
+)
+
+// interpolationFunctions holds functions available via `${function:argument}`.
+var interpolationFunctions = map[string]func(arg string) (string, error){
+	"upper": func(arg string) (string, error) {
+		return strings.ToUpper(arg), nil
+	},
+	"lower": func(arg string) (string, error) {
+		return strings.ToLower(arg), nil
+	},
+	"basename": func(arg string) (string, error) {
+		return path.Base(filepath.ToSlash(arg)), nil
+	},
+	"dirname": func(arg string) (string, error) {
+		return path.Dir(filepath.ToSlash(arg)), nil
+	},
+	"abspath": func(arg string) (string, error) {
+		p, err := filepath.Abs(arg)
+		if err != nil {
+			return "", err
+		}
+		return filepath.ToSlash(p), nil
+	},
+	"join": func(arg string) (string, error) {
+		// ${join:<sep>,<list>}
+		// <sep> is not empty, so `${join:,,<list>}` joins with ','.
+		idx := -1
+		if 0 < len(arg) {
+			idx = strings.Index(arg[1:], ",")
+		}
+		if idx < 0 {
+			return "", fmt.Errorf("missing separator in \"%s\" (expected `join:<sep>,<list>`)", arg)
+		}
+		return strings.Join(strings.Fields(arg[idx+2:]), arg[:idx+1]), nil
+	},
+	"shell": func(arg string) (string, error) {
+		if !EnableShellInterpolation {
+			return "", fmt.Errorf("`shell` function is disabled")
+		}
+		var cmd *exec.Cmd
+		if runtime.GOOS == "windows" {
+			cmd = exec.Command("cmd", "/C", arg)
+		} else {
+			cmd = exec.Command("sh", "-c", arg)
+		}
+		out, err := cmd.Output()
+		if err != nil {
+			return "", fmt.Errorf("command \"%s\" failed (%v)", arg, err)
+		}
+		return strings.TrimRight(string(out), "\r\n"), nil
+	},
+}
+
+func interpolate(dict map[string]string, mode interpolationMode, s string) (string, error) {
+	ip := interpolator{dict: dict, mode: mode}
+	result, err := ip.expand(s, 0)
+	if err != nil {
+		// Positions are already translated into the offset in `s`.
+		err.Arg = s
+		return result, err
+	}
+	return result, nil
+}
+
+type interpolator struct {
+	dict map[string]string
+	mode interpolationMode
+}
+
+func (ip *interpolator) strict() bool {
+	return ip.mode&strictMode != 0
+}
+
+// expand expands `s`.
+// Positions in the returned error are relative to `s`.
+func (ip *interpolator) expand(s string, depth int) (string, *InterpolationError) {
+	if recursionLimit <= depth {
+		return "", newError(ExceedRecursionLimit, 0)
+	}
+	var result strings.Builder
+	for i := 0; i < len(s); {
+		idx := strings.IndexByte(s[i:], '$')
+		if idx < 0 {
+			// No `$` in the rest
+			result.WriteString(s[i:])
+			break
+		}
+		result.WriteString(s[i : i+idx])
+		i += idx
+		if len(s) <= i+1 {
+			// "...$"
+			result.WriteByte('$')
+			break
+		}
+		switch s[i+1] {
+		case '{':
+			end := findClosingBrace(s, i+2)
+			if end < 0 {
+				return result.String(), newError(UnmatchedBrace, i)
+			}
+			v, err := ip.reference(s[i+2:end], depth)
+			if err != nil {
+				err.Pos += i + 2
+				return result.String(), err
+			}
+			result.WriteString(v)
+			i = end + 1
+		case '$':
+			if ip.mode&ninjaMode != 0 {
+				result.WriteString("$$")
+			} else {
+				result.WriteByte('$')
+			}
+			i += 2
+		case '}':
+			result.WriteByte('}')
+			i += 2
+		default:
+			if ip.strict() && ip.mode&ninjaMode == 0 {
+				// Invalid $... sequence
+				return result.String(), newError(InvalidDollarSequence, i)
+			}
+			// Treat it as is...
+			result.WriteByte('$')
+			i++
+		}
+	}
+	return result.String(), nil
 }
 
-func interpolate(dict map[string]string, strict bool, rest string) (string, error) {
-	depth := 0
-	result := ""
-restart:
-	for {
-		if recursionLimit <= depth {
-			return result, newError(ExceedRecursionLimit, rest)
-		}
-		if idx := strings.Index(rest, "$"); 0 <= idx {
-			// `$` found
-			result += rest[:idx]
-			r := rest[idx+1:]
-			if len(r) == 0 {
-				// "...$"
-				return result + "$", nil
+// reference expands the inside of `${...}`.
+// Positions in the returned error are relative to `body`.
+func (ip *interpolator) reference(body string, depth int) (string, *InterpolationError) {
+	head := body
+	op := ""
+	colon := findTopLevel(body, ':')
+	if 0 <= colon {
+		head = body[:colon]
+		op = body[colon+1:]
+	}
+	name := head
+	if strings.Contains(head, "$") {
+		// Nested reference (ex. `${tool_${platform}}`)
+		n, err := ip.expand(head, depth+1)
+		if err != nil {
+			return "", err
+		}
+		name = n
+	}
+	// `${@name}` outside of list contexts expands to the joined value.
+	name = strings.TrimPrefix(name, "@")
+	if colon < 0 {
+		v, ok := ip.dict[name]
+		if !ok {
+			if ip.strict() {
+				return "", &InterpolationError{Type: UnknownReference, Message: name}
 			}
-			// 0 < len (r)
-			ch, sz := utf8.DecodeRuneInString(r)
-			switch ch {
-			case '{':
-				if keyIdx := strings.Index(r[sz:], "}"); 0 <= keyIdx {
-					k := r[sz : sz+keyIdx]
-					v, ok := dict[k]
-					if strict {
-						if !ok {
-							return result, newError(UnknownReference, rest)
-						}
-					}
-					if ix := strings.Index(v, "${"); 0 <= ix {
-						depth++
-						result += v[:ix]
-						rest = v[ix:] + r[sz+keyIdx+1:]
-					} else {
-						result += v
-						rest = r[sz+keyIdx+1:]
-					}
-					goto restart
+			return "", nil
+		}
+		return ip.expandValue(v, depth)
+	}
+	switch {
+	case strings.HasPrefix(op, "-"):
+		if v, ok := ip.dict[name]; ok && 0 < len(v) {
+			return ip.expandValue(v, depth)
+		}
+		v, err := ip.expand(op[1:], depth+1)
+		if err != nil {
+			err.Pos += colon + 2
+			return "", err
+		}
+		return v, nil
+	case strings.HasPrefix(op, "?"):
+		if v, ok := ip.dict[name]; ok && 0 < len(v) {
+			return ip.expandValue(v, depth)
+		}
+		msg, err := ip.expand(op[1:], depth+1)
+		if err != nil {
+			err.Pos += colon + 2
+			return "", err
+		}
+		if len(msg) == 0 {
+			msg = fmt.Sprintf("variable \"%s\" is not defined", name)
+		}
+		return "", &InterpolationError{Type: RequiredReference, Message: msg}
+	default:
+		fn, ok := interpolationFunctions[name]
+		if !ok {
+			return "", &InterpolationError{Type: UnknownFunction, Message: name}
+		}
+		arg, err := ip.expand(op, depth+1)
+		if err != nil {
+			err.Pos += colon + 1
+			return "", err
+		}
+		v, e := fn(arg)
+		if e != nil {
+			return "", &InterpolationError{Type: FunctionFailed, Message: fmt.Sprintf("%s: %v", name, e)}
+		}
+		return v, nil
+	}
+}
+
+// expandValue expands the value of the variable.
+// Errors are reported at the position of the reference.
+func (ip *interpolator) expandValue(v string, depth int) (string, *InterpolationError) {
+	if !strings.Contains(v, "${") {
+		return v, nil
+	}
+	result, err := ip.expand(v, depth+1)
+	if err != nil {
+		err.Pos = 0
+		return "", err
+	}
+	return result, nil
+}
+
+// findClosingBrace returns the index of `}` matching with `${` ends at `start`.
+func findClosingBrace(s string, start int) int {
+	depth := 1
+	for i := start; i < len(s); i++ {
+		switch s[i] {
+		case '$':
+			if i+1 < len(s) {
+				switch s[i+1] {
+				case '{':
+					depth++
+					i++
+				case '$', '}':
+					i++
 				}
-				return result, &InterpolationError{Type: UnmatchedBrace, Arg: rest}
-			case '$':
-				result += "$"
-				rest = r[sz:]
-				goto restart
-			default:
-				if strict {
-					// Invalid $... sequence
-					return result, newError(InvalidDollarSequence, rest)
+			}
+		case '}':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// findTopLevel returns the index of `ch` not enclosed by nested `${...}`.
+func findTopLevel(s string, ch byte) int {
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '$':
+			if i+1 < len(s) && s[i+1] == '{' {
+				end := findClosingBrace(s, i+2)
+				if end < 0 {
+					return -1
 				}
-				// Treat it as is...
-				result += "$"
-				rest = r
-				goto restart
+				i = end
+			} else {
+				i++
 			}
-		} else {
-			// No `$` in `s`
-			result += rest
-			return result, nil
+		case ch:
+			return i
 		}
 	}
+	return -1
 }
 
-func newError(t ErrorType, arg string) *InterpolationError {
-	return &InterpolationError{Type: t, Arg: arg}
+func newError(t ErrorType, pos int) *InterpolationError {
+	return &InterpolationError{Type: t, Pos: pos}
 }
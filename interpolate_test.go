@@ -163,6 +163,85 @@ func TestStrictInterpolateErrors(t *testing.T) {
 	})
 }
 
+func TestInterpolateDefaultsAndFunctions(t *testing.T) {
+	Convey("GIVEN: A Test dictionary", t, func() {
+		dict := newDictionary()
+		dict["platform"] = "LINUX"
+		dict["tool_LINUX"] = "gcc"
+		dict["empty"] = ""
+		dict["path"] = "/usr/local/bin/clang"
+		dict["libs"] = "a b  c"
+		for _, v := range []testCase{
+			{input: "${mokeke:-default}", expected: "default"},
+			{input: "${empty:-default}", expected: "default"},
+			{input: "${foo:-default}", expected: "foo-value"},
+			{input: "${mokeke:-${foo}}", expected: "foo-value"},
+			{input: "${mokeke:-{$}}", expected: "{}"},
+			{input: "${mokeke:-}", expected: ""},
+			{input: "${foo:?must be defined}", expected: "foo-value"},
+			{input: "${tool_${platform}}", expected: "gcc"},
+			{input: "${upper:${platform}}", expected: "LINUX"},
+			{input: "${lower:${platform}}", expected: "linux"},
+			{input: "${basename:${path}}", expected: "clang"},
+			{input: "${dirname:${path}}", expected: "/usr/local/bin"},
+			{input: "${join:,,${libs}}", expected: "a,b,c"},
+			{input: "${join: -l,${libs}}", expected: "a -lb -lc"},
+			{input: "x${upper:${tool_${platform}}}y", expected: "xGCCy"},
+		} {
+			Convey(fmt.Sprintf("WHEN: Interpolating \"%s\" (strict mode)", v.input), func() {
+				actual, err := StrictInterpolate(v.input, dict)
+				Convey(fmt.Sprintf("THEN: Should be \"%s\"", v.expected), func() {
+					So(err, ShouldBeNil)
+					So(actual, ShouldEqual, v.expected)
+				})
+			})
+		}
+		Convey("WHEN: Interpolating \"${shell:echo foo}\" without enabling it", func() {
+			_, err := Interpolate("${shell:echo foo}", dict)
+			Convey("THEN: Should cause FunctionFailed error", func() {
+				So(err, ShouldNotBeNil)
+				e, ok := err.(*InterpolationError)
+				So(ok, ShouldBeTrue)
+				So(e.Type, ShouldEqual, FunctionFailed)
+			})
+		})
+	})
+}
+
+func TestInterpolateErrorPosition(t *testing.T) {
+	Convey("GIVEN: A Test dictionary", t, func() {
+		dict := newDictionary()
+		type errTestCase struct {
+			input   string
+			err     ErrorType
+			pos     int
+			message string
+		}
+		for _, tc := range []errTestCase{
+			{"abc${foo", UnmatchedBrace, 3, ""},
+			{"abc ${mokeke}", UnknownReference, 6, "mokeke"},
+			{"abc ${foo} ${mokeke:?mokeke is required}", RequiredReference, 13, "mokeke is required"},
+			{"abc ${mokeke:-${hoge}}", UnknownReference, 16, "hoge"},
+			{"abc ${nofunc:x}", UnknownFunction, 6, "nofunc"},
+			{"abc ${tool_${hoge}}", UnknownReference, 13, "hoge"},
+			{"abc ${rec}", ExceedRecursionLimit, 6, ""},
+		} {
+			Convey(fmt.Sprintf("WHEN: Interpolating \"%s\"", tc.input), func() {
+				_, err := StrictInterpolate(tc.input, dict)
+				Convey(fmt.Sprintf("THEN: Should have %s error at %d", tc.err.String(), tc.pos), func() {
+					So(err, ShouldNotBeNil)
+					e, ok := err.(*InterpolationError)
+					So(ok, ShouldBeTrue)
+					So(e.Type, ShouldEqual, tc.err)
+					So(e.Pos, ShouldEqual, tc.pos)
+					So(e.Arg, ShouldEqual, tc.input)
+					So(e.Message, ShouldEqual, tc.message)
+				})
+			})
+		}
+	})
+}
+
 func newDictionary() map[string]string {
 	return map[string]string{
 		"foo": "foo-value",
@@ -0,0 +1,94 @@
+// Languages compiled with the built-in rules.
+
+package main
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// sourceLang describes a language compiled with the built-in `compile` rule.
+type sourceLang struct {
+	name      string   // Language name (same as the `-x` argument of clang/gcc)
+	compilers []string // Variables of the compiler in order of precedence (`compiler` is used if none are defined)
+	options   string   // Language specific option list ("c" for `c_option:`, "c++" for `cxx_option:` or "" for none)
+	depends   bool     // Dependencies are generated (the source is preprocessed)
+	analyzed  bool     // Static analysis is available
+	explicit  bool     // `-x <name>` is passed if compiled by `${compiler}` (the C++ driver)
+}
+
+var (
+	langC         = &sourceLang{name: "c", compilers: []string{"compiler.c"}, options: "c", depends: true, analyzed: true, explicit: true}
+	langCXX       = &sourceLang{name: "c++", compilers: []string{"compiler.cxx"}, options: "c++", depends: true, analyzed: true}
+	langObjC      = &sourceLang{name: "objective-c", compilers: []string{"compiler.objc", "compiler.c"}, options: "c", depends: true, analyzed: true, explicit: true}
+	langObjCXX    = &sourceLang{name: "objective-c++", compilers: []string{"compiler.objcxx", "compiler.cxx"}, options: "c++", depends: true, analyzed: true}
+	langAsmCPP    = &sourceLang{name: "assembler-with-cpp", compilers: []string{"compiler.asm", "compiler.c"}, depends: true, explicit: true}
+	langAssembler = &sourceLang{name: "assembler", compilers: []string{"compiler.asm", "compiler.c"}, explicit: true}
+)
+
+// msvcDrivers are the compilers detecting the language by the extension only (`-x` is not available).
+var msvcDrivers = map[string]bool{"cl": true, "clang-cl": true}
+
+// sourceLangs maps the extensions to the languages.
+var sourceLangs = map[string]*sourceLang{
+	".c":   langC,
+	".cpp": langCXX,
+	".cc":  langCXX,
+	".cxx": langCXX,
+	".c++": langCXX,
+	".C":   langCXX,
+	".CPP": langCXX,
+	".m":   langObjC,
+	".mm":  langObjCXX,
+	".M":   langObjCXX,
+	".S":   langAsmCPP,
+	".sx":  langAsmCPP,
+	".s":   langAssembler,
+}
+
+// lookupSourceLang returns the language of the source `path` (`nil` if unknown).
+func lookupSourceLang(path string) *sourceLang {
+	return sourceLangs[filepath.Ext(path)]
+}
+
+// sourceLanguage returns the language name of the source `path` ("c", "c++", "objective-c" ... or "" if unknown).
+func sourceLanguage(path string) string {
+	if lang := lookupSourceLang(path); lang != nil {
+		return lang.name
+	}
+	return ""
+}
+
+// languageCompiler returns the compiler for `lang` and the arguments selecting the language.
+// Falls back to `fallback` (i.e. `${compiler}`) if no language specific compilers are defined.
+// Since `${compiler}` is the C++ driver, C family sources are compiled with `-x <lang>` in this case.
+func (info *BuildInfo) languageCompiler(lang *sourceLang, fallback string) (string, []string, error) {
+	if lang == nil {
+		return fallback, nil, nil
+	}
+	for _, v := range lang.compilers {
+		if _, ok := info.variables[v]; ok {
+			c, err := info.ExpandVariable(v)
+			return c, nil, err
+		}
+	}
+	base := filepath.Base(filepath.ToSlash(fallback))
+	if !lang.explicit || msvcDrivers[strings.ToLower(strings.TrimSuffix(base, filepath.Ext(base)))] {
+		return fallback, nil, nil
+	}
+	return fallback, []string{"-x", lang.name}, nil
+}
+
+// languageOptions returns the options specific to `lang` (`c_option:` or `cxx_option:`).
+func (info *BuildInfo) languageOptions(lang *sourceLang) []string {
+	if lang == nil {
+		return nil
+	}
+	switch lang.options {
+	case "c":
+		return info.cOptions
+	case "c++":
+		return info.cxxOptions
+	}
+	return nil
+}
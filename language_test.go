@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestSourceLanguage(t *testing.T) {
+	Convey("GIVEN: Sources", t, func() {
+		Convey("THEN: Languages should be detected by the extension", func() {
+			So(sourceLanguage("a.c"), ShouldEqual, "c")
+			So(sourceLanguage("sub/a.cpp"), ShouldEqual, "c++")
+			So(sourceLanguage("a.cc"), ShouldEqual, "c++")
+			So(sourceLanguage("a.cxx"), ShouldEqual, "c++")
+			So(sourceLanguage("a.m"), ShouldEqual, "objective-c")
+			So(sourceLanguage("a.mm"), ShouldEqual, "objective-c++")
+			So(sourceLanguage("a.S"), ShouldEqual, "assembler-with-cpp")
+			So(sourceLanguage("a.s"), ShouldEqual, "assembler")
+			So(sourceLanguage("a.txt"), ShouldBeEmpty)
+		})
+	})
+	Convey("GIVEN: Compiler variables", t, func() {
+		info := BuildInfo{
+			variables:  map[string]string{"compiler.c": "cc", "compiler.cxx": "c++", "compiler.asm": "as"},
+			cOptions:   []string{"-std=c99"},
+			cxxOptions: []string{"-std=c++17"},
+		}
+		compiler := func(path string) string {
+			c, args, err := info.languageCompiler(lookupSourceLang(path), "clang++")
+			So(err, ShouldBeNil)
+			So(args, ShouldBeEmpty)
+			return c
+		}
+		Convey("THEN: Compilers should be selected by the language", func() {
+			So(compiler("a.c"), ShouldEqual, "cc")
+			So(compiler("a.cpp"), ShouldEqual, "c++")
+			So(compiler("a.s"), ShouldEqual, "as")
+			So(compiler("a.txt"), ShouldEqual, "clang++")
+		})
+		Convey("THEN: Compilers should fall back to the related ones", func() {
+			So(compiler("a.m"), ShouldEqual, "cc")
+			So(compiler("a.mm"), ShouldEqual, "c++")
+			delete(info.variables, "compiler.cxx")
+			So(compiler("a.cpp"), ShouldEqual, "clang++")
+		})
+		Convey("WHEN: The C compiler is not defined", func() {
+			delete(info.variables, "compiler.c")
+			delete(info.variables, "compiler.asm")
+			Convey("THEN: C family sources should be compiled by `${compiler}` with the language", func() {
+				for path, lang := range map[string]string{"a.c": "c", "a.m": "objective-c", "a.S": "assembler-with-cpp", "a.s": "assembler"} {
+					c, args, err := info.languageCompiler(lookupSourceLang(path), "clang++")
+					So(err, ShouldBeNil)
+					So(c, ShouldEqual, "clang++")
+					So(args, ShouldResemble, []string{"-x", lang})
+				}
+				So(compiler("a.mm"), ShouldEqual, "c++")
+			})
+			Convey("THEN: The language should not be given to the MSVC compatible drivers", func() {
+				for _, driver := range []string{"cl", "cl.exe", "c:/Program Files/LLVM/bin/clang-cl.exe"} {
+					c, args, err := info.languageCompiler(lookupSourceLang("a.c"), driver)
+					So(err, ShouldBeNil)
+					So(c, ShouldEqual, driver)
+					So(args, ShouldBeEmpty)
+				}
+			})
+		})
+		Convey("THEN: Options should be selected by the language", func() {
+			So(info.languageOptions(lookupSourceLang("a.c")), ShouldResemble, []string{"-std=c99"})
+			So(info.languageOptions(lookupSourceLang("a.m")), ShouldResemble, []string{"-std=c99"})
+			So(info.languageOptions(lookupSourceLang("a.mm")), ShouldResemble, []string{"-std=c++17"})
+			So(info.languageOptions(lookupSourceLang("a.S")), ShouldBeEmpty)
+		})
+	})
+}
+
+func TestLanguageBuild(t *testing.T) {
+	dir := prepareSampleTree(t)
+	defer os.RemoveAll(dir)
+	for name, body := range map[string]string{
+		"sub/util.c":  "#include <stdio.h>\nint util(void) { return 1; }\n",
+		"sub/start.S": "#include \"start.h\"\n\t.text\n",
+		"sub/start.h": "#define START 1\n",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(body), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	editSampleFile(t, dir, "make.yml",
+		// Removes the custom rule for `.c`.
+		`other:
+- ext: .c
+  command: compiler.c @include @option -o $out $in
+  description: Compile C
+  need_depend: true
+  option:
+  - list: [ c, g, Wall, MMD, MT $out, MF $dep ]
+    debug: [ DDEBUG, O0 ]
+    release: [ O2 ]
+`, "",
+		"cxx_option:\n", "c_option:\n- list: [ std=c99 ]\ncxx_option:\n",
+		"  - sub/test_sub.cpp\n", "  - sub/test_sub.cpp\n  - sub/util.c\n  - sub/start.S\n",
+	)
+	Convey("GIVEN: Sources in some languages", t, func() {
+		var graph *BuildGraph
+		So(generateSample(dir, "build.ninja", func(g *BuildGraph) error {
+			graph = g
+			return (&ninjaGenerator{}).Emit(g)
+		}), ShouldBeNil)
+		find := func(typ string, suffix string) *BuildCommand {
+			for _, c := range graph.Commands {
+				if c.CommandType == typ && strings.HasSuffix(c.InFiles[0], suffix) {
+					return c
+				}
+			}
+			return nil
+		}
+		Convey("THEN: C sources should be compiled by the C compiler with the C options", func() {
+			for _, src := range []string{"/util.c", "/hello.c"} {
+				c := find("compile", src)
+				So(c, ShouldNotBeNil)
+				So(c.Command, ShouldEqual, "gcc")
+				So(c.Args, ShouldContain, "-std=c99")
+				So(c.Args, ShouldNotContain, "-std=c++14")
+				So(c.Args, ShouldContain, "-Werror")
+				So(c.DepFile, ShouldNotBeEmpty)
+			}
+			So(graph.OtherRuleFiles, ShouldBeEmpty)
+		})
+		Convey("THEN: C++ sources should be compiled with the C++ options", func() {
+			c := find("compile", "/test.cpp")
+			So(c.Command, ShouldEqual, "g++")
+			So(c.Args, ShouldContain, "-std=c++14")
+			So(c.Args, ShouldNotContain, "-std=c99")
+		})
+		Convey("THEN: Assembly sources should not have the language options", func() {
+			c := find("compile", "/start.S")
+			So(c.Command, ShouldEqual, "gcc")
+			So(c.Args, ShouldNotContain, "-std=c99")
+			So(c.DepFile, ShouldNotBeEmpty)
+			So(find("analyze", "/start.S"), ShouldBeNil)
+		})
+		Convey("THEN: All sources should be in the compilation database", func() {
+			b, err := ioutil.ReadFile(filepath.Join(dir, "build", "LINUX", "Debug", "compile_commands.json"))
+			So(err, ShouldBeNil)
+			var items []CompileDbItem
+			So(json.Unmarshal(b, &items), ShouldBeNil)
+			var files []string
+			for _, item := range items {
+				files = append(files, filepath.Base(item.File))
+			}
+			So(files, ShouldContain, "util.c")
+			So(files, ShouldContain, "hello.c")
+			So(files, ShouldContain, "start.S")
+		})
+		Convey("THEN: Dependencies should be generated", func() {
+			for _, src := range []string{"/util.c", "/start.S"} {
+				c := find("compile", src)
+				So(os.MkdirAll(filepath.Join(dir, filepath.Dir(c.OutFile)), 0755), ShouldBeNil)
+				cmd := exec.Command(c.Command, append(append([]string{}, c.Args...), "-o", c.OutFile, c.InFiles[0])...)
+				cmd.Dir = dir
+				out, err := cmd.CombinedOutput()
+				if err != nil {
+					t.Log(string(out))
+				}
+				So(err, ShouldBeNil)
+				So(Exists(filepath.Join(dir, c.DepFile)), ShouldBeTrue)
+			}
+			dep, err := ioutil.ReadFile(filepath.Join(dir, find("compile", "/start.S").DepFile))
+			So(err, ShouldBeNil)
+			So(string(dep), ShouldContainSubstring, "start.h")
+		})
+	})
+}
@@ -0,0 +1,398 @@
+// Renders the collected commands into GNU Makefile.
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultMakefileName is the default output of the make backend.
+const DefaultMakefileName = "Makefile"
+
+// makeGenerator writes GNU Makefile and `compile_commands.json`.
+type makeGenerator struct {
+	makefile string
+}
+
+func init() {
+	RegisterGenerator(&makeGenerator{})
+}
+
+func (*makeGenerator) Name() string { return "make" }
+
+func (g *makeGenerator) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&g.makefile, "makefile", DefaultMakefileName, "output Makefile filename (for -backend make)")
+}
+
+func (g *makeGenerator) Emit(graph *BuildGraph) error {
+	makefile := g.makefile
+	if len(makefile) == 0 {
+		makefile = DefaultMakefileName
+	}
+	for _, c := range graph.Commands {
+		if len(c.Dyndep) != 0 {
+			return errors.Errorf("C++20 modules (\"%s\") require the ninja backend", c.InFiles[0])
+		}
+	}
+	graph, err := normalizeGraph(graph, makefile)
+	if err != nil {
+		return err
+	}
+	if err := outputMakefile(graph, makefile); err != nil {
+		return err
+	}
+	return outputCompileDb(graph)
+}
+
+// Creates GNU Makefile.
+func outputMakefile(graph *BuildGraph, makefile string) error {
+	Verbose("%s: Creates \"%s\"\n", ProgramName, makefile)
+
+	tmpl, err := getMakefileTemplate()
+	if err != nil {
+		return errors.Wrapf(err, "failed to obtain a template")
+	}
+
+	type WriteContext struct {
+		Platform           string
+		OutputDirectory    string
+		OtherRules         map[string]OtherRule
+		AppendRules        map[string]AppendBuild
+		MakefileUpdater    string
+		GroupArchives      bool
+		CompilerLauncher   string
+		LinkLauncher       string
+		Commands           []*BuildCommand
+		OtherRuleTargets   []OtherRuleFile
+		Makefile           string
+		ConfigSources      []string
+		GeneratedFiles     []string
+		AnalysisReports    []string
+		DefaultTargets     []string
+		DepFiles           []string
+		EnvironmentFile    string
+		EnvironmentChecker string
+	}
+	osArgs := make([]string, 0, len(os.Args))
+	osArgs = append(osArgs, filepath.ToSlash(os.Args[0]))
+	osArgs = append(osArgs, os.Args[1:]...)
+	// Written in ninja syntax (converted by `ninja_to_make`).
+	launcher, linkLauncher := selectCompilerLaunchers(graph)
+	makefileName := makefile
+	if 0 < len(graph.BaseDir) {
+		makefileName = relativePath(graph.BaseDir, makefile)
+	}
+	ctx := WriteContext{
+		Platform:         option.platform,
+		OutputDirectory:  filepath.ToSlash(graph.OutputDir),
+		OtherRules:       graph.OtherRules,
+		AppendRules:      graph.AppendRules,
+		MakefileUpdater:  EscapeMakeValue(commandShell.JoinArgs(osArgs)),
+		GroupArchives:    groupArchives,
+		CompilerLauncher: launcher,
+		LinkLauncher:     linkLauncher,
+		Commands:         graph.Commands,
+		OtherRuleTargets: graph.OtherRuleFiles,
+		Makefile:         makefileName,
+		ConfigSources:    graph.ConfigSources,
+		GeneratedFiles:   graph.GeneratedFiles,
+		DefaultTargets:   graph.DefaultTargets,
+	}
+	for _, c := range graph.Commands {
+		if c.CommandType == "analyze" {
+			ctx.AnalysisReports = append(ctx.AnalysisReports, c.OutFile)
+		}
+		if 0 < len(c.DepFile) {
+			ctx.DepFiles = append(ctx.DepFiles, c.DepFile)
+		} else if r, ok := graph.AppendRules[c.CommandType]; ok && r.Deps {
+			ctx.DepFiles = append(ctx.DepFiles, c.OutFile+".d")
+		}
+	}
+	for _, o := range graph.OtherRuleFiles {
+		if 0 < len(o.Depend) {
+			ctx.DepFiles = append(ctx.DepFiles, o.Depend)
+		}
+	}
+	if len(ctx.DefaultTargets) == 0 {
+		for _, c := range graph.Commands {
+			ctx.DefaultTargets = append(ctx.DefaultTargets, c.OutFile)
+		}
+		for _, o := range graph.OtherRuleFiles {
+			ctx.DefaultTargets = append(ctx.DefaultTargets, o.Outfile)
+		}
+	}
+	if envs := graph.Environment; 0 < len(envs) {
+		ctx.EnvironmentFile = JoinPaths(graph.OutputDir, ".environment")
+		ctx.EnvironmentChecker = EscapeMakeValue(commandShell.QuoteArg(filepath.ToSlash(ProgramPath))) + " -check-environment $@"
+		if _, err := writeEnvironmentRecord(graph.LocalPath(ctx.EnvironmentFile), envs); err != nil {
+			return err
+		}
+	}
+	for _, s := range graph.SubNinjas {
+		Warn("subninja \"%s\" is ignored by the make backend.", s)
+	}
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, ctx); err != nil {
+		return errors.Wrap(err, "failed to render template")
+	}
+	updated, err := updateFile(makefile, b.Bytes())
+	if err != nil {
+		return err
+	}
+	if !updated {
+		Verbose("%s: \"%s\" is up to date\n", ProgramName, makefile)
+	}
+	return nil
+}
+
+// EscapeMakePath escapes `p` for using as a target or a prerequisite.
+func EscapeMakePath(p string) string {
+	p = lowerDriveLetter(p)
+	drive := ""
+	if 2 <= len(p) && p[1] == ':' {
+		drive, p = p[:2], p[2:]
+	}
+	r := strings.NewReplacer("$", "$$", " ", `\ `, "#", `\#`, ":", `\:`, "%", `\%`)
+	return drive + r.Replace(p)
+}
+
+// EscapeMakeValue escapes `s` for using as a variable value.
+func EscapeMakeValue(s string) string {
+	r := strings.NewReplacer("$", "$$", "#", `\#`, "\n", " ")
+	return r.Replace(s)
+}
+
+// NinjaToMake converts ninja's variable references in `s` into make's ones.
+//   - `$out` -> `$@`
+//   - `$in`, `$in_newline` -> `$(in)` (explicit inputs)
+//   - `$name`, `${name}` -> `$(name)`
+//   - `$$`, `$ `, `$:` are unescaped.
+func NinjaToMake(s string) string {
+	var b strings.Builder
+	isVarChar := func(ch byte) bool {
+		return ('a' <= ch && ch <= 'z') || ('A' <= ch && ch <= 'Z') || ('0' <= ch && ch <= '9') || ch == '_' || ch == '-'
+	}
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		switch {
+		case ch == '#':
+			b.WriteString(`\#`)
+			continue
+		case ch == '\n':
+			b.WriteByte(' ')
+			continue
+		case ch != '$' || len(s) <= i+1:
+			b.WriteByte(ch)
+			continue
+		}
+		next := s[i+1]
+		name := ""
+		switch {
+		case next == '$':
+			b.WriteString("$$")
+			i++
+			continue
+		case next == ' ' || next == ':' || next == '\n':
+			b.WriteByte(next)
+			i++
+			continue
+		case next == '{':
+			end := strings.IndexByte(s[i+2:], '}')
+			if end < 0 {
+				b.WriteString("$$")
+				continue
+			}
+			name = s[i+2 : i+2+end]
+			i += end + 2
+		case isVarChar(next):
+			j := i + 1
+			for j < len(s) && isVarChar(s[j]) {
+				j++
+			}
+			name = s[i+1 : j]
+			i = j - 1
+		default:
+			b.WriteString("$$")
+			continue
+		}
+		switch name {
+		case "out":
+			b.WriteString("$@")
+		case "in", "in_newline":
+			b.WriteString("$(in)")
+		default:
+			b.WriteString("$(" + name + ")")
+		}
+	}
+	return b.String()
+}
+
+func getMakefileTemplate() (*template.Template, error) {
+	funcs := template.FuncMap{
+		"escape_path": func(arg interface{}) (interface{}, error) {
+			switch v := arg.(type) {
+			case string:
+				return EscapeMakePath(v), nil
+			case []string:
+				tmp := make([]string, 0, len(v))
+				for _, p := range v {
+					tmp = append(tmp, EscapeMakePath(p))
+				}
+				return tmp, nil
+			}
+			return nil, errors.Errorf("can't convert \"%v\" to path", arg)
+		},
+		"escape_value":  EscapeMakeValue,
+		"ninja_to_make": NinjaToMake,
+		"shell_join":    func(args []string) string { return NinjaToMake(commandShell.JoinArgs(args)) },
+		"shell_quote":   func(arg string) string { return NinjaToMake(commandShell.QuoteArg(arg)) },
+		"intercalate":   intercalate,
+		"concat": func(lists ...[]string) []string {
+			result := make([]string, 0)
+			for _, l := range lists {
+				result = append(result, l...)
+			}
+			return result
+		},
+	}
+	return template.New("makefile").Funcs(funcs).Parse(makefileTemplateSource)
+}
+
+const makefileTemplateSource = `# AUTOGENERATED using built-in template
+# Rule definitions
+builddir := {{.OutputDirectory}}
+
+.SUFFIXES:
+.DELETE_ON_ERROR:
+Q := @
+ifeq ($(V),1)
+Q :=
+endif
+
+desc_compile := Compiling
+{{- if eq .Platform "WIN32"}}
+cmd_compile = {{ninja_to_make .CompilerLauncher}} $(compile) $(options) -Fo$@ $(in)
+{{- else}}
+cmd_compile = {{ninja_to_make .CompilerLauncher}} $(compile) $(options) -o $@ $(in)
+{{- end}}
+desc_analyze := Analyzing
+cmd_analyze = $(analyze) $(options) --analyze -Xanalyzer -analyzer-output=plist-multi-file -o $@ $(in)
+desc_gen_pch := Create PCH
+cmd_gen_pch = {{with .CompilerLauncher}}{{ninja_to_make .}} {{end}}$(gen_pch) $(options) $(in)
+desc_ar := Archiving
+cmd_ar = {{ninja_to_make .LinkLauncher}} $(ar) $(options) $@ $(in)
+desc_link := Linking
+{{- if .GroupArchives}}
+cmd_link = {{with .LinkLauncher}}{{ninja_to_make .}} {{end}}$(link) $(options) -o $@ -Wl,--start-group $(in) -Wl,--end-group
+{{- else}}
+cmd_link = {{with .LinkLauncher}}{{ninja_to_make .}} {{end}}$(link) -o $@ $(in) $(options)
+{{- end}}
+desc_packager := Packaging
+cmd_packager = $(packager) $(options) $(in) $@
+desc_convert := Converting
+cmd_convert = $(convert) $(options) -o $@ $(in)
+{{- range $k, $v := .OtherRules}}
+desc_compile{{$k}} := {{escape_value $v.Title}}
+cmd_compile{{$k}} = {{with $.CompilerLauncher}}{{ninja_to_make .}} {{end}}{{ninja_to_make $v.Command}}
+{{- end}}
+{{- range $k, $v := .AppendRules}}
+desc_{{$k}} := {{escape_value $v.Desc}}
+cmd_{{$k}} = {{ninja_to_make $v.Command}}
+{{- end}}
+desc_update_makefile := Update
+{{- /* The Makefile is left untouched if unchanged, so touches it (like restat of ninja). */}}
+cmd_update_makefile = {{.MakefileUpdater}} && touch $@
+{{- if .EnvironmentFile}}
+desc_check_environment := Check environment variables
+cmd_check_environment = {{.EnvironmentChecker}}
+{{- end}}
+
+.DEFAULT_GOAL := all
+.PHONY: all always analyze-all
+all: {{.DefaultTargets | escape_path | intercalate " "}}
+always:
+analyze-all: {{.AnalysisReports | escape_path | intercalate " "}}
+
+# end of [Rule definitions]
+{{- define "RECIPE_"}}
+	@echo '$(desc_{{.}}): $(desc)'
+	$(Q)mkdir -p $(@D)
+	$(Q)$(cmd_{{.}})
+{{- end}}
+
+# Commands
+{{.Makefile | escape_path}}: private desc = {{escape_value .Makefile}}
+{{.Makefile | escape_path}}: {{concat .ConfigSources .GeneratedFiles | escape_path | intercalate " "}}{{if .EnvironmentFile}} {{.EnvironmentFile | escape_path}}{{end}}
+{{- template "RECIPE_" "update_makefile"}}
+{{- if .GeneratedFiles}}
+{{- /* Missing ones are treated as updated, so the Makefile is regenerated (and writes them). */}}
+{{.GeneratedFiles | escape_path | intercalate " "}}:
+{{- end}}
+{{- if .EnvironmentFile}}
+
+# Imported environment variables
+{{.EnvironmentFile | escape_path}}: private desc = {{escape_value .EnvironmentFile}}
+{{.EnvironmentFile | escape_path}}: always
+{{- template "RECIPE_" "check_environment"}}
+{{- end}}
+{{range $c := .Commands}}
+{{- $out := escape_path $c.OutFile}}
+{{$out}}: private desc = {{escape_value $c.OutFile}}
+{{$out}}: private in = {{concat $c.InFiles $c.Depends | escape_path | intercalate " "}}
+{{- if $c.NeedCommandAlias}}
+{{$out}}: private {{$c.CommandType}} = {{shell_quote $c.Command}}
+{{- end}}
+{{- if $c.DepFile}}
+{{$out}}: private depf = {{escape_value $c.DepFile}}
+{{- end}}
+{{- if $c.Args}}
+{{$out}}: private options = {{shell_join $c.Args}}
+{{- end}}
+{{- if $c.Project}}
+{{$out}}: private project = {{escape_value $c.Project}}
+{{- end}}
+{{- with $c.LauncherCommand}}
+{{$out}}: private launcher = {{ninja_to_make .}}
+{{- end}}
+{{$out}}: {{concat $c.InFiles $c.Depends $c.ImplicitDepends | escape_path | intercalate " "}}
+{{- template "RECIPE_" $c.CommandType}}
+{{end}}
+# Other targets
+{{range $item := .OtherRuleTargets}}
+{{- $out := escape_path $item.Outfile}}
+{{$out}}: private desc = {{escape_value $item.Outfile}}
+{{$out}}: private in = {{escape_path $item.Infile}}
+{{$out}}: private compiler = {{shell_quote $item.Compiler}}
+{{- if $item.Include}}
+{{$out}}: private include = {{shell_join $item.Include}}
+{{- end}}
+{{- if $item.Option}}
+{{$out}}: private option = {{shell_join $item.Option}}
+{{- end}}
+{{- if $item.Define}}
+{{$out}}: private define = {{shell_join $item.Define}}
+{{- end}}
+{{- if $item.Depend}}
+{{$out}}: private depf = {{escape_value $item.Depend}}
+{{- end}}
+{{- if $item.Project}}
+{{$out}}: private project = {{escape_value $item.Project}}
+{{- end}}
+{{- with $item.LauncherCommand}}
+{{$out}}: private launcher = {{ninja_to_make .}}
+{{- end}}
+{{$out}}: {{escape_path $item.Infile}}
+{{- template "RECIPE_" $item.Rule}}
+{{end}}
+{{- if .DepFiles}}
+# Dependencies generated by compilers
+-include {{.DepFiles | escape_path | intercalate " "}}
+{{- end}}
+`
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestNinjaToMake(t *testing.T) {
+	Convey("GIVEN: Ninja command lines", t, func() {
+		type convCase struct {
+			input    string
+			expected string
+		}
+		for _, tc := range []convCase{
+			{"$compiler $include -o $out $in", "$(compiler) $(include) -o $@ $(in)"},
+			{"cat $in_newline > ${out}.tmp", "cat $(in) > $@.tmp"},
+			{"echo $$HOME # comment", `echo $$HOME \# comment`},
+			{"c$:/foo$ bar", "c:/foo bar"},
+		} {
+			Convey(fmt.Sprintf("WHEN: Converting `%s`", tc.input), func() {
+				actual := NinjaToMake(tc.input)
+				Convey(fmt.Sprintf("THEN: Should be `%s`", tc.expected), func() {
+					So(actual, ShouldEqual, tc.expected)
+				})
+			})
+		}
+	})
+}
+
+func TestEscapeMakePath(t *testing.T) {
+	Convey("GIVEN: Paths", t, func() {
+		So(EscapeMakePath("build/foo.o"), ShouldEqual, "build/foo.o")
+		So(EscapeMakePath("C:/foo bar/$x#1.o"), ShouldEqual, `c:/foo\ bar/$$x\#1.o`)
+	})
+}
+
+// prepareSampleTree copies `sample/` into a temporal directory, then replaces tools with gcc's.
+func prepareSampleTree(t *testing.T) string {
+	for _, tool := range []string{"g++", "gcc", "ar", "go"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("\"%s\" is not available", tool)
+		}
+	}
+	return copySampleTree(t, func(rel string, b []byte) []byte {
+		if rel != "make.yml" {
+			return b
+		}
+		s := strings.NewReplacer(
+			"${tool_path}clang++", "g++",
+			"${tool_path}clang", "gcc",
+			"${tool_path}llvm-ar", "ar",
+			"${tool_path}ar", "ar",
+			"define:\n", "define:\n- list: [ 'USERNAME=\"cbuild\"' ]\n").Replace(string(b))
+		return []byte(s)
+	})
+}
+
+// copySampleTree copies `sample/` into a temporal directory (contents are modified with `edit` if supplied).
+func copySampleTree(t *testing.T, edit func(rel string, b []byte) []byte) string {
+	dir, err := ioutil.TempDir("", "cbuild-sample-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = filepath.Walk("sample", func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel("sample", p)
+		dst := filepath.Join(dir, rel)
+		if fi.IsDir() {
+			return os.MkdirAll(dst, 0755)
+		}
+		b, err := ioutil.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		if edit != nil {
+			b = edit(filepath.ToSlash(rel), b)
+		}
+		return ioutil.WriteFile(dst, b, fi.Mode())
+	})
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// editSampleFile replaces strings in `rel` of the copied tree `dir` by the pairs in `oldnew` (in order).
+// Fails if any of them is not found (ex. the sample has been changed).
+func editSampleFile(t *testing.T, dir string, rel string, oldnew ...string) {
+	p := filepath.Join(dir, rel)
+	b, err := ioutil.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := string(b)
+	for i := 0; i+1 < len(oldnew); i += 2 {
+		if !strings.Contains(s, oldnew[i]) {
+			t.Fatalf("%q is not found in \"%s\"", oldnew[i], rel)
+		}
+		s = strings.Replace(s, oldnew[i], oldnew[i+1], -1)
+	}
+	if err := ioutil.WriteFile(p, []byte(s), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// generateSample collects the configurations in `dir` then writes the output using `output`.
+func generateSample(dir string, outFile string, output func(*BuildGraph) error) error {
+	return generateSampleFor(dir, "LINUX", outFile, output)
+}
+
+// generateSampleFor is same as `generateSample` except the target platform (`-type`).
+func generateSampleFor(dir string, platform string, outFile string, output func(*BuildGraph) error) error {
+	cwd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	if err := os.Chdir(dir); err != nil {
+		return err
+	}
+	defer os.Chdir(cwd)
+	saved := option
+	defer (func() {
+		option = saved
+		setImportedEnvironment(nil)
+	})()
+	option.platform = platform
+	option.variant = Debug.String()
+	option.outputRoot = "build"
+	option.outputDir = "build"
+	option.ninjaFile = outFile
+	if err := collectAll(); err != nil {
+		return err
+	}
+	return output(currentBuildGraph())
+}
+
+// ninjaDefaultClosure returns the outputs reachable from `default` statements in the ninja file.
+func ninjaDefaultClosure(ninjaFile string) ([]string, error) {
+	f, err := os.Open(ninjaFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	inputs := make(map[string][]string)
+	var defaults []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "build "):
+			kv := strings.SplitN(strings.TrimPrefix(line, "build "), " : ", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			fields := strings.Fields(strings.Replace(kv[1], "|", " ", -1))
+			inputs[strings.TrimSpace(kv[0])] = fields[1:]
+		case strings.HasPrefix(line, "default "):
+			defaults = append(defaults, strings.Fields(strings.TrimPrefix(line, "default "))...)
+		}
+	}
+	result := make([]string, 0)
+	visited := make(map[string]bool)
+	var visit func(string)
+	visit = func(p string) {
+		ins, ok := inputs[p]
+		if !ok || visited[p] {
+			return
+		}
+		visited[p] = true
+		result = append(result, p)
+		for _, in := range ins {
+			visit(in)
+		}
+	}
+	for _, d := range defaults {
+		visit(d)
+	}
+	return result, scanner.Err()
+}
+
+// listFiles returns the files under `dir` (relative to it).
+func listFiles(dir string) (map[string]bool, error) {
+	result := make(map[string]bool)
+	err := filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		result[filepath.ToSlash(rel)] = true
+		return err
+	})
+	return result, err
+}
+
+// builtFiles returns the sorted files under `dir` not listed in `generated`.
+// The depfiles (removed by ninja after reading) and the ninja's logs are excluded.
+func builtFiles(dir string, generated map[string]bool) ([]string, error) {
+	files, err := listFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]string, 0, len(files))
+	for f := range files {
+		if !generated[f] && path.Ext(f) != ".d" && !strings.HasPrefix(path.Base(f), ".ninja_") {
+			result = append(result, f)
+		}
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+// compileCommands extracts the sorted compile commands (by gcc) from the verbose output of the build in `dir`.
+// Paths in `dir` are made relative.
+func compileCommands(out []byte, dir string) []string {
+	result := make([]string, 0)
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(strings.Replace(line, dir+"/", "", -1))
+		if 0 < len(fields) && strings.HasPrefix(fields[0], "[") { // Progress of ninja
+			fields = fields[1:]
+		}
+		if len(fields) == 0 || (fields[0] != "g++" && fields[0] != "gcc") {
+			continue
+		}
+		for _, f := range fields {
+			if f == "-c" {
+				result = append(result, strings.Join(fields, " "))
+				break
+			}
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+func TestMakefileBackend(t *testing.T) {
+	if _, err := exec.LookPath("make"); err != nil {
+		t.Skip("\"make\" is not available")
+	}
+	dir := prepareSampleTree(t)
+	defer os.RemoveAll(dir)
+	// Built once (Convey runs the GIVEN for every THEN).
+	var generated map[string]bool
+	var out []byte
+	var buildErr error
+	Convey("GIVEN: The sample tree", t, func() {
+		if generated == nil {
+			So(generateSample(dir, "build.ninja", outputNinja), ShouldBeNil)
+			So(generateSample(dir, "build.ninja", (&makeGenerator{makefile: "Makefile"}).Emit), ShouldBeNil)
+			var err error
+			generated, err = listFiles(dir)
+			So(err, ShouldBeNil)
+			out, buildErr = exec.Command("make", "-C", dir, "V=1").CombinedOutput()
+		}
+		Convey("WHEN: Building with make", func() {
+			So(buildErr, ShouldBeNil)
+			Convey("THEN: All outputs required by ninja's defaults should be built", func() {
+				outputs, err := ninjaDefaultClosure(filepath.Join(dir, "build.ninja"))
+				So(err, ShouldBeNil)
+				So(len(outputs), ShouldBeGreaterThan, 0)
+				for _, o := range outputs {
+					if !filepath.IsAbs(o) {
+						o = filepath.Join(dir, o)
+					}
+					So(Exists(o), ShouldBeTrue)
+				}
+				So(string(out), ShouldContainSubstring, "Linking: build/LINUX/Debug/test.elf")
+			})
+			Convey("THEN: Nothing should be done at the 2nd time", func() {
+				out, err := exec.Command("make", "-C", dir, "-q").CombinedOutput()
+				So(err, ShouldBeNil)
+				So(string(out), ShouldNotContainSubstring, "Compiling")
+			})
+			convey := Convey
+			if _, err := exec.LookPath("ninja"); err != nil {
+				convey = SkipConvey
+			}
+			convey("THEN: ninja should build the same artifacts with the same compile commands", func() {
+				ninjaDir := prepareSampleTree(t)
+				defer os.RemoveAll(ninjaDir)
+				So(generateSample(ninjaDir, "build.ninja", outputNinja), ShouldBeNil)
+				ninjaGenerated, err := listFiles(ninjaDir)
+				So(err, ShouldBeNil)
+				ninjaOut, err := exec.Command("ninja", "-C", ninjaDir, "-v").CombinedOutput()
+				So(err, ShouldBeNil)
+				expected, err := builtFiles(dir, generated)
+				So(err, ShouldBeNil)
+				So(len(expected), ShouldBeGreaterThan, 0)
+				actual, err := builtFiles(ninjaDir, ninjaGenerated)
+				So(err, ShouldBeNil)
+				So(actual, ShouldResemble, expected)
+				commands := compileCommands(out, dir)
+				So(len(commands), ShouldBeGreaterThan, 0)
+				So(compileCommands(ninjaOut, ninjaDir), ShouldResemble, commands)
+			})
+		})
+	})
+}
+
+func TestMakefileUpdate(t *testing.T) {
+	dir := copySampleTree(t, nil)
+	defer os.RemoveAll(dir)
+	makefile := filepath.Join(dir, "Makefile")
+	emit := (&makeGenerator{makefile: "Makefile"}).Emit
+	Convey("GIVEN: A generated Makefile", t, func() {
+		So(generateSample(dir, "build.ninja", emit), ShouldBeNil)
+		old := time.Now().Add(-time.Hour)
+		So(os.Chtimes(makefile, old, old), ShouldBeNil)
+		Convey("WHEN: Generating again without changes", func() {
+			So(generateSample(dir, "build.ninja", emit), ShouldBeNil)
+			Convey("THEN: The Makefile should not be rewritten", func() {
+				fi, err := os.Stat(makefile)
+				So(err, ShouldBeNil)
+				So(fi.ModTime().Unix(), ShouldEqual, old.Unix())
+			})
+		})
+	})
+}
+
+func TestMakefileToolPaths(t *testing.T) {
+	dir := copySampleTree(t, nil)
+	defer os.RemoveAll(dir)
+	Convey("GIVEN: Tools installed in the path containing spaces", t, func() {
+		So(generateSampleFor(dir, "winclang", "build.ninja", (&makeGenerator{makefile: "Makefile"}).Emit), ShouldBeNil)
+		b, err := ioutil.ReadFile(filepath.Join(dir, "Makefile"))
+		So(err, ShouldBeNil)
+		Convey("THEN: The tools should be quoted", func() {
+			So(string(b), ShouldContainSubstring, ": private link = 'c:/Program Files/LLVM/bin/clang++'\n")
+			So(string(b), ShouldContainSubstring, ": private compiler = 'c:/Program Files/LLVM/bin/clang'\n")
+			So(string(b), ShouldContainSubstring, "cmd_link = $(link) -o $@ $(in) $(options)")
+		})
+	})
+}
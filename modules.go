@@ -0,0 +1,563 @@
+// C++20 modules (dependency scanning and ninja dyndep).
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// moduleFormat is the toolchain specific way of passing BMIs (built module interfaces).
+type moduleFormat int
+
+const (
+	moduleClang moduleFormat = iota // `-fmodule-output=` and `-fmodule-file=<name>=<bmi>` in `@<modmap>`
+	moduleGCC                       // `-fmodule-mapper=<modmap>`
+	moduleMSVC                      // `/ifcOutput` and `/reference <name>=<bmi>` in `@<modmap>`
+)
+
+var (
+	moduleFormatNames = [...]string{"clang", "gcc", "msvc"}
+	bmiExtensions     = [...]string{".pcm", ".gcm", ".ifc"}
+)
+
+func (f moduleFormat) String() string {
+	return moduleFormatNames[f]
+}
+
+// parseModuleFormat parses the format name ("clang", "gcc" or "msvc").
+func parseModuleFormat(s string) (moduleFormat, error) {
+	for i, name := range moduleFormatNames {
+		if s == name {
+			return moduleFormat(i), nil
+		}
+	}
+	return moduleClang, errors.Errorf("unknown module_format \"%s\" (clang, gcc or msvc)", s)
+}
+
+// selectModuleFormat selects the format by `${module_format}`.
+// Follows the format of pre-compiled headers if not specified.
+func selectModuleFormat(info *BuildInfo) (moduleFormat, error) {
+	if name, ok := info.variables["module_format"]; ok {
+		return parseModuleFormat(name)
+	}
+	f, err := selectPCHFormat(info)
+	if err != nil {
+		return moduleClang, err
+	}
+	switch f {
+	case pchGCC:
+		return moduleGCC, nil
+	case pchMSVC:
+		return moduleMSVC, nil
+	}
+	return moduleClang, nil
+}
+
+// isModuleInterface checks `path` is a module interface unit (`.cppm` or `.ixx`).
+func isModuleInterface(path string) bool {
+	switch filepath.Ext(path) {
+	case ".cppm", ".ixx":
+		return true
+	}
+	return false
+}
+
+// moduleScan scans the C++ sources of a target for C++20 modules.
+// Each source is scanned into `<object>.ddi` (P1689 format) by `${scan_deps}` (clang-scan-deps),
+// and they are collated into a ninja dyndep file (BMIs are built before the importers)
+// and module maps (`<object>.modmap`) passing BMIs to the compiler.
+type moduleScan struct {
+	format   moduleFormat
+	scanner  string
+	prefix   string   // Option prefix
+	dir      string   // Directory for the collated outputs
+	name     string   // Basename of the collated outputs
+	project  string   // Project of the commands
+	provides bool     // Has module interface units
+	imports  []string // Modules provided by the sub-directories
+	scans    []string // Outputs of scanning
+	modmaps  []string
+}
+
+// newModuleScan creates the scanning for `files` if any of them are module interface units
+// or the sub-directories provide modules (`imports`). Returns `nil` if modules are not used.
+func newModuleScan(info *BuildInfo, files []string, targetTag string, name string, project string, imports []string) (*moduleScan, error) {
+	provides := false
+	for _, f := range files {
+		if isModuleInterface(f) {
+			provides = true
+			break
+		}
+	}
+	if !provides && len(imports) == 0 {
+		return nil, nil
+	}
+	format, err := selectModuleFormat(info)
+	if err != nil {
+		return nil, err
+	}
+	scanner := "clang-scan-deps"
+	if _, ok := info.variables["scan_deps"]; ok {
+		if scanner, err = info.ExpandVariable("scan_deps"); err != nil {
+			return nil, err
+		}
+	}
+	return &moduleScan{
+		format:   format,
+		scanner:  scanner,
+		prefix:   info.OptionPrefix(),
+		dir:      JoinPaths(info.outputdir, buildDirectory+targetTag),
+		name:     name,
+		project:  project,
+		provides: provides,
+		imports:  imports,
+	}, nil
+}
+
+// dyndep returns the path of the dyndep file.
+func (m *moduleScan) dyndep() string {
+	return JoinPaths(m.dir, m.name+".dd")
+}
+
+// info returns the path of the modules provided by the target (imported by the parent directories).
+func (m *moduleScan) info() string {
+	return JoinPaths(m.dir, m.name+".modules.json")
+}
+
+// scan creates the command scanning `src` compiled into `obj` (`args` and `options` are same as the compilation).
+func (m *moduleScan) scan(compiler string, args []string, options []string, src string, obj string) *BuildCommand {
+	ddi := obj + ".ddi"
+	depFile := ""
+	scanArgs := append([]string{"-format=p1689", "--", compiler}, args...)
+	compileOnly := false
+	for _, opt := range options {
+		switch opt {
+		case "$out":
+			opt = ddi
+		case "$dep":
+			depFile = ddi + ".d"
+			opt = depFile
+		case "$in":
+			opt = src
+		case m.prefix + "c":
+			compileOnly = true
+		}
+		scanArgs = append(scanArgs, opt)
+	}
+	if !compileOnly {
+		scanArgs = append(scanArgs, m.prefix+"c")
+	}
+	if isModuleInterface(src) {
+		if m.format == moduleMSVC {
+			scanArgs = append(scanArgs, m.prefix+"TP")
+		} else {
+			scanArgs = append(scanArgs, "-x", "c++-module")
+		}
+	}
+	// The object is recorded as `primary-output` and used for collating.
+	if m.format == moduleMSVC {
+		scanArgs = append(scanArgs, src, m.prefix+"Fo"+portablePath(obj))
+	} else {
+		scanArgs = append(scanArgs, src, "-o", obj)
+	}
+	m.scans = append(m.scans, ddi)
+	return &BuildCommand{
+		Command:          m.scanner,
+		CommandType:      "scan_modules",
+		Args:             scanArgs,
+		InFiles:          []string{src},
+		OutFile:          ddi,
+		DepFile:          depFile,
+		NeedCommandAlias: true,
+		Project:          m.project,
+	}
+}
+
+// bind makes the compile command `cmd` (compiling `src`) use the module map and the dyndep file.
+func (m *moduleScan) bind(cmd *BuildCommand, src string) {
+	modmap := cmd.OutFile + ".modmap"
+	m.modmaps = append(m.modmaps, modmap)
+	var args []string
+	switch m.format {
+	case moduleGCC:
+		args = []string{"-fmodules-ts", "-fmodule-mapper=" + portablePath(modmap)}
+		if isModuleInterface(src) {
+			args = append(args, "-x", "c++")
+		}
+	case moduleMSVC:
+		args = []string{"@" + portablePath(modmap)}
+		if isModuleInterface(src) {
+			args = append(args, m.prefix+"interface")
+		}
+	default:
+		args = []string{"@" + portablePath(modmap)}
+		if isModuleInterface(src) {
+			args = append(args, "-x", "c++-module")
+		}
+	}
+	cmd.Args = append(cmd.Args[:len(cmd.Args):len(cmd.Args)], args...)
+	cmd.ImplicitDepends = append(cmd.ImplicitDepends, modmap)
+	cmd.OrderOnlyDepends = append(cmd.OrderOnlyDepends, m.dyndep())
+	cmd.Dyndep = m.dyndep()
+}
+
+// bindAnalysis makes the analysis `cmd` use the module map of `compile` (BMIs are ready after compiling).
+// Analysis is only available for clang.
+func (m *moduleScan) bindAnalysis(cmd *BuildCommand, compile *BuildCommand, src string) {
+	if m.format != moduleClang {
+		return
+	}
+	modmap := compile.OutFile + ".modmap"
+	args := []string{"@" + portablePath(modmap)}
+	if isModuleInterface(src) {
+		args = append(args, "-x", "c++-module")
+	}
+	cmd.Args = append(cmd.Args[:len(cmd.Args):len(cmd.Args)], args...)
+	cmd.ImplicitDepends = append(cmd.ImplicitDepends, modmap)
+	cmd.OrderOnlyDepends = append(cmd.OrderOnlyDepends, compile.OutFile)
+}
+
+// collate creates the command collating the scanned results.
+func (m *moduleScan) collate() *BuildCommand {
+	args := []string{
+		"-format", m.format.String(),
+		"-o", m.dyndep(),
+		"-info", m.info(),
+		"-bmi-dir", portablePath(JoinPaths(m.dir, "bmi")),
+	}
+	for _, i := range m.imports {
+		args = append(args, "-import", i)
+	}
+	return &BuildCommand{
+		CommandType:     "collate_modules",
+		Args:            args,
+		InFiles:         m.scans,
+		OutFile:         m.dyndep(),
+		ImplicitOutputs: append([]string{m.info()}, m.modmaps...),
+		ImplicitDepends: m.imports,
+		Project:         m.project,
+	}
+}
+
+// p1689File is the output of the dependency scanning (P1689 format).
+type p1689File struct {
+	Version  int         `json:"version"`
+	Revision int         `json:"revision"`
+	Rules    []p1689Rule `json:"rules"`
+}
+
+type p1689Rule struct {
+	PrimaryOutput string        `json:"primary-output"`
+	Provides      []p1689Module `json:"provides"`
+	Requires      []p1689Module `json:"requires"`
+}
+
+type p1689Module struct {
+	LogicalName  string `json:"logical-name"`
+	SourcePath   string `json:"source-path,omitempty"`
+	LookupMethod string `json:"lookup-method,omitempty"` // Set for header units
+	IsInterface  bool   `json:"is-interface,omitempty"`
+}
+
+// moduleInfo is a module provided by a target.
+type moduleInfo struct {
+	Name     string   `json:"name"`
+	BMI      string   `json:"bmi"`
+	Requires []string `json:"requires,omitempty"`
+}
+
+// moduleInfoFile holds the modules provided by a target (written by `collate-modules -info`).
+type moduleInfoFile struct {
+	Format  string       `json:"format"`
+	Modules []moduleInfo `json:"modules"`
+}
+
+// moduleCollation is the result of collating.
+type moduleCollation struct {
+	dyndep  []byte
+	modmaps map[string][]byte // Object to the module map
+	info    moduleInfoFile
+}
+
+// bmiPath returns the BMI of the module `name` (partitions are `<module>-<partition>`).
+func bmiPath(dir string, name string, format moduleFormat) string {
+	return path.Join(dir, strings.Replace(name, ":", "-", -1)+bmiExtensions[format])
+}
+
+// collateModules resolves the modules required by the scanned sources.
+// Modules are provided by `scans` or `imports` (provided by the other targets).
+func collateModules(format moduleFormat, bmidir string, scans []p1689File, imports []moduleInfoFile) (*moduleCollation, error) {
+	modules := make(map[string]*moduleInfo)
+	for _, f := range imports {
+		if f.Format != format.String() {
+			return nil, errors.Errorf("can't import modules built for \"%s\" (expected \"%s\")", f.Format, format)
+		}
+		for i := range f.Modules {
+			m := &f.Modules[i]
+			if prev, ok := modules[m.Name]; ok && prev.BMI != m.BMI {
+				return nil, errors.Errorf("module \"%s\" is provided by multiple targets", m.Name)
+			}
+			modules[m.Name] = m
+		}
+	}
+	var rules []p1689Rule
+	for _, s := range scans {
+		rules = append(rules, s.Rules...)
+	}
+	result := &moduleCollation{
+		modmaps: make(map[string][]byte),
+		info:    moduleInfoFile{Format: format.String(), Modules: []moduleInfo{}},
+	}
+	for _, r := range rules {
+		var requires []string
+		for _, req := range r.Requires {
+			if 0 < len(req.LookupMethod) {
+				return nil, errors.Errorf("header units are not supported (\"%s\" imported by \"%s\")", req.LogicalName, r.PrimaryOutput)
+			}
+			requires = append(requires, req.LogicalName)
+		}
+		for _, p := range r.Provides {
+			if _, ok := modules[p.LogicalName]; ok {
+				return nil, errors.Errorf("module \"%s\" is provided more than once (\"%s\")", p.LogicalName, r.PrimaryOutput)
+			}
+			m := moduleInfo{Name: p.LogicalName, BMI: bmiPath(bmidir, p.LogicalName, format), Requires: requires}
+			modules[m.Name] = &m
+			result.info.Modules = append(result.info.Modules, m)
+		}
+	}
+	sort.Slice(result.info.Modules, func(i, j int) bool {
+		return result.info.Modules[i].Name < result.info.Modules[j].Name
+	})
+
+	// Importers need the BMIs of the modules imported transitively.
+	closures := make(map[string][]string)
+	visiting := make(map[string]bool)
+	var closure func(name string, importer string) ([]string, error)
+	closure = func(name string, importer string) ([]string, error) {
+		if c, ok := closures[name]; ok {
+			return c, nil
+		}
+		m, ok := modules[name]
+		if !ok {
+			return nil, errors.Errorf("module \"%s\" imported by \"%s\" is not provided", name, importer)
+		}
+		if visiting[name] {
+			return nil, errors.Errorf("module \"%s\" imports itself", name)
+		}
+		visiting[name] = true
+		defer delete(visiting, name)
+		c, err := requiredModules(m.Requires, name, closure)
+		if err != nil {
+			return nil, err
+		}
+		closures[name] = append(c, name)
+		return closures[name], nil
+	}
+
+	var dd bytes.Buffer
+	dd.WriteString("ninja_dyndep_version = 1\n")
+	for _, r := range rules {
+		var provides, requires []string
+		for _, p := range r.Provides {
+			provides = append(provides, p.LogicalName)
+		}
+		for _, req := range r.Requires {
+			requires = append(requires, req.LogicalName)
+		}
+		deps, err := requiredModules(requires, r.PrimaryOutput, closure)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(&dd, "build %s", EscapeNinjaPath(r.PrimaryOutput))
+		if 0 < len(provides) {
+			dd.WriteString(" |")
+			for _, name := range provides {
+				fmt.Fprintf(&dd, " %s", EscapeNinjaPath(modules[name].BMI))
+			}
+		}
+		dd.WriteString(" : dyndep")
+		if 0 < len(deps) {
+			dd.WriteString(" |")
+			for _, name := range deps {
+				fmt.Fprintf(&dd, " %s", EscapeNinjaPath(modules[name].BMI))
+			}
+		}
+		dd.WriteString("\n")
+		result.modmaps[r.PrimaryOutput] = makeModuleMap(format, provides, deps, modules)
+	}
+	result.dyndep = dd.Bytes()
+	return result, nil
+}
+
+// requiredModules returns the closure of `names` (sorted, without duplicates).
+func requiredModules(names []string, importer string, closure func(string, string) ([]string, error)) ([]string, error) {
+	seen := make(map[string]bool)
+	var result []string
+	for _, name := range names {
+		c, err := closure(name, importer)
+		if err != nil {
+			return nil, err
+		}
+		for _, n := range c {
+			if !seen[n] {
+				seen[n] = true
+				result = append(result, n)
+			}
+		}
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+// makeModuleMap constructs the module map for the source providing `provides` and importing `deps`.
+func makeModuleMap(format moduleFormat, provides []string, deps []string, modules map[string]*moduleInfo) []byte {
+	var b bytes.Buffer
+	switch format {
+	case moduleGCC:
+		// Module mapper file (paths are relative to the current directory).
+		b.WriteString("$root .\n")
+		for _, name := range append(provides, deps...) {
+			fmt.Fprintf(&b, "%s %s\n", name, modules[name].BMI)
+		}
+	case moduleMSVC:
+		for _, name := range provides {
+			fmt.Fprintf(&b, "-ifcOutput %s\n", WindowsShell.QuoteArg(modules[name].BMI))
+		}
+		for _, name := range deps {
+			fmt.Fprintf(&b, "-reference %s\n", WindowsShell.QuoteArg(name+"="+modules[name].BMI))
+		}
+	default:
+		sh := DefaultShell()
+		for _, name := range provides {
+			fmt.Fprintf(&b, "%s\n", sh.QuoteArg("-fmodule-output="+modules[name].BMI))
+		}
+		for _, name := range deps {
+			fmt.Fprintf(&b, "%s\n", sh.QuoteArg("-fmodule-file="+name+"="+modules[name].BMI))
+		}
+	}
+	return b.Bytes()
+}
+
+// ScanModulesMain implements `cbuild scan-modules -o <output> -- <scanner> <args>...`.
+// The output of the scanner is written to `<output>` (left untouched if not changed).
+func ScanModulesMain(args []string) int {
+	flags := flag.NewFlagSet(ProgramName+" scan-modules", flag.ExitOnError)
+	output := flags.String("o", "", "Output file")
+	flags.Parse(args)
+	if len(*output) == 0 || flags.NArg() == 0 {
+		fmt.Fprintf(os.Stderr, "Usage: %s scan-modules -o <output> -- <scanner> <args>...\n", ProgramName)
+		return 1
+	}
+	var stdout bytes.Buffer
+	code, err := runCommand(flags.Args(), &stdout, os.Stderr)
+	if err == nil && code == 0 {
+		var f p1689File
+		if err = json.Unmarshal(stdout.Bytes(), &f); err != nil {
+			err = errors.Wrapf(err, "malformed output of \"%s\"", flags.Arg(0))
+		} else {
+			_, err = updateFile(*output, stdout.Bytes())
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s:error: %v\n", ProgramName, err)
+		return 1
+	}
+	return code
+}
+
+// pathList is a repeatable flag.
+type pathList []string
+
+func (l *pathList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *pathList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+// CollateModulesMain implements `cbuild collate-modules -o <dyndep> [options] <scanned>...`.
+func CollateModulesMain(args []string) int {
+	flags := flag.NewFlagSet(ProgramName+" collate-modules", flag.ExitOnError)
+	format := flags.String("format", "clang", "Toolchain (clang, gcc or msvc)")
+	output := flags.String("o", "", "Output dyndep file")
+	info := flags.String("info", "", "Output modules provided by the sources")
+	bmidir := flags.String("bmi-dir", ".", "Directory for BMIs")
+	var imports pathList
+	flags.Var(&imports, "import", "Modules provided by the other targets (repeatable)")
+	flags.Parse(args)
+	if err := collateModuleFiles(*format, *output, *info, *bmidir, imports, flags.Args()); err != nil {
+		fmt.Fprintf(os.Stderr, "%s:error: %v\n", ProgramName, err)
+		return 1
+	}
+	return 0
+}
+
+// collateModuleFiles collates the scanned results `scans` then writes the dyndep file `output`,
+// the module information `info` and the module maps (`<object>.modmap`).
+// Outputs are left untouched if not changed.
+func collateModuleFiles(formatName string, output string, info string, bmidir string, imports []string, scans []string) error {
+	if len(output) == 0 {
+		return errors.New("no outputs are specified")
+	}
+	format, err := parseModuleFormat(formatName)
+	if err != nil {
+		return err
+	}
+	readJSON := func(p string, v interface{}) error {
+		b, err := ioutil.ReadFile(p)
+		if err != nil {
+			return errors.Wrapf(err, "failed to read \"%s\"", p)
+		}
+		return errors.Wrapf(json.Unmarshal(b, v), "failed to parse \"%s\"", p)
+	}
+	scanned := make([]p1689File, len(scans))
+	for i, p := range scans {
+		if err := readJSON(p, &scanned[i]); err != nil {
+			return err
+		}
+	}
+	imported := make([]moduleInfoFile, len(imports))
+	for i, p := range imports {
+		if err := readJSON(p, &imported[i]); err != nil {
+			return err
+		}
+	}
+	result, err := collateModules(format, bmidir, scanned, imported)
+	if err != nil {
+		return err
+	}
+	objs := make([]string, 0, len(result.modmaps))
+	for obj := range result.modmaps {
+		objs = append(objs, obj)
+	}
+	sort.Strings(objs)
+	for _, obj := range objs {
+		if _, err := updateFile(obj+".modmap", result.modmaps[obj]); err != nil {
+			return err
+		}
+	}
+	if 0 < len(info) {
+		b, err := json.MarshalIndent(result.info, "", "    ")
+		if err != nil {
+			return errors.Wrap(err, "failed to marshal the module information")
+		}
+		if _, err := updateFile(info, append(b, '\n')); err != nil {
+			return err
+		}
+	}
+	_, err = updateFile(output, result.dyndep)
+	return err
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestCollateModules(t *testing.T) {
+	scans := []p1689File{{
+		Version: 1,
+		Rules: []p1689Rule{
+			{
+				PrimaryOutput: "obj/a.cppm.o",
+				Provides:      []p1689Module{{LogicalName: "a", IsInterface: true}},
+				Requires:      []p1689Module{{LogicalName: "a:part"}},
+			},
+			{
+				PrimaryOutput: "obj/part.cppm.o",
+				Provides:      []p1689Module{{LogicalName: "a:part", IsInterface: true}},
+			},
+			{
+				PrimaryOutput: "obj/main.cpp.o",
+				Requires:      []p1689Module{{LogicalName: "b"}, {LogicalName: "a"}},
+			},
+			{
+				PrimaryOutput: "obj/plain.cpp.o",
+			},
+		},
+	}}
+	imports := []moduleInfoFile{{
+		Format:  "clang",
+		Modules: []moduleInfo{{Name: "b", BMI: "lib/bmi/b.pcm"}},
+	}}
+	Convey("GIVEN: Scanned sources", t, func() {
+		Convey("WHEN: Collating for clang", func() {
+			r, err := collateModules(moduleClang, "obj/bmi", scans, imports)
+			So(err, ShouldBeNil)
+			Convey("THEN: BMIs should be bound to the objects", func() {
+				So(string(r.dyndep), ShouldEqual, `ninja_dyndep_version = 1
+build obj/a.cppm.o | obj/bmi/a.pcm : dyndep | obj/bmi/a-part.pcm
+build obj/part.cppm.o | obj/bmi/a-part.pcm : dyndep
+build obj/main.cpp.o : dyndep | obj/bmi/a.pcm obj/bmi/a-part.pcm lib/bmi/b.pcm
+build obj/plain.cpp.o : dyndep
+`)
+			})
+			Convey("THEN: Module maps should pass the modules imported transitively", func() {
+				So(string(r.modmaps["obj/a.cppm.o"]), ShouldEqual, "-fmodule-output=obj/bmi/a.pcm\n-fmodule-file=a:part=obj/bmi/a-part.pcm\n")
+				So(string(r.modmaps["obj/main.cpp.o"]), ShouldEqual,
+					"-fmodule-file=a=obj/bmi/a.pcm\n-fmodule-file=a:part=obj/bmi/a-part.pcm\n-fmodule-file=b=lib/bmi/b.pcm\n")
+				So(string(r.modmaps["obj/plain.cpp.o"]), ShouldEqual, "")
+			})
+			Convey("THEN: Provided modules should be recorded for the importers", func() {
+				So(r.info, ShouldResemble, moduleInfoFile{
+					Format: "clang",
+					Modules: []moduleInfo{
+						{Name: "a", BMI: "obj/bmi/a.pcm", Requires: []string{"a:part"}},
+						{Name: "a:part", BMI: "obj/bmi/a-part.pcm"},
+					},
+				})
+			})
+		})
+		Convey("WHEN: Collating for gcc", func() {
+			gccImports := []moduleInfoFile{{Format: "gcc", Modules: []moduleInfo{{Name: "b", BMI: "lib/bmi/b.gcm"}}}}
+			r, err := collateModules(moduleGCC, "obj/bmi", scans, gccImports)
+			So(err, ShouldBeNil)
+			Convey("THEN: Module mapper files should be created", func() {
+				So(string(r.modmaps["obj/a.cppm.o"]), ShouldEqual, "$root .\na obj/bmi/a.gcm\na:part obj/bmi/a-part.gcm\n")
+				So(string(r.modmaps["obj/plain.cpp.o"]), ShouldEqual, "$root .\n")
+			})
+		})
+		Convey("WHEN: Collating for MSVC", func() {
+			msvcImports := []moduleInfoFile{{Format: "msvc", Modules: []moduleInfo{{Name: "b", BMI: "lib/bmi/b.ifc"}}}}
+			r, err := collateModules(moduleMSVC, "obj/bmi", scans, msvcImports)
+			So(err, ShouldBeNil)
+			Convey("THEN: `/ifcOutput` and `/reference` should be used", func() {
+				So(string(r.modmaps["obj/a.cppm.o"]), ShouldEqual, "-ifcOutput obj/bmi/a.ifc\n-reference a:part=obj/bmi/a-part.ifc\n")
+			})
+		})
+		Convey("WHEN: Modules are broken", func() {
+			collate := func(rules ...p1689Rule) error {
+				_, err := collateModules(moduleClang, "obj/bmi", []p1689File{{Rules: rules}}, imports)
+				return err
+			}
+			Convey("THEN: Errors should be reported", func() {
+				So(collate(p1689Rule{PrimaryOutput: "x.o", Requires: []p1689Module{{LogicalName: "missing"}}}), ShouldNotBeNil)
+				So(collate(
+					p1689Rule{PrimaryOutput: "x.o", Provides: []p1689Module{{LogicalName: "x"}}},
+					p1689Rule{PrimaryOutput: "y.o", Provides: []p1689Module{{LogicalName: "x"}}}), ShouldNotBeNil)
+				So(collate(p1689Rule{PrimaryOutput: "b.o", Provides: []p1689Module{{LogicalName: "b"}}}), ShouldNotBeNil)
+				So(collate(
+					p1689Rule{PrimaryOutput: "x.o", Provides: []p1689Module{{LogicalName: "x"}}, Requires: []p1689Module{{LogicalName: "y"}}},
+					p1689Rule{PrimaryOutput: "y.o", Provides: []p1689Module{{LogicalName: "y"}}, Requires: []p1689Module{{LogicalName: "x"}}}), ShouldNotBeNil)
+				So(collate(p1689Rule{PrimaryOutput: "x.o", Requires: []p1689Module{{LogicalName: "<vector>", LookupMethod: "include-angle"}}}), ShouldNotBeNil)
+				_, err := collateModules(moduleGCC, "obj/bmi", scans, imports)
+				So(err, ShouldNotBeNil)
+			})
+		})
+	})
+}
+
+func TestCollateModuleFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cbuild-modules-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	obj := filepath.ToSlash(filepath.Join(dir, "a.cppm.o"))
+	ddi := obj + ".ddi"
+	scanned, _ := json.Marshal(p1689File{Version: 1, Rules: []p1689Rule{
+		{PrimaryOutput: obj, Provides: []p1689Module{{LogicalName: "a", IsInterface: true}}},
+	}})
+	Convey("GIVEN: A scanner", t, func() {
+		Convey("WHEN: The scanner succeeded", func() {
+			code := ScanModulesMain([]string{"-o", ddi, "--", "echo", string(scanned)})
+			Convey("THEN: The output should be written", func() {
+				So(code, ShouldEqual, 0)
+				So(Exists(ddi), ShouldBeTrue)
+			})
+			Convey("THEN: It should be collated into the files", func() {
+				dd := filepath.Join(dir, "a.dd")
+				info := filepath.Join(dir, "a.modules.json")
+				So(collateModuleFiles("clang", dd, info, "bmi", nil, []string{ddi}), ShouldBeNil)
+				b, err := ioutil.ReadFile(dd)
+				So(err, ShouldBeNil)
+				So(string(b), ShouldContainSubstring, " | bmi/a.pcm : dyndep\n")
+				b, err = ioutil.ReadFile(obj + ".modmap")
+				So(err, ShouldBeNil)
+				So(string(b), ShouldEqual, "-fmodule-output=bmi/a.pcm\n")
+				var f moduleInfoFile
+				b, err = ioutil.ReadFile(info)
+				So(err, ShouldBeNil)
+				So(json.Unmarshal(b, &f), ShouldBeNil)
+				So(f.Modules, ShouldResemble, []moduleInfo{{Name: "a", BMI: "bmi/a.pcm"}})
+			})
+		})
+		Convey("WHEN: The scanner emits garbage", func() {
+			code := ScanModulesMain([]string{"-o", filepath.Join(dir, "bad.ddi"), "--", "echo", "garbage"})
+			Convey("THEN: It should fail", func() {
+				So(code, ShouldNotEqual, 0)
+				So(Exists(filepath.Join(dir, "bad.ddi")), ShouldBeFalse)
+			})
+		})
+	})
+}
+
+func TestModuleGraph(t *testing.T) {
+	dir := copySampleTree(t, nil)
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "data", "data.cppm"), []byte("export module data;\nexport int value() { return 1; }\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	editSampleFile(t, dir, "data/make.yml", "  - data.cpp\n", "  - data.cpp\n  - data.cppm\n")
+	Convey("GIVEN: A library providing a module", t, func() {
+		var graph *BuildGraph
+		So(generateSample(dir, "build.ninja", func(g *BuildGraph) error {
+			graph = g
+			return nil
+		}), ShouldBeNil)
+		find := func(typ string, suffix string) *BuildCommand {
+			for _, c := range graph.Commands {
+				if c.CommandType == typ && strings.HasSuffix(c.InFiles[0], suffix) {
+					return c
+				}
+			}
+			return nil
+		}
+		collation := func(dir string) *BuildCommand {
+			for _, c := range graph.Commands {
+				if c.CommandType == "collate_modules" && filepath.Dir(filepath.Dir(c.OutFile)) == dir {
+					return c
+				}
+			}
+			return nil
+		}
+		Convey("THEN: Sources of the library should be scanned", func() {
+			scan := find("scan_modules", "/data.cppm")
+			So(scan, ShouldNotBeNil)
+			So(scan.Command, ShouldEqual, "clang-scan-deps")
+			So(scan.Args[:3], ShouldResemble, []string{"-format=p1689", "--", "/opt/clang/bin/clang++"})
+			So(scan.Args, ShouldContain, "c++-module")
+			So(scan.DepFile, ShouldEqual, scan.OutFile+".d")
+			So(find("scan_modules", "/data.cpp"), ShouldNotBeNil)
+		})
+		Convey("THEN: Compilations should be bound to the dyndep file", func() {
+			collate := collation("build/LINUX/Debug/data")
+			So(collate, ShouldNotBeNil)
+			So(collate.ImplicitOutputs[0], ShouldEndWith, "/data.modules.json")
+			compile := find("compile", "/data.cppm")
+			So(compile.Dyndep, ShouldEqual, collate.OutFile)
+			So(compile.OrderOnlyDepends, ShouldResemble, []string{collate.OutFile})
+			So(compile.ImplicitDepends, ShouldResemble, []string{compile.OutFile + ".modmap"})
+			So(compile.Args, ShouldContain, "@"+compile.OutFile+".modmap")
+			So(collate.ImplicitOutputs, ShouldContain, compile.OutFile+".modmap")
+		})
+		Convey("THEN: The parent directory should import the modules", func() {
+			compile := find("compile", "/test.cpp")
+			So(compile.Dyndep, ShouldNotBeEmpty)
+			var collate *BuildCommand
+			for _, c := range graph.Commands {
+				if c.OutFile == compile.Dyndep {
+					collate = c
+				}
+			}
+			So(collate, ShouldNotBeNil)
+			So(collate.ImplicitDepends, ShouldResemble, []string{collation("build/LINUX/Debug/data").ImplicitOutputs[0]})
+			So(find("compile", "/hello.c"), ShouldBeNil) // Custom rules are not scanned.
+		})
+		Convey("THEN: The ninja file should use dyndep", func() {
+			var out []byte
+			So(generateSample(dir, "build.ninja", func(g *BuildGraph) error {
+				if err := outputNinja(g); err != nil {
+					return err
+				}
+				var err error
+				out, err = ioutil.ReadFile("build.ninja")
+				return err
+			}), ShouldBeNil)
+			s := string(out)
+			So(s, ShouldContainSubstring, "\nrule collate_modules\n")
+			So(s, ShouldContainSubstring, " scan-modules -o $out -- $scan_modules $options\n")
+			So(s, ShouldContainSubstring, "    dyndep = build/LINUX/Debug/data/")
+			So(s, ShouldContainSubstring, ".modmap || build/LINUX/Debug/data/")
+		})
+		Convey("THEN: Makefiles can't be generated", func() {
+			So(generateSample(dir, "build.ninja", func(g *BuildGraph) error {
+				return (&makeGenerator{}).Emit(g)
+			}), ShouldNotBeNil)
+		})
+	})
+}
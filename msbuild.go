@@ -0,0 +1,520 @@
+// Generates MSBuild (Visual Studio) project files.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"github.com/pkg/errors"
+)
+
+// MSBuildConfiguration maps a variant to the configuration of Visual Studio.
+type MSBuildConfiguration struct {
+	Name    string // Configuration name ("Debug", "Release"...)
+	Variant string // Corresponding variant
+	Debug   bool   // Uses debug libraries
+}
+
+// msbuildConfigurations lists configurations in the generated projects.
+var msbuildConfigurations = []MSBuildConfiguration{
+	{Name: "Debug", Variant: Debug.String(), Debug: true},
+	{Name: "Release", Variant: Release.String()},
+	{Name: "Product", Variant: Product.String()},
+}
+
+// MSBuildPlatform is the platform name used in the generated projects.
+const MSBuildPlatform = "x64"
+
+// MSBuildProject holds the contents of a `.vcxproj`.
+type MSBuildProject struct {
+	Name              string
+	GUID              string
+	Platform          string
+	ConfigurationType string // "StaticLibrary", "Application", "Utility" or "Makefile"
+	Configs           []*MSBuildProjectConfig
+	Sources           []*MSBuildItem
+	Headers           []string
+	References        []*MSBuildProject
+	key               string
+}
+
+// MSBuildItem is a compiled source file.
+type MSBuildItem struct {
+	Path         string
+	ExcludedFrom []string // Configurations not containing this file
+}
+
+// MSBuildProjectConfig holds the per-configuration settings of a project.
+type MSBuildProjectConfig struct {
+	Name           string
+	Debug          bool
+	Enabled        bool // The target exists in this configuration
+	Includes       []string
+	Defines        []string
+	Options        []string // Additional compiler options
+	LinkOptions    []string // Additional linker options
+	Libraries      []string // Libraries linked (`.lib` files)
+	OutDir         string
+	TargetName     string
+	TargetExt      string
+	OutFile        string
+	BuildCommand   string
+	RebuildCommand string
+	CleanCommand   string
+}
+
+// MSBuildSettings holds the settings for generating the projects.
+type MSBuildSettings struct {
+	Solution   string // Solution name
+	RootDir    string // Absolute path of the directory contains the root `make.yml`
+	Program    string // Path to the cbuild executable
+	Platform   string // Target platform (`-type`)
+	OutputRoot string // Build directory (`-o`)
+	NinjaFile  string // Name of the ninja file (`-f`)
+	NMake      bool   // Generates NMake-style projects calling ninja
+}
+
+// ninjaCommand returns the command line which re-generates the ninja file for `cfg`, then runs ninja.
+func (s *MSBuildSettings) ninjaCommand(cfg MSBuildConfiguration, target string, clean bool) string {
+	regen := []string{s.Program, "-type", s.Platform, "-variant", cfg.Variant, "-o", s.OutputRoot, "-f", s.NinjaFile}
+	ninja := []string{"ninja", "-f", s.NinjaFile}
+	if clean {
+		ninja = append(ninja, "-t", "clean")
+	}
+	ninja = append(ninja, target)
+	return fmt.Sprintf("cd /d %s && %s && %s",
+		WindowsShell.QuoteArg(s.RootDir),
+		WindowsShell.JoinArgs(regen),
+		WindowsShell.JoinArgs(ninja))
+}
+
+// absPath converts `p` (relative to the root directory) into an absolute path.
+func (s *MSBuildSettings) absPath(p string) string {
+	if path.IsAbs(p) || filepath.IsAbs(p) || filepath.VolumeName(p) != "" {
+		return filepath.ToSlash(p)
+	}
+	return path.Join(filepath.ToSlash(s.RootDir), p)
+}
+
+// msbuildGenerator writes `.vcxproj`s and `.sln` for Visual Studio.
+type msbuildGenerator struct {
+	dir   string
+	name  string
+	nmake bool
+}
+
+func init() {
+	RegisterGenerator(&msbuildGenerator{})
+}
+
+func (*msbuildGenerator) Name() string { return "msbuild" }
+
+func (g *msbuildGenerator) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&g.dir, "msbuild-dir", "./", "MSBuild project output directory")
+	fs.StringVar(&g.name, "msbuild-proj", "out", "MSBuild project name")
+	fs.BoolVar(&g.nmake, "msbuild-nmake", false, "Export MSBuild projects as NMake-style projects invoking ninja")
+}
+
+// Emit collects all configurations by itself since a project contains all of them.
+func (g *msbuildGenerator) Emit(graph *BuildGraph) error {
+	Verbose("%s: Creates VC++ project file(s).\n", ProgramName)
+	return outputMSBuild(g.dir, g.name, g.nmake)
+}
+
+// outputMSBuild collects targets for each configuration, then writes `.vcxproj`s and `.sln`.
+func outputMSBuild(outdir, projname string, nmake bool) error {
+	variants := make([]string, 0, len(msbuildConfigurations))
+	for _, cfg := range msbuildConfigurations {
+		variants = append(variants, cfg.Variant)
+	}
+	collected, err := collectVariants(variants)
+	if err != nil {
+		return err
+	}
+	targets := make([][]*ProjectTarget, 0, len(collected))
+	for _, c := range collected {
+		targets = append(targets, c.Targets)
+	}
+	root, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	settings := MSBuildSettings{
+		Solution:   projname,
+		RootDir:    filepath.ToSlash(root),
+		Program:    filepath.ToSlash(ProgramPath),
+		Platform:   option.platform,
+		OutputRoot: option.outputRoot,
+		NinjaFile:  option.ninjaFile,
+		NMake:      nmake,
+	}
+	projects := MakeMSBuildProjects(&settings, msbuildConfigurations, targets)
+	if len(projects) == 0 {
+		fmt.Fprintf(os.Stderr, "%s: No projects to generate.\n", ProgramName)
+		return nil
+	}
+	if err := os.MkdirAll(outdir, 0755); err != nil {
+		return errors.Wrapf(err, "failed to create directory \"%s\"", outdir)
+	}
+	for _, p := range projects {
+		var b bytes.Buffer
+		if err := WriteMSBuildProject(&b, p); err != nil {
+			return err
+		}
+		out := filepath.Join(outdir, p.Name+".vcxproj")
+		Verbose("%s: Writing \"%s\"\n", ProgramName, out)
+		if _, err := updateFile(out, b.Bytes()); err != nil {
+			return err
+		}
+	}
+	var b bytes.Buffer
+	if err := WriteMSBuildSolution(&b, msbuildConfigurations, projects); err != nil {
+		return err
+	}
+	out := filepath.Join(outdir, projname+".sln")
+	Verbose("%s: Writing \"%s\"\n", ProgramName, out)
+	if _, err := updateFile(out, b.Bytes()); err != nil {
+		return err
+	}
+	return nil
+}
+
+// MakeMSBuildProjects merges `targets` (collected for each of `configs`) into projects.
+func MakeMSBuildProjects(settings *MSBuildSettings, configs []MSBuildConfiguration, targets [][]*ProjectTarget) []*MSBuildProject {
+	projects := make([]*MSBuildProject, 0)
+	byKey := make(map[string]*MSBuildProject)
+	names := make(map[string]bool)
+	keyOf := func(t *ProjectTarget) string { return t.Dir + ":" + t.Name }
+
+	// Creates projects in the order of appearance.
+	for _, ts := range targets {
+		for _, t := range ts {
+			if t.Type == "test" {
+				continue
+			}
+			key := keyOf(t)
+			if _, ok := byKey[key]; ok {
+				continue
+			}
+			name := t.Name
+			for i := 2; names[name]; i++ {
+				name = fmt.Sprintf("%s_%d", t.Name, i)
+			}
+			names[name] = true
+			p := &MSBuildProject{
+				Name:              name,
+				GUID:              msbuildGUID(settings.Solution + "/" + key),
+				Platform:          MSBuildPlatform,
+				ConfigurationType: msbuildConfigurationType(t.Type, settings.NMake),
+				key:               key,
+			}
+			for _, cfg := range configs {
+				p.Configs = append(p.Configs, &MSBuildProjectConfig{Name: cfg.Name, Debug: cfg.Debug})
+			}
+			byKey[key] = p
+			projects = append(projects, p)
+		}
+	}
+	for _, p := range projects {
+		sources := make(map[string]*MSBuildItem)
+		headers := make(map[string]bool)
+		references := make(map[string]bool)
+		for ci, cfg := range configs {
+			if len(targets) <= ci {
+				break
+			}
+			var t *ProjectTarget
+			for _, candidate := range targets[ci] {
+				if keyOf(candidate) == p.key {
+					t = candidate
+					break
+				}
+			}
+			if t == nil {
+				continue
+			}
+			pc := p.Configs[ci]
+			pc.Enabled = true
+			for _, inc := range t.Includes {
+				pc.Includes = append(pc.Includes, settings.absPath(inc))
+			}
+			pc.Defines = append(pc.Defines, t.Defines...)
+			// Options handled by MSBuild itself are removed as same as CMake.
+			pc.Options = cmakeCompileOptions(t.Options)
+			pc.LinkOptions = cmakeLinkOptions(t.LinkOptions)
+			for _, l := range t.Libraries {
+				if path.Ext(l) == "" {
+					l += ".lib"
+				}
+				pc.Libraries = append(pc.Libraries, l)
+			}
+			for _, l := range t.LinkDepends {
+				pc.Libraries = append(pc.Libraries, settings.absPath(l))
+			}
+			pc.OutFile = settings.absPath(t.OutFile)
+			pc.OutDir = path.Dir(pc.OutFile)
+			pc.TargetExt = path.Ext(pc.OutFile)
+			pc.TargetName = strings.TrimSuffix(path.Base(pc.OutFile), pc.TargetExt)
+			pc.BuildCommand = settings.ninjaCommand(cfg, t.OutFile, false)
+			pc.CleanCommand = settings.ninjaCommand(cfg, t.OutFile, true)
+			pc.RebuildCommand = pc.CleanCommand + " && " + pc.BuildCommand
+
+			contained := make(map[string]bool)
+			for _, src := range t.Sources {
+				src = settings.absPath(src)
+				contained[src] = true
+				if _, ok := sources[src]; !ok {
+					item := &MSBuildItem{Path: src}
+					// Excluded from preceding configurations.
+					for _, prev := range p.Configs[:ci] {
+						if prev.Enabled {
+							item.ExcludedFrom = append(item.ExcludedFrom, prev.Name)
+						}
+					}
+					sources[src] = item
+					p.Sources = append(p.Sources, item)
+				}
+			}
+			for _, item := range p.Sources {
+				if !contained[item.Path] && !containsString(item.ExcludedFrom, cfg.Name) {
+					item.ExcludedFrom = append(item.ExcludedFrom, cfg.Name)
+				}
+			}
+			for _, h := range t.Headers {
+				h = settings.absPath(h)
+				if !headers[h] {
+					headers[h] = true
+					p.Headers = append(p.Headers, h)
+				}
+			}
+			for _, d := range t.Depends {
+				key := keyOf(d)
+				if r, ok := byKey[key]; ok && !references[key] {
+					references[key] = true
+					p.References = append(p.References, r)
+				}
+			}
+		}
+	}
+	return projects
+}
+
+func containsString(items []string, s string) bool {
+	for _, item := range items {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func msbuildConfigurationType(targetType string, nmake bool) string {
+	if nmake {
+		return "Makefile"
+	}
+	switch targetType {
+	case "library":
+		return "StaticLibrary"
+	case "execute":
+		return "Application"
+	default:
+		return "Utility"
+	}
+}
+
+// msbuildGUID generates the stable GUID from `seed`.
+func msbuildGUID(seed string) string {
+	h := sha1.Sum([]byte(seed))
+	h[6] = (h[6] & 0x0f) | 0x50 // Version 5
+	h[8] = (h[8] & 0x3f) | 0x80 // Variant (RFC 4122)
+	return fmt.Sprintf("{%X-%X-%X-%X-%X}", h[0:4], h[4:6], h[6:8], h[8:10], h[10:16])
+}
+
+// toWindowsPath converts '/' into '\'.
+func toWindowsPath(p string) string {
+	return strings.Replace(p, "/", `\`, -1)
+}
+
+func escapeXML(s string) (string, error) {
+	var b bytes.Buffer
+	if err := xml.EscapeText(&b, []byte(s)); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+var msbuildProjectTemplate = template.Must(template.New("vcxproj").Funcs(template.FuncMap{
+	"xml":        escapeXML,
+	"join":       strings.Join,
+	"win":        toWindowsPath,
+	"shell_join": WindowsShell.JoinArgs,
+	"winpaths": func(paths []string) []string {
+		result := make([]string, 0, len(paths))
+		for _, p := range paths {
+			result = append(result, toWindowsPath(p))
+		}
+		return result
+	},
+}).Parse(`<?xml version="1.0" encoding="utf-8"?>
+<Project DefaultTargets="Build" ToolsVersion="15.0" xmlns="http://schemas.microsoft.com/developer/msbuild/2003">
+  <ItemGroup Label="ProjectConfigurations">
+{{- range $c := .Configs}}
+    <ProjectConfiguration Include="{{$c.Name}}|{{$.Platform}}">
+      <Configuration>{{$c.Name}}</Configuration>
+      <Platform>{{$.Platform}}</Platform>
+    </ProjectConfiguration>
+{{- end}}
+  </ItemGroup>
+  <PropertyGroup Label="Globals">
+    <ProjectGuid>{{.GUID}}</ProjectGuid>
+    <RootNamespace>{{xml .Name}}</RootNamespace>
+    <Keyword>{{if eq .ConfigurationType "Makefile"}}MakeFileProj{{else}}Win32Proj{{end}}</Keyword>
+  </PropertyGroup>
+  <Import Project="$(VCTargetsPath)\Microsoft.Cpp.Default.props" />
+{{- range $c := .Configs}}
+  <PropertyGroup Condition="'$(Configuration)|$(Platform)'=='{{$c.Name}}|{{$.Platform}}'" Label="Configuration">
+    <ConfigurationType>{{$.ConfigurationType}}</ConfigurationType>
+    <UseDebugLibraries>{{$c.Debug}}</UseDebugLibraries>
+    <PlatformToolset>$(DefaultPlatformToolset)</PlatformToolset>
+  </PropertyGroup>
+{{- end}}
+  <Import Project="$(VCTargetsPath)\Microsoft.Cpp.props" />
+{{- range $c := .Configs}}
+{{- if $c.Enabled}}
+  <PropertyGroup Condition="'$(Configuration)|$(Platform)'=='{{$c.Name}}|{{$.Platform}}'">
+    <OutDir>{{xml (win $c.OutDir)}}\</OutDir>
+    <TargetName>{{xml $c.TargetName}}</TargetName>
+    <TargetExt>{{xml $c.TargetExt}}</TargetExt>
+{{- if eq $.ConfigurationType "Makefile"}}
+    <NMakeBuildCommandLine>{{xml $c.BuildCommand}}</NMakeBuildCommandLine>
+    <NMakeReBuildCommandLine>{{xml $c.RebuildCommand}}</NMakeReBuildCommandLine>
+    <NMakeCleanCommandLine>{{xml $c.CleanCommand}}</NMakeCleanCommandLine>
+    <NMakeOutput>{{xml (win $c.OutFile)}}</NMakeOutput>
+    <NMakeIncludeSearchPath>{{xml (join (winpaths $c.Includes) ";")}}</NMakeIncludeSearchPath>
+    <NMakePreprocessorDefinitions>{{xml (join $c.Defines ";")}}</NMakePreprocessorDefinitions>
+{{- end}}
+  </PropertyGroup>
+{{- end}}
+{{- end}}
+{{- if ne .ConfigurationType "Makefile"}}
+{{- range $c := .Configs}}
+{{- if $c.Enabled}}
+  <ItemDefinitionGroup Condition="'$(Configuration)|$(Platform)'=='{{$c.Name}}|{{$.Platform}}'">
+    <ClCompile>
+      <AdditionalIncludeDirectories>{{range $c.Includes}}{{xml (win .)}};{{end}}%(AdditionalIncludeDirectories)</AdditionalIncludeDirectories>
+      <PreprocessorDefinitions>{{range $c.Defines}}{{xml .}};{{end}}%(PreprocessorDefinitions)</PreprocessorDefinitions>
+{{- if $c.Options}}
+      <AdditionalOptions>{{xml (shell_join $c.Options)}} %(AdditionalOptions)</AdditionalOptions>
+{{- end}}
+    </ClCompile>
+{{- if eq $.ConfigurationType "Application"}}
+    <Link>
+      <AdditionalDependencies>{{range $c.Libraries}}{{xml (win .)}};{{end}}%(AdditionalDependencies)</AdditionalDependencies>
+{{- if $c.LinkOptions}}
+      <AdditionalOptions>{{xml (shell_join $c.LinkOptions)}} %(AdditionalOptions)</AdditionalOptions>
+{{- end}}
+    </Link>
+{{- end}}
+{{- if eq $.ConfigurationType "Utility"}}
+    <PostBuildEvent>
+      <Command>{{xml $c.BuildCommand}}</Command>
+    </PostBuildEvent>
+{{- end}}
+  </ItemDefinitionGroup>
+{{- end}}
+{{- end}}
+{{- end}}
+{{- if .Sources}}
+  <ItemGroup>
+{{- range $s := .Sources}}
+{{- if $s.ExcludedFrom}}
+    <ClCompile Include="{{xml (win $s.Path)}}">
+{{- range $s.ExcludedFrom}}
+      <ExcludedFromBuild Condition="'$(Configuration)|$(Platform)'=='{{.}}|{{$.Platform}}'">true</ExcludedFromBuild>
+{{- end}}
+    </ClCompile>
+{{- else}}
+    <ClCompile Include="{{xml (win $s.Path)}}" />
+{{- end}}
+{{- end}}
+  </ItemGroup>
+{{- end}}
+{{- if .Headers}}
+  <ItemGroup>
+{{- range .Headers}}
+    <ClInclude Include="{{xml (win .)}}" />
+{{- end}}
+  </ItemGroup>
+{{- end}}
+{{- if .References}}
+  <ItemGroup>
+{{- range .References}}
+    <ProjectReference Include="{{xml .Name}}.vcxproj">
+      <Project>{{.GUID}}</Project>
+    </ProjectReference>
+{{- end}}
+  </ItemGroup>
+{{- end}}
+  <Import Project="$(VCTargetsPath)\Microsoft.Cpp.targets" />
+</Project>
+`))
+
+// WriteMSBuildProject writes `p` as `.vcxproj` into `w`.
+func WriteMSBuildProject(w io.Writer, p *MSBuildProject) error {
+	if err := msbuildProjectTemplate.Execute(w, p); err != nil {
+		return errors.Wrapf(err, "failed to render the project \"%s\"", p.Name)
+	}
+	return nil
+}
+
+// WriteMSBuildSolution writes the solution (`.sln`) contains `projects` into `w`.
+func WriteMSBuildSolution(w io.Writer, configs []MSBuildConfiguration, projects []*MSBuildProject) error {
+	const vcxprojType = "{8BC9CEB8-8B4A-11D0-8D11-00A0C91BC942}"
+	var b bytes.Buffer
+	line := func(format string, args ...interface{}) {
+		fmt.Fprintf(&b, format+"\r\n", args...)
+	}
+	line("Microsoft Visual Studio Solution File, Format Version 12.00")
+	line("# Visual Studio 15")
+	line("VisualStudioVersion = 15.0.28307.1000")
+	line("MinimumVisualStudioVersion = 10.0.40219.1")
+	for _, p := range projects {
+		line(`Project("%s") = "%s", "%s.vcxproj", "%s"`, vcxprojType, p.Name, p.Name, p.GUID)
+		line("EndProject")
+	}
+	line("Global")
+	line("\tGlobalSection(SolutionConfigurationPlatforms) = preSolution")
+	for _, cfg := range configs {
+		line("\t\t%s|%s = %s|%s", cfg.Name, MSBuildPlatform, cfg.Name, MSBuildPlatform)
+	}
+	line("\tEndGlobalSection")
+	line("\tGlobalSection(ProjectConfigurationPlatforms) = postSolution")
+	for _, p := range projects {
+		for _, pc := range p.Configs {
+			cfg := pc.Name + "|" + p.Platform
+			line("\t\t%s.%s.ActiveCfg = %s", p.GUID, cfg, cfg)
+			if pc.Enabled {
+				line("\t\t%s.%s.Build.0 = %s", p.GUID, cfg, cfg)
+			}
+		}
+	}
+	line("\tEndGlobalSection")
+	line("\tGlobalSection(SolutionProperties) = preSolution")
+	line("\t\tHideSolutionNode = FALSE")
+	line("\tEndGlobalSection")
+	line("EndGlobal")
+	if _, err := w.Write(b.Bytes()); err != nil {
+		return errors.Wrap(err, "failed to write the solution")
+	}
+	return nil
+}
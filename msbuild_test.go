@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestMakeMSBuildProjects(t *testing.T) {
+	configs := []MSBuildConfiguration{
+		{Name: "Debug", Variant: "debug", Debug: true},
+		{Name: "Release", Variant: "release"},
+	}
+	lib := func(defines ...string) *ProjectTarget {
+		return &ProjectTarget{
+			Name:     "foo",
+			Type:     "library",
+			Dir:      "./foo/",
+			Sources:  []string{"/work/foo/a.cpp"},
+			Headers:  []string{"/work/foo/a.h"},
+			Includes: []string{"include", "/usr/include/foo bar"},
+			Defines:  defines,
+			Options:  []string{"-c", "-W4", "-MF", "$dep", "-Fo$out"},
+			OutFile:  "build/WIN32/Debug/foo/foo.lib",
+		}
+	}
+	debugLib := lib("DEBUG", "MSG=\"<debug>\"")
+	releaseLib := lib("NDEBUG")
+	releaseLib.OutFile = "build/WIN32/Release/foo/foo.lib"
+	targets := [][]*ProjectTarget{
+		{
+			debugLib,
+			{
+				Name:        "app",
+				Type:        "execute",
+				Dir:         "./",
+				Sources:     []string{"/work/main.cpp", "/work/debug.cpp"},
+				LinkOptions: []string{"/DEBUG", "/MAP:$out.map"},
+				Libraries:   []string{"user32", "extra.lib"},
+				LinkDepends: []string{"lib/vendor.lib"},
+				OutFile:     "build/WIN32/Debug/app.exe",
+				Depends:     []*ProjectTarget{debugLib},
+			},
+		},
+		{
+			releaseLib,
+			{
+				Name:    "app",
+				Type:    "execute",
+				Dir:     "./",
+				Sources: []string{"/work/main.cpp"},
+				OutFile: "build/WIN32/Release/app.exe",
+				Depends: []*ProjectTarget{releaseLib},
+			},
+		},
+	}
+	settings := MSBuildSettings{
+		Solution:   "sample",
+		RootDir:    "/work",
+		Program:    "/usr/bin/cbuild",
+		Platform:   "WIN32",
+		OutputRoot: "build",
+		NinjaFile:  "build.ninja",
+	}
+	Convey("GIVEN: Targets collected for Debug and Release", t, func() {
+		Convey("WHEN: Making projects", func() {
+			projects := MakeMSBuildProjects(&settings, configs, targets)
+			So(len(projects), ShouldEqual, 2)
+			foo, app := projects[0], projects[1]
+			Convey("THEN: Projects should be merged per target", func() {
+				So(foo.Name, ShouldEqual, "foo")
+				So(foo.ConfigurationType, ShouldEqual, "StaticLibrary")
+				So(app.ConfigurationType, ShouldEqual, "Application")
+				So(app.References, ShouldResemble, []*MSBuildProject{foo})
+				So(foo.GUID, ShouldNotEqual, app.GUID)
+				So(foo.GUID, ShouldEqual, MakeMSBuildProjects(&settings, configs, targets)[0].GUID)
+			})
+			Convey("THEN: Configurations should carry their own settings", func() {
+				So(foo.Configs[0].Includes, ShouldResemble, []string{"/work/include", "/usr/include/foo bar"})
+				So(foo.Configs[0].Defines, ShouldResemble, []string{"DEBUG", "MSG=\"<debug>\""})
+				So(foo.Configs[1].Defines, ShouldResemble, []string{"NDEBUG"})
+				So(foo.Configs[0].Options, ShouldResemble, []string{"-W4"})
+				So(app.Configs[0].LinkOptions, ShouldResemble, []string{"/DEBUG"})
+				So(app.Configs[0].Libraries, ShouldResemble, []string{"user32.lib", "extra.lib", "/work/lib/vendor.lib"})
+				So(app.Configs[1].Libraries, ShouldBeEmpty)
+				So(foo.Configs[1].OutDir, ShouldEqual, "/work/build/WIN32/Release/foo")
+				So(foo.Configs[1].BuildCommand, ShouldEqual,
+					"cd /d /work && /usr/bin/cbuild -type WIN32 -variant release -o build -f build.ninja && ninja -f build.ninja build/WIN32/Release/foo/foo.lib")
+			})
+			Convey("THEN: Sources missing in some configurations should be excluded", func() {
+				So(len(app.Sources), ShouldEqual, 2)
+				So(app.Sources[0].ExcludedFrom, ShouldBeEmpty)
+				So(app.Sources[1].Path, ShouldEqual, "/work/debug.cpp")
+				So(app.Sources[1].ExcludedFrom, ShouldResemble, []string{"Release"})
+			})
+			Convey("THEN: Generated XML should be well-formed and contain the settings", func() {
+				var b bytes.Buffer
+				So(WriteMSBuildProject(&b, foo), ShouldBeNil)
+				var doc struct {
+					XMLName xml.Name `xml:"Project"`
+				}
+				So(xml.Unmarshal(b.Bytes(), &doc), ShouldBeNil)
+				actual := b.String()
+				So(actual, ShouldContainSubstring, `<ConfigurationType>StaticLibrary</ConfigurationType>`)
+				So(actual, ShouldContainSubstring,
+					`<AdditionalIncludeDirectories>\work\include;\usr\include\foo bar;%(AdditionalIncludeDirectories)</AdditionalIncludeDirectories>`)
+				So(actual, ShouldContainSubstring,
+					`<PreprocessorDefinitions>DEBUG;MSG=&#34;&lt;debug&gt;&#34;;%(PreprocessorDefinitions)</PreprocessorDefinitions>`)
+				So(actual, ShouldContainSubstring, `<ClInclude Include="\work\foo\a.h" />`)
+				So(actual, ShouldContainSubstring, `<AdditionalOptions>-W4 %(AdditionalOptions)</AdditionalOptions>`)
+				So(actual, ShouldNotContainSubstring, `<Link>`)
+				b.Reset()
+				So(WriteMSBuildProject(&b, app), ShouldBeNil)
+				So(b.String(), ShouldContainSubstring, `
+    <ClCompile Include="\work\debug.cpp">
+      <ExcludedFromBuild Condition="'$(Configuration)|$(Platform)'=='Release|x64'">true</ExcludedFromBuild>
+    </ClCompile>
+`)
+				So(b.String(), ShouldContainSubstring, `
+    <Link>
+      <AdditionalDependencies>user32.lib;extra.lib;\work\lib\vendor.lib;%(AdditionalDependencies)</AdditionalDependencies>
+      <AdditionalOptions>/DEBUG %(AdditionalOptions)</AdditionalOptions>
+    </Link>
+`)
+				So(b.String(), ShouldContainSubstring, `
+    <ProjectReference Include="foo.vcxproj">
+      <Project>`+foo.GUID+`</Project>
+    </ProjectReference>
+`)
+			})
+			Convey("THEN: Solution should list projects and configurations", func() {
+				var b bytes.Buffer
+				So(WriteMSBuildSolution(&b, configs, projects), ShouldBeNil)
+				actual := strings.Replace(b.String(), "\r\n", "\n", -1)
+				So(actual, ShouldContainSubstring,
+					`Project("{8BC9CEB8-8B4A-11D0-8D11-00A0C91BC942}") = "app", "app.vcxproj", "`+app.GUID+`"`)
+				So(actual, ShouldContainSubstring, "\t\tRelease|x64 = Release|x64\n")
+				So(actual, ShouldContainSubstring, "\t\t"+foo.GUID+".Release|x64.Build.0 = Release|x64\n")
+			})
+		})
+		Convey("WHEN: Making NMake-style projects", func() {
+			nmake := settings
+			nmake.NMake = true
+			projects := MakeMSBuildProjects(&nmake, configs[:1], targets[:1])
+			var b bytes.Buffer
+			So(WriteMSBuildProject(&b, projects[1]), ShouldBeNil)
+			Convey("THEN: Should invoke ninja", func() {
+				expected := `<?xml version="1.0" encoding="utf-8"?>
+<Project DefaultTargets="Build" ToolsVersion="15.0" xmlns="http://schemas.microsoft.com/developer/msbuild/2003">
+  <ItemGroup Label="ProjectConfigurations">
+    <ProjectConfiguration Include="Debug|x64">
+      <Configuration>Debug</Configuration>
+      <Platform>x64</Platform>
+    </ProjectConfiguration>
+  </ItemGroup>
+  <PropertyGroup Label="Globals">
+    <ProjectGuid>` + projects[1].GUID + `</ProjectGuid>
+    <RootNamespace>app</RootNamespace>
+    <Keyword>MakeFileProj</Keyword>
+  </PropertyGroup>
+  <Import Project="$(VCTargetsPath)\Microsoft.Cpp.Default.props" />
+  <PropertyGroup Condition="'$(Configuration)|$(Platform)'=='Debug|x64'" Label="Configuration">
+    <ConfigurationType>Makefile</ConfigurationType>
+    <UseDebugLibraries>true</UseDebugLibraries>
+    <PlatformToolset>$(DefaultPlatformToolset)</PlatformToolset>
+  </PropertyGroup>
+  <Import Project="$(VCTargetsPath)\Microsoft.Cpp.props" />
+  <PropertyGroup Condition="'$(Configuration)|$(Platform)'=='Debug|x64'">
+    <OutDir>\work\build\WIN32\Debug\</OutDir>
+    <TargetName>app</TargetName>
+    <TargetExt>.exe</TargetExt>
+    <NMakeBuildCommandLine>cd /d /work &amp;&amp; /usr/bin/cbuild -type WIN32 -variant debug -o build -f build.ninja &amp;&amp; ninja -f build.ninja build/WIN32/Debug/app.exe</NMakeBuildCommandLine>
+    <NMakeReBuildCommandLine>cd /d /work &amp;&amp; /usr/bin/cbuild -type WIN32 -variant debug -o build -f build.ninja &amp;&amp; ninja -f build.ninja -t clean build/WIN32/Debug/app.exe &amp;&amp; cd /d /work &amp;&amp; /usr/bin/cbuild -type WIN32 -variant debug -o build -f build.ninja &amp;&amp; ninja -f build.ninja build/WIN32/Debug/app.exe</NMakeReBuildCommandLine>
+    <NMakeCleanCommandLine>cd /d /work &amp;&amp; /usr/bin/cbuild -type WIN32 -variant debug -o build -f build.ninja &amp;&amp; ninja -f build.ninja -t clean build/WIN32/Debug/app.exe</NMakeCleanCommandLine>
+    <NMakeOutput>\work\build\WIN32\Debug\app.exe</NMakeOutput>
+    <NMakeIncludeSearchPath></NMakeIncludeSearchPath>
+    <NMakePreprocessorDefinitions></NMakePreprocessorDefinitions>
+  </PropertyGroup>
+  <ItemGroup>
+    <ClCompile Include="\work\main.cpp" />
+    <ClCompile Include="\work\debug.cpp" />
+  </ItemGroup>
+  <ItemGroup>
+    <ProjectReference Include="foo.vcxproj">
+      <Project>` + projects[0].GUID + `</Project>
+    </ProjectReference>
+  </ItemGroup>
+  <Import Project="$(VCTargetsPath)\Microsoft.Cpp.targets" />
+</Project>
+`
+				So(b.String(), ShouldEqual, expected)
+			})
+		})
+	})
+}
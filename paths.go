@@ -0,0 +1,298 @@
+// Normalizes paths in the generated build files.
+
+package main
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// PathNormalizer rewrites absolute paths under `root` to the ones relative to `base`.
+// It makes the outputs reproducible (and portable) across checkouts.
+type PathNormalizer struct {
+	root    string // Absolute path of the root (slash separated)
+	rel     string // `root` relative to `base`
+	base    string // `base` relative to the current directory
+	fromCwd string // The current directory relative to `base`
+}
+
+// NewPathNormalizer creates a normalizer for paths under `root`.
+func NewPathNormalizer(root string, base string) (*PathNormalizer, error) {
+	absRoot, err := filepath.Abs(root)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to obtain the absolute path for \"%s\"", root)
+	}
+	absBase, err := filepath.Abs(base)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to obtain the absolute path for \"%s\"", base)
+	}
+	rel, err := filepath.Rel(absBase, absRoot)
+	if err != nil {
+		return nil, errors.Wrapf(err, "\"%s\" can't be relative to \"%s\"", root, base)
+	}
+	cwd, err := os.Getwd()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to obtain the current directory")
+	}
+	fromCwd, err := filepath.Rel(absBase, cwd)
+	if err != nil {
+		return nil, errors.Wrapf(err, "the current directory can't be relative to \"%s\"", base)
+	}
+	return &PathNormalizer{
+		root:    filepath.ToSlash(absRoot),
+		rel:     filepath.ToSlash(rel),
+		base:    JoinPaths(base),
+		fromCwd: filepath.ToSlash(fromCwd),
+	}, nil
+}
+
+// Path rewrites the paths under the root contained in `s`.
+// Paths may be a part of an argument (ex. `-I/path/to/root/include` or `--sysroot=/path/to/root`).
+func (n *PathNormalizer) Path(s string) string {
+	if n.root == "/" || !strings.Contains(s, n.root) {
+		return s
+	}
+	var b strings.Builder
+	for {
+		i := strings.Index(s, n.root)
+		if i < 0 {
+			break
+		}
+		end := i + len(n.root)
+		if !isPathStart(s, i) || (end < len(s) && s[end] != '/') {
+			b.WriteString(s[:end])
+			s = s[end:]
+			continue
+		}
+		b.WriteString(s[:i])
+		s = s[end:]
+		switch {
+		case n.rel != ".":
+			b.WriteString(n.rel)
+		case len(s) == 0:
+			b.WriteString(".")
+		default:
+			s = s[1:] // Strips '/'
+		}
+	}
+	b.WriteString(s)
+	return b.String()
+}
+
+// isPathStart checks a path can start at `s[i]`.
+func isPathStart(s string, i int) bool {
+	if i == 0 {
+		return true
+	}
+	if strings.IndexByte(" \t=,;\"'@", s[i-1]) >= 0 {
+		return true
+	}
+	// Options like `-I<path>` or `-L<path>`.
+	return i == 2 && s[0] == '-'
+}
+
+// Rebase rewrites the path `p` (absolute or relative to the current directory) relative to the base.
+func (n *PathNormalizer) Rebase(p string) string {
+	if len(p) == 0 || n.fromCwd == "." || filepath.IsAbs(p) || path.IsAbs(p) {
+		return n.Path(p)
+	}
+	return path.Join(n.fromCwd, p)
+}
+
+// rebaseAll applies `Rebase` to each of `paths`.
+func (n *PathNormalizer) rebaseAll(paths []string) []string {
+	if paths == nil {
+		return nil
+	}
+	result := make([]string, 0, len(paths))
+	for _, p := range paths {
+		result = append(result, n.Rebase(p))
+	}
+	return result
+}
+
+// Paths rewrites each of `args`.
+func (n *PathNormalizer) Paths(args []string) []string {
+	if args == nil {
+		return nil
+	}
+	result := make([]string, 0, len(args))
+	for _, a := range args {
+		result = append(result, n.Path(a))
+	}
+	return result
+}
+
+// args rewrites `args` of a build statement. Arguments same as `files` (inputs, outputs...) are rebased.
+func (n *PathNormalizer) args(args []string, files map[string]bool) []string {
+	if args == nil {
+		return nil
+	}
+	result := make([]string, 0, len(args))
+	for _, a := range args {
+		if files[a] {
+			result = append(result, n.Rebase(a))
+		} else {
+			result = append(result, n.Path(a))
+		}
+	}
+	return result
+}
+
+// Graph returns a copy of `graph` whose build statements and project targets are normalized.
+func (n *PathNormalizer) Graph(graph *BuildGraph) *BuildGraph {
+	result := *graph
+	if n.base != "." {
+		result.BaseDir = n.base
+	}
+	// Files appeared in the graph (arguments referring them are also rebased).
+	files := make(map[string]bool)
+	addFiles := func(paths ...string) {
+		for _, p := range paths {
+			if 0 < len(p) {
+				files[p] = true
+			}
+		}
+	}
+	for _, c := range graph.Commands {
+		addFiles(c.OutFile, c.DepFile)
+		addFiles(c.InFiles...)
+		addFiles(c.Depends...)
+		addFiles(c.ImplicitDepends...)
+		addFiles(c.OrderOnlyDepends...)
+		addFiles(c.ImplicitOutputs...)
+	}
+	for _, f := range graph.OtherRuleFiles {
+		addFiles(f.Infile, f.Outfile, f.Depend)
+	}
+	result.Commands = make([]*BuildCommand, 0, len(graph.Commands))
+	commands := make(map[*BuildCommand]*BuildCommand, len(graph.Commands))
+	for _, c := range graph.Commands {
+		cmd := *c
+		cmd.Command = n.Path(c.Command)
+		cmd.Args = n.args(c.Args, files)
+		cmd.InFiles = n.rebaseAll(c.InFiles)
+		cmd.OutFile = n.Rebase(c.OutFile)
+		cmd.DepFile = n.Rebase(c.DepFile)
+		cmd.Depends = n.rebaseAll(c.Depends)
+		cmd.ImplicitDepends = n.rebaseAll(c.ImplicitDepends)
+		cmd.OrderOnlyDepends = n.rebaseAll(c.OrderOnlyDepends)
+		cmd.ImplicitOutputs = n.rebaseAll(c.ImplicitOutputs)
+		cmd.Dyndep = n.Rebase(c.Dyndep)
+		cmd.Sources = n.rebaseAll(c.Sources)
+		result.Commands = append(result.Commands, &cmd)
+		commands[c] = &cmd
+	}
+	result.OtherRuleFiles = make([]OtherRuleFile, 0, len(graph.OtherRuleFiles))
+	for _, f := range graph.OtherRuleFiles {
+		f.Compiler = n.Path(f.Compiler)
+		f.Include = n.Paths(f.Include)
+		f.Option = n.args(f.Option, files)
+		f.Define = n.Paths(f.Define)
+		f.Infile = n.Rebase(f.Infile)
+		f.Outfile = n.Rebase(f.Outfile)
+		f.Depend = n.Rebase(f.Depend)
+		result.OtherRuleFiles = append(result.OtherRuleFiles, f)
+	}
+	result.AppendRules = make(map[string]AppendBuild, len(graph.AppendRules))
+	for label, r := range graph.AppendRules {
+		r.Command = n.Path(r.Command)
+		result.AppendRules[label] = r
+	}
+	result.OtherRules = make(map[string]OtherRule, len(graph.OtherRules))
+	for ext, r := range graph.OtherRules {
+		r.Options = n.Paths(r.Options)
+		result.OtherRules[ext] = r
+	}
+	result.Targets = n.targets(graph.Targets, commands)
+	result.OutputDir = n.Rebase(graph.OutputDir)
+	result.SubNinjas = n.rebaseAll(graph.SubNinjas)
+	result.ConfigSources = n.rebaseAll(graph.ConfigSources)
+	result.GeneratedFiles = n.rebaseAll(graph.GeneratedFiles)
+	result.DefaultTargets = n.rebaseAll(graph.DefaultTargets)
+	return &result
+}
+
+// targets returns copies of `targets` whose paths are normalized.
+// Prebuild commands are replaced with the normalized ones in `commands`.
+func (n *PathNormalizer) targets(targets []*ProjectTarget, commands map[*BuildCommand]*BuildCommand) []*ProjectTarget {
+	if targets == nil {
+		return nil
+	}
+	copied := make(map[*ProjectTarget]*ProjectTarget, len(targets))
+	result := make([]*ProjectTarget, 0, len(targets))
+	for _, t := range targets {
+		target := *t
+		target.Sources = n.rebaseAll(t.Sources)
+		target.Headers = n.rebaseAll(t.Headers)
+		target.Includes = n.rebaseAll(t.Includes)
+		target.Options = n.Paths(t.Options)
+		target.LinkOptions = n.Paths(t.LinkOptions)
+		target.LinkDepends = n.rebaseAll(t.LinkDepends)
+		target.OutFile = n.Rebase(t.OutFile)
+		if t.Prebuilds != nil {
+			target.Prebuilds = make([]*BuildCommand, 0, len(t.Prebuilds))
+			for _, pb := range t.Prebuilds {
+				if c, ok := commands[pb]; ok {
+					pb = c
+				}
+				target.Prebuilds = append(target.Prebuilds, pb)
+			}
+		}
+		copied[t] = &target
+		result = append(result, &target)
+	}
+	for _, t := range result {
+		if t.Depends == nil {
+			continue
+		}
+		depends := make([]*ProjectTarget, 0, len(t.Depends))
+		for _, d := range t.Depends {
+			if c, ok := copied[d]; ok {
+				d = c
+			}
+			depends = append(depends, d)
+		}
+		t.Depends = depends
+	}
+	return result
+}
+
+// normalizeGraph normalizes `graph` written to `buildFile` if `-root` or `-relative-paths` is specified.
+// With `-relative-paths`, paths are relative to the directory of `buildFile`
+// (under the root, or the current directory if `-root` is not specified).
+func normalizeGraph(graph *BuildGraph, buildFile string) (*BuildGraph, error) {
+	root := option.pathRoot
+	base := "."
+	if option.relativePaths {
+		if len(root) == 0 {
+			root = "."
+		}
+		base = filepath.Dir(buildFile)
+	}
+	if len(root) == 0 {
+		return graph, nil
+	}
+	n, err := NewPathNormalizer(root, base)
+	if err != nil {
+		return nil, err
+	}
+	return n.Graph(graph), nil
+}
+
+// portablePath makes the relative path `p` absolute with `-relative-paths`.
+// It is converted to the one relative to the build file later (by `normalizeGraph`).
+func portablePath(p string) string {
+	if !option.relativePaths || filepath.IsAbs(p) {
+		return p
+	}
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		return p
+	}
+	return filepath.ToSlash(abs)
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+var updateGolden = flag.Bool("update", false, "Update golden files in testdata/")
+
+func TestPathNormalizer(t *testing.T) {
+	Convey("GIVEN: A normalizer for the current directory", t, func() {
+		cwd, err := os.Getwd()
+		So(err, ShouldBeNil)
+		root := filepath.ToSlash(cwd)
+		n, err := NewPathNormalizer(".", ".")
+		So(err, ShouldBeNil)
+		Convey("THEN: Paths under the root should be relative", func() {
+			So(n.Path(root+"/src/a.cpp"), ShouldEqual, "src/a.cpp")
+			So(n.Path(root), ShouldEqual, ".")
+			So(n.Path("-I"+root+"/include"), ShouldEqual, "-Iinclude")
+			So(n.Path("--sysroot="+root+"/sysroot"), ShouldEqual, "--sysroot=sysroot")
+			So(n.Path(root+"/tool -o $out "+root+"/a.txt"), ShouldEqual, "tool -o $out a.txt")
+			So(n.Paths([]string{root + "/a", "b"}), ShouldResemble, []string{"a", "b"})
+		})
+		Convey("THEN: Other paths should be kept", func() {
+			So(n.Path("/usr/include"), ShouldEqual, "/usr/include")
+			So(n.Path(root+"-other/a.cpp"), ShouldEqual, root+"-other/a.cpp")
+			So(n.Path("/x"+root+"/a.cpp"), ShouldEqual, "/x"+root+"/a.cpp")
+		})
+		Convey("WHEN: The base is a sub-directory", func() {
+			n, err := NewPathNormalizer(".", "build")
+			So(err, ShouldBeNil)
+			Convey("THEN: Paths should be relative to the base", func() {
+				So(n.Path(root+"/src/a.cpp"), ShouldEqual, "../src/a.cpp")
+				So(n.Rebase(root+"/src/a.cpp"), ShouldEqual, "../src/a.cpp")
+				So(n.Rebase("build/Debug/a.o"), ShouldEqual, "../build/Debug/a.o")
+				So(n.Rebase("/usr/include"), ShouldEqual, "/usr/include")
+			})
+			Convey("THEN: Arguments referring files should be rebased", func() {
+				graph := n.Graph(&BuildGraph{
+					OutputDir: "build/Debug",
+					Commands: []*BuildCommand{{
+						Command: "c++",
+						Args:    []string{"-I" + root + "/include", "-c", "-MF", "build/Debug/a.d"},
+						InFiles: []string{root + "/a.cpp"},
+						OutFile: "build/Debug/a.o",
+						DepFile: "build/Debug/a.d",
+					}},
+				})
+				So(graph.BaseDir, ShouldEqual, "build")
+				So(graph.OutputDir, ShouldEqual, "../build/Debug")
+				So(graph.LocalPath(graph.OutputDir), ShouldEqual, "build/Debug")
+				cmd := graph.Commands[0]
+				So(cmd.Command, ShouldEqual, "c++")
+				So(cmd.Args, ShouldResemble, []string{"-I../include", "-c", "-MF", "../build/Debug/a.d"})
+				So(cmd.InFiles, ShouldResemble, []string{"../a.cpp"})
+				So(cmd.OutFile, ShouldEqual, "../build/Debug/a.o")
+			})
+			Convey("THEN: Project targets should be rebased", func() {
+				lib := &ProjectTarget{Name: "a", Type: "library", OutFile: "build/Debug/liba.a"}
+				graph := n.Graph(&BuildGraph{
+					Targets: []*ProjectTarget{lib, {
+						Name:     "app",
+						Type:     "execute",
+						Sources:  []string{root + "/app.cpp"},
+						Includes: []string{root + "/include"},
+						Options:  []string{"-I" + root + "/include"},
+						OutFile:  "build/Debug/app.elf",
+						Depends:  []*ProjectTarget{lib},
+					}},
+				})
+				app := graph.Targets[1]
+				So(app.Sources, ShouldResemble, []string{"../app.cpp"})
+				So(app.Includes, ShouldResemble, []string{"../include"})
+				So(app.Options, ShouldResemble, []string{"-I../include"})
+				So(app.OutFile, ShouldEqual, "../build/Debug/app.elf")
+				So(app.Depends[0], ShouldEqual, graph.Targets[0])
+				So(graph.Targets[0].OutFile, ShouldEqual, "../build/Debug/liba.a")
+				So(lib.OutFile, ShouldEqual, "build/Debug/liba.a")
+			})
+		})
+	})
+}
+
+// TestGoldenOutputs checks the outputs for `sample/` are reproducible (`go test -update` updates them).
+func TestGoldenOutputs(t *testing.T) {
+	dir := copySampleTree(t, nil)
+	defer os.RemoveAll(dir)
+	savedArgs := os.Args
+	savedOption := option
+	defer (func() {
+		os.Args = savedArgs
+		option = savedOption
+	})()
+	option.pathRoot = "."
+	realDir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Golden files for each platform.
+	goldens := map[string]map[string]string{
+		"LINUX": {
+			"sample.ninja":                 "build.ninja",
+			"sample_compile_commands.json": "build/LINUX/Debug/compile_commands.json",
+		},
+		// Tools are installed in the path containing spaces.
+		"winclang": {
+			"sample_winclang.ninja": "build.ninja",
+		},
+	}
+	generate := func(jobs int) map[string]string {
+		option.jobs = jobs
+		result := make(map[string]string)
+		for _, platform := range []string{"LINUX", "winclang"} {
+			// The command line is recorded in the output.
+			os.Args = []string{"cbuild", "-type", platform, "-root", "."}
+			So(generateSampleFor(dir, platform, "build.ninja", (&ninjaGenerator{}).Emit), ShouldBeNil)
+			for name, p := range goldens[platform] {
+				b, err := ioutil.ReadFile(filepath.Join(dir, p))
+				So(err, ShouldBeNil)
+				result[name] = string(b)
+			}
+		}
+		return result
+	}
+	Convey("GIVEN: The sample tree", t, func() {
+		Convey("WHEN: Generating with -root", func() {
+			outputs := generate(1)
+			if *updateGolden {
+				for name, s := range outputs {
+					So(ioutil.WriteFile(filepath.Join("testdata", name), []byte(s), 0644), ShouldBeNil)
+				}
+			}
+			Convey("THEN: Outputs should match the golden files", func() {
+				So(len(outputs), ShouldEqual, 3)
+				for name, s := range outputs {
+					golden, err := ioutil.ReadFile(filepath.Join("testdata", name))
+					So(err, ShouldBeNil)
+					So(s, ShouldEqual, string(golden))
+					So(s, ShouldNotContainSubstring, filepath.ToSlash(realDir))
+					So(s, ShouldNotContainSubstring, filepath.ToSlash(dir))
+				}
+			})
+			Convey("THEN: Outputs should be identical regardless of the concurrency", func() {
+				for _, jobs := range []int{2, 8} {
+					So(generate(jobs), ShouldResemble, outputs)
+				}
+			})
+		})
+	})
+}
+
+func TestRelativePaths(t *testing.T) {
+	dir := copySampleTree(t, nil)
+	defer os.RemoveAll(dir)
+	saved := option
+	defer (func() { option = saved })()
+	option.relativePaths = true
+	realDir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	Convey("GIVEN: The sample tree", t, func() {
+		Convey("WHEN: Generating with -relative-paths into a sub-directory", func() {
+			So(generateSample(dir, "out/build.ninja", (&ninjaGenerator{}).Emit), ShouldBeNil)
+			b, err := ioutil.ReadFile(filepath.Join(dir, "out", "build.ninja"))
+			So(err, ShouldBeNil)
+			ninja := string(b)
+			Convey("THEN: Paths should be relative to the ninja file", func() {
+				So(ninja, ShouldContainSubstring, "builddir = ../build/LINUX/Debug\n")
+				So(ninja, ShouldContainSubstring, "build build.ninja : update_ninja_file ../make.yml ../data/make.yml")
+				So(ninja, ShouldContainSubstring, "command = ../build/LINUX/Debug/txt2c -o $out $in")
+				So(ninja, ShouldContainSubstring, "-I../include -I../data")
+				for _, line := range strings.Split(ninja, "\n") {
+					if strings.Contains(line, "update_ninja_file") || strings.HasPrefix(line, "    command     =") {
+						continue
+					}
+					So(line, ShouldNotContainSubstring, filepath.ToSlash(realDir))
+				}
+			})
+			Convey("THEN: The compilation database should be resolvable", func() {
+				b, err := ioutil.ReadFile(filepath.Join(dir, "build", "LINUX", "Debug", "compile_commands.json"))
+				So(err, ShouldBeNil)
+				db := string(b)
+				So(db, ShouldContainSubstring, `"directory": "`+filepath.ToSlash(realDir)+`/out"`)
+				So(db, ShouldContainSubstring, `"file": "../test.cpp"`)
+				So(db, ShouldContainSubstring, `"output": "../build/LINUX/Debug/CBuild.dir_test/test.cpp.o"`)
+			})
+		})
+	})
+}
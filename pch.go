@@ -0,0 +1,221 @@
+// Pre-compiled headers.
+
+package main
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// legacyPCHName is used as the C++ pre-compiled header if `pch:` is not specified.
+const legacyPCHName = "00-common-prefix.hpp"
+
+// pchFormat is the toolchain specific format of pre-compiled headers.
+type pchFormat int
+
+const (
+	pchClang pchFormat = iota // `-include-pch <header>.pch`
+	pchGCC                    // `-include <header>` (uses `<header>.gch`)
+	pchMSVC                   // `/Yc` and `/Yu`
+)
+
+// selectPCHFormat selects the format by `${pch_format}` ("clang", "gcc" or "msvc").
+// Defaults to "msvc" for WIN32 and "clang" for others.
+func selectPCHFormat(info *BuildInfo) (pchFormat, error) {
+	format, ok := info.variables["pch_format"]
+	if !ok {
+		if option.platform == "WIN32" {
+			return pchMSVC, nil
+		}
+		return pchClang, nil
+	}
+	switch format {
+	case "clang":
+		return pchClang, nil
+	case "gcc":
+		return pchGCC, nil
+	case "msvc":
+		return pchMSVC, nil
+	}
+	return pchClang, errors.Errorf("unknown pch_format \"%s\" (clang, gcc or msvc)", format)
+}
+
+// precompiledHeader is a pre-compiled header for a language.
+type precompiledHeader struct {
+	command     *BuildCommand // Creates the PCH
+	useArgs     []string      // Arguments for compiling with the PCH
+	analyzeArgs []string      // Arguments for analyzing (clang) with the PCH
+	object      string        // Object to be linked (MSVC)
+}
+
+// pchSet holds the pre-compiled headers of a target.
+type pchSet struct {
+	headers map[string]*precompiledHeader // Language to the PCH
+	exclude map[string]bool
+}
+
+// createPCHs creates the pre-compiled headers specified by `setting`
+// (or `00-common-prefix.hpp` in `srcdir` if not specified).
+// Returns `nil` if no PCHs are used.
+func createPCHs(info BuildInfo, srcdir string, compiler string, targetTag string, setting *PCHSetting) (*pchSet, error) {
+	if setting == nil || setting.IsEmpty() {
+		legacy := JoinPaths(srcdir, legacyPCHName)
+		if !Exists(legacy) {
+			Verbose("%s: \"%s\" is not detected.\n", ProgramName, legacy)
+			return nil, nil
+		}
+		Verbose("%s: \"%s\" found.\n", ProgramName, legacy)
+		setting = &PCHSetting{CXX: legacyPCHName}
+	}
+	format, err := selectPCHFormat(&info)
+	if err != nil {
+		return nil, err
+	}
+	set := &pchSet{headers: make(map[string]*precompiledHeader), exclude: make(map[string]bool)}
+	for _, e := range setting.Exclude {
+		set.exclude[filepath.ToSlash(filepath.Clean(e))] = true
+	}
+	for _, h := range []struct {
+		lang   *sourceLang
+		header string
+	}{{langC, setting.C}, {langCXX, setting.CXX}} {
+		if len(h.header) == 0 {
+			continue
+		}
+		header, err := info.StrictInterpolate(h.header)
+		if err != nil {
+			return nil, err
+		}
+		name := filepath.Base(header)
+		if h.lang == langC && setting.C == setting.CXX {
+			name += ".c" // Avoids collisions with the C++ one.
+		}
+		langCompiler, _, err := info.languageCompiler(h.lang, compiler) // `-x` is given by `createPCH`.
+		if err != nil {
+			return nil, err
+		}
+		pch, err := createPCH(info, srcdir, langCompiler, targetTag, header, name, h.lang, format)
+		if err != nil {
+			return nil, err
+		}
+		set.headers[h.lang.name] = pch
+	}
+	return set, nil
+}
+
+// createPCH creates the pre-compiled header `header` (relative to `srcdir`) for `lang`.
+// Outputs are named after `name`.
+func createPCH(info BuildInfo, srcdir string, compiler string, targetTag string, header string, name string, lang *sourceLang, format pchFormat) (*precompiledHeader, error) {
+	pchSrc := header
+	if !filepath.IsAbs(pchSrc) {
+		pchSrc = filepath.Join(srcdir, header)
+	}
+	if !Exists(pchSrc) {
+		return nil, errors.Errorf("pre-compiled header \"%s\" is not found", pchSrc)
+	}
+	pchSrc, _ = filepath.Abs(pchSrc)
+	pchSrc = JoinPaths(pchSrc)
+	// Objects of `info.outputdir` are placed in the same directory.
+	outdir := JoinPaths(info.outputdir, buildDirectory+targetTag)
+	pfx := info.OptionPrefix()
+	result := &precompiledHeader{}
+	var pchDst, outFile string
+	var genArgs []string
+	switch format {
+	case pchClang:
+		pchDst = JoinPaths(outdir, name+".pch")
+		outFile = pchDst
+		genArgs = []string{"-x", lang.name + "-header", "-o", pchDst}
+		result.useArgs = []string{"-include-pch", pchDst}
+		result.analyzeArgs = result.useArgs
+	case pchGCC:
+		// GCC looks for `<name>.gch` while processing `-include <name>`.
+		pchDst = JoinPaths(outdir, name+".gch")
+		outFile = pchDst
+		genArgs = []string{"-x", lang.name + "-header", "-o", pchDst}
+		result.useArgs = []string{"-include", JoinPaths(outdir, name), "-Winvalid-pch"}
+		result.analyzeArgs = []string{"-include", pchSrc}
+	case pchMSVC:
+		// The header is compiled as the source, and the object should be linked.
+		pchDst = JoinPaths(outdir, name+".pch")
+		outFile = JoinPaths(outdir, name+".obj")
+		langOpt := "TP"
+		if lang == langC {
+			langOpt = "TC"
+		}
+		genArgs = []string{pfx + "Yc" + pchSrc, pfx + "FI" + pchSrc, pfx + "Fp" + pchDst, pfx + "Fo" + outFile, pfx + langOpt}
+		result.useArgs = []string{pfx + "Yu" + pchSrc, pfx + "FI" + pchSrc, pfx + "Fp" + pchDst}
+		result.analyzeArgs = []string{"-include", pchSrc}
+		result.object = outFile
+	}
+	Verbose("%s: Create PCH \"%s\"\n", ProgramName, pchDst)
+	depFile := ""
+	args := append(info.includes, info.defines...)
+	for _, opt := range append(info.options[:len(info.options):len(info.options)], info.languageOptions(lang)...) {
+		switch opt {
+		case "$out":
+			opt = outFile
+		case "$dep":
+			depFile = outFile + ".dep"
+			opt = depFile
+		case "$in":
+			opt = pchSrc
+		}
+		args = append(args, opt)
+	}
+	args = append(args[:len(args):len(args)], genArgs...)
+	Verbose("%s: PCH creation command line is \"%s\".\n", ProgramName, strings.Join(args, " "))
+	result.command = &BuildCommand{
+		Command:          compiler,
+		CommandType:      "gen_pch",
+		Args:             args,
+		InFiles:          []string{pchSrc},
+		OutFile:          outFile,
+		DepFile:          depFile,
+		NeedCommandAlias: true,
+		Project:          info.target,
+		Launcher:         info.launcher,
+	}
+	return result, nil
+}
+
+// sorted returns the PCHs in the order of the languages.
+func (s *pchSet) sorted() []*precompiledHeader {
+	if s == nil {
+		return nil
+	}
+	langs := make([]string, 0, len(s.headers))
+	for lang := range s.headers {
+		langs = append(langs, lang)
+	}
+	sort.Strings(langs)
+	result := make([]*precompiledHeader, 0, len(langs))
+	for _, lang := range langs {
+		result = append(result, s.headers[lang])
+	}
+	return result
+}
+
+// lookup returns the PCH used for compiling `src` (`nil` if not used).
+// `src` is the path listed in `make.yml` (excluded sources are matched by the path or the basename).
+func (s *pchSet) lookup(src string) *precompiledHeader {
+	if s == nil {
+		return nil
+	}
+	if s.excludes(src) {
+		return nil
+	}
+	return s.headers[sourceLanguage(src)]
+}
+
+// excludes checks `src` is excluded from using the PCHs.
+func (s *pchSet) excludes(src string) bool {
+	if s == nil {
+		return false
+	}
+	p := filepath.ToSlash(filepath.Clean(src))
+	return s.exclude[p] || s.exclude[filepath.Base(p)]
+}
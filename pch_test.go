@@ -0,0 +1,174 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/yaml.v2"
+)
+
+func TestPCHSetting(t *testing.T) {
+	Convey("GIVEN: `pch:` settings", t, func() {
+		var targets []Target
+		So(yaml.Unmarshal([]byte(`
+- {name: a, pch: common.hpp}
+- name: b
+  pch: {c: common.h, cxx: common.hpp, exclude: [legacy.cpp]}
+- name: c
+`), &targets), ShouldBeNil)
+		Convey("THEN: A scalar should be the C++ header", func() {
+			So(targets[0].PCH, ShouldResemble, PCHSetting{CXX: "common.hpp"})
+		})
+		Convey("THEN: Headers can be specified per language", func() {
+			So(targets[1].PCH, ShouldResemble, PCHSetting{C: "common.h", CXX: "common.hpp", Exclude: []string{"legacy.cpp"}})
+			So(targets[2].PCH.IsEmpty(), ShouldBeTrue)
+		})
+	})
+}
+
+func TestCreatePCHs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cbuild-pch-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"common.h", "common.hpp"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("#pragma once\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	info := BuildInfo{
+		variables: map[string]string{},
+		includes:  []string{"-Iinclude"},
+		options:   []string{"-c", "-MMD", "-MF", "$dep"},
+		outputdir: "build/lib",
+		target:    "lib",
+	}
+	setting := &PCHSetting{C: "common.h", CXX: "common.hpp", Exclude: []string{"legacy.cpp"}}
+	create := func(format string) *pchSet {
+		info.variables["pch_format"] = format
+		pchs, err := createPCHs(info, dir, "cc", "_lib", setting)
+		So(err, ShouldBeNil)
+		So(pchs, ShouldNotBeNil)
+		return pchs
+	}
+	Convey("GIVEN: Headers for C and C++", t, func() {
+		Convey("WHEN: Using clang", func() {
+			pchs := create("clang")
+			Convey("THEN: PCHs should be selected by the language", func() {
+				So(pchs.lookup("a.c").command.OutFile, ShouldEqual, "build/lib/CBuild.dir_lib/common.h.pch")
+				So(pchs.lookup("sub/a.cpp").command.OutFile, ShouldEqual, "build/lib/CBuild.dir_lib/common.hpp.pch")
+				So(pchs.lookup("a.cpp").useArgs, ShouldResemble, []string{"-include-pch", "build/lib/CBuild.dir_lib/common.hpp.pch"})
+				So(pchs.lookup("a.s"), ShouldBeNil)
+			})
+			Convey("THEN: Excluded sources should not use PCHs", func() {
+				So(pchs.lookup("legacy.cpp"), ShouldBeNil)
+				So(pchs.lookup("sub/legacy.cpp"), ShouldBeNil)
+			})
+			Convey("THEN: The header should be compiled in the language", func() {
+				cmds := pchs.sorted()
+				So(len(cmds), ShouldEqual, 2)
+				cmd := cmds[0].command
+				So(cmd.CommandType, ShouldEqual, "gen_pch")
+				So(cmd.InFiles, ShouldResemble, []string{filepath.ToSlash(filepath.Join(dir, "common.h"))})
+				So(cmd.DepFile, ShouldEqual, "build/lib/CBuild.dir_lib/common.h.pch.dep")
+				So(strings.Join(cmd.Args, " "), ShouldEndWith, "-x c-header -o build/lib/CBuild.dir_lib/common.h.pch")
+				So(strings.Join(cmds[1].command.Args, " "), ShouldContainSubstring, "-x c++-header")
+			})
+		})
+		Convey("WHEN: Using gcc", func() {
+			pchs := create("gcc")
+			Convey("THEN: `.gch` should be created next to the included name", func() {
+				p := pchs.lookup("a.cpp")
+				So(p.command.OutFile, ShouldEqual, "build/lib/CBuild.dir_lib/common.hpp.gch")
+				So(p.useArgs, ShouldResemble, []string{"-include", "build/lib/CBuild.dir_lib/common.hpp", "-Winvalid-pch"})
+			})
+		})
+		Convey("WHEN: Using MSVC", func() {
+			pchs := create("msvc")
+			Convey("THEN: `/Yc` and `/Yu` should be used", func() {
+				p := pchs.lookup("a.cpp")
+				hdr := filepath.ToSlash(filepath.Join(dir, "common.hpp"))
+				So(p.command.OutFile, ShouldEqual, "build/lib/CBuild.dir_lib/common.hpp.obj")
+				So(p.object, ShouldEqual, p.command.OutFile)
+				So(p.command.Args, ShouldContain, "-Yc"+hdr)
+				So(p.command.Args, ShouldContain, "-TP")
+				So(p.useArgs, ShouldResemble, []string{"-Yu" + hdr, "-FI" + hdr, "-Fpbuild/lib/CBuild.dir_lib/common.hpp.pch"})
+				So(pchs.lookup("a.c").command.Args, ShouldContain, "-TC")
+			})
+		})
+		Convey("WHEN: The header does not exist", func() {
+			_, err := createPCHs(info, dir, "cc", "_lib", &PCHSetting{CXX: "missing.hpp"})
+			Convey("THEN: It should be an error", func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+		Convey("WHEN: Nothing is specified", func() {
+			pchs, err := createPCHs(info, dir, "cc", "_lib", nil)
+			Convey("THEN: PCHs should not be used", func() {
+				So(err, ShouldBeNil)
+				So(pchs, ShouldBeNil)
+				So(pchs.lookup("a.cpp"), ShouldBeNil)
+			})
+		})
+	})
+}
+
+func TestPCHBuild(t *testing.T) {
+	dir := prepareSampleTree(t)
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "common.hpp"), []byte("#ifndef COMMON_HPP\n#define COMMON_HPP\n#include <cstdio>\n#endif\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	editSampleFile(t, dir, "make.yml",
+		"variable:\n", "variable:\n- {name: pch_format, value: gcc}\n",
+		"- name: test\n  type: execute\n", "- name: test\n  type: execute\n  pch: {cxx: common.hpp, exclude: [sub/test_sub.cpp]}\n",
+	)
+	Convey("GIVEN: A target using the PCH", t, func() {
+		var graph *BuildGraph
+		So(generateSample(dir, "build.ninja", func(g *BuildGraph) error {
+			graph = g
+			return nil
+		}), ShouldBeNil)
+		find := func(typ string, suffix string) *BuildCommand {
+			for _, c := range graph.Commands {
+				if c.CommandType == typ && strings.HasSuffix(c.InFiles[0], suffix) {
+					return c
+				}
+			}
+			return nil
+		}
+		gen := find("gen_pch", "/common.hpp")
+		So(gen, ShouldNotBeNil)
+		So(gen.OutFile, ShouldEqual, "build/LINUX/Debug/CBuild.dir_test/common.hpp.gch")
+		Convey("THEN: Sources should depend on the PCH except the excluded ones", func() {
+			So(find("compile", "/test.cpp").ImplicitDepends, ShouldResemble, []string{gen.OutFile})
+			So(find("compile", "/test_sub.cpp").ImplicitDepends, ShouldBeEmpty)
+			So(find("compile", "/test_sub.cpp").Args, ShouldNotContain, "-Winvalid-pch")
+		})
+		Convey("THEN: The PCH should be used by the compiler", func() {
+			run := func(args ...string) string {
+				cmd := exec.Command(args[0], args[1:]...)
+				cmd.Dir = dir
+				out, err := cmd.CombinedOutput()
+				if err != nil {
+					t.Log(string(out))
+				}
+				So(err, ShouldBeNil)
+				return string(out)
+			}
+			So(os.MkdirAll(filepath.Join(dir, filepath.Dir(gen.OutFile)), 0755), ShouldBeNil)
+			run(append(append([]string{"g++"}, gen.Args...), gen.InFiles...)...)
+			So(Exists(filepath.Join(dir, gen.OutFile)), ShouldBeTrue)
+			c := find("compile", "/test.cpp")
+			out := run(append(append([]string{"g++", "-H"}, c.Args...), "-o", filepath.Join(dir, "test.o"), c.InFiles[0])...)
+			So(out, ShouldStartWith, "! ")
+			So(strings.SplitN(out, "\n", 2)[0], ShouldEndWith, gen.OutFile)
+		})
+	})
+}
@@ -0,0 +1,161 @@
+// Escaping/quoting for ninja files and command shells.
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ShellType represents the quoting convention of the command lines.
+type ShellType string
+
+const (
+	// PosixShell quotes arguments for POSIX `sh`.
+	PosixShell ShellType = "sh"
+	// WindowsShell quotes arguments for `cmd.exe` (and MSVC runtime's argument parser).
+	WindowsShell ShellType = "cmd"
+)
+
+// DefaultShell returns the shell type of the running platform.
+func DefaultShell() ShellType {
+	if runtime.GOOS == "windows" {
+		return WindowsShell
+	}
+	return PosixShell
+}
+
+// ParseShellType converts `s` ("sh", "cmd") into `ShellType`.
+func ParseShellType(s string) (ShellType, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "sh", "posix", "bash":
+		return PosixShell, nil
+	case "cmd", "cmd.exe", "windows":
+		return WindowsShell, nil
+	}
+	return "", errors.Errorf("unknown shell type \"%s\" (should be \"sh\" or \"cmd\")", s)
+}
+
+// QuoteArg quotes `arg` for the shell if needed.
+// `$` is left as is since ninja expands `$name` before passing the command to the shell.
+func (sh ShellType) QuoteArg(arg string) string {
+	if sh == WindowsShell {
+		return quoteWindowsArg(arg)
+	}
+	return quotePosixArg(arg)
+}
+
+// JoinArgs quotes and joins `args` with ' '.
+func (sh ShellType) JoinArgs(args []string) string {
+	tmp := make([]string, 0, len(args))
+	for _, arg := range args {
+		tmp = append(tmp, sh.QuoteArg(arg))
+	}
+	return strings.Join(tmp, " ")
+}
+
+func quotePosixArg(arg string) string {
+	if len(arg) == 0 {
+		return "''"
+	}
+	safe := true
+	for _, ch := range arg {
+		if !(('a' <= ch && ch <= 'z') || ('A' <= ch && ch <= 'Z') || ('0' <= ch && ch <= '9') ||
+			strings.ContainsRune("_@%+=:,./-$", ch)) {
+			safe = false
+			break
+		}
+	}
+	if safe {
+		return arg
+	}
+	return "'" + strings.Replace(arg, "'", `'\''`, -1) + "'"
+}
+
+func quoteWindowsArg(arg string) string {
+	if 0 < len(arg) && !strings.ContainsAny(arg, " \t\n\v\"&|<>^") {
+		return arg
+	}
+	var b strings.Builder
+	b.WriteByte('"')
+	backslashes := 0
+	for _, ch := range arg {
+		switch ch {
+		case '\\':
+			backslashes++
+			continue
+		case '"':
+			// Backslashes preceding `"` should be doubled, then `"` is escaped.
+			b.WriteString(strings.Repeat(`\`, backslashes*2+1))
+		default:
+			b.WriteString(strings.Repeat(`\`, backslashes))
+		}
+		backslashes = 0
+		b.WriteRune(ch)
+	}
+	// Backslashes preceding the closing `"` should be doubled.
+	b.WriteString(strings.Repeat(`\`, backslashes*2))
+	b.WriteByte('"')
+	return b.String()
+}
+
+// EscapeNinjaPath escapes `p` for using as a path in ninja's `build` (and `default`, `subninja`) statements.
+func EscapeNinjaPath(p string) string {
+	p = lowerDriveLetter(p)
+	r := strings.NewReplacer("$", "$$", " ", "$ ", ":", "$:", "\n", "$\n")
+	return r.Replace(p)
+}
+
+// EscapeNinjaValue escapes `s` for using as a variable value in ninja.
+func EscapeNinjaValue(s string) string {
+	r := strings.NewReplacer("$", "$$", "\n", "$\n")
+	return r.Replace(s)
+}
+
+// UnescapeNinja restores `$$` and `$ ` like sequences into the original characters.
+// References to the ninja variables (ex. `$out`) are kept as is.
+func UnescapeNinja(s string) string {
+	if !strings.Contains(s, "$") {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '$' && i+1 < len(s) && strings.IndexByte("$ :\n", s[i+1]) >= 0 {
+			i++
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// lowerDriveLetter converts the drive letter (ex. `C:/...`) to lower case.
+func lowerDriveLetter(p string) string {
+	if 2 <= len(p) && p[1] == ':' {
+		if ch := p[0]; 'A' <= ch && ch <= 'Z' {
+			return strings.ToLower(p[:1]) + p[1:]
+		}
+	}
+	return p
+}
+
+// escapeNinjaPaths applies `EscapeNinjaPath` to a path or a list of paths.
+func escapeNinjaPaths(arg interface{}) (interface{}, error) {
+	switch v := arg.(type) {
+	case string:
+		return EscapeNinjaPath(v), nil
+	case []string:
+		tmp := make([]string, 0, len(v))
+		for _, p := range v {
+			tmp = append(tmp, EscapeNinjaPath(p))
+		}
+		return tmp, nil
+	default:
+		if s, ok := arg.(fmt.Stringer); ok {
+			return EscapeNinjaPath(s.String()), nil
+		}
+	}
+	return "", errors.Errorf("can't convert \"%v\" to string", arg)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestShellType_QuoteArg(t *testing.T) {
+	type quoteCase struct {
+		input    string
+		expected string
+	}
+	Convey("GIVEN: POSIX shell", t, func() {
+		for _, tc := range []quoteCase{
+			{"-Iinclude", "-Iinclude"},
+			{"$out", "$out"},
+			{"", "''"},
+			{"/usr/foo bar", "'/usr/foo bar'"},
+			{`-DMSG="hello"`, `'-DMSG="hello"'`},
+			{"it's", `'it'\''s'`},
+			{"a;b", "'a;b'"},
+		} {
+			Convey(fmt.Sprintf("WHEN: Quoting `%s`", tc.input), func() {
+				actual := PosixShell.QuoteArg(tc.input)
+				Convey(fmt.Sprintf("THEN: Should be `%s`", tc.expected), func() {
+					So(actual, ShouldEqual, tc.expected)
+				})
+			})
+		}
+	})
+	Convey("GIVEN: Windows shell", t, func() {
+		for _, tc := range []quoteCase{
+			{"/Iinclude", "/Iinclude"},
+			{`c:\foo\bar`, `c:\foo\bar`},
+			{"", `""`},
+			{`c:\Program Files\foo`, `"c:\Program Files\foo"`},
+			{`c:\Program Files\`, `"c:\Program Files\\"`},
+			{`-DMSG="hello"`, `"-DMSG=\"hello\""`},
+			{`a\"b`, `"a\\\"b"`},
+		} {
+			Convey(fmt.Sprintf("WHEN: Quoting `%s`", tc.input), func() {
+				actual := WindowsShell.QuoteArg(tc.input)
+				Convey(fmt.Sprintf("THEN: Should be `%s`", tc.expected), func() {
+					So(actual, ShouldEqual, tc.expected)
+				})
+			})
+		}
+	})
+}
+
+func TestEscapeNinja(t *testing.T) {
+	Convey("GIVEN: Paths", t, func() {
+		type escapeCase struct {
+			input    string
+			expected string
+		}
+		for _, tc := range []escapeCase{
+			{"build/foo.o", "build/foo.o"},
+			{"C:/foo/bar.o", "c$:/foo/bar.o"},
+			{"/usr/foo bar/baz.o", "/usr/foo$ bar/baz.o"},
+			{"a$b", "a$$b"},
+		} {
+			Convey(fmt.Sprintf("WHEN: Escaping `%s`", tc.input), func() {
+				actual := EscapeNinjaPath(tc.input)
+				Convey(fmt.Sprintf("THEN: Should be `%s`", tc.expected), func() {
+					So(actual, ShouldEqual, tc.expected)
+				})
+				Convey("THEN: Unescaping should restore it (except the drive letter)", func() {
+					So(UnescapeNinja(actual), ShouldEqual, lowerDriveLetter(tc.input))
+				})
+			})
+		}
+		Convey("WHEN: Unescaping the string contains ninja variables", func() {
+			actual := UnescapeNinja("-o $out -DPRICE=$$10")
+			Convey("THEN: Variable references should be kept", func() {
+				So(actual, ShouldEqual, "-o $out -DPRICE=$10")
+			})
+		})
+	})
+}
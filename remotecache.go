@@ -0,0 +1,287 @@
+// HTTP remote cache client (Bazel remote cache style).
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultRemoteCacheTimeout is the default timeout of the requests to the remote cache.
+const DefaultRemoteCacheTimeout = 5 * time.Second
+
+// maxRemoteBlobSize limits the size of the blobs downloaded from the remote cache.
+const maxRemoteBlobSize = 1 << 30
+
+const (
+	// remoteCacheBackoff is the period the remote cache is disabled after the first failure
+	// (doubled on each consecutive failure).
+	remoteCacheBackoff = 30 * time.Second
+	// maxRemoteCacheBackoff limits the period the remote cache is disabled.
+	maxRemoteCacheBackoff = 30 * time.Minute
+)
+
+// RemoteCache is a client of the HTTP remote cache.
+// Blobs are stored as `<URL>/cas/<sha256 of the blob>`, and the action results
+// (maps from the outputs to the blobs) are stored as `<URL>/ac/<cache key>`.
+// Any errors (including timeouts) disable the remote cache for the rest of the process
+// and the compilation falls back to the local one.
+// The failure is also recorded in `StateFile` (if specified), so the following processes
+// skip the remote cache until the backoff period expires.
+type RemoteCache struct {
+	URL       string
+	Writable  bool   // Uploads the results (read-only if `false`)
+	StateFile string // Records the failures across the processes ("" for not recording)
+	client    *http.Client
+	mutex     sync.Mutex
+	failure   error
+	checked   bool // `StateFile` is checked
+	retrying  bool // Retrying after the backoff period
+}
+
+// remoteCacheState is the content of `RemoteCache.StateFile`.
+type remoteCacheState struct {
+	RetryAt  time.Time `json:"retry_at"`
+	Failures int       `json:"failures"`
+	Error    string    `json:"error"`
+}
+
+// remoteActionResult is the content of `/ac/<key>`.
+type remoteActionResult struct {
+	Object  string `json:"object"`
+	Depfile string `json:"depfile,omitempty"`
+	Stderr  string `json:"stderr,omitempty"`
+}
+
+// NewRemoteCache creates a client for `url`.
+func NewRemoteCache(url string, writable bool, timeout time.Duration) *RemoteCache {
+	return &RemoteCache{
+		URL:      strings.TrimRight(url, "/"),
+		Writable: writable,
+		client:   &http.Client{Timeout: timeout},
+	}
+}
+
+// OpenRemoteCache opens the remote cache specified by `$CBUILD_REMOTE_CACHE`.
+// `$CBUILD_REMOTE_CACHE_MODE` is "read-only" (default) or "read-write",
+// and `$CBUILD_REMOTE_CACHE_TIMEOUT` is a duration (ex. "500ms").
+// Returns `nil` if the remote cache is not configured.
+func OpenRemoteCache() (*RemoteCache, error) {
+	url := os.Getenv("CBUILD_REMOTE_CACHE")
+	if len(url) == 0 {
+		return nil, nil
+	}
+	writable := false
+	switch mode := os.Getenv("CBUILD_REMOTE_CACHE_MODE"); mode {
+	case "", "read-only":
+		/* NO-OP */
+	case "read-write":
+		writable = true
+	default:
+		return nil, errors.Errorf("malformed CBUILD_REMOTE_CACHE_MODE \"%s\" (read-only or read-write)", mode)
+	}
+	timeout := DefaultRemoteCacheTimeout
+	if s := os.Getenv("CBUILD_REMOTE_CACHE_TIMEOUT"); 0 < len(s) {
+		var err error
+		if timeout, err = time.ParseDuration(s); err != nil {
+			return nil, errors.Wrap(err, "malformed CBUILD_REMOTE_CACHE_TIMEOUT")
+		}
+	}
+	return NewRemoteCache(url, writable, timeout), nil
+}
+
+// Failure returns the error disabled the remote cache (`nil` if available).
+func (r *RemoteCache) Failure() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.failure == nil && !r.checked {
+		r.checked = true
+		if state, ok := r.readState(); ok {
+			if time.Now().Before(state.RetryAt) {
+				r.failure = errors.Errorf("disabled until %s (%s)", state.RetryAt.Format(time.RFC3339), state.Error)
+			} else {
+				r.retrying = true
+			}
+		}
+	}
+	return r.failure
+}
+
+// fail disables the remote cache (and records the failure to `StateFile`).
+func (r *RemoteCache) fail(err error) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.failure != nil {
+		return err
+	}
+	r.failure = err
+	if len(r.StateFile) == 0 {
+		return err
+	}
+	state, _ := r.readState()
+	backoff := maxRemoteCacheBackoff
+	if state.Failures < 16 {
+		if d := remoteCacheBackoff << uint(state.Failures); d < backoff {
+			backoff = d
+		}
+	}
+	state = remoteCacheState{RetryAt: time.Now().Add(backoff), Failures: state.Failures + 1, Error: err.Error()}
+	if b, e := json.Marshal(&state); e == nil {
+		writeFileAtomically(r.StateFile, b)
+	}
+	return err
+}
+
+// succeed clears the failures recorded in `StateFile` (after the backoff period expired).
+func (r *RemoteCache) succeed() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.retrying && r.failure == nil {
+		r.retrying = false
+		os.Remove(r.StateFile)
+	}
+}
+
+// readState reads `StateFile` (`false` if not recorded).
+func (r *RemoteCache) readState() (remoteCacheState, bool) {
+	var state remoteCacheState
+	if len(r.StateFile) == 0 {
+		return state, false
+	}
+	b, err := ioutil.ReadFile(r.StateFile)
+	if err != nil || json.Unmarshal(b, &state) != nil {
+		return remoteCacheState{}, false
+	}
+	return state, true
+}
+
+// Get retrieves the entry for `key`. Returns `nil` if not found.
+func (r *RemoteCache) Get(key string) (*cacheEntry, error) {
+	if r.Failure() != nil {
+		return nil, nil
+	}
+	b, err := r.get("ac", key)
+	if err != nil || b == nil {
+		return nil, err
+	}
+	var ar remoteActionResult
+	if err := json.Unmarshal(b, &ar); err != nil || len(ar.Object) == 0 {
+		// Broken entries are treated as missing.
+		return nil, nil
+	}
+	entry := &cacheEntry{}
+	for _, blob := range []struct {
+		digest string
+		dst    *[]byte
+	}{
+		{ar.Object, &entry.Object},
+		{ar.Depfile, &entry.Depfile},
+		{ar.Stderr, &entry.Stderr},
+	} {
+		if len(blob.digest) == 0 {
+			continue
+		}
+		b, err := r.get("cas", blob.digest)
+		if err != nil || b == nil {
+			return nil, err
+		}
+		if digestOf(b) != blob.digest {
+			return nil, nil
+		}
+		*blob.dst = b
+	}
+	return entry, nil
+}
+
+// Put uploads `entry` as `key` (blobs first, then the action result).
+// It does nothing in read-only mode.
+func (r *RemoteCache) Put(key string, entry *cacheEntry) error {
+	if !r.Writable || r.Failure() != nil {
+		return nil
+	}
+	var ar remoteActionResult
+	for _, blob := range []struct {
+		data   []byte
+		digest *string
+	}{
+		{entry.Object, &ar.Object},
+		{entry.Depfile, &ar.Depfile},
+		{entry.Stderr, &ar.Stderr},
+	} {
+		if blob.data == nil {
+			continue
+		}
+		*blob.digest = digestOf(blob.data)
+		if err := r.put("cas", *blob.digest, blob.data); err != nil {
+			return err
+		}
+	}
+	b, err := json.Marshal(&ar)
+	if err != nil {
+		return err
+	}
+	return r.put("ac", key, b)
+}
+
+// get issues `GET <URL>/<kind>/<name>`. Returns `nil` if not found.
+func (r *RemoteCache) get(kind string, name string) ([]byte, error) {
+	url := fmt.Sprintf("%s/%s/%s", r.URL, kind, name)
+	resp, err := r.client.Get(url)
+	if err != nil {
+		return nil, r.fail(errors.Wrapf(err, "failed to GET \"%s\"", url))
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		io.Copy(ioutil.Discard, resp.Body)
+		r.succeed()
+		return nil, nil
+	case resp.StatusCode != http.StatusOK:
+		return nil, r.fail(errors.Errorf("failed to GET \"%s\" (%s)", url, resp.Status))
+	}
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxRemoteBlobSize))
+	if err != nil {
+		return nil, r.fail(errors.Wrapf(err, "failed to GET \"%s\"", url))
+	}
+	r.succeed()
+	return b, nil
+}
+
+// put issues `PUT <URL>/<kind>/<name>`.
+func (r *RemoteCache) put(kind string, name string, data []byte) error {
+	url := fmt.Sprintf("%s/%s/%s", r.URL, kind, name)
+	req, err := http.NewRequest(http.MethodPut, url, bytes.NewReader(data))
+	if err != nil {
+		return r.fail(errors.Wrapf(err, "failed to PUT \"%s\"", url))
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return r.fail(errors.Wrapf(err, "failed to PUT \"%s\"", url))
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode < 200 || 300 <= resp.StatusCode {
+		return r.fail(errors.Errorf("failed to PUT \"%s\" (%s)", url, resp.Status))
+	}
+	r.succeed()
+	return nil
+}
+
+// digestOf computes the digest of the blob `b`.
+func digestOf(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// remoteCacheServer is a stand-in of the HTTP remote cache.
+type remoteCacheServer struct {
+	mutex sync.Mutex
+	blobs map[string][]byte
+	puts  []string
+	delay time.Duration
+}
+
+// setDelay makes the following responses slow (guarded since handlers are running concurrently).
+func (s *remoteCacheServer) setDelay(d time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.delay = d
+}
+
+func (s *remoteCacheServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	delay := s.delay
+	s.mutex.Unlock()
+	time.Sleep(delay)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	switch r.Method {
+	case http.MethodGet:
+		b, ok := s.blobs[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(b)
+	case http.MethodPut:
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.blobs[r.URL.Path] = b
+		s.puts = append(s.puts, r.URL.Path)
+	default:
+		http.Error(w, "unsupported", http.StatusMethodNotAllowed)
+	}
+}
+
+func newRemoteCacheServer() (*remoteCacheServer, *httptest.Server) {
+	s := &remoteCacheServer{blobs: make(map[string][]byte)}
+	return s, httptest.NewServer(s)
+}
+
+func TestRemoteCache(t *testing.T) {
+	Convey("GIVEN: A remote cache server", t, func() {
+		s, server := newRemoteCacheServer()
+		defer server.Close()
+		entry := &cacheEntry{Object: []byte("object"), Depfile: []byte("a.o: a.c")}
+		Convey("WHEN: Uploading in read-write mode", func() {
+			r := NewRemoteCache(server.URL+"/", true, time.Second)
+			So(r.Put("0123", entry), ShouldBeNil)
+			Convey("THEN: Blobs and the action result should be stored", func() {
+				So(len(s.puts), ShouldEqual, 3)
+				So(s.puts[0], ShouldEqual, "/cas/"+digestOf(entry.Object))
+				So(s.puts[2], ShouldEqual, "/ac/0123")
+				e, err := r.Get("0123")
+				So(err, ShouldBeNil)
+				So(e, ShouldResemble, entry)
+			})
+			Convey("THEN: Unknown keys should be missing", func() {
+				e, err := r.Get("4567")
+				So(err, ShouldBeNil)
+				So(e, ShouldBeNil)
+			})
+			Convey("THEN: Corrupted blobs should be ignored", func() {
+				s.blobs["/cas/"+digestOf(entry.Object)] = []byte("broken")
+				e, err := r.Get("0123")
+				So(err, ShouldBeNil)
+				So(e, ShouldBeNil)
+			})
+		})
+		Convey("WHEN: Uploading in read-only mode", func() {
+			r := NewRemoteCache(server.URL, false, time.Second)
+			So(r.Put("0123", entry), ShouldBeNil)
+			Convey("THEN: Nothing should be uploaded", func() {
+				So(s.puts, ShouldBeEmpty)
+			})
+		})
+		Convey("WHEN: The server is too slow", func() {
+			s.setDelay(200 * time.Millisecond)
+			r := NewRemoteCache(server.URL, true, 20*time.Millisecond)
+			_, err := r.Get("0123")
+			Convey("THEN: The remote cache should be disabled", func() {
+				So(err, ShouldNotBeNil)
+				So(r.Failure(), ShouldNotBeNil)
+				e, err := r.Get("0123")
+				So(err, ShouldBeNil)
+				So(e, ShouldBeNil)
+				So(r.Put("0123", entry), ShouldBeNil)
+				So(s.puts, ShouldBeEmpty)
+			})
+		})
+	})
+}
+
+func TestRemoteCacheBackoff(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cbuild-remote-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	state := filepath.Join(dir, remoteCacheStateFile)
+	open := func(url string, timeout time.Duration) *RemoteCache {
+		r := NewRemoteCache(url, true, timeout)
+		r.StateFile = state
+		return r
+	}
+	Convey("GIVEN: A remote cache server", t, func() {
+		os.Remove(state)
+		s, server := newRemoteCacheServer()
+		defer server.Close()
+		Convey("WHEN: A process fails to connect", func() {
+			s.setDelay(200 * time.Millisecond)
+			_, err := open(server.URL, 20*time.Millisecond).Get("0123")
+			So(err, ShouldNotBeNil)
+			s.setDelay(0)
+			Convey("THEN: The following processes should not connect until the backoff period expires", func() {
+				r := open(server.URL, time.Second)
+				So(r.Failure(), ShouldNotBeNil)
+				So(r.Put("0123", &cacheEntry{Object: []byte("object")}), ShouldBeNil)
+				So(s.puts, ShouldBeEmpty)
+			})
+			Convey("THEN: The backoff period should be extended on consecutive failures", func() {
+				first, ok := open(server.URL, time.Second).readState()
+				So(ok, ShouldBeTrue)
+				So(first.Failures, ShouldEqual, 1)
+				open(server.URL, time.Second).fail(errors.New("failed again"))
+				second, _ := open(server.URL, time.Second).readState()
+				So(second.Failures, ShouldEqual, 2)
+				So(second.RetryAt, ShouldHappenAfter, first.RetryAt)
+			})
+			Convey("THEN: Succeeding after the backoff period should clear the failures", func() {
+				expired, _ := open(server.URL, time.Second).readState()
+				expired.RetryAt = time.Now().Add(-time.Second)
+				b, err := json.Marshal(&expired)
+				So(err, ShouldBeNil)
+				So(ioutil.WriteFile(state, b, 0644), ShouldBeNil)
+				r := open(server.URL, time.Second)
+				So(r.Failure(), ShouldBeNil)
+				So(r.Put("0123", &cacheEntry{Object: []byte("object")}), ShouldBeNil)
+				So(s.puts, ShouldNotBeEmpty)
+				So(Exists(state), ShouldBeFalse)
+			})
+		})
+	})
+}
+
+func TestOpenRemoteCache(t *testing.T) {
+	saved := make(map[string]string)
+	for _, name := range []string{"CBUILD_REMOTE_CACHE", "CBUILD_REMOTE_CACHE_MODE", "CBUILD_REMOTE_CACHE_TIMEOUT"} {
+		saved[name] = os.Getenv(name)
+	}
+	defer (func() {
+		for name, v := range saved {
+			os.Setenv(name, v)
+		}
+	})()
+	Convey("GIVEN: Environment variables", t, func() {
+		os.Setenv("CBUILD_REMOTE_CACHE", "")
+		os.Setenv("CBUILD_REMOTE_CACHE_MODE", "")
+		os.Setenv("CBUILD_REMOTE_CACHE_TIMEOUT", "")
+		Convey("THEN: No remote caches should be used by default", func() {
+			r, err := OpenRemoteCache()
+			So(err, ShouldBeNil)
+			So(r, ShouldBeNil)
+		})
+		Convey("THEN: The mode and the timeout should be configurable", func() {
+			os.Setenv("CBUILD_REMOTE_CACHE", "http://cache.local:8080/")
+			r, err := OpenRemoteCache()
+			So(err, ShouldBeNil)
+			So(r.URL, ShouldEqual, "http://cache.local:8080")
+			So(r.Writable, ShouldBeFalse)
+			So(r.client.Timeout, ShouldEqual, DefaultRemoteCacheTimeout)
+			os.Setenv("CBUILD_REMOTE_CACHE_MODE", "read-write")
+			os.Setenv("CBUILD_REMOTE_CACHE_TIMEOUT", "250ms")
+			r, err = OpenRemoteCache()
+			So(err, ShouldBeNil)
+			So(r.Writable, ShouldBeTrue)
+			So(r.client.Timeout, ShouldEqual, 250*time.Millisecond)
+			os.Setenv("CBUILD_REMOTE_CACHE_MODE", "write-only")
+			_, err = OpenRemoteCache()
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestCompileCacheWithRemote(t *testing.T) {
+	if _, err := exec.LookPath("cc"); err != nil {
+		t.Skip("no C compilers found")
+	}
+	dir, err := ioutil.TempDir("", "cbuild-remote-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "a.c")
+	obj := filepath.Join(dir, "a.o")
+	dep := filepath.Join(dir, "a.d")
+	if err := ioutil.WriteFile(src, []byte("int value() { return 1; }\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	compile := func(cache *CompileCache) int {
+		code, err := cache.Exec([]string{"cc", "-c", "-MMD", "-MF", dep, "-o", obj, src}, ioutil.Discard, ioutil.Discard)
+		So(err, ShouldBeNil)
+		return code
+	}
+	Convey("GIVEN: A remote cache shared by CI and developers", t, func() {
+		s, server := newRemoteCacheServer()
+		defer server.Close()
+		ci := &CompileCache{Dir: filepath.Join(dir, "ci"), MaxSize: DefaultCacheSize, Remote: NewRemoteCache(server.URL, true, time.Second)}
+		dev := &CompileCache{Dir: filepath.Join(dir, "dev"), MaxSize: DefaultCacheSize, Remote: NewRemoteCache(server.URL, false, time.Second)}
+		So(ci.Clear(), ShouldBeNil)
+		So(dev.Clear(), ShouldBeNil)
+		Convey("WHEN: CI compiles first", func() {
+			So(compile(ci), ShouldEqual, 0)
+			uploaded := len(s.puts)
+			expected, err := ioutil.ReadFile(obj)
+			So(err, ShouldBeNil)
+			So(os.Remove(obj), ShouldBeNil)
+			So(compile(dev), ShouldEqual, 0)
+			Convey("THEN: The developer should obtain the object from the remote cache", func() {
+				So(uploaded, ShouldEqual, 3)
+				b, err := ioutil.ReadFile(obj)
+				So(err, ShouldBeNil)
+				So(b, ShouldResemble, expected)
+				stats, err := dev.Stats()
+				So(err, ShouldBeNil)
+				So(stats.RemoteHits, ShouldEqual, 1)
+				So(stats.Misses, ShouldEqual, 0)
+				So(stats.Entries, ShouldEqual, 1)
+				So(len(s.puts), ShouldEqual, uploaded)
+			})
+		})
+		Convey("WHEN: The remote entry depends on the files missing locally", func() {
+			So(compile(ci), ShouldEqual, 0)
+			// Replaces the dependency file as produced on another machine.
+			depfile := []byte(cacheDepTarget + ": /nonexistent/producer/a.c\n")
+			for path, b := range s.blobs {
+				var ar remoteActionResult
+				if strings.HasPrefix(path, "/ac/") && json.Unmarshal(b, &ar) == nil {
+					ar.Depfile = digestOf(depfile)
+					s.blobs[path], _ = json.Marshal(&ar)
+				}
+			}
+			s.blobs["/cas/"+digestOf(depfile)] = depfile
+			So(os.Remove(obj), ShouldBeNil)
+			So(compile(dev), ShouldEqual, 0)
+			Convey("THEN: The entry should not be used", func() {
+				stats, err := dev.Stats()
+				So(err, ShouldBeNil)
+				So(stats.RemoteHits, ShouldEqual, 0)
+				So(stats.Misses, ShouldEqual, 1)
+				d, err := ioutil.ReadFile(dep)
+				So(err, ShouldBeNil)
+				So(string(d), ShouldNotContainSubstring, "/nonexistent/")
+			})
+		})
+		Convey("WHEN: The remote cache times out", func() {
+			s.setDelay(200 * time.Millisecond)
+			dev.Remote = NewRemoteCache(server.URL, true, 20*time.Millisecond)
+			So(os.Remove(obj), ShouldBeNil)
+			code := compile(dev)
+			Convey("THEN: It should fall back to the local compilation", func() {
+				So(code, ShouldEqual, 0)
+				So(Exists(obj), ShouldBeTrue)
+				So(dev.Remote.Failure(), ShouldNotBeNil)
+				var out bytes.Buffer
+				So(runCacheCommand(dev, []string{"stats"}, &out), ShouldBeNil)
+				So(out.String(), ShouldContainSubstring, "misses:          1")
+				So(strings.Contains(out.String(), "(read-write)"), ShouldBeTrue)
+			})
+		})
+	})
+}
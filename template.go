@@ -0,0 +1,236 @@
+// Data model and functions for the ninja template.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"github.com/pkg/errors"
+)
+
+// NinjaWriteContext is the data passed to the ninja template (`-show-template-data` dumps it).
+// Maps are rendered in the key order (`range` sorts them), so the output is reproducible.
+type NinjaWriteContext struct {
+	TemplateFile       string                 // Template file (`-template`)
+	Platform           string                 // Platform identifier ("WIN32", "LINUX"...)
+	OutputDirectory    string                 // The output directory
+	OtherRules         map[string]OtherRule   // Extension to rule map
+	AppendRules        map[string]AppendBuild // Custom build rules to command map
+	NinjaUpdater       string                 // Command for updating *.ninja itself
+	UsePCH             bool                   // Some of the commands create pre-compiled headers (`gen_pch`)
+	UseModules         bool                   // Some of the sources are scanned for C++20 modules
+	ModuleTool         string                 // Command scanning and collating C++20 modules (`scan-modules` and `collate-modules`)
+	UseDepsMsvc        bool                   // Use MSVC depend format
+	UseResponse        bool                   // Prefer using a response file to pass the lengthy arguments
+	NewlineAsDelimiter bool                   // When using a response file, delimit items with '\n' instead of '\x20'
+	GroupArchives      bool                   // Groups library items (for symbol resolution)
+	CompilerLauncher   string                 // Prepended to the compile commands including custom rules (`compiler_launcher:`)
+	LinkLauncher       string                 // Prepended to the archive and link commands (`link: true`)
+	CompileCache       string                 // Set if the launcher is the compilation cache (`-compile-cache`)
+	Shell              ShellType              // Quoting convention of the commands
+
+	Commands         []*BuildCommand // List of build commands
+	OtherRuleTargets []OtherRuleFile // List of targets using custom rules
+	SubNinjas        []string
+	NinjaFile        string   // Name of the output
+	ConfigSources    []string // Files referenced to build the output
+	GeneratedFiles   []string // Files written along with the output
+	AnalysisReports  []string // Outputs of the `analyze` commands
+	DefaultTargets   []string
+
+	Environment        []ImportedEnvironment // Imported environment variables
+	EnvironmentFile    string                // Records imported environment variables
+	EnvironmentChecker string                // Command for updating `EnvironmentFile`
+}
+
+// makeNinjaWriteContext constructs the template data for `graph`.
+func makeNinjaWriteContext(graph *BuildGraph) NinjaWriteContext {
+	osArgs := make([]string, 0, len(os.Args))
+	osArgs = append(osArgs, filepath.ToSlash(os.Args[0]))
+	osArgs = append(osArgs, os.Args[1:]...)
+	launcher, linkLauncher := selectCompilerLaunchers(graph)
+	cache := ""
+	if option.useCompileCache {
+		cache = launcher
+	}
+	ninjaFile := option.ninjaFile
+	if 0 < len(graph.BaseDir) {
+		ninjaFile = relativePath(graph.BaseDir, ninjaFile)
+	}
+	ctx := NinjaWriteContext{
+		TemplateFile:       option.templateFile,
+		Platform:           option.platform,
+		UseResponse:        useResponse,
+		NewlineAsDelimiter: responseNewline,
+		GroupArchives:      groupArchives,
+		OutputDirectory:    filepath.ToSlash(graph.OutputDir),
+		OtherRules:         graph.OtherRules,
+		AppendRules:        graph.AppendRules,
+		UseDepsMsvc:        useDepsMsvc,
+		NinjaUpdater:       EscapeNinjaValue(commandShell.JoinArgs(osArgs)),
+		CompilerLauncher:   launcher,
+		LinkLauncher:       linkLauncher,
+		CompileCache:       cache,
+		Shell:              commandShell,
+
+		Commands:         graph.Commands,
+		OtherRuleTargets: graph.OtherRuleFiles,
+		SubNinjas:        graph.SubNinjas,
+		NinjaFile:        ninjaFile,
+		ConfigSources:    graph.ConfigSources,
+		GeneratedFiles:   graph.GeneratedFiles,
+		DefaultTargets:   graph.DefaultTargets,
+	}
+	if envs := graph.Environment; 0 < len(envs) {
+		// Changes of the imported variables are detected by `check_environment` rule.
+		ctx.Environment = envs
+		ctx.EnvironmentFile = JoinPaths(graph.OutputDir, ".environment")
+		ctx.EnvironmentChecker = EscapeNinjaValue(commandShell.QuoteArg(filepath.ToSlash(ProgramPath))) + " -check-environment $out"
+	}
+	for _, f := range graph.Commands {
+		switch f.CommandType {
+		case "analyze":
+			ctx.AnalysisReports = append(ctx.AnalysisReports, f.OutFile)
+		case "gen_pch":
+			ctx.UsePCH = true
+		case "collate_modules":
+			ctx.UseModules = true
+			ctx.ModuleTool = EscapeNinjaValue(commandShell.QuoteArg(filepath.ToSlash(ProgramPath)))
+		}
+	}
+	return ctx
+}
+
+// ShowNinjaWriteContext writes `ctx` as JSON.
+func ShowNinjaWriteContext(w io.Writer, ctx NinjaWriteContext) error {
+	b, err := json.MarshalIndent(ctx, "", "    ")
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal the template data")
+	}
+	if _, err := w.Write(append(b, '\n')); err != nil {
+		return errors.Wrap(err, "failed to write the template data")
+	}
+	return nil
+}
+
+// ninjaTemplateFuncs returns the functions available in the ninja template.
+func ninjaTemplateFuncs() template.FuncMap {
+	return template.FuncMap{
+		"escape_drive":         escapeNinjaPaths, // Kept for compatibility (same as `escape_path`).
+		"escape_path":          escapeNinjaPaths,
+		"escape_value":         EscapeNinjaValue,
+		"shell_join":           func(args []string) string { return commandShell.JoinArgs(args) },
+		"shell_quote":          func(arg string) string { return commandShell.QuoteArg(arg) },
+		"posix_quote":          PosixShell.QuoteArg,
+		"windows_quote":        WindowsShell.QuoteArg,
+		"join":                 strings.Join,
+		"intercalate":          intercalate,
+		"substitute_extension": substituteExtension,
+		"rel_path":             relativePath,
+		"has_prefix":           func(prefix string, s string) bool { return strings.HasPrefix(s, prefix) },
+		"has_suffix":           func(suffix string, s string) bool { return strings.HasSuffix(s, suffix) },
+		"trim_prefix":          func(prefix string, s string) string { return strings.TrimPrefix(s, prefix) },
+		"trim_suffix":          func(suffix string, s string) string { return strings.TrimSuffix(s, suffix) },
+		"uniq":                 uniqStrings,
+		"union":                unionStrings,
+		"intersect":            intersectStrings,
+		"difference":           differenceStrings,
+	}
+}
+
+// relativePath returns `target` relative to `base` (`target` itself if not possible).
+func relativePath(base string, target string) string {
+	rel, err := filepath.Rel(filepath.FromSlash(base), filepath.FromSlash(target))
+	if err != nil {
+		return target
+	}
+	return filepath.ToSlash(rel)
+}
+
+// toStrings converts a list (or a string) passed to the template functions into `[]string`.
+func toStrings(arg interface{}) ([]string, error) {
+	switch v := arg.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []string{v}, nil
+	case []string:
+		return v, nil
+	case []interface{}:
+		result := make([]string, 0, len(v))
+		for _, item := range v {
+			switch s := item.(type) {
+			case string:
+				result = append(result, s)
+			case fmt.Stringer:
+				result = append(result, s.String())
+			default:
+				return nil, errors.Errorf("can't convert \"%v\" to string", item)
+			}
+		}
+		return result, nil
+	}
+	return nil, errors.Errorf("can't convert \"%v\" to a list of strings", arg)
+}
+
+// uniqStrings removes duplicated items preserving the order.
+func uniqStrings(arg interface{}) ([]string, error) {
+	return unionStrings(arg)
+}
+
+// unionStrings concatenates lists without duplicates.
+func unionStrings(args ...interface{}) ([]string, error) {
+	result := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, arg := range args {
+		items, err := toStrings(arg)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range items {
+			if !seen[item] {
+				seen[item] = true
+				result = append(result, item)
+			}
+		}
+	}
+	return result, nil
+}
+
+// intersectStrings returns the items of `a` contained in `b`.
+func intersectStrings(a interface{}, b interface{}) ([]string, error) {
+	return filterStrings(a, b, true)
+}
+
+// differenceStrings returns the items of `a` not contained in `b`.
+func differenceStrings(a interface{}, b interface{}) ([]string, error) {
+	return filterStrings(a, b, false)
+}
+
+func filterStrings(a interface{}, b interface{}, contained bool) ([]string, error) {
+	as, err := toStrings(a)
+	if err != nil {
+		return nil, err
+	}
+	bs, err := toStrings(b)
+	if err != nil {
+		return nil, err
+	}
+	set := make(map[string]bool, len(bs))
+	for _, item := range bs {
+		set[item] = true
+	}
+	result := make([]string, 0, len(as))
+	for _, item := range as {
+		if set[item] == contained {
+			result = append(result, item)
+		}
+	}
+	return uniqStrings(result)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestTemplateSetFunctions(t *testing.T) {
+	Convey("GIVEN: Lists", t, func() {
+		a := []string{"a", "b", "c", "a"}
+		b := []interface{}{"b", "d"}
+		uq, err := uniqStrings(a)
+		So(err, ShouldBeNil)
+		So(uq, ShouldResemble, []string{"a", "b", "c"})
+		u, err := unionStrings(a, b)
+		So(err, ShouldBeNil)
+		So(u, ShouldResemble, []string{"a", "b", "c", "d"})
+		i, err := intersectStrings(a, b)
+		So(err, ShouldBeNil)
+		So(i, ShouldResemble, []string{"b"})
+		d, err := differenceStrings(a, b)
+		So(err, ShouldBeNil)
+		So(d, ShouldResemble, []string{"a", "c"})
+		So(relativePath("build/LINUX", "build/LINUX/Debug/a.o"), ShouldEqual, "Debug/a.o")
+	})
+}
+
+func TestNinjaTemplateOverride(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cbuild-template-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	graph := &BuildGraph{
+		OutputDir: "build",
+		Commands: []*BuildCommand{
+			{Command: "cc", CommandType: "compile", InFiles: []string{"a.c"}, OutFile: "build/a.o"},
+		},
+		DefaultTargets: []string{"build/a.o"},
+	}
+	ctx := makeNinjaWriteContext(graph)
+	render := func(path string) string {
+		tmpl, err := getNinjaTemplate(path)
+		So(err, ShouldBeNil)
+		var b bytes.Buffer
+		So(tmpl.Execute(&b, ctx), ShouldBeNil)
+		return b.String()
+	}
+	Convey("GIVEN: A template overriding a block", t, func() {
+		path := filepath.Join(dir, "override.tpl")
+		src := `{{/* Only overrides defaults */}}
+{{define "defaults"}}
+default {{intercalate " " (union .DefaultTargets .ConfigSources)}} # overridden
+{{end}}`
+		So(ioutil.WriteFile(path, []byte(src), 0644), ShouldBeNil)
+		Convey("WHEN: Rendering", func() {
+			actual := render(path)
+			Convey("THEN: Only the block should be replaced", func() {
+				So(actual, ShouldContainSubstring, "\ndefault build/a.o # overridden\n")
+				So(actual, ShouldContainSubstring, "\nrule compile\n")
+				So(actual, ShouldContainSubstring, "\nbuild build/a.o : compile a.c")
+			})
+		})
+	})
+	Convey("GIVEN: A template having its own body", t, func() {
+		path := filepath.Join(dir, "full.tpl")
+		So(ioutil.WriteFile(path, []byte(`# full {{.OutputDirectory}}`), 0644), ShouldBeNil)
+		Convey("THEN: The whole template should be replaced", func() {
+			So(render(path), ShouldEqual, "# full build")
+		})
+	})
+	Convey("GIVEN: The sample user template", t, func() {
+		Convey("THEN: Should be rendered as same as the built-in one", func() {
+			So(render("test.tpl"), ShouldEqual, render(""))
+		})
+	})
+	Convey("GIVEN: The template data", t, func() {
+		var b bytes.Buffer
+		So(ShowNinjaWriteContext(&b, ctx), ShouldBeNil)
+		Convey("THEN: Should be a JSON", func() {
+			var data map[string]interface{}
+			So(json.Unmarshal(b.Bytes(), &data), ShouldBeNil)
+			So(data["OutputDirectory"], ShouldEqual, "build")
+			So(data["DefaultTargets"], ShouldResemble, []interface{}{"build/a.o"})
+			So(data["UsePCH"], ShouldEqual, false)
+		})
+		Convey("THEN: The rule for pre-compiled headers should be omitted", func() {
+			So(render(""), ShouldNotContainSubstring, "rule gen_pch")
+		})
+	})
+	Convey("GIVEN: A graph creating a pre-compiled header", t, func() {
+		pch := *graph
+		pch.Commands = append([]*BuildCommand{
+			{Command: "cc", CommandType: "gen_pch", InFiles: []string{"a.h"}, OutFile: "build/a.h.gch"},
+		}, graph.Commands...)
+		ctx := makeNinjaWriteContext(&pch)
+		Convey("THEN: The rule should be used", func() {
+			So(ctx.UsePCH, ShouldBeTrue)
+			tmpl, err := getNinjaTemplate("")
+			So(err, ShouldBeNil)
+			var b bytes.Buffer
+			So(tmpl.Execute(&b, ctx), ShouldBeNil)
+			So(b.String(), ShouldContainSubstring, "\nrule gen_pch\n")
+		})
+	})
+}
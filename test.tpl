@@ -1,6 +1,16 @@
 {{/*
-Following properties/functions are available:
- - Properties
+Sample user template (`cbuild -template test.tpl`).
+
+A template containing only `{{define}}`s overrides the named blocks of the built-in template
+(`cbuild -show-default-template`). A template having its own body replaces the whole one.
+
+ - Blocks
+    - rules          // Rule definitions (contains `compile_rule`)
+    - compile_rule   // `rule compile`
+    - commands       // Build statements for `.Commands`
+    - other_targets  // Build statements for `.OtherRuleTargets` and `subninja`s
+    - defaults       // `default` statement
+ - Properties (`cbuild -show-template-data` shows the actual values)
     - TemplateFile       string     // Template file
     - Platform           string     // Platform identifier ("WIN32", "Mac"...)
     - UseResponse        bool       // Prefer using a response file to pass the lengthy arguments
@@ -9,136 +19,59 @@ Following properties/functions are available:
     - OutputDirectory    string     // The output directory
     - OtherRules         map[string]OtherRule   // extension to rule map
     - AppendRules        map[string]AppendBuild // custom build rules to command map
-    - UsePCH             bool       // Prefer using pre-compiled header
+    - UsePCH             bool       // Some of the commands create pre-compiled headers (`gen_pch`)
+    - UseModules         bool       // Some of the sources are scanned for C++20 modules
+    - ModuleTool         string     // Command scanning and collating C++20 modules
     - UseDepsMsvc        bool       // Use MSVC depend format
     - NinjaUpdater       string     // Command for updating *.ninja itself
+    - CompilerLauncher   string     // Prepended to the compile commands including custom rules (`compiler_launcher:`)
+    - LinkLauncher       string     // Prepended to the archive and link commands (`link: true`)
+    - CompileCache       string     // Set if the launcher is the compilation cache (`-compile-cache`)
+    - Shell              string     // Quoting convention of the commands ("sh" or "cmd")
     - Commands         []*BuildCommand  // List of build commands
     - OtherRuleTargets []OtherRuleFile  // List of targets using custom rules
     - SubNinjas        []string
     - NinjaFile        string       // Name of the output
     - ConfigSources    []string     // Files referenced to build the output
-  - Functions
+    - GeneratedFiles   []string     // Files written along with the output
+    - AnalysisReports  []string     // Outputs of the `analyze` commands
+    - DefaultTargets   []string
+    - Environment        []ImportedEnvironment // Imported environment variables
+    - EnvironmentFile    string     // Records imported environment variables
+    - EnvironmentChecker string     // Command for updating `EnvironmentFile`
+ - Functions
     - join          // join <list> <sep>
-    - escape_drive  // Escapes ':'
+    - intercalate   // intercalate <sep> <list>
+    - escape_drive  // Escapes ':' (alias of escape_path)
+    - escape_path   // Escapes a path (or a list of paths) for build statements
+    - escape_value  // Escapes a variable value
+    - shell_join    // Quotes <list> for the command shell and joins with ' '
+    - shell_quote   // Quotes an argument for the command shell
+    - posix_quote   // Quotes an argument for POSIX sh
+    - windows_quote // Quotes an argument for cmd.exe
+    - rel_path      // rel_path <base> <path>
+    - has_prefix    // has_prefix <prefix> <string>
+    - has_suffix    // has_suffix <suffix> <string>
+    - trim_prefix   // trim_prefix <prefix> <string>
+    - trim_suffix   // trim_suffix <suffix> <string>
+    - uniq          // Removes duplicated items from <list>
+    - union         // union <list>...
+    - intersect     // intersect <list> <list>
+    - difference    // difference <list> <list>
+    - substitute_extension // substitute_extension <ext> <path or list>
 */ -}}
-# AUTOGENERATED {{if .TemplateFile}}using {{.TemplateFile}}{{end}}
-# Rule definitions
-builddir = {{.OutputDirectory}}
-
-rule compile
+{{define "compile_rule"}}rule compile
     description = Compiling: $desc
 {{- if eq .Platform "WIN32"}}
     command = {{.CompilerLauncher}} $compile $options -Fo$out $in
-    {{- if eq .UseDepsMsvc}}
+    {{- if .UseDepsMsvc}}
     deps = msvc
     {{- else}}
+    depfile = $depf
     deps = gcc
     {{- end}}
 {{- else}}
     command = {{.CompilerLauncher}} $compile $options -o $out $in
     depfile = $depf
     deps = gcc
-{{- end}}
-
-{{- if .UsePCH}}
-rule gen_pch
-    description = Create PCH: $desc
-    command = $gen_pch $options -x c++-header -o $out $in
-    depfile = $depf
-    deps = gcc
-{{- end}}
-
-rule ar
-    description = Archiving: $desc
-{{- if .UseResponse}}
-    command = $ar $options {{if eq .Platform "WIN32"}}/out:$out{{else}}$out{{end}} @$out.rsp
-    rspfile = $out.rsp
-    rspfile_content = {{if .NewlineAsDelimiter}}$in_newline{{else}}$in{{end}}
-{{- else}}
-    command = $ar $options $out $in
-{{- end}}
-
-rule link
-{{- if .UseResponse}}
-    description = Linking: $desc
-    command = $link $options {{if eq .Platform "WIN32"}}/out:$out{{else}}-o $out{{end}} @$out.rsp
-    rspfile = $out.rsp
-    rspfile_content = {{if .NewlineAsDelimiter}}$in_newline{{else}}$in{{end}}
-{{- else}}
-    command = $link $options -o $out {{if .GroupArchives}}-Wl,--start-group $in -Wl,--end-group{{else}}$in{{end}}
-{{- end}}
-
-rule packager
-    description = Packaging: $desc
-    command = $packager $options $in $out
-
-rule convert
-    description = Converting: $desc
-    command = $convert $options -o $out $in
-{{range $k, $v := .OtherRules}}
-rule compile{{- $k}}
-    description = {{$v.Title}}: $desc
-    command = {{$v.Command}}
-    {{- if $v.NeedDepend}}
-    depfile = $depf
-    deps = gcc
-    {{- end}}
-{{end}}
-{{range $k, $v := .AppendRules}}
-rule {{$k}}
-    description = {{$v.Desc}}: $desc
-    command = {{$v.Command}}
-    {{- if $v.Deps}}
-    depfile = $out.d
-    deps = gcc
-    {{- end}}
-{{end}}
-rule update_ninja_file
-    description = Update $desc
-    command     = {{.NinjaUpdater}}
-    generator   = 1
-
-build always: phony
-# end of [Rule definitions]
-
-{{- define "IMPDEPS_"}}
-    {{- if .}} | {{join . " "}}{{end}}
-{{- end}}
-{{/* Render rules */}}
-
-# Commands
-build {{.NinjaFile | escape_drive}} : update_ninja_file {{join .ConfigSources " "}}
-    desc = {{.NinjaFile}}
-{{range $c := .Commands}}
-build {{$c.OutFile}} : {{$c.CommandType}} {{join $c.InFiles " "}} {{join $c.Depends " "}} {{template "IMPDEPS_" $c.ImplicitDepends}}
-    desc = {{$c.OutFile}}
-{{- if $c.NeedCommandAlias}}
-    {{$c.CommandType}} = {{$c.Command}}
-{{- end}}
-{{- if $c.DepFile}}
-    depf = {{$c.DepFile}}
-{{- end}}
-{{- if $c.Args}}
-    options = {{join $c.Args " "}}
-{{- end}}
-{{end}}
-# Other targets
-{{range $item := .OtherRuleTargets}}
-build {{$item.Outfile}} : {{$item.Rule}} {{$item.Infile}}
-    desc     = {{$item.Outfile}}
-    compiler = {{$item.Compiler}}
-{{- if $item.Include}}
-    include  = {{$item.Include}}
-{{- end}}
-{{- if  $item.Option}}
-    option   = {{$item.Option}}
-{{- end}}
-{{- if  $item.Depend}}
-    depf     = {{$item.Depend}}
-{{- end}}
-{{end}}
-{{- if .SubNinjas}}
-{{range $subninja := .SubNinjas}}
-subninja {{$subninja}}
-{{end}}
-{{end}}
+{{end}}{{end}}
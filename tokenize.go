@@ -0,0 +1,140 @@
+// Shell-like tokenization of command lines.
+
+package main
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Tokenize splits `s` into arguments in shell-like manner.
+//   - Arguments are delimited by white-spaces.
+//   - '...' quotes everything literally.
+//   - "..." quotes white-spaces, `\"` and `\\` are unescaped.
+//   - `\` outside of quotes escapes following white-space, quote or `\`
+//     (otherwise it is kept as is, for Windows paths).
+//   - `${...}` is kept as a part of the argument even if it contains white-spaces.
+func Tokenize(s string) ([]string, error) {
+	result := make([]string, 0)
+	var cur strings.Builder
+	inToken := false
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		switch {
+		case ch == ' ' || ch == '\t' || ch == '\n' || ch == '\r':
+			if inToken {
+				result = append(result, cur.String())
+				cur.Reset()
+				inToken = false
+			}
+		case ch == '\'':
+			end := strings.IndexByte(s[i+1:], '\'')
+			if end < 0 {
+				return nil, errors.Errorf("unterminated quote found in \"%s\"", s)
+			}
+			cur.WriteString(s[i+1 : i+1+end])
+			i += end + 1
+			inToken = true
+		case ch == '"':
+			closed := false
+			for i++; i < len(s); i++ {
+				if s[i] == '"' {
+					closed = true
+					break
+				}
+				if s[i] == '\\' && i+1 < len(s) && (s[i+1] == '"' || s[i+1] == '\\') {
+					i++
+				}
+				cur.WriteByte(s[i])
+			}
+			if !closed {
+				return nil, errors.Errorf("unterminated quote found in \"%s\"", s)
+			}
+			inToken = true
+		case ch == '\\' && i+1 < len(s) && strings.IndexByte(" \t\"'\\", s[i+1]) >= 0:
+			cur.WriteByte(s[i+1])
+			i++
+			inToken = true
+		case ch == '$' && i+1 < len(s) && s[i+1] == '{':
+			end := findClosingBrace(s, i+2)
+			if end < 0 {
+				return nil, errors.Errorf("unmatched brace found in \"%s\"", s)
+			}
+			cur.WriteString(s[i : end+1])
+			i = end
+			inToken = true
+		default:
+			cur.WriteByte(ch)
+			inToken = true
+		}
+	}
+	if inToken {
+		result = append(result, cur.String())
+	}
+	return result, nil
+}
+
+// splitCommand splits `command` into the 1st argument (unquoted) and the rest (as is).
+func splitCommand(command string) (first string, rest string) {
+	s := strings.TrimLeft(command, " \t")
+	end := len(s)
+scan:
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case ' ', '\t':
+			end = i
+			break scan
+		case '\\':
+			i++
+		case '\'', '"':
+			if e := strings.IndexByte(s[i+1:], s[i]); 0 <= e {
+				i += e + 1
+			}
+		}
+	}
+	args, err := Tokenize(s[:end])
+	if err != nil || len(args) == 0 {
+		first = s[:end]
+	} else {
+		first = args[0]
+	}
+	return first, strings.TrimLeft(s[end:], " \t")
+}
+
+// JoinArgs joins `args` with ' '.
+// Arguments containing white-spaces or quotes are quoted so that `Tokenize` can restore them.
+func JoinArgs(args []string) string {
+	tmp := make([]string, 0, len(args))
+	for _, arg := range args {
+		tmp = append(tmp, quoteArg(arg))
+	}
+	return strings.Join(tmp, " ")
+}
+
+func quoteArg(arg string) string {
+	if !needsQuote(arg) {
+		return arg
+	}
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+	return `"` + r.Replace(arg) + `"`
+}
+
+// needsQuote checks `arg` should be quoted to be restored by `Tokenize`.
+func needsQuote(arg string) bool {
+	if len(arg) == 0 || strings.ContainsAny(arg, " \t\n\r\"'") || strings.Contains(arg, `\\`) {
+		return true
+	}
+	for i := strings.Index(arg, "${"); 0 <= i; {
+		end := findClosingBrace(arg, i+2)
+		if end < 0 {
+			return true
+		}
+		next := strings.Index(arg[end+1:], "${")
+		if next < 0 {
+			break
+		}
+		i = end + 1 + next
+	}
+	return false
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/leanovate/gopter/convey"
+	"github.com/leanovate/gopter/gen"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestTokenize(t *testing.T) {
+	Convey("GIVEN: Test cases", t, func() {
+		type tokenizeCase struct {
+			input    string
+			expected []string
+		}
+		for _, tc := range []tokenizeCase{
+			{"", []string{}},
+			{"  a  b\tc ", []string{"a", "b", "c"}},
+			{`"c:/Program Files/LLVM" -o $out`, []string{"c:/Program Files/LLVM", "-o", "$out"}},
+			{`'a "b" c' d`, []string{`a "b" c`, "d"}},
+			{`"a \"b\" \\c"`, []string{`a "b" \c`}},
+			{`a\ b c:\foo\bar`, []string{"a b", `c:\foo\bar`}},
+			{`-D"FOO BAR"=1`, []string{"-DFOO BAR=1"}},
+			{`${join: -l,${libs}} x`, []string{"${join: -l,${libs}}", "x"}},
+			{`""`, []string{""}},
+		} {
+			Convey(fmt.Sprintf("WHEN: Tokenize (`%s`)", tc.input), func() {
+				actual, err := Tokenize(tc.input)
+				Convey(fmt.Sprintf("THEN: Should be %q", tc.expected), func() {
+					So(err, ShouldBeNil)
+					So(actual, ShouldResemble, tc.expected)
+				})
+			})
+		}
+		for _, input := range []string{`"abc`, `'abc`, `${abc`} {
+			Convey(fmt.Sprintf("WHEN: Tokenize (`%s`)", input), func() {
+				_, err := Tokenize(input)
+				Convey("THEN: Should fail", func() {
+					So(err, ShouldNotBeNil)
+				})
+			})
+		}
+	})
+}
+
+func TestJoinArgsThenTokenize(t *testing.T) {
+	Convey("Tokenize (JoinArgs (args)) should return to original", t, func() {
+		condition := func(args []string) bool {
+			actual, err := Tokenize(JoinArgs(args))
+			if err != nil || len(actual) != len(args) {
+				return false
+			}
+			for i := range args {
+				if actual[i] != args[i] {
+					return false
+				}
+			}
+			return true
+		}
+		So(condition, convey.ShouldSucceedForAll,
+			gen.SliceOf(genPathComponent(true)).WithLabel("args"))
+	})
+}
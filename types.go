@@ -51,11 +51,12 @@ type OtherRuleFile struct {
 	Compiler string
 	Infile   string
 	Outfile  string
-	Include  string
-	Option   string
-	Define   string
+	Include  []string
+	Option   []string
+	Define   []string
 	Depend   string
 	Project  string
+	Launcher *LauncherSetting `json:",omitempty"` // `compiler_launcher:` in the directory
 }
 
 // AppendBuild ...
@@ -80,6 +81,29 @@ type BuildCommand struct {
 	DepFile          string
 	Depends          []string
 	ImplicitDepends  []string
+	OrderOnlyDepends []string
+	ImplicitOutputs  []string
+	Dyndep           string   // Dyndep file binding the dependencies discovered while building (C++20 modules)
+	Sources          []string // Sources included by the unity file `InFiles[0]` (listed in `compile_commands.json`)
 	NeedCommandAlias bool
 	Project          string
+	Launcher         *LauncherSetting `json:",omitempty"` // `compiler_launcher:` in the directory (`nil` if not launched)
+}
+
+// ProjectTarget holds the target information for project file generators (ex. MSBuild).
+type ProjectTarget struct {
+	Name        string
+	Type        string   // "library", "execute" or "convert"
+	Dir         string   // Directory contains `make.yml` (ends with '/')
+	Sources     []string // Absolute paths of compiled sources
+	Headers     []string // Absolute paths of headers
+	Includes    []string // Include directories (without option prefix)
+	Defines     []string // Macro definitions (without option prefix)
+	Options     []string // Other compiler options (`$out`, `$dep` and `$in` are not replaced)
+	LinkOptions []string
+	Libraries   []string // System libraries (without option prefix)
+	LinkDepends []string
+	Prebuilds   []*BuildCommand // Prebuild commands in the directory
+	OutFile     string
+	Depends     []*ProjectTarget // Libraries in the sub-directories
 }
@@ -0,0 +1,124 @@
+// Unity (jumbo) builds.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"path/filepath"
+	"sort"
+)
+
+// defaultUnityBatch is the number of sources in a unity file if `batch:` is not specified.
+const defaultUnityBatch = 8
+
+// unityFile is a generated source including a batch of sources.
+type unityFile struct {
+	path    string   // `$`-prefixed path (generated in the output directory)
+	sources []string // Absolute paths of the included sources
+}
+
+// sourceHash returns the hash of the source path `src`.
+func sourceHash(src string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(filepath.ToSlash(filepath.Clean(src))))
+	return h.Sum32()
+}
+
+// batchUnitySources splits `files` into batches of at most `batch` sources.
+// Sources are sorted by the path, and a batch also ends at a source whose hash hits 1/`batch` chance.
+// Since the boundaries depend on the sources themselves (not on the positions),
+// adding or removing a source changes its own batch (and rarely the next few ones) only.
+func batchUnitySources(files []string, batch int) [][]string {
+	sorted := append([]string{}, files...)
+	sort.Strings(sorted)
+	var result [][]string
+	var current []string
+	for _, f := range sorted {
+		current = append(current, f)
+		if len(current) == batch || sourceHash(f)%uint32(batch) == 0 {
+			result = append(result, current)
+			current = nil
+		}
+	}
+	if 0 < len(current) {
+		result = append(result, current)
+	}
+	return result
+}
+
+// makeUnityFiles batches C/C++ sources of `files` (relative to `loaddir`) into unity files as specified by `setting`.
+// Sources matched to `individual` (and the ones listed in `exclude:`) are compiled individually.
+// Returns `files` replacing the batched sources with the unity files (generated in `info.outputdir`).
+func makeUnityFiles(info BuildInfo, loaddir string, files []string, setting *UnitySetting, individual func(src string) bool) ([]string, map[string]*unityFile, error) {
+	if setting == nil || !setting.Enabled {
+		return files, nil, nil
+	}
+	batch := setting.Batch
+	if batch <= 0 {
+		batch = defaultUnityBatch
+	}
+	excluded := make(map[string]bool)
+	for _, e := range setting.Exclude {
+		excluded[filepath.ToSlash(filepath.Clean(e))] = true
+	}
+	candidates := make(map[string][]string) // Language to the sources
+	for _, f := range files {
+		p := filepath.ToSlash(filepath.Clean(f))
+		lang := sourceLanguage(f)
+		if f[0] == '$' || (lang != "c" && lang != "c++") || excluded[p] || excluded[filepath.Base(p)] || individual(f) {
+			continue
+		}
+		candidates[lang] = append(candidates[lang], f)
+	}
+	outdir, err := filepath.Abs(info.outputdir)
+	if err != nil {
+		return nil, nil, err
+	}
+	unities := make(map[string]*unityFile)
+	batched := make(map[string]string) // Source to the unity file
+	for lang, sources := range candidates {
+		ext := ".cpp"
+		if lang == "c" {
+			ext = ".c"
+		}
+		for _, b := range batchUnitySources(sources, batch) {
+			if len(b) < 2 {
+				continue
+			}
+			name := fmt.Sprintf("unity_%08x%s", sourceHash(b[0]), ext)
+			u := &unityFile{path: "$" + name}
+			var content bytes.Buffer
+			content.WriteString("// Generated by cbuild (unity build).\n")
+			for _, src := range b {
+				abs, _ := filepath.Abs(filepath.Join(loaddir, src))
+				u.sources = append(u.sources, filepath.ToSlash(abs))
+				inc := filepath.ToSlash(abs)
+				if rel, err := filepath.Rel(outdir, abs); err == nil {
+					inc = filepath.ToSlash(rel)
+				}
+				fmt.Fprintf(&content, "#include \"%s\"\n", inc)
+				batched[src] = u.path
+			}
+			if _, err := updateFile(filepath.Join(info.outputdir, name), content.Bytes()); err != nil {
+				return nil, nil, err
+			}
+			unities[u.path] = u
+		}
+	}
+	// Unity files are placed at the first one of the batched sources.
+	result := make([]string, 0, len(files))
+	placed := make(map[string]bool)
+	for _, f := range files {
+		u, ok := batched[f]
+		switch {
+		case !ok:
+			result = append(result, f)
+		case !placed[u]:
+			placed[u] = true
+			result = append(result, u)
+		}
+	}
+	return result, unities, nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/yaml.v2"
+)
+
+func TestUnitySetting(t *testing.T) {
+	Convey("GIVEN: `unity:` settings", t, func() {
+		var targets []Target
+		So(yaml.Unmarshal([]byte(`
+- {name: a, unity: {enabled: true, batch: 16, exclude: [legacy.cpp]}}
+- name: b
+`), &targets), ShouldBeNil)
+		Convey("THEN: Settings should be read per target", func() {
+			So(targets[0].Unity, ShouldResemble, UnitySetting{Enabled: true, Batch: 16, Exclude: []string{"legacy.cpp"}})
+			So(targets[1].Unity.Enabled, ShouldBeFalse)
+		})
+	})
+}
+
+func TestBatchUnitySources(t *testing.T) {
+	var files []string
+	for i := 0; i < 100; i++ {
+		files = append(files, fmt.Sprintf("src/file%03d.cpp", i))
+	}
+	Convey("GIVEN: Many sources", t, func() {
+		batches := batchUnitySources(files, 8)
+		Convey("THEN: All sources should be batched in order", func() {
+			var all []string
+			for _, b := range batches {
+				So(len(b), ShouldBeBetweenOrEqual, 1, 8)
+				all = append(all, b...)
+			}
+			So(all, ShouldResemble, files)
+		})
+		Convey("THEN: Batches should not depend on the order of the sources", func() {
+			reversed := make([]string, 0, len(files))
+			for i := len(files) - 1; 0 <= i; i-- {
+				reversed = append(reversed, files[i])
+			}
+			So(batchUnitySources(reversed, 8), ShouldResemble, batches)
+		})
+		Convey("WHEN: A source is added", func() {
+			added := batchUnitySources(append(append([]string{}, files...), "src/file050a.cpp"), 8)
+			Convey("THEN: Most of batches should be kept", func() {
+				kept := 0
+				for _, b := range added {
+					for _, o := range batches {
+						if strings.Join(b, " ") == strings.Join(o, " ") {
+							kept++
+							break
+						}
+					}
+				}
+				So(kept, ShouldBeGreaterThanOrEqualTo, len(batches)-3)
+			})
+		})
+	})
+}
+
+func TestUnityBuild(t *testing.T) {
+	dir := prepareSampleTree(t)
+	defer os.RemoveAll(dir)
+	for name, body := range map[string]string{
+		"sub/extra.cpp":  "int extra() { return 1; }\n",
+		"sub/legacy.cpp": "static int value = 2;\nint legacy() { return value; }\n",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(body), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	editSampleFile(t, dir, "make.yml",
+		"  - sub/test_sub.cpp\n", "  - sub/test_sub.cpp\n  - sub/extra.cpp\n  - sub/legacy.cpp\n",
+		"- name: test\n  type: execute\n", "- name: test\n  type: execute\n  unity: {enabled: true, batch: 16, exclude: [legacy.cpp]}\n",
+	)
+	Convey("GIVEN: A target using the unity build", t, func() {
+		var graph *BuildGraph
+		So(generateSample(dir, "build.ninja", func(g *BuildGraph) error {
+			graph = g
+			return (&ninjaGenerator{}).Emit(g)
+		}), ShouldBeNil)
+		var compiles []*BuildCommand
+		for _, c := range graph.Commands {
+			if c.CommandType == "compile" && strings.Contains(c.OutFile, "CBuild.dir_test/") {
+				compiles = append(compiles, c)
+			}
+		}
+		var unity *BuildCommand
+		var individuals []string
+		for _, c := range compiles {
+			if 0 < len(c.Sources) {
+				unity = c
+			} else {
+				individuals = append(individuals, filepath.Base(c.InFiles[0]))
+			}
+		}
+		So(unity, ShouldNotBeNil)
+		Convey("THEN: Sources should be compiled in the unity file", func() {
+			So(filepath.Base(unity.InFiles[0]), ShouldStartWith, "unity_")
+			So(filepath.Ext(unity.InFiles[0]), ShouldEqual, ".cpp")
+			var names []string
+			for _, src := range unity.Sources {
+				rel, _ := filepath.Rel(dir, src)
+				names = append(names, filepath.ToSlash(rel))
+			}
+			// The hash of `sub/test_sub.cpp` ends the batch.
+			So(names, ShouldResemble, []string{"sub/extra.cpp", "sub/test_sub.cpp"})
+			content, err := ioutil.ReadFile(unity.InFiles[0])
+			So(err, ShouldBeNil)
+			So(string(content), ShouldContainSubstring, "#include \"../../../sub/test_sub.cpp\"\n")
+		})
+		Convey("THEN: Excluded sources and single source batches should be compiled individually", func() {
+			So(individuals, ShouldResemble, []string{"test.cpp", "legacy.cpp"})
+		})
+		Convey("THEN: The compilation database should list the original sources", func() {
+			b, err := ioutil.ReadFile(filepath.Join(dir, "build", "LINUX", "Debug", "compile_commands.json"))
+			So(err, ShouldBeNil)
+			var items []CompileDbItem
+			So(json.Unmarshal(b, &items), ShouldBeNil)
+			var files []string
+			for _, item := range items {
+				if item.Output == unity.OutFile {
+					files = append(files, item.File)
+					So(item.Arguments[len(item.Arguments)-1], ShouldEqual, item.File)
+				}
+			}
+			So(files, ShouldResemble, []string{"sub/extra.cpp", "sub/test_sub.cpp"})
+		})
+		Convey("THEN: The unity file should be written by the update of build.ninja", func() {
+			So(graph.GeneratedFiles, ShouldResemble, []string{unity.InFiles[0]})
+			b, err := ioutil.ReadFile(filepath.Join(dir, "build.ninja"))
+			So(err, ShouldBeNil)
+			So(string(b), ShouldContainSubstring, "build build.ninja | "+EscapeNinjaPath(unity.InFiles[0])+" : update_ninja_file ")
+		})
+		Convey("THEN: The unity file should be compilable", func() {
+			So(os.MkdirAll(filepath.Join(dir, filepath.Dir(unity.OutFile)), 0755), ShouldBeNil)
+			cmd := exec.Command("g++", append(append([]string{}, unity.Args...), "-o", "unity.o", unity.InFiles[0])...)
+			cmd.Dir = dir
+			out, err := cmd.CombinedOutput()
+			if err != nil {
+				t.Log(string(out))
+			}
+			So(err, ShouldBeNil)
+		})
+	})
+}
@@ -0,0 +1,257 @@
+// Exports VS Code tasks and launch configurations.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// VSCodeLabelPrefix marks tasks and launch configurations generated by cbuild.
+// Entries with other labels are kept when updating existing files.
+const VSCodeLabelPrefix = "cbuild: "
+
+// VSCodeTask is an entry of `tasks.json`.
+type VSCodeTask struct {
+	Label          string             `json:"label"`
+	Type           string             `json:"type"`
+	Command        string             `json:"command"`
+	Args           []string           `json:"args,omitempty"`
+	Options        *VSCodeTaskOptions `json:"options,omitempty"`
+	Group          string             `json:"group,omitempty"`
+	DependsOn      []string           `json:"dependsOn,omitempty"`
+	ProblemMatcher []string           `json:"problemMatcher"`
+}
+
+// VSCodeTaskOptions holds the options of a task.
+type VSCodeTaskOptions struct {
+	Cwd string `json:"cwd"`
+}
+
+// VSCodeLaunch is an entry of `launch.json`.
+type VSCodeLaunch struct {
+	Name          string   `json:"name"`
+	Type          string   `json:"type"`
+	Request       string   `json:"request"`
+	Program       string   `json:"program"`
+	Args          []string `json:"args"`
+	Cwd           string   `json:"cwd"`
+	StopAtEntry   bool     `json:"stopAtEntry"`
+	PreLaunchTask string   `json:"preLaunchTask"`
+	MIMode        string   `json:"MIMode,omitempty"`
+}
+
+// VSCodeSettings holds the settings for exporting.
+type VSCodeSettings struct {
+	Tool      string // Build tool run by the tasks ("ninja" or "make")
+	BuildFile string // Name of the build file (`-f`, relative to `BaseDir`)
+	BaseDir   string // Directory to run the build tool (empty for the workspace folder)
+	Windows   bool   // Uses the debugger and the problem matcher for MSVC
+}
+
+// vscodeGenerator writes `tasks.json` and `launch.json`.
+type vscodeGenerator struct {
+	dir string
+}
+
+func init() {
+	RegisterGenerator(&vscodeGenerator{})
+}
+
+func (*vscodeGenerator) Name() string { return "vscode" }
+
+func (g *vscodeGenerator) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&g.dir, "vscode-dir", ".vscode", "VS Code settings output directory")
+}
+
+// Emit writes tasks running the build file of the ninja or make backend (ninja is preferred if both are selected).
+func (g *vscodeGenerator) Emit(graph *BuildGraph) error {
+	tool, buildFile, err := vscodeBuildTool(option.backend)
+	if err != nil {
+		return err
+	}
+	graph, err = normalizeGraph(graph, buildFile)
+	if err != nil {
+		return err
+	}
+	settings := VSCodeSettings{
+		Tool:      tool,
+		BuildFile: filepath.ToSlash(buildFile),
+		BaseDir:   graph.BaseDir,
+		Windows:   commandShell == WindowsShell,
+	}
+	if 0 < len(graph.BaseDir) {
+		settings.BuildFile = relativePath(graph.BaseDir, buildFile)
+	}
+	tasks, launches := MakeVSCodeTasks(&settings, graph.Targets)
+	if len(tasks) == 0 {
+		Warn("There are no targets for VS Code.")
+		return nil
+	}
+	if err := os.MkdirAll(g.dir, 0755); err != nil {
+		return errors.Wrapf(err, "failed to create directory \"%s\"", g.dir)
+	}
+	taskItems := make([]interface{}, 0, len(tasks))
+	for _, t := range tasks {
+		taskItems = append(taskItems, t)
+	}
+	if err := updateVSCodeFile(filepath.Join(g.dir, "tasks.json"), "2.0.0", "tasks", "label", taskItems); err != nil {
+		return err
+	}
+	launchItems := make([]interface{}, 0, len(launches))
+	for _, l := range launches {
+		launchItems = append(launchItems, l)
+	}
+	return updateVSCodeFile(filepath.Join(g.dir, "launch.json"), "0.2.0", "configurations", "name", launchItems)
+}
+
+// vscodeBuildTool returns the build tool and the build file written by the backends in `spec`.
+func vscodeBuildTool(spec string) (string, string, error) {
+	selected, err := SelectGenerators(spec)
+	if err != nil {
+		return "", "", err
+	}
+	var makefile string
+	for _, g := range selected {
+		switch gen := g.(type) {
+		case *ninjaGenerator:
+			return "ninja", option.ninjaFile, nil
+		case *makeGenerator:
+			makefile = gen.makefile
+			if len(makefile) == 0 {
+				makefile = DefaultMakefileName
+			}
+		}
+	}
+	if len(makefile) == 0 {
+		return "", "", errors.New("the vscode backend requires the ninja or make backend (ex. \"-backend ninja,vscode\")")
+	}
+	return "make", makefile, nil
+}
+
+// MakeVSCodeTasks makes build tasks and launch configurations for `execute` and `test` targets.
+func MakeVSCodeTasks(settings *VSCodeSettings, targets []*ProjectTarget) ([]*VSCodeTask, []*VSCodeLaunch) {
+	problemMatcher := "$gcc"
+	debugger := "cppdbg"
+	miMode := "gdb"
+	if settings.Windows {
+		problemMatcher = "$msCompile"
+		debugger = "cppvsdbg"
+		miMode = ""
+	}
+	workspacePath := func(p string) string {
+		p = filepath.ToSlash(p)
+		if path.IsAbs(p) || filepath.IsAbs(p) {
+			return p
+		}
+		return path.Join("${workspaceFolder}", p)
+	}
+	// Targets are relative to `BaseDir`.
+	outputPath := func(p string) string {
+		p = filepath.ToSlash(p)
+		if len(settings.BaseDir) == 0 || path.IsAbs(p) || filepath.IsAbs(p) {
+			return workspacePath(p)
+		}
+		return workspacePath(path.Join(settings.BaseDir, p))
+	}
+	cwd := workspacePath(settings.BaseDir)
+	tasks := make([]*VSCodeTask, 0)
+	launches := make([]*VSCodeLaunch, 0)
+	for _, t := range targets {
+		if t.Type != "execute" && t.Type != "test" {
+			continue
+		}
+		name := strings.TrimPrefix(path.Join(t.Dir, t.Name), "./")
+		build := &VSCodeTask{
+			Label:          VSCodeLabelPrefix + "build " + name,
+			Type:           "shell",
+			Command:        settings.Tool,
+			Args:           []string{"-f", settings.BuildFile, t.OutFile},
+			Options:        &VSCodeTaskOptions{Cwd: cwd},
+			Group:          "build",
+			ProblemMatcher: []string{problemMatcher},
+		}
+		tasks = append(tasks, build)
+		if t.Type == "test" {
+			tasks = append(tasks, &VSCodeTask{
+				Label:          VSCodeLabelPrefix + "run " + name,
+				Type:           "process",
+				Command:        outputPath(t.OutFile),
+				Options:        &VSCodeTaskOptions{Cwd: "${workspaceFolder}"},
+				Group:          "test",
+				DependsOn:      []string{build.Label},
+				ProblemMatcher: []string{},
+			})
+		}
+		launches = append(launches, &VSCodeLaunch{
+			Name:          VSCodeLabelPrefix + name,
+			Type:          debugger,
+			Request:       "launch",
+			Program:       outputPath(t.OutFile),
+			Args:          []string{},
+			Cwd:           "${workspaceFolder}",
+			PreLaunchTask: build.Label,
+			MIMode:        miMode,
+		})
+	}
+	return tasks, launches
+}
+
+// updateVSCodeFile replaces the entries generated by cbuild in `key` of the JSON file.
+// Other entries (labeled with `labelKey`) and top level properties are preserved.
+func updateVSCodeFile(file string, version string, key string, labelKey string, items []interface{}) error {
+	doc := make(map[string]json.RawMessage)
+	var entries []json.RawMessage
+	if b, err := ioutil.ReadFile(file); err == nil {
+		if err := json.Unmarshal(b, &doc); err != nil {
+			return errors.Wrapf(err, "failed to parse \"%s\" (comments are not supported)", file)
+		}
+		if raw, ok := doc[key]; ok {
+			if err := json.Unmarshal(raw, &entries); err != nil {
+				return errors.Wrapf(err, "malformed \"%s\" in \"%s\"", key, file)
+			}
+		}
+	} else if !os.IsNotExist(err) {
+		return errors.Wrapf(err, "failed to read \"%s\"", file)
+	}
+	result := make([]interface{}, 0, len(entries)+len(items))
+	for _, e := range entries {
+		var labeled map[string]interface{}
+		if err := json.Unmarshal(e, &labeled); err == nil {
+			if label, ok := labeled[labelKey].(string); ok && strings.HasPrefix(label, VSCodeLabelPrefix) {
+				continue
+			}
+		}
+		result = append(result, e)
+	}
+	result = append(result, items...)
+	if _, ok := doc["version"]; !ok {
+		doc["version"], _ = json.Marshal(version)
+	}
+	raw, err := json.Marshal(result)
+	if err != nil {
+		return errors.Wrapf(err, "failed to marshal \"%s\"", key)
+	}
+	doc[key] = raw
+	b, err := json.MarshalIndent(doc, "", "    ")
+	if err != nil {
+		return errors.Wrapf(err, "failed to marshal \"%s\"", file)
+	}
+	b = append(b, '\n')
+	if old, err := ioutil.ReadFile(file); err == nil && bytes.Equal(old, b) {
+		return nil
+	}
+	Verbose("%s: Writing \"%s\"\n", ProgramName, file)
+	if err := ioutil.WriteFile(file, b, 0644); err != nil {
+		return errors.Wrapf(err, "failed to write \"%s\"", file)
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestMakeVSCodeTasks(t *testing.T) {
+	targets := []*ProjectTarget{
+		{Name: "foo", Type: "library", Dir: "./foo/", OutFile: "build/foo/libfoo.a"},
+		{Name: "app", Type: "execute", Dir: "./", OutFile: "build/app.elf"},
+		{Name: "test_foo", Type: "test", Dir: "./foo/", OutFile: "build/foo/test_foo.elf"},
+	}
+	Convey("GIVEN: Targets", t, func() {
+		settings := VSCodeSettings{Tool: "ninja", BuildFile: "build.ninja"}
+		Convey("WHEN: Making tasks", func() {
+			tasks, launches := MakeVSCodeTasks(&settings, targets)
+			Convey("THEN: Executables and tests should have build tasks", func() {
+				So(len(tasks), ShouldEqual, 3)
+				So(tasks[0].Label, ShouldEqual, "cbuild: build app")
+				So(tasks[0].Args, ShouldResemble, []string{"-f", "build.ninja", "build/app.elf"})
+				So(tasks[1].Label, ShouldEqual, "cbuild: build foo/test_foo")
+				So(tasks[2].Label, ShouldEqual, "cbuild: run foo/test_foo")
+				So(tasks[2].Command, ShouldEqual, "${workspaceFolder}/build/foo/test_foo.elf")
+				So(tasks[2].DependsOn, ShouldResemble, []string{"cbuild: build foo/test_foo"})
+			})
+			Convey("THEN: Launch configurations should build the target first", func() {
+				So(len(launches), ShouldEqual, 2)
+				So(launches[0].Type, ShouldEqual, "cppdbg")
+				So(launches[0].Program, ShouldEqual, "${workspaceFolder}/build/app.elf")
+				So(launches[0].PreLaunchTask, ShouldEqual, "cbuild: build app")
+			})
+		})
+		Convey("WHEN: The build file is run in a sub-directory", func() {
+			settings := VSCodeSettings{Tool: "make", BuildFile: "Makefile", BaseDir: "out"}
+			tasks, launches := MakeVSCodeTasks(&settings, []*ProjectTarget{
+				{Name: "app", Type: "execute", Dir: "./", OutFile: "../build/app.elf"},
+			})
+			Convey("THEN: Tasks should run the build tool in the directory", func() {
+				So(len(tasks), ShouldEqual, 1)
+				So(tasks[0].Command, ShouldEqual, "make")
+				So(tasks[0].Args, ShouldResemble, []string{"-f", "Makefile", "../build/app.elf"})
+				So(tasks[0].Options.Cwd, ShouldEqual, "${workspaceFolder}/out")
+				So(launches[0].Program, ShouldEqual, "${workspaceFolder}/build/app.elf")
+			})
+		})
+	})
+}
+
+func TestVSCodeBuildTool(t *testing.T) {
+	Convey("GIVEN: Backends", t, func() {
+		savedNinja := option.ninjaFile
+		defer func() { option.ninjaFile = savedNinja }()
+		option.ninjaFile = "out.ninja"
+		Convey("WHEN: The ninja backend is selected", func() {
+			tool, file, err := vscodeBuildTool("make,vscode,ninja")
+			Convey("THEN: Tasks should run ninja", func() {
+				So(err, ShouldBeNil)
+				So(tool, ShouldEqual, "ninja")
+				So(file, ShouldEqual, "out.ninja")
+			})
+		})
+		Convey("WHEN: Only the make backend is selected", func() {
+			tool, file, err := vscodeBuildTool("make,vscode")
+			Convey("THEN: Tasks should run make", func() {
+				So(err, ShouldBeNil)
+				So(tool, ShouldEqual, "make")
+				So(file, ShouldEqual, DefaultMakefileName)
+			})
+		})
+		Convey("WHEN: Neither of them is selected", func() {
+			_, _, err := vscodeBuildTool("vscode")
+			Convey("THEN: Should fail", func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+	})
+}
+
+func TestUpdateVSCodeFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cbuild-vscode-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "tasks.json")
+	Convey("GIVEN: Existing tasks.json", t, func() {
+		existing := `{"version": "2.0.0", "inputs": [],
+  "tasks": [{"label": "mine", "command": "true"}, {"label": "cbuild: build old", "command": "ninja"}]}`
+		So(ioutil.WriteFile(file, []byte(existing), 0644), ShouldBeNil)
+		Convey("WHEN: Updating", func() {
+			err := updateVSCodeFile(file, "2.0.0", "tasks", "label",
+				[]interface{}{&VSCodeTask{Label: "cbuild: build new", Command: "ninja"}})
+			So(err, ShouldBeNil)
+			Convey("THEN: Only generated entries should be replaced", func() {
+				var doc struct {
+					Version string                   `json:"version"`
+					Inputs  []interface{}            `json:"inputs"`
+					Tasks   []map[string]interface{} `json:"tasks"`
+				}
+				b, err := ioutil.ReadFile(file)
+				So(err, ShouldBeNil)
+				So(json.Unmarshal(b, &doc), ShouldBeNil)
+				So(doc.Version, ShouldEqual, "2.0.0")
+				So(doc.Inputs, ShouldNotBeNil)
+				So(len(doc.Tasks), ShouldEqual, 2)
+				So(doc.Tasks[0]["label"], ShouldEqual, "mine")
+				So(doc.Tasks[1]["label"], ShouldEqual, "cbuild: build new")
+			})
+		})
+		Convey("WHEN: The file contains comments", func() {
+			So(ioutil.WriteFile(file, []byte("// comment\n"+existing), 0644), ShouldBeNil)
+			err := updateVSCodeFile(file, "2.0.0", "tasks", "label", nil)
+			Convey("THEN: Should fail without overwriting", func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+	})
+}
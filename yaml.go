@@ -11,25 +11,67 @@ import (
 
 // Data format make.yml top structure
 type Data struct {
-	Target        []Target     `yaml:",flow"`
-	Include       []StringList `yaml:",flow"`
-	Variable      []Variable   `yaml:",flow"`
-	Define        []StringList `yaml:",flow"`
-	Option        []StringList `yaml:",flow"`
-	ArchiveOption []StringList `yaml:"archive_option,flow"`
-	ConvertOption []StringList `yaml:"convert_option,flow"`
-	LinkOption    []StringList `yaml:"link_option,flow"`
-	LinkDepend    []StringList `yaml:"link_depend,flow"`
-	Libraries     []StringList `yaml:",flow"`
-	Prebuild      []Build      `yaml:",flow"`
-	Postbuild     []Build      `yaml:",flow"`
-	Source        []StringList `yaml:",flow"`
-	Headers       []StringList `yaml:"header,flow"`
-	ConvertList   []StringList `yaml:"convert_list,flow"`
-	Subdirs       []StringList `yaml:"subdir,flow"`
-	Tests         []StringList `yaml:",flow"`
-	Other         []Other      `yaml:",flow"`
-	SubNinja      []StringList `yaml:",flow"`
+	Target        []Target              `yaml:",flow"`
+	Include       []StringList          `yaml:",flow"`
+	Variable      []Variable            `yaml:",flow"`
+	Define        []StringList          `yaml:",flow"`
+	Option        []StringList          `yaml:",flow"` // Common to all languages (ex. not `-std=`)
+	COption       []StringList          `yaml:"c_option,flow"`
+	CXXOption     []StringList          `yaml:"cxx_option,flow"`
+	ArchiveOption []StringList          `yaml:"archive_option,flow"`
+	ConvertOption []StringList          `yaml:"convert_option,flow"`
+	LinkOption    []StringList          `yaml:"link_option,flow"`
+	LinkDepend    []StringList          `yaml:"link_depend,flow"`
+	Libraries     []StringList          `yaml:",flow"`
+	Prebuild      []Build               `yaml:",flow"`
+	Postbuild     []Build               `yaml:",flow"`
+	Source        []StringList          `yaml:",flow"`
+	Headers       []StringList          `yaml:"header,flow"`
+	ConvertList   []StringList          `yaml:"convert_list,flow"`
+	Subdirs       []StringList          `yaml:"subdir,flow"`
+	Tests         []StringList          `yaml:",flow"`
+	Other         []Other               `yaml:",flow"`
+	SubNinja      []StringList          `yaml:",flow"`
+	Environment   []EnvironmentVariable `yaml:",flow"`
+	Launcher      []Launcher            `yaml:"compiler_launcher,flow"`
+}
+
+// conditions returns all `when:` conditions in the configuration.
+func (d *Data) conditions() []*Condition {
+	result := make([]*Condition, 0)
+	add := func(c *Condition) {
+		if c != nil {
+			result = append(result, c)
+		}
+	}
+	addLists := func(lists []StringList) {
+		for i := range lists {
+			add(lists[i].When())
+		}
+	}
+	for _, lists := range [][]StringList{
+		d.Include, d.Define, d.Option, d.COption, d.CXXOption, d.ArchiveOption, d.ConvertOption, d.LinkOption,
+		d.LinkDepend, d.Libraries, d.Source, d.Headers, d.ConvertList, d.Subdirs, d.Tests, d.SubNinja,
+	} {
+		addLists(lists)
+	}
+	for _, v := range d.Variable {
+		add(v.When)
+	}
+	for _, builds := range [][]Build{d.Prebuild, d.Postbuild} {
+		for _, b := range builds {
+			add(b.When)
+			addLists(b.Source)
+		}
+	}
+	for _, o := range d.Other {
+		add(o.When)
+		addLists(o.Option)
+	}
+	for _, l := range d.Launcher {
+		add(l.When)
+	}
+	return result
 }
 
 // Target make.yml target file information
@@ -38,6 +80,40 @@ type Target struct {
 	Type     string
 	ByTarget string `yaml:"by_target"`
 	Packager Packager
+	PCH      PCHSetting   `yaml:"pch"`
+	Unity    UnitySetting `yaml:"unity"`
+}
+
+// PCHSetting make.yml target pch section.
+// Either the header for C++ (`pch: common.hpp`) or the headers per language
+// (`pch: {c: common.h, cxx: common.hpp, exclude: [legacy.cpp]}`).
+type PCHSetting struct {
+	C       string
+	CXX     string   `yaml:"cxx"`
+	Exclude []string `yaml:",flow"` // Sources compiled without the PCH
+}
+
+// IsEmpty returns true if no headers are specified.
+func (p *PCHSetting) IsEmpty() bool {
+	return len(p.C) == 0 && len(p.CXX) == 0
+}
+
+// UnmarshalYAML is the custom handler for mapping YAML to `PCHSetting`
+func (p *PCHSetting) UnmarshalYAML(unmarshaler func(interface{}) error) error {
+	var header string
+	if err := unmarshaler(&header); err == nil {
+		p.CXX = header
+		return nil
+	}
+	type plain PCHSetting
+	return unmarshaler((*plain)(p))
+}
+
+// UnitySetting make.yml target unity section (`unity: {enabled: true, batch: 16, exclude: [foo.cpp]}`).
+type UnitySetting struct {
+	Enabled bool
+	Batch   int      // Number of sources in a unity file (8 if not specified)
+	Exclude []string `yaml:",flow"` // Sources compiled individually
 }
 
 // Packager make.yml package information
@@ -46,12 +122,62 @@ type Packager struct {
 	Option string
 }
 
+// SourceOption make.yml per-file settings in `source:` lists
+// (`- {file: foo.cpp, option: [O0], define: [FOO], exclude_variant: [product], pch: false}`).
+type SourceOption struct {
+	File           string
+	Option         []string `yaml:",flow"`
+	Define         []string `yaml:",flow"`
+	ExcludeVariant []string `yaml:"exclude_variant,flow"`
+	PCH            *bool    `yaml:"pch"` // `false` to compile without the pre-compiled header
+}
+
+// UsePCH returns false if the pre-compiled header is disabled for the file.
+func (o *SourceOption) UsePCH() bool {
+	return o == nil || o.PCH == nil || *o.PCH
+}
+
+// Excludes checks the file is excluded from the `variant` build or not.
+func (o *SourceOption) Excludes(variant string) bool {
+	for _, v := range o.ExcludeVariant {
+		if strings.EqualFold(v, variant) {
+			return true
+		}
+	}
+	return false
+}
+
+// stringListItem is an item of `StringList` (either a string or a `SourceOption` mapping).
+type stringListItem struct {
+	value  string
+	source *SourceOption
+}
+
+// UnmarshalYAML is the custom handler for mapping YAML to `stringListItem`
+func (item *stringListItem) UnmarshalYAML(unmarshaler func(interface{}) error) error {
+	if err := unmarshaler(&item.value); err == nil {
+		return nil
+	}
+	var source SourceOption
+	if err := unmarshaler(&source); err != nil {
+		return err
+	}
+	if len(source.File) == 0 {
+		return errors.New("`file:` is required for the per-file settings")
+	}
+	item.value = source.File
+	item.source = &source
+	return nil
+}
+
 // StringList make.yml string list('- list: ...')
 type StringList struct {
 	// Target selector
 	Target    string
 	platforms *PlatformIDSet
+	when      *Condition
 	items     map[string](*[]string)
+	sources   map[string][]*SourceOption // Per-file settings associated to the key
 }
 
 // Platforms retrieves list of target platforms.
@@ -104,73 +230,200 @@ func (s *StringList) getItems(key string) *[]string {
 	return nil
 }
 
+// When retrieves the `when:` condition (`nil` if not specified).
+func (s *StringList) When() *Condition {
+	return s.when
+}
+
 // GetMatchedItems retrieves items matched conditions.
-func (s *StringList) GetMatchedItems(buildTarget string, platform string, variant string) []string {
-	if !s.Match(buildTarget, platform) {
+func (s *StringList) GetMatchedItems(ctx ConditionContext) []string {
+	keys := s.matchedKeys(ctx)
+	if keys == nil {
 		return nil
 	}
+	excluded := make(map[string]bool)
+	for _, o := range s.GetMatchedSourceOptions(ctx) {
+		if o.Excludes(ctx.Variant) {
+			excluded[o.File] = true
+		}
+	}
 	result := make([]string, 0)
-	appender := func(key interface{}) {
+	for _, key := range keys {
 		if l := s.Items(key); l != nil {
-			result = append(result, *l...)
+			for _, item := range *l {
+				if !excluded[item] {
+					result = append(result, item)
+				}
+			}
 		}
 	}
-	appender(Common)
-	switch variant {
-	case Debug.String():
-		appender(Debug)
-	case Develop.String():
-		appender(Develop)
-	case Release.String():
-		appender(Release)
-	case DevelopRelease.String():
-		appender(DevelopRelease)
-	case Product.String():
-		appender(Product)
-	default:
-		appender(variant)
+	return result
+}
+
+// GetMatchedSourceOptions retrieves per-file settings matched conditions.
+func (s *StringList) GetMatchedSourceOptions(ctx ConditionContext) []*SourceOption {
+	var result []*SourceOption
+	for _, key := range s.matchedKeys(ctx) {
+		result = append(result, s.sources[key.String()]...)
 	}
 	return result
 }
 
+// matchedKeys returns the keys of the lists matched conditions (`nil` if nothing matched).
+func (s *StringList) matchedKeys(ctx ConditionContext) []fmt.Stringer {
+	if !s.Match(ctx.Target, ctx.Platform) {
+		return nil
+	}
+	if !s.when.Evaluate(ctx) {
+		return nil
+	}
+	return []fmt.Stringer{Common, KnownBuildType(ctx.Variant)}
+}
+
 // UnmarshalYAML is the custom handler for mapping YAML to `StringList`
 func (s *StringList) UnmarshalYAML(unmarshaler func(interface{}) error) error {
 	var fixedSlot struct {
 		Types  *PlatformIDSet `yaml:"type"`
 		Target string
+		When   *Condition
 	}
 	err := unmarshaler(&fixedSlot)
 	if err != nil {
 		return errors.Wrapf(err, "unmarshaling failed on `StringList` fixed slots")
 	}
-	var items map[string]*[]string
-	err = unmarshaler(&items)
+	var lists map[string]*[]stringListItem
+	err = unmarshaler(&lists)
 	if err != nil {
 		if _, ok := err.(*yaml.TypeError); !ok {
 			return err
 		}
 	}
+	var items map[string]*[]string
+	if lists != nil {
+		items = make(map[string]*[]string, len(lists))
+	}
+	sources := make(map[string][]*SourceOption)
+	for key, l := range lists {
+		if l == nil {
+			items[key] = nil
+			continue
+		}
+		values := make([]string, 0, len(*l))
+		for _, item := range *l {
+			values = append(values, item.value)
+			if item.source != nil {
+				sources[key] = append(sources[key], item.source)
+			}
+		}
+		items[key] = &values
+	}
 	s.platforms = fixedSlot.Types
 	s.Target = fixedSlot.Target
+	s.when = fixedSlot.When
 	s.items = items
+	s.sources = sources
 	return nil
 }
 
 // Variable make.yml variable section
 type Variable struct {
+	Name  string
+	Value string
+	// Values holds items if the value is specified as a list (`value: [a, b, c]`).
+	// `Value` holds them joined with ' ' in that case.
+	Values    []string       `yaml:"-"`
+	Platforms *PlatformIDSet `yaml:"type"`
+	Target    string
+	Build     string
+	When      *Condition
+}
+
+// variableSlots is used for (un)marshaling `Variable`.
+type variableSlots struct {
 	Name      string
-	Value     string
+	Value     interface{}
 	Platforms *PlatformIDSet `yaml:"type"`
 	Target    string
 	Build     string
+	When      *Condition
+}
+
+// IsList returns true if the value is specified as a list.
+func (v *Variable) IsList() bool {
+	return v.Values != nil
+}
+
+// UnmarshalYAML is the custom handler for mapping YAML to `Variable`
+func (v *Variable) UnmarshalYAML(unmarshaler func(interface{}) error) error {
+	var slots struct {
+		Name      string
+		Platforms *PlatformIDSet `yaml:"type"`
+		Target    string
+		Build     string
+		When      *Condition
+	}
+	if err := unmarshaler(&slots); err != nil {
+		return err
+	}
+	*v = Variable{
+		Name:      slots.Name,
+		Platforms: slots.Platforms,
+		Target:    slots.Target,
+		Build:     slots.Build,
+		When:      slots.When,
+	}
+	var probe struct{ Value interface{} }
+	if err := unmarshaler(&probe); err != nil {
+		return err
+	}
+	if _, ok := probe.Value.([]interface{}); ok {
+		var list struct{ Value []string }
+		if err := unmarshaler(&list); err != nil {
+			return errors.Wrapf(err, "failed to unmarshal the list value of \"%s\"", v.Name)
+		}
+		v.Values = list.Value
+		v.Value = JoinArgs(v.Values)
+		return nil
+	}
+	var scalar struct{ Value string }
+	if err := unmarshaler(&scalar); err != nil {
+		return errors.Wrapf(err, "failed to unmarshal the value of \"%s\"", v.Name)
+	}
+	v.Value = scalar.Value
+	return nil
+}
+
+// MarshalYAML is called while marshaling `Variable`.
+func (v *Variable) MarshalYAML() (interface{}, error) {
+	slots := variableSlots{
+		Name:      v.Name,
+		Value:     v.Value,
+		Platforms: v.Platforms,
+		Target:    v.Target,
+		Build:     v.Build,
+		When:      v.When,
+	}
+	if v.IsList() {
+		slots.Value = v.Values
+	}
+	return &slots, nil
 }
 
 // Equals checks v == other.
 func (v *Variable) Equals(other *Variable) bool {
+	if v.IsList() != other.IsList() || len(v.Values) != len(other.Values) {
+		return false
+	}
+	for i := range v.Values {
+		if v.Values[i] != other.Values[i] {
+			return false
+		}
+	}
 	if !(v.Name == other.Name &&
 		v.Value == other.Value &&
 		v.Target == other.Target &&
-		v.Build == other.Build) {
+		v.Build == other.Build &&
+		v.When.Equals(other.When)) {
 		return false
 	}
 	if v.Platforms == nil {
@@ -191,16 +444,19 @@ func (v *Variable) MatchPlatform(platform string) bool {
 }
 
 // GetMatchedValue returns the value of this variable if conditions met.
-func (v *Variable) GetMatchedValue(target string, platform string, variant string) (result string, ok bool) {
-	if !v.MatchPlatform(platform) {
+func (v *Variable) GetMatchedValue(ctx ConditionContext) (result string, ok bool) {
+	if !v.MatchPlatform(ctx.Platform) {
 		return
 	}
-	if 0 < len(v.Target) && v.Target != target {
+	if 0 < len(v.Target) && v.Target != ctx.Target {
+		return
+	}
+	if !v.When.Evaluate(ctx) {
 		return
 	}
 	if 0 < len(v.Build) {
 		bld := strings.ToLower(v.Build)
-		switch variant {
+		switch ctx.Variant {
 		case Debug.String():
 			if bld != "debug" {
 				return
@@ -234,12 +490,15 @@ type Build struct {
 	Target  string
 	Type    PlatformID
 	Deps    string
+	When    *Condition
 	Source  []StringList `yaml:",flow"`
 }
 
-// Match returns `true` if build target and target-type matched.
-func (b *Build) Match(target string, targetType string) bool {
-	return (len(b.Target) == 0 || b.Target == target) && (len(b.Type) == 0 || b.Type.String() == targetType)
+// Match returns `true` if build target, target-type and `when:` condition matched.
+func (b *Build) Match(ctx ConditionContext) bool {
+	return (len(b.Target) == 0 || b.Target == ctx.Target) &&
+		(len(b.Type) == 0 || b.Type.String() == ctx.Platform) &&
+		b.When.Evaluate(ctx)
 }
 
 //MatchType checks `platform` is in the target platforms.
@@ -247,6 +506,21 @@ func (b *Build) MatchType(platform string) bool {
 	return len(b.Type) == 0 || b.Type.String() == platform
 }
 
+// Launcher make.yml compiler_launcher section
+type Launcher struct {
+	Command   string         `yaml:"command"`
+	Args      string         `yaml:"args"` // `$project`, `$out` and `$in` are available.
+	Link      bool           `yaml:"link"` // Also applied to archiving and linking.
+	Platforms *PlatformIDSet `yaml:"type"`
+	When      *Condition     `yaml:"when"`
+}
+
+// Match checks `platform` and the `when:` condition.
+func (l *Launcher) Match(ctx ConditionContext) bool {
+	return (l.Platforms == nil || l.Platforms.Contains(ctx.Platform)) &&
+		l.When.Evaluate(ctx)
+}
+
 // Other make.yml other section
 type Other struct {
 	Extension   string         `yaml:"ext"`
@@ -254,6 +528,7 @@ type Other struct {
 	Description string         `yaml:"description"`
 	NeedDepend  bool           `yaml:"need_depend"`
 	Platforms   *PlatformIDSet `yaml:"type"`
+	When        *Condition     `yaml:"when"`
 	Option      []StringList   `yaml:"option,flow"`
 }
 
@@ -264,3 +539,9 @@ func (o *Other) MatchPlatform(platform string) bool {
 	}
 	return o.Platforms.Contains(platform)
 }
+
+// Match checks `platform` and the `when:` condition.
+func (o *Other) Match(ctx ConditionContext) bool {
+	return o.MatchPlatform(ctx.Platform) &&
+		o.When.Evaluate(ctx)
+}
@@ -50,20 +50,20 @@ instrumentation:
 		err := yaml.Unmarshal([]byte(srcYAML), &slist)
 		So(err, ShouldBeNil)
 		Convey(`WHEN: call GetMatchedItem ("foo", "LINUX", "product")`, func() {
-			actual := slist.GetMatchedItems("foo", "LINUX", "product")
+			actual := slist.GetMatchedItems(ConditionContext{Target: "foo", Platform: "LINUX", Variant: "product"})
 			Convey(`THEN: Should match ["list item", "dummy", "product item", "dummy"]`, func() {
 				So(actual, ShouldResemble, []string{"list item", "dummy", "product item", "dummy"})
 			})
 		})
 		Convey(`WHEN: call GetMatchedItem ("foo", "Darwin", "product")`, func() {
-			actual := slist.GetMatchedItems("foo", "Darwin", "product")
+			actual := slist.GetMatchedItems(ConditionContext{Target: "foo", Platform: "Darwin", Variant: "product"})
 			Convey(`THEN: Should be empty`, func() {
 				So(actual, ShouldBeEmpty)
 			})
 		})
 		Convey(`WHEN: Testing property`, func() {
 			condition := func(buildTarget string, platform string, variant string) bool {
-				actual := slist.GetMatchedItems(buildTarget, platform, variant)
+				actual := slist.GetMatchedItems(ConditionContext{Target: buildTarget, Platform: platform, Variant: variant})
 				// t.Logf("(%s %s %s) = %v", buildTarget, platform, variant, actual)
 				if buildTarget == "dummy" || platform == "unknown" {
 					return len(actual) == 0
@@ -245,6 +245,113 @@ list:
 	})
 }
 
+func TestStringList_When(t *testing.T) {
+	srcYAML := `
+when: platform in [LINUX, Mac] && variant != product
+list:
+- item1
+debug:
+- debug item`
+	Convey(`GIVEN: A StringList with "when:" condition`, t, func() {
+		var slist StringList
+		err := yaml.Unmarshal([]byte(srcYAML), &slist)
+		So(err, ShouldBeNil)
+		So(slist.When().String(), ShouldEqual, "platform in [LINUX, Mac] && variant != product")
+		Convey(`WHEN: call GetMatchedItems ("foo", "LINUX", "debug")`, func() {
+			actual := slist.GetMatchedItems(ConditionContext{Target: "foo", Platform: "LINUX", Variant: "debug"})
+			Convey(`THEN: Should match ["item1", "debug item"]`, func() {
+				So(actual, ShouldResemble, []string{"item1", "debug item"})
+			})
+		})
+		Convey(`WHEN: call GetMatchedItems ("foo", "LINUX", "product")`, func() {
+			actual := slist.GetMatchedItems(ConditionContext{Target: "foo", Platform: "LINUX", Variant: "product"})
+			Convey(`THEN: Should be empty`, func() {
+				So(actual, ShouldBeEmpty)
+			})
+		})
+		Convey(`WHEN: call GetMatchedItems ("foo", "WIN", "debug")`, func() {
+			actual := slist.GetMatchedItems(ConditionContext{Target: "foo", Platform: "WIN", Variant: "debug"})
+			Convey(`THEN: Should be empty`, func() {
+				So(actual, ShouldBeEmpty)
+			})
+		})
+	})
+	Convey(`GIVEN: A StringList with malformed "when:" condition`, t, func() {
+		var slist StringList
+		err := yaml.Unmarshal([]byte("when: platform in LINUX\nlist: [item1]\n"), &slist)
+		Convey(`THEN: Unmarshal should fail`, func() {
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "at column 13")
+		})
+	})
+}
+
+func TestVariable_When(t *testing.T) {
+	srcYAML := `
+- {name: v, value: a, when: variant == debug}
+- {name: v, value: b, when: "!(variant == debug)"}
+`
+	Convey(`GIVEN: Variables with "when:" condition`, t, func() {
+		var vars []Variable
+		err := yaml.Unmarshal([]byte(srcYAML), &vars)
+		So(err, ShouldBeNil)
+		So(vars, ShouldHaveLength, 2)
+		for _, variant := range []string{"debug", "release"} {
+			Convey(fmt.Sprintf(`WHEN: variant = "%s"`, variant), func() {
+				matched := make([]string, 0)
+				for _, v := range vars {
+					if val, ok := v.GetMatchedValue(ConditionContext{Target: "foo", Platform: "LINUX", Variant: variant}); ok {
+						matched = append(matched, val)
+					}
+				}
+				Convey(`THEN: Only one should match`, func() {
+					So(matched, ShouldHaveLength, 1)
+					if variant == "debug" {
+						So(matched[0], ShouldEqual, "a")
+					} else {
+						So(matched[0], ShouldEqual, "b")
+					}
+				})
+			})
+		}
+	})
+}
+
+func TestVariable_ListValue(t *testing.T) {
+	srcYAML := `
+- {name: scalar, value: 1.10}
+- {name: list, value: [a, "b c", 1.10]}
+- {name: empty, value: []}
+`
+	Convey(`GIVEN: Variables with scalar and list values`, t, func() {
+		var vars []Variable
+		err := yaml.Unmarshal([]byte(srcYAML), &vars)
+		So(err, ShouldBeNil)
+		So(vars, ShouldHaveLength, 3)
+		Convey(`THEN: Scalar value should be kept as is`, func() {
+			So(vars[0].IsList(), ShouldBeFalse)
+			So(vars[0].Value, ShouldEqual, "1.10")
+		})
+		Convey(`THEN: List value should be unmarshaled into .Values`, func() {
+			So(vars[1].IsList(), ShouldBeTrue)
+			So(vars[1].Values, ShouldResemble, []string{"a", "b c", "1.10"})
+			So(vars[1].Value, ShouldEqual, `a "b c" 1.10`)
+			So(vars[2].IsList(), ShouldBeTrue)
+			So(vars[2].Values, ShouldBeEmpty)
+		})
+		Convey(`WHEN: Marshal then Unmarshal the list variable`, func() {
+			b, err := yaml.Marshal(&vars[1])
+			So(err, ShouldBeNil)
+			var v Variable
+			err = yaml.Unmarshal(b, &v)
+			Convey(`THEN: Should return to original`, func() {
+				So(err, ShouldBeNil)
+				So(v.Equals(&vars[1]), ShouldBeTrue)
+			})
+		})
+	})
+}
+
 func TestVariable(t *testing.T) {
 	arbitraries := arbitrary.DefaultArbitraries()
 	arbitraries.RegisterGen(gen.Identifier().Map(func(arg interface{}) PlatformID {
@@ -285,3 +392,51 @@ func TestVariable(t *testing.T) {
 		So(condition, convey.ShouldSucceedForAll, arbitraries)
 	})
 }
+
+func TestStringList_SourceOption(t *testing.T) {
+	srcYAML := `
+list:
+- a.cpp
+- {file: b.cpp, option: [O0, Wno-unused], define: [FOO=1], pch: false}
+- {file: c.cpp, exclude_variant: [product]}
+release:
+- {file: d.cpp, option: [O3]}`
+	Convey(`GIVEN: A StringList with per-file settings`, t, func() {
+		var slist StringList
+		So(yaml.Unmarshal([]byte(srcYAML), &slist), ShouldBeNil)
+		Convey(`WHEN: call GetMatchedItems ("foo", "LINUX", "debug")`, func() {
+			Convey(`THEN: Should match file names`, func() {
+				So(slist.GetMatchedItems(ConditionContext{Target: "foo", Platform: "LINUX", Variant: "debug"}), ShouldResemble, []string{"a.cpp", "b.cpp", "c.cpp"})
+			})
+			Convey(`THEN: Settings should be retrieved`, func() {
+				actual := slist.GetMatchedSourceOptions(ConditionContext{Target: "foo", Platform: "LINUX", Variant: "debug"})
+				So(actual, ShouldHaveLength, 2)
+				So(actual[0].File, ShouldEqual, "b.cpp")
+				So(actual[0].Option, ShouldResemble, []string{"O0", "Wno-unused"})
+				So(actual[0].Define, ShouldResemble, []string{"FOO=1"})
+				So(actual[0].UsePCH(), ShouldBeFalse)
+				So(actual[1].UsePCH(), ShouldBeTrue)
+			})
+		})
+		Convey(`WHEN: call GetMatchedItems ("foo", "LINUX", "product")`, func() {
+			Convey(`THEN: Excluded files should not match`, func() {
+				So(slist.GetMatchedItems(ConditionContext{Target: "foo", Platform: "LINUX", Variant: "product"}), ShouldResemble, []string{"a.cpp", "b.cpp"})
+			})
+		})
+		Convey(`WHEN: call GetMatchedSourceOptions ("foo", "LINUX", "release")`, func() {
+			actual := slist.GetMatchedSourceOptions(ConditionContext{Target: "foo", Platform: "LINUX", Variant: "release"})
+			Convey(`THEN: Settings in the variant list should be included`, func() {
+				So(actual, ShouldHaveLength, 3)
+				So(actual[2].Option, ShouldResemble, []string{"O3"})
+				So(slist.GetMatchedItems(ConditionContext{Target: "foo", Platform: "LINUX", Variant: "release"}), ShouldResemble, []string{"a.cpp", "b.cpp", "c.cpp", "d.cpp"})
+			})
+		})
+	})
+	Convey(`GIVEN: A per-file setting without "file:"`, t, func() {
+		var slist StringList
+		err := yaml.Unmarshal([]byte("list:\n- {option: [O0]}\n"), &slist)
+		Convey(`THEN: Unmarshal should fail`, func() {
+			So(err, ShouldNotBeNil)
+		})
+	})
+}